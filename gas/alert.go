@@ -0,0 +1,79 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+const (
+	alertLowGas           = "low_gas"
+	alertEvaluateInterval = time.Minute
+)
+
+// AlertEvaluator 在后台评估预警：新数据入库时触发，并由定时器兜底，
+// 使指标查询接口保持只读
+type AlertEvaluator struct {
+	store   *Store
+	outbox  *NotificationOutbox
+	trigger chan struct{}
+	stopCh  chan struct{}
+}
+
+func NewAlertEvaluator(store *Store, outbox *NotificationOutbox) *AlertEvaluator {
+	return &AlertEvaluator{
+		store:   store,
+		outbox:  outbox,
+		trigger: make(chan struct{}, 1),
+		stopCh:  make(chan struct{}),
+	}
+}
+
+func (e *AlertEvaluator) Start() {
+	go func() {
+		ticker := time.NewTicker(alertEvaluateInterval)
+		defer ticker.Stop()
+		e.evaluate()
+		for {
+			select {
+			case <-e.stopCh:
+				return
+			case <-e.trigger:
+				e.evaluate()
+			case <-ticker.C:
+				e.evaluate()
+			}
+		}
+	}()
+}
+
+func (e *AlertEvaluator) Stop() {
+	close(e.stopCh)
+}
+
+// 请求一次评估；已有待处理的请求时合并，不阻塞调用方
+func (e *AlertEvaluator) Trigger() {
+	select {
+	case e.trigger <- struct{}{}:
+	default:
+	}
+}
+
+func (e *AlertEvaluator) evaluate() {
+	settings, err := loadSettings(e.store)
+	if err != nil {
+		log.Printf("alert evaluator: load settings: %v", err)
+		return
+	}
+	balance, err := computeGasBalance(e.store, settings)
+	if err != nil {
+		log.Printf("alert evaluator: compute balance: %v", err)
+		return
+	}
+	now := time.Now().In(loadLocation(settings.Timezone))
+	forecast, err := forecastDepletion(e.store, settings, balance.Remain, now)
+	if err != nil {
+		log.Printf("alert evaluator: forecast: %v", err)
+	}
+	checkAndNotifyLowGas(e.store, e.outbox, settings, balance.Remain, forecast)
+	evaluateAlertRules(e.store, e.outbox, settings, balance.Remain, now)
+}
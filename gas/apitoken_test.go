@@ -0,0 +1,93 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestScopesAllow(t *testing.T) {
+	cases := []struct {
+		name   string
+		scopes []string
+		method string
+		path   string
+		want   bool
+	}{
+		{"只读可查询指标", []string{scopeRead}, http.MethodGet, "/api/metrics", true},
+		{"只读不能读取配置", []string{scopeRead}, http.MethodGet, "/api/settings", false},
+		{"只读不能写入事件", []string{scopeRead}, http.MethodPost, "/api/events", false},
+		{"写入可上报事件", []string{scopeIngest}, http.MethodPost, "/api/events", true},
+		{"写入可批量上报", []string{scopeIngest}, http.MethodPost, "/api/events/batch", true},
+		{"写入不能删除事件", []string{scopeIngest}, http.MethodDelete, "/api/events/1", false},
+		{"写入不能查询", []string{scopeIngest}, http.MethodGet, "/api/metrics", false},
+		{"写入不能修改配置", []string{scopeIngest}, http.MethodPost, "/api/settings", false},
+		{"组合权限", []string{scopeIngest, scopeRead}, http.MethodGet, "/api/metrics", true},
+		{"管理权限不受限", []string{scopeAdmin}, http.MethodPut, "/api/settings", true},
+		{"无权限", nil, http.MethodGet, "/api/metrics", false},
+	}
+	for _, c := range cases {
+		if got := scopesAllow(c.scopes, c.method, c.path); got != c.want {
+			t.Errorf("%s: scopesAllow(%v, %s %s) = %v, want %v", c.name, c.scopes, c.method, c.path, got, c.want)
+		}
+	}
+}
+
+func TestAuthenticateAPIToken(t *testing.T) {
+	store, err := NewStore(filepath.Join(t.TempDir(), "gas.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	r := httptest.NewRequest("POST", "/api/events", nil)
+
+	token, plain, err := CreateAPIToken(store, "meter", []string{"ingest", "INGEST"}, 0, "admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isAPIToken(plain) || token.Prefix != plain[:apiTokenShowPrefix] || token.TokenHash == plain || strings.Contains(token.TokenHash, plain) {
+		t.Fatalf("token %+v for %q", token, plain)
+	}
+	if len(token.Scopes) != 1 || token.Scopes[0] != scopeIngest {
+		t.Fatalf("scopes = %v", token.Scopes)
+	}
+
+	claims, err := authenticateToken(store, plain, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims.Role != roleViewer || claims.Subject != "token:meter" || len(claims.Scopes) != 1 {
+		t.Fatalf("claims = %+v", claims)
+	}
+
+	// 只有完整 Token 能通过校验，前缀或篡改后的 Token 都不行
+	for _, bad := range []string{token.Prefix, plain + "x", plain[:len(plain)-1]} {
+		if _, err := authenticateAPIToken(store, bad, r); err == nil {
+			t.Errorf("token %q accepted", bad)
+		}
+	}
+
+	if err := store.RevokeAPIToken(token.ID, time.Now().Unix()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := authenticateAPIToken(store, plain, r); err == nil {
+		t.Error("revoked token accepted")
+	}
+
+	expiring, plain, err := CreateAPIToken(store, "temp", []string{scopeAdmin}, 1, "admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims, err := authenticateAPIToken(store, plain, r); err != nil || claims.Role != roleAdmin {
+		t.Fatalf("admin token: %+v, %v", claims, err)
+	}
+	if _, err := store.db.Exec(`UPDATE api_tokens SET expires_ts=? WHERE id=?;`, time.Now().Unix()-1, expiring.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := authenticateAPIToken(store, plain, r); err == nil {
+		t.Error("expired token accepted")
+	}
+}
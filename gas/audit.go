@@ -0,0 +1,194 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5/middleware"
+)
+
+const (
+	defaultAuditRetentionDays = 365
+	auditPruneInterval        = time.Hour
+	auditRedacted             = "******"
+)
+
+// 字段名包含这些片段时视为敏感信息，写入审计日志前打码
+var auditSensitiveKeys = []string{"password", "secret", "token", "hash"}
+
+var auditPrune struct {
+	sync.Mutex
+	last time.Time
+}
+
+func isSensitiveKey(key string) bool {
+	key = strings.ToLower(key)
+	for _, part := range auditSensitiveKeys {
+		if strings.Contains(key, part) {
+			return true
+		}
+	}
+	return false
+}
+
+// 转为 JSON 通用结构，便于按字段打码和比较
+func auditValue(v interface{}) interface{} {
+	if v == nil {
+		return nil
+	}
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return nil
+	}
+	var out interface{}
+	if err := json.Unmarshal(raw, &out); err != nil {
+		return nil
+	}
+	return redactAudit(out)
+}
+
+// 敏感字段只保留“是否为空”，不记录明文
+func redactAudit(v interface{}) interface{} {
+	switch val := v.(type) {
+	case map[string]interface{}:
+		for k, item := range val {
+			if isSensitiveKey(k) {
+				if item != nil && item != "" {
+					val[k] = auditRedacted
+				}
+				continue
+			}
+			val[k] = redactAudit(item)
+		}
+	case []interface{}:
+		for i, item := range val {
+			val[i] = redactAudit(item)
+		}
+	}
+	return v
+}
+
+// 对象类的前后值只保留有变化的字段；敏感字段比较明文，变化时两侧都显示为打码值
+func auditDiff(before, after interface{}) (interface{}, interface{}) {
+	rawBefore, errBefore := json.Marshal(before)
+	rawAfter, errAfter := json.Marshal(after)
+	var b, a map[string]interface{}
+	if errBefore != nil || errAfter != nil ||
+		json.Unmarshal(rawBefore, &b) != nil || json.Unmarshal(rawAfter, &a) != nil || b == nil || a == nil {
+		return auditValue(before), auditValue(after)
+	}
+	changedBefore := make(map[string]interface{})
+	changedAfter := make(map[string]interface{})
+	for k, v := range a {
+		if reflect.DeepEqual(b[k], v) {
+			continue
+		}
+		changedBefore[k] = b[k]
+		changedAfter[k] = v
+	}
+	for k, v := range b {
+		if _, ok := a[k]; !ok {
+			changedBefore[k] = v
+		}
+	}
+	return redactAudit(changedBefore), redactAudit(changedAfter)
+}
+
+func auditJSON(v interface{}) json.RawMessage {
+	if v == nil {
+		return nil
+	}
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return nil
+	}
+	return raw
+}
+
+// 当前请求的操作者：登录用户名、API Token 名称或 anonymous（未开启登录保护时）
+func auditActor(r *http.Request) string {
+	if claims := claimsFromRequest(r); claims != nil && claims.Subject != "" {
+		return claims.Subject
+	}
+	return "anonymous"
+}
+
+// 记录一次状态变更；before/after 为变更前后的值（可为 nil），敏感字段自动打码。
+// 审计写入失败只记日志，不影响业务请求
+func recordAudit(store *Store, r *http.Request, action, target string, before, after interface{}) {
+	writeAudit(store, requestAuditEntry(r, action, target, auditValue(before), auditValue(after)))
+}
+
+// 同 recordAudit，但只记录发生变化的字段，适用于设置等大对象
+func recordAuditDiff(store *Store, r *http.Request, action, target string, before, after interface{}) {
+	changedBefore, changedAfter := auditDiff(before, after)
+	writeAudit(store, requestAuditEntry(r, action, target, changedBefore, changedAfter))
+}
+
+// 登录、登出等请求不经过认证中间件，由调用方给出操作者
+func recordAuditAs(store *Store, r *http.Request, actor, action, target string, before, after interface{}) {
+	entry := requestAuditEntry(r, action, target, auditValue(before), auditValue(after))
+	entry.Actor = actor
+	writeAudit(store, entry)
+}
+
+// 非 HTTP 来源（如 Telegram 机器人命令）的状态变更，由调用方给出操作者
+func recordSystemAudit(store *Store, actor, action, target string, before, after interface{}) {
+	writeAudit(store, AuditEntry{
+		TS:     time.Now().Unix(),
+		Actor:  actor,
+		Action: action,
+		Target: target,
+		Before: auditJSON(auditValue(before)),
+		After:  auditJSON(auditValue(after)),
+	})
+}
+
+func requestAuditEntry(r *http.Request, action, target string, before, after interface{}) AuditEntry {
+	return AuditEntry{
+		TS:        time.Now().Unix(),
+		Actor:     auditActor(r),
+		IP:        clientIP(r),
+		RequestID: middleware.GetReqID(r.Context()),
+		Action:    action,
+		Target:    target,
+		Before:    auditJSON(before),
+		After:     auditJSON(after),
+	}
+}
+
+func writeAudit(store *Store, entry AuditEntry) {
+	if err := store.InsertAuditEntry(entry); err != nil {
+		log.Printf("audit log: %v", err)
+	}
+	pruneAuditLog(store)
+}
+
+// 按保留天数清理过期审计记录，每小时最多执行一次；0 表示永久保留
+func pruneAuditLog(store *Store) {
+	auditPrune.Lock()
+	if time.Since(auditPrune.last) < auditPruneInterval {
+		auditPrune.Unlock()
+		return
+	}
+	auditPrune.last = time.Now()
+	auditPrune.Unlock()
+
+	raw, err := store.GetSetting("audit_retention_days", strconv.Itoa(defaultAuditRetentionDays))
+	if err != nil {
+		return
+	}
+	days, err := strconv.Atoi(raw)
+	if err != nil || days <= 0 {
+		return
+	}
+	if err := store.PruneAuditLog(time.Now().AddDate(0, 0, -days).Unix()); err != nil {
+		log.Printf("audit prune: %v", err)
+	}
+}
@@ -1,9 +1,13 @@
 package main
 
 import (
+	"context"
 	"crypto/rand"
+	"database/sql"
 	"encoding/hex"
 	"errors"
+	"fmt"
+	"net"
 	"net/http"
 	"strings"
 	"time"
@@ -13,18 +17,71 @@ import (
 )
 
 const (
-	jwtSecretKey     = "gas-monitor-jwt-secret-change-in-production"
 	tokenExpiryHours = 24
+	signingKeyBytes  = 32
+	// 密钥轮换后旧密钥的保留时间，与 Token 有效期一致，保证已签发的 Token 不会提前失效
+	signingKeyGrace = tokenExpiryHours * time.Hour
 )
 
+const (
+	roleViewer   = "viewer"
+	roleOperator = "operator"
+	roleAdmin    = "admin"
+)
+
+// 角色等级，高等级包含低等级的全部权限
+var roleRanks = map[string]int{
+	roleViewer:   1,
+	roleOperator: 2,
+	roleAdmin:    3,
+}
+
+func roleAllows(role, required string) bool {
+	return roleRanks[role] >= roleRanks[required]
+}
+
 type Claims struct {
+	Role string `json:"role"`
+	// 使用 API Token 访问时的权限范围，会话 JWT 为空
+	Scopes []string `json:"-"`
 	jwt.RegisteredClaims
 }
 
-type AuthConfig struct {
-	Enabled       bool   `json:"enabled"`
-	AdminUsername string `json:"admin_username"`
-	AdminPassword string `json:"admin_password"` // bcrypt 加密后的密码
+type ctxKey int
+
+const (
+	claimsCtxKey ctxKey = iota
+	peerAddrCtxKey
+)
+
+var (
+	errNoCredentials  = errors.New("no token")
+	errExternalDenied = errors.New("外部认证被拒绝")
+)
+
+// 记录 TCP 连接的对端地址，必须放在 trustedRealIP 之前；
+// 代理头认证只信任来自指定网段的直接连接，不能使用可被伪造的 X-Forwarded-For
+func capturePeerAddr(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), peerAddrCtxKey, r.RemoteAddr)))
+	})
+}
+
+func peerIP(r *http.Request) net.IP {
+	addr, _ := r.Context().Value(peerAddrCtxKey).(string)
+	if addr == "" {
+		addr = r.RemoteAddr
+	}
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
+	}
+	return net.ParseIP(addr)
+}
+
+// 获取认证中间件写入请求上下文的 Claims，未登录时返回 nil
+func claimsFromRequest(r *http.Request) *Claims {
+	claims, _ := r.Context().Value(claimsCtxKey).(*Claims)
+	return claims
 }
 
 // 检查是否已启用认证
@@ -36,81 +93,210 @@ func isAuthEnabled(store *Store) (bool, error) {
 	return parseBoolSetting(enabled, false), nil
 }
 
-// 检查是否已配置管理员密码
+// 检查是否已创建管理员
 func isAdminConfigured(store *Store) (bool, error) {
-	password, err := store.GetSetting("admin_password", "")
-	if err != nil {
-		return false, err
+	n, err := store.CountActiveAdmins()
+	return n > 0, err
+}
+
+// 仪表盘是否允许未登录访问
+func isDashboardPublic(store *Store) bool {
+	v, _ := store.GetSetting("public_dashboard", "1")
+	return parseBoolSetting(v, true)
+}
+
+func validateUsername(username string) error {
+	if username == "" {
+		return errors.New("用户名不能为空")
+	}
+	if len(username) > 64 || strings.ContainsAny(username, " \t\r\n") {
+		return errors.New("用户名不能包含空白字符，且不超过 64 个字符")
+	}
+	return nil
+}
+
+func hashPassword(password string) (string, error) {
+	if password == "" {
+		return "", errors.New("密码不能为空")
 	}
-	return password != "", nil
+	hashed, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	return string(hashed), err
 }
 
 // 初始化管理员账号（默认不自动开启认证，交由设置页开关控制）
-func InitAdmin(store *Store, username, password string) error {
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+func InitAdmin(store *Store, username, password string) (User, error) {
+	if err := validateUsername(username); err != nil {
+		return User{}, err
+	}
+	hashed, err := hashPassword(password)
 	if err != nil {
-		return err
+		return User{}, err
+	}
+	user := User{Username: username, PasswordHash: hashed, Role: roleAdmin}
+	user.ID, err = store.InsertUser(user)
+	return user, err
+}
+
+// 用户不存在时也做一次 bcrypt 比较，避免通过响应时间判断用户名是否存在
+var dummyPasswordHash, _ = bcrypt.GenerateFromPassword([]byte("gas-monitor-dummy"), bcrypt.DefaultCost)
+
+// 校验用户名和密码，用户不存在、已停用或密码错误都返回 nil
+func AuthenticateUser(store *Store, username, password string) (*User, error) {
+	user, err := store.FetchUserByName(username)
+	if errors.Is(err, sql.ErrNoRows) {
+		_ = bcrypt.CompareHashAndPassword(dummyPasswordHash, []byte(password))
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if user.Disabled {
+		return nil, nil
+	}
+	if bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(password)) != nil {
+		return nil, nil
 	}
+	return &user, nil
+}
 
-	if err := store.SetSetting("admin_username", username); err != nil {
+// 更新用户的账号和密码
+func UpdateUserCredentials(store *Store, user User, username, password string) error {
+	if err := validateUsername(username); err != nil {
 		return err
 	}
-	if err := store.SetSetting("admin_password", string(hashedPassword)); err != nil {
+	hashed, err := hashPassword(password)
+	if err != nil {
 		return err
 	}
-	return nil
+	user.Username = username
+	user.PasswordHash = hashed
+	return store.UpdateUser(user)
 }
 
-// 校验管理员密码
-func VerifyAdminPassword(store *Store, password string) (bool, error) {
-	hashedPassword, err := store.GetSetting("admin_password", "")
+func setAuthCookie(w http.ResponseWriter, token string) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     "auth_token",
+		Value:    token,
+		Path:     "/",
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+		Expires:  time.Now().Add(time.Hour * tokenExpiryHours),
+	})
+}
+
+// 签发 Token、写入 Cookie 并返回登录结果
+func respondLogin(w http.ResponseWriter, r *http.Request, store *Store, user User) {
+	_ = store.TouchUserLogin(user.ID)
+
+	token, err := GenerateToken(store, user, r)
 	if err != nil {
-		return false, err
+		respondError(w, http.StatusInternalServerError, err)
+		return
 	}
-	if hashedPassword == "" {
-		return false, nil
+	setAuthCookie(w, token)
+
+	respondJSON(w, map[string]string{
+		"status": "success",
+		"token":  token,
+		"role":   user.Role,
+	})
+}
+
+// 当前登录的用户；未开启登录保护或使用 API Token 时没有对应用户
+func currentUser(store *Store, r *http.Request) (User, error) {
+	claims := claimsFromRequest(r)
+	if claims == nil || claims.Scopes != nil {
+		return User{}, errors.New("请先开启登录保护并使用账号登录")
 	}
+	return store.FetchUserByName(claims.Subject)
+}
 
-	err = bcrypt.CompareHashAndPassword([]byte(hashedPassword), []byte(password))
-	return err == nil, nil
+// 获取当前签名密钥，首次启动时生成并保存到数据库
+func ensureSigningKey(store *Store) (SigningKey, error) {
+	key, err := store.ActiveSigningKey()
+	if errors.Is(err, sql.ErrNoRows) {
+		return RotateSigningKey(store)
+	}
+	return key, err
 }
 
-// 更新管理员账号和密码
-func UpdateAdminCredentials(store *Store, username, password string) error {
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+// 生成新的签名密钥，旧密钥在宽限期内仍可校验已签发的 Token
+func RotateSigningKey(store *Store) (SigningKey, error) {
+	kid, err := generateSecureKey(8)
 	if err != nil {
-		return err
+		return SigningKey{}, err
 	}
-	if err := store.SetSetting("admin_username", username); err != nil {
-		return err
+	secret, err := generateSecureKey(signingKeyBytes)
+	if err != nil {
+		return SigningKey{}, err
 	}
-	if err := store.SetSetting("admin_password", string(hashedPassword)); err != nil {
-		return err
+	now := time.Now()
+	key := SigningKey{KID: kid, Secret: secret, CreatedTS: now.Unix()}
+	if err := store.RotateSigningKey(key, now.Add(-signingKeyGrace).Unix()); err != nil {
+		return SigningKey{}, err
 	}
-	return nil
+	return key, nil
 }
 
-// 生成 JWT Token
-func GenerateToken(store *Store) (string, error) {
+// 生成 JWT Token，同时创建对应的登录会话
+func GenerateToken(store *Store, user User, r *http.Request) (string, error) {
+	key, err := ensureSigningKey(store)
+	if err != nil {
+		return "", err
+	}
+	sessionID, err := generateSecureKey(16)
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	expires := now.Add(time.Hour * tokenExpiryHours)
+	session := Session{
+		ID:        sessionID,
+		UserID:    user.ID,
+		CreatedTS: now.Unix(),
+		ExpiresTS: expires.Unix(),
+		IP:        clientIP(r),
+		UserAgent: r.UserAgent(),
+	}
+	if err := store.InsertSession(session); err != nil {
+		return "", err
+	}
+	_ = store.PruneSessions(now.Add(-signingKeyGrace).Unix())
+
 	claims := &Claims{
+		Role: user.Role,
 		RegisteredClaims: jwt.RegisteredClaims{
-			ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour * tokenExpiryHours)),
-			IssuedAt:  jwt.NewNumericDate(time.Now()),
-			Subject:   "admin",
+			ID:        sessionID,
+			ExpiresAt: jwt.NewNumericDate(expires),
+			IssuedAt:  jwt.NewNumericDate(now),
+			Subject:   user.Username,
 		},
 	}
 
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString([]byte(jwtSecretKey))
+	token.Header["kid"] = key.KID
+	return token.SignedString([]byte(key.Secret))
 }
 
-// 校验 JWT Token
-func ValidateToken(tokenString string) (*Claims, error) {
+// 只校验签名和有效期，不检查会话状态
+func parseToken(store *Store, tokenString string) (*Claims, error) {
 	token, err := jwt.ParseWithClaims(tokenString, &Claims{}, func(token *jwt.Token) (interface{}, error) {
 		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
 			return nil, errors.New("unexpected signing method")
 		}
-		return []byte(jwtSecretKey), nil
+		kid, _ := token.Header["kid"].(string)
+		if kid == "" {
+			return nil, errors.New("missing key id")
+		}
+		key, err := store.FetchSigningKey(kid)
+		if err != nil {
+			return nil, errors.New("unknown key id")
+		}
+		if key.RetiredTS > 0 && time.Since(time.Unix(key.RetiredTS, 0)) > signingKeyGrace {
+			return nil, errors.New("signing key expired")
+		}
+		return []byte(key.Secret), nil
 	})
 
 	if err != nil {
@@ -124,7 +310,34 @@ func ValidateToken(tokenString string) (*Claims, error) {
 	return nil, errors.New("invalid token")
 }
 
-// 从 Authorization 或 Cookie 中获取 Token 并校验
+// 校验 JWT Token 及其会话；角色和用户名以数据库中的当前值为准
+func ValidateToken(store *Store, tokenString string) (*Claims, error) {
+	claims, err := parseToken(store, tokenString)
+	if err != nil {
+		return nil, err
+	}
+	session, err := store.FetchSession(claims.ID)
+	if err != nil {
+		return nil, errors.New("session not found")
+	}
+	if session.RevokedTS > 0 || session.ExpiresTS <= time.Now().Unix() || session.Disabled {
+		return nil, errors.New("session revoked")
+	}
+	claims.Subject = session.Username
+	claims.Role = session.Role
+	return claims, nil
+}
+
+// 撤销 Token 对应的会话，用于退出登录
+func RevokeToken(store *Store, tokenString string) (*Claims, error) {
+	claims, err := parseToken(store, tokenString)
+	if err != nil {
+		return nil, err
+	}
+	return claims, store.RevokeSession(claims.ID, time.Now().Unix())
+}
+
+// 从 Authorization、X-API-Key 或 Cookie 中获取 Token
 func extractToken(r *http.Request) (string, error) {
 	authHeader := r.Header.Get("Authorization")
 	if authHeader != "" {
@@ -134,6 +347,10 @@ func extractToken(r *http.Request) (string, error) {
 		}
 	}
 
+	if key := r.Header.Get("X-API-Key"); key != "" {
+		return key, nil
+	}
+
 	if c, err := r.Cookie("auth_token"); err == nil && c.Value != "" {
 		return c.Value, nil
 	}
@@ -141,7 +358,296 @@ func extractToken(r *http.Request) (string, error) {
 	if authHeader != "" {
 		return "", errors.New("invalid auth header")
 	}
-	return "", errors.New("no token")
+	return "", errNoCredentials
+}
+
+// 外部认证提供方确认的身份
+type ExternalIdentity struct {
+	Provider string
+	// 提供方内唯一且不变的标识，用于关联本地用户；用户名只在首次创建账号时使用
+	Subject  string
+	Username string
+	Groups   []string
+}
+
+// AuthProvider 是外部认证提供方的统一抽象，身份确认后统一映射到本地用户
+type AuthProvider interface {
+	Name() string
+}
+
+// 每个请求独立识别身份的提供方（如反向代理注入的用户头），请求不适用时返回 nil
+type RequestAuthProvider interface {
+	AuthProvider
+	AuthenticateRequest(r *http.Request) (*ExternalIdentity, error)
+}
+
+// 通过浏览器跳转完成登录的提供方（如 OIDC），登录完成后签发本地会话
+type RedirectAuthProvider interface {
+	AuthProvider
+	LoginURL(r *http.Request) (string, error)
+	CompleteLogin(r *http.Request) (*ExternalIdentity, error)
+}
+
+// 当前启用的请求级认证提供方
+func requestAuthProviders(settings Settings) []RequestAuthProvider {
+	var providers []RequestAuthProvider
+	if settings.AuthProxyEnabled {
+		providers = append(providers, newProxyHeaderProvider(settings))
+	}
+	return providers
+}
+
+// 按名称获取已启用的跳转登录提供方
+func redirectAuthProvider(settings Settings, name string) (RedirectAuthProvider, error) {
+	switch name {
+	case "oidc":
+		if settings.OIDCEnabled {
+			return newOIDCProvider(settings), nil
+		}
+	}
+	return nil, fmt.Errorf("未启用的登录方式: %s", name)
+}
+
+// 解析组与角色的映射，格式为 "组=角色"，多项用逗号分隔
+func parseGroupRoles(raw string) (map[string]string, error) {
+	mapping := make(map[string]string)
+	for _, item := range splitList(raw) {
+		group, role, ok := strings.Cut(item, "=")
+		group, role = strings.TrimSpace(group), strings.TrimSpace(role)
+		if !ok || group == "" {
+			return nil, fmt.Errorf("组角色映射格式错误: %s", item)
+		}
+		if _, valid := roleRanks[role]; !valid {
+			return nil, fmt.Errorf("组角色映射中的角色无效: %s", role)
+		}
+		mapping[group] = role
+	}
+	return mapping, nil
+}
+
+// 取所属组映射到的最高角色，没有匹配时使用默认角色；默认角色为空表示拒绝登录
+func mapGroupsToRole(settings Settings, groups []string) (string, error) {
+	mapping, err := parseGroupRoles(settings.AuthGroupRoles)
+	if err != nil {
+		return "", err
+	}
+	role := ""
+	for _, group := range groups {
+		if mapped, ok := mapping[group]; ok && roleRanks[mapped] > roleRanks[role] {
+			role = mapped
+		}
+	}
+	if role == "" {
+		role = settings.AuthDefaultRole
+	}
+	if role == "" {
+		return "", errors.New("该账号不属于任何已授权的组")
+	}
+	return role, nil
+}
+
+// 将外部身份映射为本地用户：按 (provider, subject) 查找已关联的账号。未关联时只在用户名
+// 空闲时自动创建账号并关联；同名的本地账号已存在时拒绝登录，需由管理员手动关联，
+// 否则 IdP 中同名的用户即可绕过本地密码和两步验证接管该账号。
+// 每次登录按组同步角色，会降级最后一个启用的管理员时拒绝登录
+func resolveExternalUser(store *Store, settings Settings, identity *ExternalIdentity) (User, error) {
+	if identity.Subject == "" {
+		return User{}, errors.New("外部身份缺少唯一标识")
+	}
+	role, err := mapGroupsToRole(settings, identity.Groups)
+	if err != nil {
+		return User{}, err
+	}
+
+	link, err := store.FetchExternalLink(identity.Provider, identity.Subject)
+	if err != nil {
+		return User{}, err
+	}
+	var user User
+	if link != nil {
+		if user, err = store.FetchUser(link.UserID); err != nil {
+			return User{}, err
+		}
+	} else {
+		if user, err = linkExternalIdentity(store, identity, role); err != nil {
+			return User{}, err
+		}
+	}
+
+	if user.Disabled {
+		return User{}, errors.New("账号已停用")
+	}
+	if user.Role != role {
+		if user.Role == roleAdmin {
+			n, err := store.CountActiveAdmins()
+			if err != nil {
+				return User{}, err
+			}
+			if n <= 1 {
+				return User{}, errors.New("组映射会降级唯一的管理员，已拒绝登录")
+			}
+		}
+		user.Role = role
+		if err := store.UpdateUser(user); err != nil {
+			return User{}, err
+		}
+	}
+	return user, nil
+}
+
+// 首次登录的外部身份：用户名空闲时创建无本地密码的账号并关联。
+// 旧版本按用户名自动创建的外部账号（无本地密码、未关联任何身份）在首次登录时补充关联
+func linkExternalIdentity(store *Store, identity *ExternalIdentity, role string) (User, error) {
+	if err := validateUsername(identity.Username); err != nil {
+		return User{}, err
+	}
+	user, err := store.FetchUserByName(identity.Username)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		user = User{Username: identity.Username, Role: role}
+		if user.ID, err = store.InsertUser(user); err != nil {
+			return User{}, err
+		}
+		if user, err = store.FetchUser(user.ID); err != nil {
+			return User{}, err
+		}
+	case err != nil:
+		return User{}, err
+	default:
+		links, err := store.FetchUserExternalLinks(user.ID)
+		if err != nil {
+			return User{}, err
+		}
+		if user.PasswordHash != "" || len(links) > 0 {
+			return User{}, fmt.Errorf("本地账号 %s 已存在，需由管理员关联该外部身份后才能登录", user.Username)
+		}
+	}
+	err = store.InsertExternalLink(ExternalLink{
+		Provider:  identity.Provider,
+		Subject:   identity.Subject,
+		UserID:    user.ID,
+		CreatedTS: time.Now().Unix(),
+	})
+	return user, err
+}
+
+// 反向代理头认证：只接受来自可信网段的请求中的用户头
+type proxyHeaderProvider struct {
+	networks     []*net.IPNet
+	userHeader   string
+	groupsHeader string
+}
+
+func newProxyHeaderProvider(settings Settings) *proxyHeaderProvider {
+	networks, _ := parseCIDRs(settings.AuthProxyCIDRs)
+	p := &proxyHeaderProvider{
+		networks:     networks,
+		userHeader:   settings.AuthProxyUserHeader,
+		groupsHeader: settings.AuthProxyGroupsHeader,
+	}
+	if p.userHeader == "" {
+		p.userHeader = defaultProxyUserHeader
+	}
+	if p.groupsHeader == "" {
+		p.groupsHeader = defaultProxyGroupHeader
+	}
+	return p
+}
+
+func (p *proxyHeaderProvider) Name() string { return "proxy" }
+
+func (p *proxyHeaderProvider) AuthenticateRequest(r *http.Request) (*ExternalIdentity, error) {
+	username := strings.TrimSpace(r.Header.Get(p.userHeader))
+	if username == "" {
+		return nil, nil
+	}
+	if !ipInNetworks(peerIP(r), p.networks) {
+		return nil, nil
+	}
+	return &ExternalIdentity{
+		Provider: p.Name(),
+		Subject:  username,
+		Username: username,
+		Groups:   splitList(r.Header.Get(p.groupsHeader)),
+	}, nil
+}
+
+// 解析逗号分隔的网段，单个 IP 视为 /32 或 /128
+func parseCIDRs(raw string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, item := range splitList(raw) {
+		if !strings.Contains(item, "/") {
+			if ip := net.ParseIP(item); ip != nil && ip.To4() != nil {
+				item += "/32"
+			} else {
+				item += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(item)
+		if err != nil {
+			return nil, fmt.Errorf("无效的网段: %s", item)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// 外部认证的跨字段校验，单个字段的格式由配置登记表校验
+func validateAuthProviderSettings(settings Settings) settingsErrors {
+	errs := settingsErrors{}
+	if settings.AuthProxyEnabled && strings.TrimSpace(settings.AuthProxyCIDRs) == "" {
+		errs["auth_proxy_cidrs"] = "启用代理头认证时必须填写可信代理网段"
+	}
+	if settings.OIDCEnabled {
+		required := map[string]string{
+			"oidc_issuer":       settings.OIDCIssuer,
+			"oidc_client_id":    settings.OIDCClientID,
+			"oidc_redirect_url": settings.OIDCRedirectURL,
+		}
+		for name, value := range required {
+			if value == "" {
+				errs[name] = "启用 OIDC 时必须填写"
+			}
+		}
+	}
+	return errs
+}
+
+// 识别请求身份：优先使用 Token，没有 Token 时尝试请求级外部认证
+func requestClaims(store *Store, r *http.Request) (*Claims, error) {
+	tokenStr, err := extractToken(r)
+	if err == nil {
+		return authenticateToken(store, tokenStr, r)
+	}
+	if !errors.Is(err, errNoCredentials) {
+		return nil, err
+	}
+
+	var settings Settings
+	if err := loadAuthProviderSettings(store, &settings); err != nil {
+		return nil, err
+	}
+	for _, provider := range requestAuthProviders(settings) {
+		identity, err := provider.AuthenticateRequest(r)
+		if err != nil {
+			return nil, err
+		}
+		if identity == nil {
+			continue
+		}
+		user, err := resolveExternalUser(store, settings, identity)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", errExternalDenied, err)
+		}
+		// 代理头认证无法插入验证码步骤，已启用两步验证的账号不接受代理头登录
+		if user.MFAEnabled {
+			return nil, fmt.Errorf("%w: 账号已启用两步验证，请使用密码或 OIDC 登录", errExternalDenied)
+		}
+		claims := &Claims{Role: user.Role}
+		claims.Subject = user.Username
+		return claims, nil
+	}
+	return nil, errNoCredentials
 }
 
 // 生成安全的随机密钥
@@ -153,6 +659,47 @@ func generateSecureKey(length int) (string, error) {
 	return hex.EncodeToString(bytes), nil
 }
 
+type routeRole struct {
+	Method string // 为空表示任意方法
+	Prefix string
+	Role   string
+}
+
+// 按顺序匹配的路由权限表：操作员可以记录充值、抄表和确认预警，
+// 其余写操作与敏感数据只允许管理员访问
+var routeRoles = []routeRole{
+	{Method: http.MethodGet, Prefix: "/api/settings", Role: roleAdmin},
+	{Method: http.MethodGet, Prefix: "/api/debug/", Role: roleAdmin},
+	{Method: http.MethodGet, Prefix: "/api/users", Role: roleAdmin},
+	{Method: http.MethodGet, Prefix: "/api/sessions", Role: roleAdmin},
+	{Method: http.MethodGet, Prefix: "/api/login-attempts", Role: roleAdmin},
+	{Method: http.MethodGet, Prefix: "/api/audit", Role: roleAdmin},
+	{Method: http.MethodGet, Prefix: "/api/tokens", Role: roleAdmin},
+	{Method: http.MethodGet, Prefix: "/api/admin/", Role: roleAdmin},
+	{Method: http.MethodGet, Prefix: "/api/devices/", Role: roleAdmin},
+	{Method: http.MethodGet, Prefix: "/api/notifications", Role: roleAdmin},
+	{Method: http.MethodPost, Prefix: "/api/topups", Role: roleOperator},
+	{Method: http.MethodPost, Prefix: "/api/readings", Role: roleOperator},
+	{Method: http.MethodPost, Prefix: "/api/alerts/history/", Role: roleOperator},
+	{Method: http.MethodPost, Prefix: "/api/mfa/", Role: roleViewer},
+	{Method: http.MethodPost, Prefix: "/api/account/", Role: roleViewer},
+	{Method: http.MethodGet, Prefix: "/api/", Role: roleViewer},
+	{Method: http.MethodGet, Prefix: "/data-import", Role: roleOperator},
+	{Prefix: "/api/", Role: roleAdmin},
+}
+
+func requiredRole(method, path string) string {
+	for _, rr := range routeRoles {
+		if rr.Method != "" && rr.Method != method {
+			continue
+		}
+		if strings.HasPrefix(path, rr.Prefix) {
+			return rr.Role
+		}
+	}
+	return roleViewer
+}
+
 // JWT 认证中间件
 func AuthMiddleware(store *Store) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
@@ -177,65 +724,94 @@ func AuthMiddleware(store *Store) func(http.Handler) http.Handler {
 				"/":                {},
 				"/login":           {},
 				"/api/login":       {},
+				"/api/logout":      {},
+				"/api/login/mfa":   {},
 				"/api/auth/status": {},
-				"/api/metrics":     {},
-				"/api/hourly":      {},
-				"/api/monthly":     {},
-				"/api/recent":      {},
-				"/favicon.ico":     {},
+				// 单点登录跳转与回调
+				"/api/auth/oidc/login":    {},
+				"/api/auth/oidc/callback": {},
+				"/favicon.ico":            {},
+			}
+			// 仪表盘数据接口，可通过 public_dashboard 设置要求登录
+			dashboardExact := map[string]struct{}{
+				"/api/metrics": {},
+				"/api/hourly":  {},
+				"/api/monthly": {},
+				"/api/usage":   {},
+				"/api/recent":  {},
+				"/api/stream":  {},
 			}
 			publicPrefixes := []string{"/static/"}
 
+			isPublic := func() bool {
+				if _, ok := publicExact[r.URL.Path]; ok {
+					return true
+				}
+				if _, ok := dashboardExact[r.URL.Path]; ok && isDashboardPublic(store) {
+					return true
+				}
+				for _, prefix := range publicPrefixes {
+					if strings.HasPrefix(r.URL.Path, prefix) {
+						return true
+					}
+				}
+				return false
+			}
+
 			if !configured {
 				if r.URL.Path == "/data-import" {
 					http.Redirect(w, r, "/login", http.StatusFound)
 					return
 				}
-				if _, ok := publicExact[r.URL.Path]; ok {
+				if isPublic() {
 					next.ServeHTTP(w, r)
 					return
 				}
-				for _, prefix := range publicPrefixes {
-					if strings.HasPrefix(r.URL.Path, prefix) {
-						next.ServeHTTP(w, r)
-						return
-					}
-				}
 				http.Error(w, `{"error":"尚未设置管理员，请先创建管理员"}`, http.StatusUnauthorized)
 				return
 			}
 
-			if _, ok := publicExact[r.URL.Path]; ok {
+			if isPublic() {
 				next.ServeHTTP(w, r)
 				return
 			}
-			for _, prefix := range publicPrefixes {
-				if strings.HasPrefix(r.URL.Path, prefix) {
-					next.ServeHTTP(w, r)
+
+			claims, err := requestClaims(store, r)
+			if errors.Is(err, errNoCredentials) {
+				if r.URL.Path == "/data-import" {
+					http.Redirect(w, r, "/login", http.StatusFound)
 					return
 				}
+				http.Error(w, `{"error":"未登录，请先登录"}`, http.StatusUnauthorized)
+				return
+			}
+			if errors.Is(err, errExternalDenied) {
+				respondError(w, http.StatusForbidden, err)
+				return
 			}
-
-			tokenStr, err := extractToken(r)
 			if err != nil {
 				if r.URL.Path == "/data-import" {
 					http.Redirect(w, r, "/login", http.StatusFound)
 					return
 				}
-				http.Error(w, `{"error":"未登录，请先登录"}`, http.StatusUnauthorized)
+				http.Error(w, `{"error":"Token 无效或已过期"}`, http.StatusUnauthorized)
 				return
 			}
 
-			if _, err := ValidateToken(tokenStr); err != nil {
+			allowed := roleAllows(claims.Role, requiredRole(r.Method, r.URL.Path))
+			if claims.Scopes != nil {
+				allowed = scopesAllow(claims.Scopes, r.Method, r.URL.Path)
+			}
+			if !allowed {
 				if r.URL.Path == "/data-import" {
-					http.Redirect(w, r, "/login", http.StatusFound)
+					http.Redirect(w, r, "/", http.StatusFound)
 					return
 				}
-				http.Error(w, `{"error":"Token 无效或已过期"}`, http.StatusUnauthorized)
+				http.Error(w, `{"error":"权限不足"}`, http.StatusForbidden)
 				return
 			}
 
-			next.ServeHTTP(w, r)
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), claimsCtxKey, claims)))
 		})
 	}
 }
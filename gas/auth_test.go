@@ -0,0 +1,185 @@
+package main
+
+import (
+	"errors"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestResolveExternalUser(t *testing.T) {
+	store, err := NewStore(filepath.Join(t.TempDir(), "gas.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	settings := Settings{AuthGroupRoles: "gas-admins=admin", AuthDefaultRole: roleViewer}
+
+	admin, err := InitAdmin(store, "admin", "secret-password")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 与本地密码账号同名的外部身份不能自动关联
+	if _, err := resolveExternalUser(store, settings, &ExternalIdentity{Provider: "oidc", Subject: "sub-evil", Username: "admin", Groups: []string{"gas-admins"}}); err == nil {
+		t.Fatal("external identity was linked to an existing password account")
+	}
+
+	// 用户名空闲时创建并关联，之后按 subject 识别，不受用户名变化影响
+	alice, err := resolveExternalUser(store, settings, &ExternalIdentity{Provider: "oidc", Subject: "sub-alice", Username: "alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if alice.Role != roleViewer || alice.PasswordHash != "" {
+		t.Fatalf("created user = %+v", alice)
+	}
+	again, err := resolveExternalUser(store, settings, &ExternalIdentity{Provider: "oidc", Subject: "sub-alice", Username: "alice-renamed"})
+	if err != nil || again.ID != alice.ID {
+		t.Fatalf("relogin by subject: user %d, err %v; want user %d", again.ID, err, alice.ID)
+	}
+
+	// 同名但 subject 不同的身份不能接管已关联的外部账号
+	if _, err := resolveExternalUser(store, settings, &ExternalIdentity{Provider: "proxy", Subject: "alice", Username: "alice"}); err == nil {
+		t.Fatal("second identity was linked to an already linked account")
+	}
+
+	// 管理员手动关联后可以登录，组映射会降级唯一的管理员时拒绝登录
+	if err := store.InsertExternalLink(ExternalLink{Provider: "oidc", Subject: "sub-admin", UserID: admin.ID}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := resolveExternalUser(store, settings, &ExternalIdentity{Provider: "oidc", Subject: "sub-admin", Username: "admin"}); err == nil {
+		t.Fatal("login demoting the last admin was allowed")
+	}
+	user, err := resolveExternalUser(store, settings, &ExternalIdentity{Provider: "oidc", Subject: "sub-admin", Username: "admin", Groups: []string{"gas-admins"}})
+	if err != nil || user.ID != admin.ID || user.Role != roleAdmin {
+		t.Fatalf("linked admin login: %+v, %v", user, err)
+	}
+}
+
+func TestSigningKeyRotation(t *testing.T) {
+	store, err := NewStore(filepath.Join(t.TempDir(), "gas.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	box, err := newSecretBox(make([]byte, masterKeyBytes))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 升级前遗留的明文签名密钥在启用加密时被加密
+	if err := store.InsertSigningKey(SigningKey{KID: "legacy", Secret: "legacy-secret", CreatedTS: 1, RetiredTS: 2}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.EnableSecretEncryption(box); err != nil {
+		t.Fatal(err)
+	}
+	var raw string
+	if err := store.db.QueryRow(`SELECT secret FROM signing_keys WHERE kid='legacy';`).Scan(&raw); err != nil || !isSealed(raw) {
+		t.Fatalf("legacy signing key not sealed: %q, %v", raw, err)
+	}
+	if legacy, err := store.FetchSigningKey("legacy"); err != nil || legacy.Secret != "legacy-secret" {
+		t.Fatalf("legacy signing key: %+v, %v", legacy, err)
+	}
+	admin, err := InitAdmin(store, "admin", "secret-password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest("POST", "/api/login", nil)
+
+	oldToken, err := GenerateToken(store, admin, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldKey, err := store.ActiveSigningKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.db.QueryRow(`SELECT secret FROM signing_keys WHERE kid=?;`, oldKey.KID).Scan(&raw); err != nil {
+		t.Fatal(err)
+	}
+	if !isSealed(raw) || raw == oldKey.Secret {
+		t.Fatalf("signing key stored in plaintext: %q", raw)
+	}
+
+	// 轮换后新旧 Token 都有效，宽限期过后旧密钥签发的 Token 失效
+	if _, err := RotateSigningKey(store); err != nil {
+		t.Fatal(err)
+	}
+	newToken, err := GenerateToken(store, admin, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ValidateToken(store, oldToken); err != nil {
+		t.Fatalf("old token rejected within grace period: %v", err)
+	}
+	if _, err := ValidateToken(store, newToken); err != nil {
+		t.Fatalf("new token rejected: %v", err)
+	}
+	expired := time.Now().Add(-signingKeyGrace - time.Minute).Unix()
+	if _, err := store.db.Exec(`UPDATE signing_keys SET retired_ts=? WHERE kid=?;`, expired, oldKey.KID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ValidateToken(store, oldToken); err == nil {
+		t.Fatal("old token accepted after grace period")
+	}
+
+	// 更换主密钥后签名密钥随之重新加密，已签发的 Token 仍然有效
+	key := make([]byte, masterKeyBytes)
+	key[0] = 1
+	newBox, err := newSecretBox(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.ReencryptSecrets(box, newBox); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ValidateToken(store, newToken); err != nil {
+		t.Fatalf("token rejected after master key rotation: %v", err)
+	}
+
+	// 撤销用户全部会话后 Token 立即失效
+	if err := store.RevokeUserSessions(admin.ID, time.Now().Unix()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ValidateToken(store, newToken); err == nil {
+		t.Fatal("token accepted after RevokeUserSessions")
+	}
+}
+
+func TestProxyAuthRejectsMFAUsers(t *testing.T) {
+	store, err := NewStore(filepath.Join(t.TempDir(), "gas.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if err := store.SetSettings(map[string]string{
+		"auth_proxy_enabled": "1",
+		"auth_proxy_cidrs":   "192.0.2.0/24",
+		"auth_default_role":  roleViewer,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest("GET", "/api/metrics", nil)
+	r.Header.Set(defaultProxyUserHeader, "bob")
+
+	claims, err := requestClaims(store, r)
+	if err != nil || claims.Subject != "bob" {
+		t.Fatalf("proxy login: %+v, %v", claims, err)
+	}
+
+	// 本地启用两步验证后，代理头无法完成验证码步骤，拒绝登录
+	bob, err := store.FetchUserByName("bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.SavePendingMFA(bob.ID, "JBSWY3DPEHPK3PXP"); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.EnableMFA(bob.ID, 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := requestClaims(store, r); !errors.Is(err, errExternalDenied) {
+		t.Fatalf("proxy login for MFA user: err %v, want errExternalDenied", err)
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import "time"
+
+const (
+	defaultWeekStart        = 1
+	defaultBillingCycleDay  = 1
+	defaultBillingYearMonth = 1
+	maxBillingCycleDay      = 28
+)
+
+// 统计周期规则：周起始日、账单结算日及年度阶梯起始月
+type PeriodRules struct {
+	WeekStart        time.Weekday
+	BillingDay       int
+	BillingYearMonth time.Month
+}
+
+// 账单周期，区间为 [Start, End)
+type BillingPeriod struct {
+	Start time.Time
+	End   time.Time
+}
+
+func periodRulesFromSettings(settings Settings) PeriodRules {
+	rules := PeriodRules{
+		WeekStart:        time.Weekday(settings.WeekStart),
+		BillingDay:       settings.BillingCycleDay,
+		BillingYearMonth: time.Month(settings.BillingYearMonth),
+	}
+	if rules.WeekStart < time.Sunday || rules.WeekStart > time.Saturday {
+		rules.WeekStart = defaultWeekStart
+	}
+	if rules.BillingDay < 1 || rules.BillingDay > maxBillingCycleDay {
+		rules.BillingDay = defaultBillingCycleDay
+	}
+	if rules.BillingYearMonth < time.January || rules.BillingYearMonth > time.December {
+		rules.BillingYearMonth = defaultBillingYearMonth
+	}
+	return rules
+}
+
+// t 所在的账单周期：从每月结算日 0 点开始，到下月结算日结束
+func billingPeriodFor(t time.Time, rules PeriodRules) BillingPeriod {
+	start := time.Date(t.Year(), t.Month(), rules.BillingDay, 0, 0, 0, 0, t.Location())
+	if t.Before(start) {
+		start = start.AddDate(0, -1, 0)
+	}
+	return BillingPeriod{Start: start, End: start.AddDate(0, 1, 0)}
+}
+
+// t 所在的年度阶梯周期：从起始月的结算日开始，为期一年
+func billingYearFor(t time.Time, rules PeriodRules) BillingPeriod {
+	start := time.Date(t.Year(), rules.BillingYearMonth, rules.BillingDay, 0, 0, 0, 0, t.Location())
+	if t.Before(start) {
+		start = start.AddDate(-1, 0, 0)
+	}
+	return BillingPeriod{Start: start, End: start.AddDate(1, 0, 0)}
+}
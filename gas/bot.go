@@ -0,0 +1,337 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+const (
+	tgPollTimeoutSec = 25
+	tgIdleInterval   = 30 * time.Second
+	tgErrorBackoff   = 10 * time.Second
+	maxMuteDuration  = 30 * 24 * time.Hour
+	maxTopupAmount   = 100000
+)
+
+const tgHelpText = `可用命令：
+/status - 系统状态概览
+/today - 今日用气
+/month - 本月及本期账单用气
+/remain - 剩余燃气与用完预测
+/topup 50 - 记录充值 50 m³
+/mute 12h - 静音预警（支持 m/h/d，/mute off 取消）`
+
+type tgUpdate struct {
+	UpdateID int64 `json:"update_id"`
+	Message  *struct {
+		Text string `json:"text"`
+		Chat struct {
+			ID   int64  `json:"id"`
+			Type string `json:"type"`
+		} `json:"chat"`
+		From struct {
+			ID       int64  `json:"id"`
+			Username string `json:"username"`
+		} `json:"from"`
+	} `json:"message"`
+}
+
+type tgUpdatesResponse struct {
+	OK          bool       `json:"ok"`
+	Description string     `json:"description"`
+	Result      []tgUpdate `json:"result"`
+}
+
+// TelegramBot 通过 getUpdates 长轮询接收命令，只响应授权的 Chat ID
+type TelegramBot struct {
+	store  *Store
+	hub    *Hub
+	alerts *AlertEvaluator
+	client *http.Client
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func NewTelegramBot(store *Store, hub *Hub, alerts *AlertEvaluator) *TelegramBot {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &TelegramBot{
+		store:  store,
+		hub:    hub,
+		alerts: alerts,
+		client: &http.Client{Timeout: (tgPollTimeoutSec + 10) * time.Second},
+		ctx:    ctx,
+		cancel: cancel,
+	}
+}
+
+func (b *TelegramBot) Start() {
+	go b.run()
+}
+
+func (b *TelegramBot) Stop() {
+	b.cancel()
+}
+
+func (b *TelegramBot) run() {
+	for b.ctx.Err() == nil {
+		settings, err := loadSettings(b.store)
+		if err != nil || !settings.TGBotEnabled || settings.TGBotToken == "" {
+			b.sleep(tgIdleInterval)
+			continue
+		}
+		if err := b.poll(settings); err != nil && b.ctx.Err() == nil {
+			log.Printf("telegram bot: %v", err)
+			b.sleep(tgErrorBackoff)
+		}
+	}
+}
+
+func (b *TelegramBot) sleep(d time.Duration) {
+	select {
+	case <-b.ctx.Done():
+	case <-time.After(d):
+	}
+}
+
+func (b *TelegramBot) poll(settings Settings) error {
+	offsetRaw, _ := b.store.GetSetting("tg_update_offset", "0")
+	query := url.Values{}
+	query.Set("timeout", strconv.Itoa(tgPollTimeoutSec))
+	query.Set("offset", offsetRaw)
+	query.Set("allowed_updates", `["message"]`)
+
+	req, err := http.NewRequestWithContext(b.ctx, http.MethodGet,
+		telegramAPIURL(settings.TGAPIEndpoint, settings.TGBotToken, "getUpdates")+"?"+query.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var body tgUpdatesResponse
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return fmt.Errorf("decode getUpdates: %w", err)
+	}
+	if !body.OK {
+		return fmt.Errorf("getUpdates: %s (%s)", resp.Status, body.Description)
+	}
+
+	allowed := tgAllowedChats(settings)
+	for _, update := range body.Result {
+		_ = b.store.SetSetting("tg_update_offset", strconv.FormatInt(update.UpdateID+1, 10))
+		if update.Message == nil || !strings.HasPrefix(update.Message.Text, "/") {
+			continue
+		}
+		chatID := strconv.FormatInt(update.Message.Chat.ID, 10)
+		if _, ok := allowed[chatID]; !ok {
+			log.Printf("telegram bot: ignore command from unauthorized chat %s", chatID)
+			continue
+		}
+		from := update.Message.From.Username
+		if from == "" {
+			from = strconv.FormatInt(update.Message.From.ID, 10)
+		}
+		canModify := tgUserCanModify(settings, update.Message.Chat.Type, update.Message.From.ID)
+		reply := b.handleCommand(settings, update.Message.Text, "tg:"+from, canModify)
+		if err := sendTelegramNotification(settings.TGBotToken, chatID, reply, settings.TGAPIEndpoint); err != nil {
+			log.Printf("telegram bot: reply to %s: %v", chatID, err)
+		}
+	}
+	return nil
+}
+
+// 授权的 Chat ID，未单独配置时只允许通知接收的 Chat ID
+func tgAllowedChats(settings Settings) map[string]struct{} {
+	raw := settings.TGAllowedChatIDs
+	if strings.TrimSpace(raw) == "" {
+		raw = settings.TGChatID
+	}
+	allowed := make(map[string]struct{})
+	for _, id := range strings.Split(raw, ",") {
+		if id = strings.TrimSpace(id); id != "" {
+			allowed[id] = struct{}{}
+		}
+	}
+	return allowed
+}
+
+// 发送者能否执行充值、静音等修改状态的命令。群组中任何成员都能发命令，
+// 因此需要在 tg_allowed_user_ids 中列出用户 ID；未配置时只允许私聊
+func tgUserCanModify(settings Settings, chatType string, userID int64) bool {
+	raw := strings.TrimSpace(settings.TGAllowedUserIDs)
+	if raw == "" {
+		return chatType == "private"
+	}
+	id := strconv.FormatInt(userID, 10)
+	for _, allowed := range strings.Split(raw, ",") {
+		if strings.TrimSpace(allowed) == id {
+			return true
+		}
+	}
+	return false
+}
+
+// 解析静音时长，支持 Go 时长格式及以 d 结尾的天数
+func parseMuteDuration(raw string) (time.Duration, error) {
+	raw = strings.TrimSpace(strings.ToLower(raw))
+	if strings.HasSuffix(raw, "d") {
+		days, err := strconv.ParseFloat(strings.TrimSuffix(raw, "d"), 64)
+		if err != nil {
+			return 0, fmt.Errorf("无效的时长: %s", raw)
+		}
+		return time.Duration(days * float64(24*time.Hour)), nil
+	}
+	d, err := time.ParseDuration(raw)
+	if err != nil {
+		return 0, fmt.Errorf("无效的时长: %s", raw)
+	}
+	return d, nil
+}
+
+func (b *TelegramBot) handleCommand(settings Settings, text, from string, canModify bool) string {
+	fields := strings.Fields(text)
+	// 群组中的命令形如 /status@my_bot
+	cmd := strings.ToLower(strings.SplitN(fields[0], "@", 2)[0])
+	args := fields[1:]
+
+	reply, err := b.dispatch(settings, cmd, args, from, canModify)
+	if err != nil {
+		// 回复以 HTML 模式发送，错误信息可能回显用户输入，需转义
+		return "❌ " + html.EscapeString(err.Error())
+	}
+	return reply
+}
+
+func (b *TelegramBot) dispatch(settings Settings, cmd string, args []string, from string, canModify bool) (string, error) {
+	errForbidden := errors.New("没有执行此命令的权限，请在 tg_allowed_user_ids 中添加你的用户 ID")
+	loc := loadLocation(settings.Timezone)
+	now := time.Now().In(loc)
+	price := parseDecimal(settings.GasPrice, defaultGasPrice)
+	cost := func(gas string) string {
+		return parseDecimal(gas, "0").Mul(price).StringFixed(2)
+	}
+
+	switch cmd {
+	case "/start", "/help":
+		return tgHelpText, nil
+
+	case "/status":
+		metrics, err := computeMetrics(b.store)
+		if err != nil {
+			return "", err
+		}
+		muted := "否"
+		if until := notifyMutedUntil(b.store); until > now.Unix() {
+			muted = time.Unix(until, 0).In(loc).Format("2006-01-02 15:04") + " 前"
+		}
+		return fmt.Sprintf("📟 <b>系统状态</b>\n\n🔋 剩余燃气：<b>%s m³</b>\n🔥 今日用气：%s m³\n📅 本月用气：%s m³\n🧮 燃气表读数：%s m³\n📡 MQTT：%s\n🕒 最后数据：%s\n🔕 预警静音：%s",
+			metrics.RemainGas, metrics.TodayGas, metrics.MonthGas, metrics.MeterReading, metrics.MQTTStatus, metrics.LastMsgTime, muted), nil
+
+	case "/today":
+		metrics, err := computeMetrics(b.store)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("🔥 今日用气（%s）：<b>%s m³</b>（%s 元）", now.Format("2006-01-02"), metrics.TodayGas, cost(metrics.TodayGas)), nil
+
+	case "/month":
+		metrics, err := computeMetrics(b.store)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("📅 本月用气：<b>%s m³</b>（%s 元）\n🧾 本期账单 %s ~ %s：%s m³（%s 元）",
+			metrics.MonthGas, cost(metrics.MonthGas), metrics.BillStart, metrics.BillEnd, metrics.BillGas, metrics.BillCost), nil
+
+	case "/remain":
+		metrics, err := computeMetrics(b.store)
+		if err != nil {
+			return "", err
+		}
+		reply := fmt.Sprintf("🔋 剩余燃气：<b>%s m³</b>", metrics.RemainGas)
+		if metrics.DailyAvgGas != "" {
+			reply += fmt.Sprintf("\n📊 近期日均：%s m³", metrics.DailyAvgGas)
+		}
+		if metrics.DaysLeft != "" {
+			reply += fmt.Sprintf("\n📅 预计 %s 天后用完（%s）", metrics.DaysLeft, metrics.EmptyDate)
+		}
+		return reply, nil
+
+	case "/topup":
+		if !canModify {
+			return "", errForbidden
+		}
+		if len(args) == 0 {
+			return "", errors.New("用法：/topup 50")
+		}
+		amount, err := decimal.NewFromString(args[0])
+		if err != nil || !amount.IsPositive() || amount.GreaterThan(decimal.NewFromInt(maxTopupAmount)) {
+			return "", fmt.Errorf("充值量必须是 0 到 %d 之间的数字", maxTopupAmount)
+		}
+		topup := Topup{
+			TS:        now.Unix(),
+			Amount:    amount.String(),
+			Source:    "telegram",
+			Note:      strings.Join(args[1:], " "),
+			CreatedBy: from,
+		}
+		id, err := b.store.InsertTopup(topup)
+		if err != nil {
+			return "", err
+		}
+		topup.ID = id
+		recordSystemAudit(b.store, from, "topup.create", fmt.Sprintf("topup:%d", id), nil, topup)
+		b.alerts.Trigger()
+		b.hub.PublishMetrics(b.store)
+		balance, err := computeGasBalance(b.store, settings)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("✅ 已记录充值 %s m³\n🔋 当前剩余：<b>%s m³</b>", amount.String(), balance.Remain.StringFixed(3)), nil
+
+	case "/mute":
+		if len(args) == 0 {
+			if until := notifyMutedUntil(b.store); until > now.Unix() {
+				return fmt.Sprintf("🔕 预警已静音至 %s", time.Unix(until, 0).In(loc).Format("2006-01-02 15:04")), nil
+			}
+			return "🔔 预警未静音。用法：/mute 12h", nil
+		}
+		if !canModify {
+			return "", errForbidden
+		}
+		if arg := strings.ToLower(args[0]); arg == "off" || arg == "0" {
+			if err := b.store.SetSetting("notify_mute_until", "0"); err != nil {
+				return "", err
+			}
+			recordSystemAudit(b.store, from, "notify.unmute", "settings", nil, nil)
+			return "🔔 已取消预警静音", nil
+		}
+		d, err := parseMuteDuration(args[0])
+		if err != nil {
+			return "", err
+		}
+		if d <= 0 || d > maxMuteDuration {
+			return "", errors.New("静音时长须在 30 天以内")
+		}
+		until := now.Add(d)
+		if err := b.store.SetSetting("notify_mute_until", strconv.FormatInt(until.Unix(), 10)); err != nil {
+			return "", err
+		}
+		recordSystemAudit(b.store, from, "notify.mute", "settings", nil, map[string]int64{"mute_until": until.Unix()})
+		return fmt.Sprintf("🔕 预警已静音至 %s", until.Format("2006-01-02 15:04")), nil
+	}
+	return "", fmt.Errorf("未知命令 %s\n\n%s", cmd, tgHelpText)
+}
@@ -0,0 +1,20 @@
+package main
+
+import "testing"
+
+func TestHandleCommandEscapesErrors(t *testing.T) {
+	b := &TelegramBot{}
+	cases := []struct {
+		name string
+		text string
+		want string
+	}{
+		{"未知命令", "/<b>", "❌ 未知命令 /&lt;b&gt;\n\n" + tgHelpText},
+		{"无效时长", "/mute <x", "❌ 无效的时长: &lt;x"},
+	}
+	for _, c := range cases {
+		if got := b.handleCommand(Settings{}, c.text, "1", true); got != c.want {
+			t.Errorf("%s: got %q, want %q", c.name, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+)
+
+const (
+	configFileEnv     = "GAS_CONFIG"
+	settingEnvPrefix  = "GAS_"
+	defaultServerAddr = ":8080"
+)
+
+// 来自配置文件或环境变量的配置项，优先级高于数据库中的值，界面上不可修改
+type settingOverride struct {
+	Value  string `json:"-"`      // 规范化后的值
+	Source string `json:"source"` // env 或 file
+	Ref    string `json:"ref"`    // 环境变量名或配置文件路径
+}
+
+func (o settingOverride) String() string {
+	if o.Source == "env" {
+		return "环境变量 " + o.Ref
+	}
+	return "配置文件 " + o.Ref
+}
+
+// 启动参数：服务地址、数据库路径、调试模式及各配置项的覆盖值（按配置字段名）
+type startupConfig struct {
+	File       string
+	ServerAddr string
+	DBPath     string
+	Debug      bool
+	Overrides  map[string]settingOverride
+}
+
+// 优先级：环境变量 > 配置文件 > 数据库 > 默认值
+func loadStartupConfig() (startupConfig, error) {
+	cfg := startupConfig{
+		File:       os.Getenv(configFileEnv),
+		ServerAddr: defaultServerAddr,
+		DBPath:     defaultDBPath,
+		Overrides:  make(map[string]settingOverride),
+	}
+	if cfg.File != "" {
+		if err := cfg.loadFile(); err != nil {
+			return cfg, fmt.Errorf("%s: %w", cfg.File, err)
+		}
+	}
+	cfg.ServerAddr = getenv("GAS_SERVER_ADDR", cfg.ServerAddr)
+	cfg.DBPath = getenv("GAS_DB_PATH", cfg.DBPath)
+	if raw := os.Getenv("GAS_DEBUG"); raw != "" {
+		debug, ok := parseBool(raw)
+		if !ok {
+			return cfg, errors.New("GAS_DEBUG 必须是布尔值")
+		}
+		cfg.Debug = debug
+	}
+
+	for _, def := range settingDefs {
+		name := settingEnvName(def)
+		raw, ok := os.LookupEnv(name)
+		if !ok {
+			continue
+		}
+		value, err := normalizeOverride(def, raw)
+		if err != nil {
+			return cfg, fmt.Errorf("%s: %w", name, err)
+		}
+		cfg.Overrides[def.Name] = settingOverride{Value: value, Source: "env", Ref: name}
+	}
+	return cfg, nil
+}
+
+// 配置文件为 TOML，键名与 /api/settings 字段一致；表名会作为前缀拼接，
+// 如 [mqtt] 下的 host 等同于 mqtt_host
+func (cfg *startupConfig) loadFile() error {
+	var raw map[string]interface{}
+	if _, err := toml.DecodeFile(cfg.File, &raw); err != nil {
+		return err
+	}
+	values := make(map[string]interface{})
+	flattenConfig("", raw, values)
+
+	var unknown []string
+	for key, v := range values {
+		switch key {
+		case "debug":
+			debug, ok := v.(bool)
+			if !ok {
+				return errors.New("debug 必须是布尔值")
+			}
+			cfg.Debug = debug
+			continue
+		case "server_addr", "db_path":
+			s, ok := v.(string)
+			if !ok {
+				return fmt.Errorf("%s 必须是字符串", key)
+			}
+			if key == "server_addr" {
+				cfg.ServerAddr = s
+			} else {
+				cfg.DBPath = s
+			}
+			continue
+		}
+		def, ok := settingDefsByName[key]
+		if !ok {
+			unknown = append(unknown, key)
+			continue
+		}
+		value, err := normalizeOverride(def, configValueString(v))
+		if err != nil {
+			return fmt.Errorf("%s: %w", key, err)
+		}
+		cfg.Overrides[key] = settingOverride{Value: value, Source: "file", Ref: cfg.File}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return fmt.Errorf("未知的配置项: %s", strings.Join(unknown, ", "))
+	}
+	return nil
+}
+
+func flattenConfig(prefix string, in, out map[string]interface{}) {
+	for key, v := range in {
+		if prefix != "" {
+			key = prefix + "_" + key
+		}
+		if table, ok := v.(map[string]interface{}); ok {
+			flattenConfig(key, table, out)
+			continue
+		}
+		out[key] = v
+	}
+}
+
+func configValueString(v interface{}) string {
+	switch val := v.(type) {
+	case string:
+		return val
+	case bool:
+		return strconv.FormatBool(val)
+	case int64:
+		return strconv.FormatInt(val, 10)
+	case float64:
+		return strconv.FormatFloat(val, 'f', -1, 64)
+	default:
+		return fmt.Sprint(val)
+	}
+}
+
+// 按登记表解析并校验覆盖值，启动时发现错误直接退出，避免带着错误配置运行
+func normalizeOverride(def settingDef, raw string) (string, error) {
+	var scratch Settings
+	if err := setSettingValue(&scratch, def, raw); err != nil {
+		return "", err
+	}
+	value := getSettingValue(&scratch, def)
+	if def.Validate != nil {
+		if err := def.Validate(value); err != nil {
+			return "", err
+		}
+	}
+	return value, nil
+}
+
+// 配置项对应的环境变量名，如 mqtt_host → GAS_MQTT_HOST
+func settingEnvName(def settingDef) string {
+	return settingEnvPrefix + strings.ToUpper(def.Name)
+}
+
+// 命令行：gas-go dump-config [-show-secrets]
+// 以 TOML 格式输出当前生效的全部配置，注释标明每项来源；输出可直接作为配置文件使用
+func dumpConfig(cfg startupConfig, args []string) error {
+	fs := flag.NewFlagSet("dump-config", flag.ContinueOnError)
+	showSecrets := fs.Bool("show-secrets", false, "输出敏感配置明文（默认打码）")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	store, err := NewStore(cfg.DBPath)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	if err := initSecretEncryption(store, cfg.DBPath); err != nil {
+		return err
+	}
+	store.SetSettingOverrides(cfg.Overrides)
+	settings, err := loadSettings(store)
+	if err != nil {
+		return err
+	}
+	if !*showSecrets {
+		maskSecretSettings(&settings)
+	}
+	stored, err := store.SettingKeys()
+	if err != nil {
+		return err
+	}
+
+	var out bytes.Buffer
+	fmt.Fprintf(&out, "# 生效配置（数据库 %s）\n", cfg.DBPath)
+	for _, def := range settingDefs {
+		source := "默认值"
+		if override, ok := cfg.Overrides[def.Name]; ok {
+			source = override.String()
+		} else if stored[def.key()] {
+			source = "数据库"
+		}
+		line, err := encodeConfigLine(def.Name, settingField(&settings, def).Interface())
+		if err != nil {
+			return err
+		}
+		// 打码的敏感配置注释掉，避免输出被当作配置文件时锁定为打码值
+		if def.Secret && !*showSecrets {
+			line = "# " + line
+		}
+		fmt.Fprintf(&out, "%s  # %s\n", line, source)
+	}
+	_, err = os.Stdout.Write(out.Bytes())
+	return err
+}
+
+func encodeConfigLine(name string, value interface{}) (string, error) {
+	var buf bytes.Buffer
+	if err := toml.NewEncoder(&buf).Encode(map[string]interface{}{name: value}); err != nil {
+		return "", err
+	}
+	line := strings.TrimRight(buf.String(), "\n")
+	if strings.Contains(line, "\n") {
+		return "", errors.New("无法编码配置项 " + name)
+	}
+	return line, nil
+}
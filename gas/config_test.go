@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadStartupConfigPrecedence(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "gas.toml")
+	content := "gas_price = 1.5\n\n[mqtt]\nhost = \"file-host\"\nport = 1883\n"
+	if err := os.WriteFile(file, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv(configFileEnv, file)
+	t.Setenv("GAS_MQTT_HOST", "env-host")
+
+	cfg, err := loadStartupConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		name, value, source string
+	}{
+		{"gas_price", "1.5", "file"},
+		{"mqtt_port", "1883", "file"},
+		{"mqtt_host", "env-host", "env"},
+	}
+	for _, c := range cases {
+		o, ok := cfg.Overrides[c.name]
+		if !ok || o.Value != c.value || o.Source != c.source {
+			t.Errorf("%s: override %+v (present %v), want %s from %s", c.name, o, ok, c.value, c.source)
+		}
+	}
+
+	t.Setenv("GAS_MQTT_PORT", "70000")
+	if _, err := loadStartupConfig(); err == nil {
+		t.Error("invalid environment override accepted")
+	}
+}
+
+func TestSettingsUpdateWithOverrides(t *testing.T) {
+	store, err := NewStore(filepath.Join(t.TempDir(), "gas.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if err := store.SetSettings(map[string]string{"mqtt_host": "db-host", "gas_price": "2"}); err != nil {
+		t.Fatal(err)
+	}
+	store.SetSettingOverrides(map[string]settingOverride{
+		"mqtt_host": {Value: "env-host", Source: "env", Ref: "GAS_MQTT_HOST"},
+		"gas_price": {Value: "1.5", Source: "file", Ref: "gas.toml"},
+	})
+
+	settings, err := loadSettings(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if settings.MQTTHost != "env-host" || settings.GasPrice != "1.5" {
+		t.Fatalf("overrides not applied: mqtt_host=%q gas_price=%q", settings.MQTTHost, settings.GasPrice)
+	}
+
+	cases := []struct {
+		name     string
+		method   string
+		body     string
+		wantCode int
+		locked   string // 期望报错的锁定字段
+	}{
+		{"PUT 省略锁定字段", http.MethodPut, `{"mqtt_port": 1883}`, http.StatusOK, ""},
+		{"PUT 提交锁定字段的当前值", http.MethodPut, `{"mqtt_host": "env-host", "gas_price": "1.5", "mqtt_port": 1883}`, http.StatusOK, ""},
+		{"PUT 修改配置文件锁定的字段", http.MethodPut, `{"gas_price": "3", "mqtt_port": 1883}`, http.StatusBadRequest, "gas_price"},
+		{"PATCH 修改环境变量锁定的字段", http.MethodPatch, `{"mqtt_host": "other"}`, http.StatusBadRequest, "mqtt_host"},
+		{"PATCH 恢复锁定字段的默认值", http.MethodPatch, `{"mqtt_host": null}`, http.StatusBadRequest, "mqtt_host"},
+		{"PATCH 未锁定字段", http.MethodPatch, `{"mqtt_port": 1884}`, http.StatusOK, ""},
+	}
+	for _, c := range cases {
+		w := httptest.NewRecorder()
+		settingsUpdateHandler(store, c.method == http.MethodPut)(w, httptest.NewRequest(c.method, "/api/settings", strings.NewReader(c.body)))
+		if w.Code != c.wantCode {
+			t.Errorf("%s: status %d, want %d: %s", c.name, w.Code, c.wantCode, w.Body.String())
+			continue
+		}
+		if c.locked != "" {
+			var resp struct {
+				Fields map[string]string `json:"fields"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || resp.Fields[c.locked] == "" {
+				t.Errorf("%s: expected field error for %s, got %s", c.name, c.locked, w.Body.String())
+			}
+		}
+	}
+
+	// 锁定字段始终取覆盖值，数据库中的原值不被界面写入改动
+	settings, err = loadSettings(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if settings.MQTTHost != "env-host" || settings.GasPrice != "1.5" || settings.MQTTPort != 1884 {
+		t.Errorf("after updates: mqtt_host=%q gas_price=%q mqtt_port=%d", settings.MQTTHost, settings.GasPrice, settings.MQTTPort)
+	}
+	var raw string
+	if err := store.db.QueryRow(`SELECT v FROM settings WHERE k='mqtt_host';`).Scan(&raw); err != nil || raw != "db-host" {
+		t.Errorf("stored mqtt_host = %q, %v; want db-host", raw, err)
+	}
+}
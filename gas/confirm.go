@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	confirmTokenTTL    = 2 * time.Minute
+	confirmTokenHeader = "X-Confirm-Token"
+	snapshotDirName    = "snapshots"
+	maxSnapshots       = 10
+)
+
+// 危险操作的确认令牌，绑定操作与操作者，一次有效，仅保存在内存中
+type pendingConfirm struct {
+	action  string
+	actor   string
+	expires time.Time
+}
+
+var confirmTokens = struct {
+	sync.Mutex
+	items map[string]pendingConfirm
+}{items: make(map[string]pendingConfirm)}
+
+// 二次确认：请求头未携带有效令牌时返回 428 和新令牌（附带受影响的记录数），
+// 调用方据此提示用户后携带令牌重新提交；返回 true 表示已确认可以执行。
+// action 应包含操作的参数，避免令牌被挪用到其他数据上
+func requireConfirmation(w http.ResponseWriter, r *http.Request, action string, affected int64) bool {
+	actor := auditActor(r)
+	now := time.Now()
+
+	confirmTokens.Lock()
+	for key, c := range confirmTokens.items {
+		if now.After(c.expires) {
+			delete(confirmTokens.items, key)
+		}
+	}
+	if token := strings.TrimSpace(r.Header.Get(confirmTokenHeader)); token != "" {
+		c, ok := confirmTokens.items[token]
+		delete(confirmTokens.items, token)
+		if ok && c.action == action && c.actor == actor {
+			confirmTokens.Unlock()
+			return true
+		}
+	}
+	confirmTokens.Unlock()
+
+	token, err := generateSecureKey(16)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, err)
+		return false
+	}
+	confirmTokens.Lock()
+	confirmTokens.items[token] = pendingConfirm{action: action, actor: actor, expires: now.Add(confirmTokenTTL)}
+	confirmTokens.Unlock()
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(http.StatusPreconditionRequired)
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{
+		"error":         fmt.Sprintf("该操作将影响 %d 条记录，请在 %d 秒内通过 %s 请求头携带 confirm_token 再次提交以确认", affected, int(confirmTokenTTL.Seconds()), confirmTokenHeader),
+		"confirm_token": token,
+		"expires_in":    int(confirmTokenTTL.Seconds()),
+		"affected":      affected,
+	})
+	return false
+}
+
+// 批量删除前把整个数据库复制到数据库目录下的 snapshots/，只保留最近 maxSnapshots 份，
+// 返回快照路径；恢复时停止服务并用快照替换数据库文件即可
+func snapshotDatabase(store *Store, reason string) (string, error) {
+	dir := filepath.Join(filepath.Dir(store.path), snapshotDirName)
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return "", fmt.Errorf("创建快照目录失败: %w", err)
+	}
+	base := strings.TrimSuffix(filepath.Base(store.path), filepath.Ext(store.path))
+	dest, err := reserveSnapshotFile(dir, base, reason, time.Now())
+	if err != nil {
+		return "", err
+	}
+	if err := store.Snapshot(dest); err != nil {
+		_ = os.Remove(dest)
+		return "", fmt.Errorf("创建快照失败: %w", err)
+	}
+	if err := os.Chmod(dest, 0o600); err != nil {
+		return "", err
+	}
+	pruneSnapshots(dir, base)
+	return dest, nil
+}
+
+// 以独占方式创建空的快照文件占用文件名（VACUUM INTO 允许写入空文件）。文件名精确到
+// 微秒，同一微秒内的多次快照顺延 1 微秒，保持文件名定宽且按时间有序。
+// 快照包含密码哈希和加密的凭据，仅允许服务用户读取
+func reserveSnapshotFile(dir, base, reason string, now time.Time) (string, error) {
+	for {
+		dest := filepath.Join(dir, fmt.Sprintf("%s-%s-%s.db", base, now.Format("20060102-150405.000000"), reason))
+		f, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+		if errors.Is(err, os.ErrExist) {
+			now = now.Add(time.Microsecond)
+			continue
+		}
+		if err != nil {
+			return "", fmt.Errorf("创建快照失败: %w", err)
+		}
+		return dest, f.Close()
+	}
+}
+
+func pruneSnapshots(dir, base string) {
+	matches, err := filepath.Glob(filepath.Join(dir, base+"-*.db"))
+	if err != nil || len(matches) <= maxSnapshots {
+		return
+	}
+	// 文件名以定宽的时间开头，按名称排序即按时间排序
+	sort.Strings(matches)
+	for _, old := range matches[:len(matches)-maxSnapshots] {
+		if err := os.Remove(old); err != nil {
+			log.Printf("remove snapshot %s: %v", old, err)
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestRequireConfirmation(t *testing.T) {
+	confirm := func(action, token string) (bool, string) {
+		r := httptest.NewRequest("POST", "/api/debug/clear-events", nil)
+		if token != "" {
+			r.Header.Set(confirmTokenHeader, token)
+		}
+		w := httptest.NewRecorder()
+		ok := requireConfirmation(w, r, action, 3)
+		if ok {
+			return true, ""
+		}
+		if w.Code != http.StatusPreconditionRequired {
+			t.Fatalf("status %d, want 428", w.Code)
+		}
+		var resp struct {
+			Token string `json:"confirm_token"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || resp.Token == "" {
+			t.Fatalf("no confirm token in %s", w.Body.String())
+		}
+		return false, resp.Token
+	}
+
+	_, token := confirm("event.clear", "")
+	if ok, _ := confirm("event.clear", token); !ok {
+		t.Fatal("valid token rejected")
+	}
+	if ok, _ := confirm("event.clear", token); ok {
+		t.Fatal("token accepted twice")
+	}
+
+	// 令牌绑定操作，不能挪用到其他数据上
+	_, token = confirm("event.delete:1:2", "")
+	if ok, _ := confirm("event.delete:1:3", token); ok {
+		t.Fatal("token accepted for another action")
+	}
+
+	// 过期的令牌失效
+	_, token = confirm("event.clear", "")
+	confirmTokens.Lock()
+	c := confirmTokens.items[token]
+	c.expires = time.Now().Add(-time.Second)
+	confirmTokens.items[token] = c
+	confirmTokens.Unlock()
+	if ok, _ := confirm("event.clear", token); ok {
+		t.Fatal("expired token accepted")
+	}
+}
+
+func TestSnapshotDatabase(t *testing.T) {
+	store, err := NewStore(filepath.Join(t.TempDir(), "gas.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if err := store.InsertEvent(time.Now().Unix(), 1); err != nil {
+		t.Fatal(err)
+	}
+
+	// 同一时刻的多次快照使用不同的文件名，且按名称排序与创建顺序一致
+	dir := t.TempDir()
+	now := time.Now()
+	first, err := reserveSnapshotFile(dir, "gas", "clear-events", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := reserveSnapshotFile(dir, "gas", "clear-events", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first == second || first > second {
+		t.Fatalf("snapshot names %s, %s are not unique and ordered", first, second)
+	}
+
+	var created []string
+	for i := 0; i < maxSnapshots+3; i++ {
+		dest, err := snapshotDatabase(store, "delete-event")
+		if err != nil {
+			t.Fatalf("snapshot %d: %v", i, err)
+		}
+		info, err := os.Stat(dest)
+		if err != nil || info.Size() == 0 || info.Mode().Perm() != 0o600 {
+			t.Fatalf("snapshot %s: %v, %v", dest, info, err)
+		}
+		created = append(created, dest)
+	}
+	kept, err := filepath.Glob(filepath.Join(filepath.Dir(created[0]), "gas-*.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(kept)
+	want := created[len(created)-maxSnapshots:]
+	if len(kept) != len(want) {
+		t.Fatalf("kept %d snapshots, want %d", len(kept), len(want))
+	}
+	for i := range want {
+		if kept[i] != want[i] {
+			t.Errorf("kept[%d] = %s, want %s", i, kept[i], want[i])
+		}
+	}
+}
@@ -2,16 +2,58 @@ package main
 
 import (
 	"database/sql"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"math"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"time"
 
+	"github.com/shopspring/decimal"
 	_ "modernc.org/sqlite"
 )
 
 type Store struct {
-	db *sql.DB
+	db   *sql.DB
+	path string
+	// 敏感配置的加解密，启用前读写的均为明文
+	secrets *secretBox
+	// 配置文件和环境变量指定的配置项（按字段名），读取时优先于数据库；启动后不再修改
+	overrides map[string]settingOverride
+	// 事件或更正记录每次写入后递增，供按事件缓存的统计判断是否失效
+	eventsVersion atomic.Int64
+	// 自上次断档检测以来被修改的最早事件时间，math.MaxInt64 表示没有修改
+	eventsDirtyFrom atomic.Int64
+}
+
+func (s *Store) EventsVersion() int64 {
+	return s.eventsVersion.Load()
+}
+
+// 记录 ts 及之后的事件有修改，须在写入完成后调用
+func (s *Store) markEventsDirty(ts int64) {
+	for {
+		cur := s.eventsDirtyFrom.Load()
+		if ts >= cur || s.eventsDirtyFrom.CompareAndSwap(cur, ts) {
+			return
+		}
+	}
+}
+
+func (s *Store) markEventDirty(id int64) {
+	var ts int64
+	if err := s.db.QueryRow(`SELECT ts FROM events WHERE id=?;`, id).Scan(&ts); err == nil {
+		s.markEventsDirty(ts)
+	}
+}
+
+// 取出并清除修改的起点，没有修改时返回 math.MaxInt64
+func (s *Store) TakeEventsDirtyFrom() int64 {
+	return s.eventsDirtyFrom.Swap(math.MaxInt64)
 }
 
 func NewStore(dbPath string) (*Store, error) {
@@ -50,10 +92,228 @@ func NewStore(dbPath string) (*Store, error) {
 		);`,
 		`CREATE INDEX IF NOT EXISTS idx_events_ts ON events(ts);`,
 		`CREATE INDEX IF NOT EXISTS idx_events_count ON events(count);`,
+		`CREATE TABLE IF NOT EXISTS event_adjustments (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			kind TEXT NOT NULL,
+			event_id INTEGER NOT NULL DEFAULT 0,
+			count INTEGER NOT NULL DEFAULT 0,
+			start_ts INTEGER NOT NULL DEFAULT 0,
+			end_ts INTEGER NOT NULL DEFAULT 0,
+			pulses INTEGER NOT NULL DEFAULT 0,
+			note TEXT NOT NULL DEFAULT '',
+			created_by TEXT NOT NULL DEFAULT '',
+			created_ts INTEGER NOT NULL,
+			revoked_ts INTEGER NOT NULL DEFAULT 0,
+			revoked_by TEXT NOT NULL DEFAULT ''
+		);`,
+		`CREATE INDEX IF NOT EXISTS idx_event_adjustments_range ON event_adjustments(kind, start_ts, end_ts);`,
+		// 每条事件最多一条生效的更正
+		`CREATE UNIQUE INDEX IF NOT EXISTS idx_event_adjustments_correct ON event_adjustments(event_id) WHERE kind='correct' AND revoked_ts=0;`,
+		`CREATE TABLE IF NOT EXISTS event_gaps (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			start_ts INTEGER NOT NULL,
+			end_ts INTEGER NOT NULL,
+			pulses INTEGER NOT NULL,
+			detected_ts INTEGER NOT NULL,
+			UNIQUE(start_ts, end_ts, pulses)
+		);`,
 		`CREATE TABLE IF NOT EXISTS settings (
 			k TEXT PRIMARY KEY,
 			v TEXT NOT NULL
 		);`,
+		`CREATE TABLE IF NOT EXISTS device_commands (
+			id TEXT PRIMARY KEY,
+			device TEXT NOT NULL,
+			command TEXT NOT NULL,
+			params TEXT NOT NULL DEFAULT '',
+			status TEXT NOT NULL,
+			response TEXT NOT NULL DEFAULT '',
+			error TEXT NOT NULL DEFAULT '',
+			issued_by TEXT NOT NULL DEFAULT '',
+			source_ip TEXT NOT NULL DEFAULT '',
+			created_ts INTEGER NOT NULL,
+			acked_ts INTEGER NOT NULL DEFAULT 0
+		);`,
+		`CREATE INDEX IF NOT EXISTS idx_device_commands_device ON device_commands(device, created_ts);`,
+		`CREATE TABLE IF NOT EXISTS temperatures (
+			day TEXT PRIMARY KEY,
+			temp_sum REAL NOT NULL,
+			samples INTEGER NOT NULL,
+			source TEXT NOT NULL,
+			updated_ts INTEGER NOT NULL
+		);`,
+		`CREATE TABLE IF NOT EXISTS alert_state (
+			name TEXT PRIMARY KEY,
+			active INTEGER NOT NULL DEFAULT 0,
+			notify_count INTEGER NOT NULL DEFAULT 0,
+			first_notify_ts INTEGER NOT NULL DEFAULT 0,
+			last_notify_ts INTEGER NOT NULL DEFAULT 0,
+			updated_ts INTEGER NOT NULL DEFAULT 0
+		);`,
+		`CREATE TABLE IF NOT EXISTS alert_rules (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			name TEXT NOT NULL,
+			kind TEXT NOT NULL,
+			threshold TEXT NOT NULL,
+			hysteresis TEXT NOT NULL DEFAULT '0',
+			severity TEXT NOT NULL DEFAULT 'warning',
+			repeat_minutes INTEGER NOT NULL DEFAULT 0,
+			max_repeats INTEGER NOT NULL DEFAULT 0,
+			quiet_start TEXT NOT NULL DEFAULT '',
+			quiet_end TEXT NOT NULL DEFAULT '',
+			channels TEXT NOT NULL DEFAULT 'telegram',
+			enabled INTEGER NOT NULL DEFAULT 1,
+			notify_on_resolve INTEGER NOT NULL DEFAULT 0,
+			created_ts INTEGER NOT NULL,
+			updated_ts INTEGER NOT NULL
+		);`,
+		`CREATE TABLE IF NOT EXISTS alert_history (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			rule_id INTEGER NOT NULL,
+			rule_name TEXT NOT NULL,
+			kind TEXT NOT NULL,
+			severity TEXT NOT NULL,
+			value TEXT NOT NULL,
+			threshold TEXT NOT NULL,
+			fired_ts INTEGER NOT NULL,
+			resolved_ts INTEGER NOT NULL DEFAULT 0,
+			acked_ts INTEGER NOT NULL DEFAULT 0,
+			acked_by TEXT NOT NULL DEFAULT '',
+			notify_count INTEGER NOT NULL DEFAULT 0,
+			last_notify_ts INTEGER NOT NULL DEFAULT 0
+		);`,
+		`CREATE INDEX IF NOT EXISTS idx_alert_history_rule ON alert_history(rule_id, resolved_ts);`,
+		`CREATE INDEX IF NOT EXISTS idx_alert_history_fired ON alert_history(fired_ts);`,
+		`CREATE TABLE IF NOT EXISTS topups (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			ts INTEGER NOT NULL,
+			amount TEXT NOT NULL,
+			source TEXT NOT NULL,
+			note TEXT NOT NULL DEFAULT '',
+			created_by TEXT NOT NULL DEFAULT ''
+		);`,
+		`CREATE INDEX IF NOT EXISTS idx_topups_ts ON topups(ts);`,
+		`CREATE TABLE IF NOT EXISTS notifications (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			channel TEXT NOT NULL,
+			target TEXT NOT NULL,
+			kind TEXT NOT NULL,
+			message TEXT NOT NULL,
+			status TEXT NOT NULL,
+			attempts INTEGER NOT NULL DEFAULT 0,
+			next_attempt_ts INTEGER NOT NULL,
+			last_error TEXT NOT NULL DEFAULT '',
+			created_ts INTEGER NOT NULL,
+			sent_ts INTEGER NOT NULL DEFAULT 0
+		);`,
+		`CREATE INDEX IF NOT EXISTS idx_notifications_due ON notifications(status, next_attempt_ts);`,
+		`CREATE TABLE IF NOT EXISTS notification_attempts (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			notification_id INTEGER NOT NULL,
+			ts INTEGER NOT NULL,
+			success INTEGER NOT NULL,
+			error TEXT NOT NULL DEFAULT '',
+			duration_ms INTEGER NOT NULL DEFAULT 0
+		);`,
+		`CREATE INDEX IF NOT EXISTS idx_notification_attempts_nid ON notification_attempts(notification_id);`,
+		`CREATE TABLE IF NOT EXISTS users (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			username TEXT NOT NULL UNIQUE,
+			password_hash TEXT NOT NULL,
+			role TEXT NOT NULL,
+			disabled INTEGER NOT NULL DEFAULT 0,
+			created_ts INTEGER NOT NULL,
+			updated_ts INTEGER NOT NULL,
+			last_login_ts INTEGER NOT NULL DEFAULT 0
+		);`,
+		`CREATE TABLE IF NOT EXISTS readings (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			ts INTEGER NOT NULL,
+			meter_m3 TEXT NOT NULL,
+			system_m3 TEXT NOT NULL,
+			note TEXT NOT NULL DEFAULT '',
+			created_by TEXT NOT NULL DEFAULT ''
+		);`,
+		`CREATE TABLE IF NOT EXISTS signing_keys (
+			kid TEXT PRIMARY KEY,
+			secret TEXT NOT NULL,
+			created_ts INTEGER NOT NULL,
+			retired_ts INTEGER NOT NULL DEFAULT 0
+		);`,
+		`CREATE TABLE IF NOT EXISTS sessions (
+			id TEXT PRIMARY KEY,
+			user_id INTEGER NOT NULL,
+			created_ts INTEGER NOT NULL,
+			expires_ts INTEGER NOT NULL,
+			revoked_ts INTEGER NOT NULL DEFAULT 0,
+			ip TEXT NOT NULL DEFAULT '',
+			user_agent TEXT NOT NULL DEFAULT ''
+		);`,
+		`CREATE INDEX IF NOT EXISTS idx_sessions_user ON sessions(user_id);`,
+		`CREATE TABLE IF NOT EXISTS external_identities (
+			provider TEXT NOT NULL,
+			subject TEXT NOT NULL,
+			user_id INTEGER NOT NULL,
+			created_ts INTEGER NOT NULL,
+			PRIMARY KEY (provider, subject)
+		);`,
+		`CREATE INDEX IF NOT EXISTS idx_external_identities_user ON external_identities(user_id);`,
+		`CREATE TABLE IF NOT EXISTS user_mfa (
+			user_id INTEGER PRIMARY KEY,
+			secret TEXT NOT NULL,
+			enabled INTEGER NOT NULL DEFAULT 0,
+			last_step INTEGER NOT NULL DEFAULT 0,
+			created_ts INTEGER NOT NULL
+		);`,
+		`CREATE TABLE IF NOT EXISTS mfa_recovery_codes (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			user_id INTEGER NOT NULL,
+			code_hash TEXT NOT NULL,
+			used_ts INTEGER NOT NULL DEFAULT 0
+		);`,
+		`CREATE INDEX IF NOT EXISTS idx_mfa_recovery_codes_user ON mfa_recovery_codes(user_id);`,
+		`CREATE TABLE IF NOT EXISTS login_attempts (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			ts INTEGER NOT NULL,
+			username TEXT NOT NULL,
+			ip TEXT NOT NULL,
+			success INTEGER NOT NULL,
+			reason TEXT NOT NULL,
+			user_agent TEXT NOT NULL DEFAULT ''
+		);`,
+		`CREATE INDEX IF NOT EXISTS idx_login_attempts_user ON login_attempts(username, ts);`,
+		`CREATE INDEX IF NOT EXISTS idx_login_attempts_ip ON login_attempts(ip, ts);`,
+		`CREATE TABLE IF NOT EXISTS api_tokens (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			name TEXT NOT NULL,
+			prefix TEXT NOT NULL,
+			token_hash TEXT NOT NULL UNIQUE,
+			scopes TEXT NOT NULL,
+			created_by TEXT NOT NULL DEFAULT '',
+			created_ts INTEGER NOT NULL,
+			expires_ts INTEGER NOT NULL DEFAULT 0,
+			last_used_ts INTEGER NOT NULL DEFAULT 0,
+			last_used_ip TEXT NOT NULL DEFAULT '',
+			revoked_ts INTEGER NOT NULL DEFAULT 0
+		);`,
+		`CREATE TABLE IF NOT EXISTS audit_log (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			ts INTEGER NOT NULL,
+			actor TEXT NOT NULL,
+			ip TEXT NOT NULL DEFAULT '',
+			request_id TEXT NOT NULL DEFAULT '',
+			action TEXT NOT NULL,
+			target TEXT NOT NULL DEFAULT '',
+			before_json TEXT NOT NULL DEFAULT '',
+			after_json TEXT NOT NULL DEFAULT ''
+		);`,
+		`CREATE INDEX IF NOT EXISTS idx_audit_log_ts ON audit_log(ts);`,
+		`CREATE INDEX IF NOT EXISTS idx_audit_log_action ON audit_log(action, ts);`,
+		// 审计记录只允许追加，过期记录由保留策略删除
+		`CREATE TRIGGER IF NOT EXISTS audit_log_no_update BEFORE UPDATE ON audit_log
+		BEGIN
+			SELECT RAISE(ABORT, 'audit log is append-only');
+		END;`,
 	}
 	for _, stmt := range schema {
 		if _, err := db.Exec(stmt); err != nil {
@@ -61,24 +321,212 @@ func NewStore(dbPath string) (*Store, error) {
 		}
 	}
 
-	return &Store{db: db}, nil
+	// 旧版本的 events 表没有软删除和备注字段
+	for _, column := range []string{
+		`note TEXT NOT NULL DEFAULT ''`,
+		`deleted_ts INTEGER NOT NULL DEFAULT 0`,
+		`deleted_by TEXT NOT NULL DEFAULT ''`,
+	} {
+		if err := addColumnIfMissing(db, "events", column); err != nil {
+			return nil, fmt.Errorf("migrate events: %w", err)
+		}
+	}
+
+	store := &Store{db: db, path: dbPath}
+	store.eventsDirtyFrom.Store(math.MaxInt64)
+	if err := store.migrateLegacyAlertState(); err != nil {
+		return nil, fmt.Errorf("migrate alert state: %w", err)
+	}
+	if err := store.migrateLegacyAdmin(); err != nil {
+		return nil, fmt.Errorf("migrate admin user: %w", err)
+	}
+	return store, nil
+}
+
+// column 为完整的列定义，列名取第一个单词
+func addColumnIfMissing(db *sql.DB, table, column string) error {
+	name := strings.Fields(column)[0]
+	rows, err := db.Query(`SELECT name FROM pragma_table_info(?);`, table)
+	if err != nil {
+		return err
+	}
+	found := false
+	for rows.Next() {
+		var existing string
+		if err := rows.Scan(&existing); err != nil {
+			rows.Close()
+			return err
+		}
+		found = found || existing == name
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil || found {
+		return err
+	}
+	_, err = db.Exec(`ALTER TABLE ` + table + ` ADD COLUMN ` + column + `;`)
+	return err
+}
+
+// 旧版本只有一个保存在 settings 中的管理员，迁移为 users 表中的 admin 用户
+func (s *Store) migrateLegacyAdmin() error {
+	var hash string
+	err := s.db.QueryRow(`SELECT v FROM settings WHERE k='admin_password';`).Scan(&hash)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	username := "admin"
+	if err := s.db.QueryRow(`SELECT v FROM settings WHERE k='admin_username';`).Scan(&username); err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	if hash != "" {
+		now := time.Now().Unix()
+		if _, err := tx.Exec(`INSERT OR IGNORE INTO users(username, password_hash, role, created_ts, updated_ts) VALUES(?, ?, ?, ?, ?);`,
+			username, hash, roleAdmin, now, now); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	if _, err := tx.Exec(`DELETE FROM settings WHERE k IN ('admin_username', 'admin_password');`); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// 旧版本把低气量预警状态保存在 settings 中，迁移到 alert_state 后删除
+func (s *Store) migrateLegacyAlertState() error {
+	legacyKeys := []string{"low_gas_notify_count", "low_gas_first_notify_time", "last_notify_time"}
+	values := make(map[string]int64, len(legacyKeys))
+	found := false
+	for _, k := range legacyKeys {
+		var v string
+		err := s.db.QueryRow(`SELECT v FROM settings WHERE k=?;`, k).Scan(&v)
+		if errors.Is(err, sql.ErrNoRows) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		found = true
+		values[k], _ = strconv.ParseInt(v, 10, 64)
+	}
+	if !found {
+		return nil
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	count := values["low_gas_notify_count"]
+	if _, err := tx.Exec(`INSERT OR IGNORE INTO alert_state(name, active, notify_count, first_notify_ts, last_notify_ts, updated_ts) VALUES(?, ?, ?, ?, ?, ?);`,
+		alertLowGas, count > 0, count, values["low_gas_first_notify_time"], values["last_notify_time"], time.Now().Unix()); err != nil {
+		tx.Rollback()
+		return err
+	}
+	for _, k := range legacyKeys {
+		if _, err := tx.Exec(`DELETE FROM settings WHERE k=?;`, k); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
 }
 
 func (s *Store) Close() error {
 	return s.db.Close()
 }
 
+// 敏感配置项在启用加密后自动加密保存
 func (s *Store) SetSetting(key, value string) error {
-	_, err := s.db.Exec(`INSERT INTO settings(k, v) VALUES(?, ?) ON CONFLICT(k) DO UPDATE SET v=excluded.v;`, key, value)
+	value, err := s.sealSetting(key, value)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec(`INSERT INTO settings(k, v) VALUES(?, ?) ON CONFLICT(k) DO UPDATE SET v=excluded.v;`, key, value)
 	return err
 }
 
+// 在同一事务中写入多个配置项，任一失败则全部不生效
+func (s *Store) SetSettings(values map[string]string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for key, value := range values {
+		value, err := s.sealSetting(key, value)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`INSERT INTO settings(k, v) VALUES(?, ?) ON CONFLICT(k) DO UPDATE SET v=excluded.v;`, key, value); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *Store) sealSetting(key, value string) (string, error) {
+	if s.secrets == nil || value == "" || !isSecretSetting(key) {
+		return value, nil
+	}
+	return s.secrets.seal(value)
+}
+
+func (s *Store) SetSettingOverrides(overrides map[string]settingOverride) {
+	s.overrides = overrides
+}
+
+// 被配置文件或环境变量锁定的配置项，按字段名索引
+func (s *Store) SettingOverrides() map[string]settingOverride {
+	return s.overrides
+}
+
+// 数据库中已保存的配置键
+func (s *Store) SettingKeys() (map[string]bool, error) {
+	rows, err := s.db.Query(`SELECT k FROM settings;`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	keys := make(map[string]bool)
+	for rows.Next() {
+		var k string
+		if err := rows.Scan(&k); err != nil {
+			return nil, err
+		}
+		keys[k] = true
+	}
+	return keys, rows.Err()
+}
+
 func (s *Store) GetSetting(key string, def string) (string, error) {
+	if override, ok := s.overrides[settingDefsByKey[key].Name]; ok {
+		return override.Value, nil
+	}
 	row := s.db.QueryRow(`SELECT v FROM settings WHERE k=?;`, key)
 	var v string
 	switch err := row.Scan(&v); err {
 	case nil:
-		return v, nil
+		if !isSealed(v) {
+			return v, nil
+		}
+		if s.secrets == nil {
+			return def, fmt.Errorf("配置 %s 已加密，但未加载主密钥", key)
+		}
+		plain, err := s.secrets.open(v)
+		if err != nil {
+			return def, fmt.Errorf("解密配置 %s 失败: %w", key, err)
+		}
+		return plain, nil
 	case sql.ErrNoRows:
 		return def, nil
 	default:
@@ -86,44 +534,198 @@ func (s *Store) GetSetting(key string, def string) (string, error) {
 	}
 }
 
+// 启用敏感配置加密：校验已有密文能用当前主密钥解密，并加密遗留的明文配置和签名密钥
+func (s *Store) EnableSecretEncryption(box *secretBox) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, key := range secretSettingKeys() {
+		var v string
+		err := tx.QueryRow(`SELECT v FROM settings WHERE k=?;`, key).Scan(&v)
+		if errors.Is(err, sql.ErrNoRows) || (err == nil && v == "") {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if isSealed(v) {
+			if _, err := box.open(v); err != nil {
+				return fmt.Errorf("配置 %s 无法解密，请检查主密钥: %w", key, err)
+			}
+			continue
+		}
+		sealed, err := box.seal(v)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`UPDATE settings SET v=? WHERE k=?;`, sealed, key); err != nil {
+			return err
+		}
+	}
+	keys, err := signingKeySecrets(tx)
+	if err != nil {
+		return err
+	}
+	for kid, v := range keys {
+		if isSealed(v) {
+			if _, err := box.open(v); err != nil {
+				return fmt.Errorf("签名密钥 %s 无法解密，请检查主密钥: %w", kid, err)
+			}
+			continue
+		}
+		sealed, err := box.seal(v)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`UPDATE signing_keys SET secret=? WHERE kid=?;`, sealed, kid); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	s.secrets = box
+	return nil
+}
+
+// 读取全部签名密钥的原始值（可能是密文），按 kid 索引
+func signingKeySecrets(tx *sql.Tx) (map[string]string, error) {
+	rows, err := tx.Query(`SELECT kid, secret FROM signing_keys;`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	keys := make(map[string]string)
+	for rows.Next() {
+		var kid, secret string
+		if err := rows.Scan(&kid, &secret); err != nil {
+			return nil, err
+		}
+		keys[kid] = secret
+	}
+	return keys, rows.Err()
+}
+
+// 使用新主密钥重新加密全部敏感配置和签名密钥，返回处理的项数；任一项失败则整体回滚
+func (s *Store) ReencryptSecrets(oldBox, newBox *secretBox) (int, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	count := 0
+	for _, key := range secretSettingKeys() {
+		var v string
+		err := tx.QueryRow(`SELECT v FROM settings WHERE k=?;`, key).Scan(&v)
+		if errors.Is(err, sql.ErrNoRows) || (err == nil && v == "") {
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		if isSealed(v) {
+			if v, err = oldBox.open(v); err != nil {
+				return 0, fmt.Errorf("配置 %s: %w", key, err)
+			}
+		}
+		sealed, err := newBox.seal(v)
+		if err != nil {
+			return 0, err
+		}
+		if _, err := tx.Exec(`UPDATE settings SET v=? WHERE k=?;`, sealed, key); err != nil {
+			return 0, err
+		}
+		count++
+	}
+	keys, err := signingKeySecrets(tx)
+	if err != nil {
+		return 0, err
+	}
+	for kid, v := range keys {
+		if isSealed(v) {
+			if v, err = oldBox.open(v); err != nil {
+				return 0, fmt.Errorf("签名密钥 %s: %w", kid, err)
+			}
+		}
+		sealed, err := newBox.seal(v)
+		if err != nil {
+			return 0, err
+		}
+		if _, err := tx.Exec(`UPDATE signing_keys SET secret=? WHERE kid=?;`, sealed, kid); err != nil {
+			return 0, err
+		}
+		count++
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	s.secrets = newBox
+	return count, nil
+}
+
 func (s *Store) InsertEvent(ts int64, count int64) error {
+	defer s.eventsVersion.Add(1)
+	defer s.markEventsDirty(ts)
 	_, err := s.db.Exec(`INSERT INTO events(ts, count, received_ts) VALUES(?, ?, ?);`, ts, count, time.Now().Unix())
 	return err
 }
 
-func (s *Store) FetchLatestEvent() (int64, int64, error) {
-	row := s.db.QueryRow(`SELECT ts, count FROM events ORDER BY ts DESC, id DESC LIMIT 1;`)
-	var ts int64
-	var count int64
-	if err := row.Scan(&ts, &count); err != nil {
-		return 0, 0, err
+// 事件及其生效的更正读数（未更正时为 NULL）
+const eventColumnsSQL = `SELECT e.id, e.ts, e.count, e.received_ts, e.note, e.deleted_ts, e.deleted_by, a.count
+	FROM events e
+	LEFT JOIN event_adjustments a ON a.event_id=e.id AND a.kind='correct' AND a.revoked_ts=0`
+
+// 参与统计的事件：排除已删除的事件，有更正时使用更正后的读数
+const effectiveEventsSQL = `(SELECT e.id, e.ts, COALESCE(a.count, e.count) AS count
+	FROM events e
+	LEFT JOIN event_adjustments a ON a.event_id=e.id AND a.kind='correct' AND a.revoked_ts=0
+	WHERE e.deleted_ts=0)`
+
+func scanEvent(row interface{ Scan(...any) error }) (Event, error) {
+	var ev Event
+	var corrected sql.NullInt64
+	if err := row.Scan(&ev.ID, &ev.Timestamp, &ev.Count, &ev.ReceivedTS, &ev.Note, &ev.DeletedTS, &ev.DeletedBy, &corrected); err != nil {
+		return ev, err
 	}
-	return ts, count, nil
+	if corrected.Valid {
+		ev.CorrectedCount = &corrected.Int64
+	}
+	return ev, nil
 }
 
-func (s *Store) FetchPrevCountBefore(tsExclusive int64) (*int64, error) {
-	row := s.db.QueryRow(`SELECT count FROM events WHERE ts < ? ORDER BY ts DESC, id DESC LIMIT 1;`, tsExclusive)
-	var count int64
-	if err := row.Scan(&count); err != nil {
-		if err == sql.ErrNoRows {
-			return nil, nil
-		}
-		return nil, err
+// 按时间倒序（最新在前）分页查询事件，含接收时间、备注和更正读数
+func (s *Store) FetchEvents(f EventFilter) ([]Event, error) {
+	var where []string
+	var args []any
+	if f.From > 0 {
+		where = append(where, "e.ts>=?")
+		args = append(args, f.From)
 	}
-	return &count, nil
-}
+	if f.To > 0 {
+		where = append(where, "e.ts<?")
+		args = append(args, f.To)
+	}
+	if !f.IncludeDeleted {
+		where = append(where, "e.deleted_ts=0")
+	}
+	query := eventColumnsSQL
+	if len(where) > 0 {
+		query += ` WHERE ` + strings.Join(where, " AND ")
+	}
+	query += ` ORDER BY e.ts DESC, e.id DESC LIMIT ? OFFSET ?;`
+	args = append(args, f.Limit, f.Offset)
 
-func (s *Store) FetchEventsInRange(startTS, endTS int64) ([]Event, error) {
-	rows, err := s.db.Query(`SELECT ts, count FROM events WHERE ts >= ? AND ts < ? ORDER BY ts ASC, id ASC;`, startTS, endTS)
+	rows, err := s.db.Query(query, args...)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
-
 	var events []Event
 	for rows.Next() {
-		var ev Event
-		if err := rows.Scan(&ev.Timestamp, &ev.Count); err != nil {
+		ev, err := scanEvent(rows)
+		if err != nil {
 			return nil, err
 		}
 		events = append(events, ev)
@@ -131,38 +733,1359 @@ func (s *Store) FetchEventsInRange(startTS, endTS int64) ([]Event, error) {
 	return events, rows.Err()
 }
 
-func (s *Store) FetchAllEvents() ([]Event, error) {
-	rows, err := s.db.Query(`SELECT ts, count FROM events ORDER BY ts ASC, id ASC;`)
+// 按 ID 查询事件（含已删除的事件），不存在时返回 nil
+func (s *Store) FetchEvent(id int64) (*Event, error) {
+	ev, err := scanEvent(s.db.QueryRow(eventColumnsSQL+` WHERE e.id=?;`, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
 	if err != nil {
 		return nil, err
 	}
-	defer rows.Close()
+	return &ev, nil
+}
 
-	var events []Event
-	for rows.Next() {
-		var ev Event
-		if err := rows.Scan(&ev.Timestamp, &ev.Count); err != nil {
-			return nil, err
+// 软删除：事件保留在数据库中，但不再参与统计，可恢复
+func (s *Store) SoftDeleteEvent(id int64, by string, now int64) error {
+	defer s.eventsVersion.Add(1)
+	defer s.markEventDirty(id)
+	_, err := s.db.Exec(`UPDATE events SET deleted_ts=?, deleted_by=? WHERE id=? AND deleted_ts=0;`, now, by, id)
+	return err
+}
+
+func (s *Store) RestoreEvent(id int64) error {
+	defer s.eventsVersion.Add(1)
+	defer s.markEventDirty(id)
+	_, err := s.db.Exec(`UPDATE events SET deleted_ts=0, deleted_by='' WHERE id=?;`, id)
+	return err
+}
+
+func (s *Store) UpdateEventNote(id int64, note string) error {
+	_, err := s.db.Exec(`UPDATE events SET note=? WHERE id=?;`, note, id)
+	return err
+}
+
+// 在同一事务中写入多条事件，任一失败则全部不写入
+func (s *Store) InsertEvents(events []Event) error {
+	defer s.eventsVersion.Add(1)
+	earliest := int64(math.MaxInt64)
+	for _, ev := range events {
+		earliest = min(earliest, ev.Timestamp)
+	}
+	defer s.markEventsDirty(earliest)
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	now := time.Now().Unix()
+	for _, ev := range events {
+		if _, err := tx.Exec(`INSERT INTO events(ts, count, received_ts) VALUES(?, ?, ?);`, ev.Timestamp, ev.Count, now); err != nil {
+			return err
 		}
-		events = append(events, ev)
 	}
-	return events, rows.Err()
+	return tx.Commit()
 }
 
-func (s *Store) FetchRecentEvents(limit int) ([]Event, error) {
-	rows, err := s.db.Query(`SELECT ts, count FROM events ORDER BY ts DESC, id DESC LIMIT ?;`, limit)
-	if err != nil {
-		return nil, err
+// 统计匹配的事件数；ts 为 0 时统计全部事件
+func (s *Store) CountEvents(ts, count int64) (int64, error) {
+	var n int64
+	var err error
+	if ts == 0 {
+		err = s.db.QueryRow(`SELECT COUNT(*) FROM events;`).Scan(&n)
+	} else {
+		err = s.db.QueryRow(`SELECT COUNT(*) FROM events WHERE ts=? AND count=?;`, ts, count).Scan(&n)
 	}
-	defer rows.Close()
+	return n, err
+}
 
-	var events []Event
-	for rows.Next() {
-		var ev Event
-		if err := rows.Scan(&ev.Timestamp, &ev.Count); err != nil {
-			return nil, err
+// 物理删除匹配的事件及其更正记录；ts 为 0 时清空全部事件和更正记录
+func (s *Store) DeleteEvents(ts, count int64) (int64, error) {
+	defer s.eventsVersion.Add(1)
+	if ts == 0 {
+		defer s.markEventsDirty(math.MinInt64)
+	} else {
+		defer s.markEventsDirty(ts)
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	var res sql.Result
+	if ts == 0 {
+		if _, err := tx.Exec(`DELETE FROM event_adjustments;`); err != nil {
+			return 0, err
 		}
-		events = append(events, ev)
+		res, err = tx.Exec(`DELETE FROM events;`)
+	} else {
+		if _, err := tx.Exec(`DELETE FROM event_adjustments WHERE event_id IN (SELECT id FROM events WHERE ts=? AND count=?);`, ts, count); err != nil {
+			return 0, err
+		}
+		res, err = tx.Exec(`DELETE FROM events WHERE ts=? AND count=?;`, ts, count)
 	}
-	return events, rows.Err()
-}
\ No newline at end of file
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	return n, tx.Commit()
+}
+
+// 将整个数据库复制到 dest（VACUUM INTO），复制期间不阻塞读写
+func (s *Store) Snapshot(dest string) error {
+	_, err := s.db.Exec(`VACUUM INTO ?;`, dest)
+	return err
+}
+
+const adjustmentColumnsSQL = `SELECT id, kind, event_id, count, start_ts, end_ts, pulses, note, created_by, created_ts, revoked_ts, revoked_by FROM event_adjustments`
+
+func scanAdjustment(row interface{ Scan(...any) error }) (EventAdjustment, error) {
+	var a EventAdjustment
+	err := row.Scan(&a.ID, &a.Kind, &a.EventID, &a.Count, &a.StartTS, &a.EndTS, &a.Pulses, &a.Note, &a.CreatedBy, &a.CreatedTS, &a.RevokedTS, &a.RevokedBy)
+	return a, err
+}
+
+// 更正事件读数，替换该事件之前生效的更正（旧记录标记为已撤销）
+func (s *Store) CorrectEvent(a EventAdjustment) (int64, error) {
+	defer s.eventsVersion.Add(1)
+	defer s.markEventDirty(a.EventID)
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	// 与软删除在同一事务中检查，避免更正刚被删除的事件
+	var deletedTS int64
+	if err := tx.QueryRow(`SELECT deleted_ts FROM events WHERE id=?;`, a.EventID).Scan(&deletedTS); err != nil {
+		return 0, err
+	}
+	if deletedTS > 0 {
+		return 0, errEventDeleted
+	}
+	if _, err := tx.Exec(`UPDATE event_adjustments SET revoked_ts=?, revoked_by=? WHERE kind=? AND event_id=? AND revoked_ts=0;`,
+		a.CreatedTS, a.CreatedBy, adjustmentCorrect, a.EventID); err != nil {
+		return 0, err
+	}
+	res, err := tx.Exec(`INSERT INTO event_adjustments(kind, event_id, count, note, created_by, created_ts) VALUES(?, ?, ?, ?, ?, ?);`,
+		adjustmentCorrect, a.EventID, a.Count, a.Note, a.CreatedBy, a.CreatedTS)
+	if err != nil {
+		return 0, err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+	return id, tx.Commit()
+}
+
+func (s *Store) InsertMissingPulses(a EventAdjustment) (int64, error) {
+	defer s.eventsVersion.Add(1)
+	res, err := s.db.Exec(`INSERT INTO event_adjustments(kind, start_ts, end_ts, pulses, note, created_by, created_ts) VALUES(?, ?, ?, ?, ?, ?, ?);`,
+		adjustmentMissing, a.StartTS, a.EndTS, a.Pulses, a.Note, a.CreatedBy, a.CreatedTS)
+	if err != nil {
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
+func (s *Store) RevokeAdjustment(id int64, by string, now int64) error {
+	defer s.eventsVersion.Add(1)
+	_, err := s.db.Exec(`UPDATE event_adjustments SET revoked_ts=?, revoked_by=? WHERE id=? AND revoked_ts=0;`, now, by, id)
+	// 撤销更正会改变事件读数，补录的脉冲不参与断档检测
+	var eventID int64
+	if s.db.QueryRow(`SELECT event_id FROM event_adjustments WHERE id=? AND kind=?;`, id, adjustmentCorrect).Scan(&eventID) == nil {
+		s.markEventDirty(eventID)
+	}
+	return err
+}
+
+// 按 ID 查询更正记录，不存在时返回 nil
+func (s *Store) FetchAdjustment(id int64) (*EventAdjustment, error) {
+	a, err := scanAdjustment(s.db.QueryRow(adjustmentColumnsSQL+` WHERE id=?;`, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &a, nil
+}
+
+// 按创建时间倒序查询更正记录
+func (s *Store) FetchAdjustments(f AdjustmentFilter) ([]EventAdjustment, error) {
+	var where []string
+	var args []any
+	if f.Kind != "" {
+		where = append(where, "kind=?")
+		args = append(args, f.Kind)
+	}
+	if f.EventID > 0 {
+		where = append(where, "event_id=?")
+		args = append(args, f.EventID)
+	}
+	if !f.IncludeRevoked {
+		where = append(where, "revoked_ts=0")
+	}
+	query := adjustmentColumnsSQL
+	if len(where) > 0 {
+		query += ` WHERE ` + strings.Join(where, " AND ")
+	}
+	query += ` ORDER BY id DESC LIMIT ?;`
+	args = append(args, f.Limit)
+
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var list []EventAdjustment
+	for rows.Next() {
+		a, err := scanAdjustment(rows)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, a)
+	}
+	return list, rows.Err()
+}
+
+// 与 [startTS, endTS) 重叠的生效补录脉冲
+func (s *Store) FetchMissingPulses(startTS, endTS int64) ([]EventAdjustment, error) {
+	rows, err := s.db.Query(adjustmentColumnsSQL+` WHERE kind=? AND revoked_ts=0 AND start_ts<? AND end_ts>? ORDER BY start_ts ASC;`,
+		adjustmentMissing, endTS, startTS)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var list []EventAdjustment
+	for rows.Next() {
+		a, err := scanAdjustment(rows)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, a)
+	}
+	return list, rows.Err()
+}
+
+func (s *Store) SumMissingPulses() (int64, error) {
+	var total int64
+	err := s.db.QueryRow(`SELECT COALESCE(SUM(pulses), 0) FROM event_adjustments WHERE kind=? AND revoked_ts=0;`, adjustmentMissing).Scan(&total)
+	return total, err
+}
+
+// 以检测结果替换开始时间不早于 fromTS 的断档记录：已有的保留原检测时间，
+// 不再出现的（事件被删除或更正）移除。返回新发现的断档
+func (s *Store) SyncGaps(fromTS int64, gaps []EventGap, now int64) ([]EventGap, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(`CREATE TEMP TABLE IF NOT EXISTS detected_gaps (start_ts INTEGER, end_ts INTEGER, pulses INTEGER);`); err != nil {
+		return nil, err
+	}
+	if _, err := tx.Exec(`DELETE FROM temp.detected_gaps;`); err != nil {
+		return nil, err
+	}
+	var added []EventGap
+	for _, g := range gaps {
+		if _, err := tx.Exec(`INSERT INTO temp.detected_gaps(start_ts, end_ts, pulses) VALUES(?, ?, ?);`, g.StartTS, g.EndTS, g.Pulses); err != nil {
+			return nil, err
+		}
+		res, err := tx.Exec(`INSERT OR IGNORE INTO event_gaps(start_ts, end_ts, pulses, detected_ts) VALUES(?, ?, ?, ?);`, g.StartTS, g.EndTS, g.Pulses, now)
+		if err != nil {
+			return nil, err
+		}
+		if n, _ := res.RowsAffected(); n > 0 {
+			added = append(added, g)
+		}
+	}
+	if _, err := tx.Exec(`DELETE FROM event_gaps WHERE start_ts >= ? AND NOT EXISTS (
+		SELECT 1 FROM temp.detected_gaps d
+		WHERE d.start_ts=event_gaps.start_ts AND d.end_ts=event_gaps.end_ts AND d.pulses=event_gaps.pulses);`, fromTS); err != nil {
+		return nil, err
+	}
+	return added, tx.Commit()
+}
+
+// 按结束时间倒序查询断档，from/to 为 0 时不限
+func (s *Store) FetchGaps(from, to int64, limit int) ([]EventGap, error) {
+	query := `SELECT id, start_ts, end_ts, pulses, detected_ts FROM event_gaps WHERE 1=1`
+	var args []any
+	if from > 0 {
+		query += ` AND end_ts>?`
+		args = append(args, from)
+	}
+	if to > 0 {
+		query += ` AND start_ts<?`
+		args = append(args, to)
+	}
+	query += ` ORDER BY end_ts DESC LIMIT ?;`
+	args = append(args, limit)
+
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var gaps []EventGap
+	for rows.Next() {
+		var g EventGap
+		if err := rows.Scan(&g.ID, &g.StartTS, &g.EndTS, &g.Pulses, &g.DetectedTS); err != nil {
+			return nil, err
+		}
+		gaps = append(gaps, g)
+	}
+	return gaps, rows.Err()
+}
+
+// 以下查询用于统计，均基于 effectiveEventsSQL
+
+func (s *Store) FetchLatestEvent() (int64, int64, error) {
+	row := s.db.QueryRow(`SELECT ts, count FROM ` + effectiveEventsSQL + ` ORDER BY ts DESC, id DESC LIMIT 1;`)
+	var ts int64
+	var count int64
+	if err := row.Scan(&ts, &count); err != nil {
+		return 0, 0, err
+	}
+	return ts, count, nil
+}
+
+func (s *Store) FetchPrevEventBefore(tsExclusive int64) (*Event, error) {
+	return s.queryEffectiveEvent(`SELECT ts, count FROM `+effectiveEventsSQL+` WHERE ts < ? ORDER BY ts DESC, id DESC LIMIT 1;`, tsExclusive)
+}
+
+func (s *Store) FetchNextEventFrom(tsInclusive int64) (*Event, error) {
+	return s.queryEffectiveEvent(`SELECT ts, count FROM `+effectiveEventsSQL+` WHERE ts >= ? ORDER BY ts ASC, id ASC LIMIT 1;`, tsInclusive)
+}
+
+func (s *Store) queryEffectiveEvent(query string, args ...any) (*Event, error) {
+	var ev Event
+	if err := s.db.QueryRow(query, args...).Scan(&ev.Timestamp, &ev.Count); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &ev, nil
+}
+
+func (s *Store) FetchEventsInRange(startTS, endTS int64) ([]Event, error) {
+	return s.queryEffectiveEvents(`SELECT ts, count FROM `+effectiveEventsSQL+` WHERE ts >= ? AND ts < ? ORDER BY ts ASC, id ASC;`, startTS, endTS)
+}
+
+func (s *Store) FetchAllEvents() ([]Event, error) {
+	return s.queryEffectiveEvents(`SELECT ts, count FROM ` + effectiveEventsSQL + ` ORDER BY ts ASC, id ASC;`)
+}
+
+func (s *Store) FetchRecentEvents(limit int) ([]Event, error) {
+	return s.queryEffectiveEvents(`SELECT ts, count FROM `+effectiveEventsSQL+` ORDER BY ts DESC, id DESC LIMIT ?;`, limit)
+}
+
+func (s *Store) queryEffectiveEvents(query string, args ...any) ([]Event, error) {
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var events []Event
+	for rows.Next() {
+		var ev Event
+		if err := rows.Scan(&ev.Timestamp, &ev.Count); err != nil {
+			return nil, err
+		}
+		events = append(events, ev)
+	}
+	return events, rows.Err()
+}
+
+func (s *Store) InsertDeviceCommand(cmd DeviceCommand) error {
+	_, err := s.db.Exec(`INSERT INTO device_commands(id, device, command, params, status, issued_by, source_ip, created_ts) VALUES(?, ?, ?, ?, ?, ?, ?, ?);`,
+		cmd.ID, cmd.Device, cmd.Command, cmd.Params, cmd.Status, cmd.IssuedBy, cmd.SourceIP, cmd.CreatedTS)
+	return err
+}
+
+func (s *Store) UpdateDeviceCommandStatus(id, status, response, errMsg string, ackedTS int64) error {
+	_, err := s.db.Exec(`UPDATE device_commands SET status=?, response=?, error=?, acked_ts=? WHERE id=?;`, status, response, errMsg, ackedTS, id)
+	return err
+}
+
+func (s *Store) FetchDeviceCommand(id string) (DeviceCommand, error) {
+	row := s.db.QueryRow(`SELECT id, device, command, params, status, response, error, issued_by, source_ip, created_ts, acked_ts FROM device_commands WHERE id=?;`, id)
+	var cmd DeviceCommand
+	err := row.Scan(&cmd.ID, &cmd.Device, &cmd.Command, &cmd.Params, &cmd.Status, &cmd.Response, &cmd.Error, &cmd.IssuedBy, &cmd.SourceIP, &cmd.CreatedTS, &cmd.AckedTS)
+	return cmd, err
+}
+
+func (s *Store) FetchDeviceCommands(device string, limit int) ([]DeviceCommand, error) {
+	rows, err := s.db.Query(`SELECT id, device, command, params, status, response, error, issued_by, source_ip, created_ts, acked_ts FROM device_commands WHERE device=? ORDER BY created_ts DESC LIMIT ?;`, device, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var cmds []DeviceCommand
+	for rows.Next() {
+		var cmd DeviceCommand
+		if err := rows.Scan(&cmd.ID, &cmd.Device, &cmd.Command, &cmd.Params, &cmd.Status, &cmd.Response, &cmd.Error, &cmd.IssuedBy, &cmd.SourceIP, &cmd.CreatedTS, &cmd.AckedTS); err != nil {
+			return nil, err
+		}
+		cmds = append(cmds, cmd)
+	}
+	return cmds, rows.Err()
+}
+
+// 追加一条实时气温采样，日均气温由累加值计算
+func (s *Store) AddTemperatureSample(day string, temp float64) error {
+	_, err := s.db.Exec(`INSERT INTO temperatures(day, temp_sum, samples, source, updated_ts) VALUES(?, ?, 1, 'mqtt', ?)
+		ON CONFLICT(day) DO UPDATE SET temp_sum=temp_sum+excluded.temp_sum, samples=samples+1, source='mqtt', updated_ts=excluded.updated_ts;`,
+		day, temp, time.Now().Unix())
+	return err
+}
+
+// 导入日均气温，覆盖当天已有数据
+func (s *Store) UpsertDailyTemperatures(temps map[string]float64, source string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	now := time.Now().Unix()
+	for day, temp := range temps {
+		if _, err := tx.Exec(`INSERT INTO temperatures(day, temp_sum, samples, source, updated_ts) VALUES(?, ?, 1, ?, ?)
+			ON CONFLICT(day) DO UPDATE SET temp_sum=excluded.temp_sum, samples=1, source=excluded.source, updated_ts=excluded.updated_ts;`,
+			day, temp, source, now); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *Store) FetchDailyTemperatures(fromDay, toDay string) ([]DailyTemperature, error) {
+	rows, err := s.db.Query(`SELECT day, temp_sum / samples, samples, source FROM temperatures WHERE day >= ? AND day <= ? ORDER BY day ASC;`, fromDay, toDay)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var temps []DailyTemperature
+	for rows.Next() {
+		var t DailyTemperature
+		if err := rows.Scan(&t.Day, &t.AvgTemp, &t.Samples, &t.Source); err != nil {
+			return nil, err
+		}
+		temps = append(temps, t)
+	}
+	return temps, rows.Err()
+}
+
+func (s *Store) GetAlertState(name string) (AlertState, error) {
+	state := AlertState{Name: name}
+	err := s.db.QueryRow(`SELECT active, notify_count, first_notify_ts, last_notify_ts, updated_ts FROM alert_state WHERE name=?;`, name).
+		Scan(&state.Active, &state.NotifyCount, &state.FirstNotifyTS, &state.LastNotifyTS, &state.UpdatedTS)
+	if errors.Is(err, sql.ErrNoRows) {
+		return state, nil
+	}
+	return state, err
+}
+
+func (s *Store) SaveAlertState(state AlertState) error {
+	_, err := s.db.Exec(`INSERT INTO alert_state(name, active, notify_count, first_notify_ts, last_notify_ts, updated_ts) VALUES(?, ?, ?, ?, ?, ?)
+		ON CONFLICT(name) DO UPDATE SET active=excluded.active, notify_count=excluded.notify_count, first_notify_ts=excluded.first_notify_ts, last_notify_ts=excluded.last_notify_ts, updated_ts=excluded.updated_ts;`,
+		state.Name, state.Active, state.NotifyCount, state.FirstNotifyTS, state.LastNotifyTS, time.Now().Unix())
+	return err
+}
+
+const alertRuleColumns = `id, name, kind, threshold, hysteresis, severity, repeat_minutes, max_repeats, quiet_start, quiet_end, channels, enabled, notify_on_resolve, created_ts, updated_ts`
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanAlertRule(row rowScanner) (AlertRule, error) {
+	var rule AlertRule
+	var channels string
+	err := row.Scan(&rule.ID, &rule.Name, &rule.Kind, &rule.Threshold, &rule.Hysteresis, &rule.Severity, &rule.RepeatMinutes, &rule.MaxRepeats,
+		&rule.QuietStart, &rule.QuietEnd, &channels, &rule.Enabled, &rule.NotifyOnResolve, &rule.CreatedTS, &rule.UpdatedTS)
+	rule.Channels = splitList(channels)
+	return rule, err
+}
+
+func (s *Store) InsertAlertRule(rule AlertRule) (int64, error) {
+	now := time.Now().Unix()
+	res, err := s.db.Exec(`INSERT INTO alert_rules(name, kind, threshold, hysteresis, severity, repeat_minutes, max_repeats, quiet_start, quiet_end, channels, enabled, notify_on_resolve, created_ts, updated_ts)
+		VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?);`,
+		rule.Name, rule.Kind, rule.Threshold, rule.Hysteresis, rule.Severity, rule.RepeatMinutes, rule.MaxRepeats,
+		rule.QuietStart, rule.QuietEnd, strings.Join(rule.Channels, ","), rule.Enabled, rule.NotifyOnResolve, now, now)
+	if err != nil {
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
+func (s *Store) UpdateAlertRule(rule AlertRule) error {
+	res, err := s.db.Exec(`UPDATE alert_rules SET name=?, kind=?, threshold=?, hysteresis=?, severity=?, repeat_minutes=?, max_repeats=?, quiet_start=?, quiet_end=?, channels=?, enabled=?, notify_on_resolve=?, updated_ts=? WHERE id=?;`,
+		rule.Name, rule.Kind, rule.Threshold, rule.Hysteresis, rule.Severity, rule.RepeatMinutes, rule.MaxRepeats,
+		rule.QuietStart, rule.QuietEnd, strings.Join(rule.Channels, ","), rule.Enabled, rule.NotifyOnResolve, time.Now().Unix(), rule.ID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+func (s *Store) DeleteAlertRule(id int64) error {
+	res, err := s.db.Exec(`DELETE FROM alert_rules WHERE id=?;`, id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+func (s *Store) FetchAlertRule(id int64) (AlertRule, error) {
+	return scanAlertRule(s.db.QueryRow(`SELECT `+alertRuleColumns+` FROM alert_rules WHERE id=?;`, id))
+}
+
+func (s *Store) FetchAlertRules() ([]AlertRule, error) {
+	rows, err := s.db.Query(`SELECT ` + alertRuleColumns + ` FROM alert_rules ORDER BY id ASC;`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var rules []AlertRule
+	for rows.Next() {
+		rule, err := scanAlertRule(rows)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+	return rules, rows.Err()
+}
+
+const alertHistoryColumns = `id, rule_id, rule_name, kind, severity, value, threshold, fired_ts, resolved_ts, acked_ts, acked_by, notify_count, last_notify_ts`
+
+func scanAlertHistory(row rowScanner) (AlertHistory, error) {
+	var h AlertHistory
+	err := row.Scan(&h.ID, &h.RuleID, &h.RuleName, &h.Kind, &h.Severity, &h.Value, &h.Threshold, &h.FiredTS, &h.ResolvedTS, &h.AckedTS, &h.AckedBy, &h.NotifyCount, &h.LastNotifyTS)
+	return h, err
+}
+
+func (s *Store) InsertAlertHistory(h AlertHistory) (int64, error) {
+	res, err := s.db.Exec(`INSERT INTO alert_history(rule_id, rule_name, kind, severity, value, threshold, fired_ts) VALUES(?, ?, ?, ?, ?, ?, ?);`,
+		h.RuleID, h.RuleName, h.Kind, h.Severity, h.Value, h.Threshold, h.FiredTS)
+	if err != nil {
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
+// 规则当前未恢复的预警，没有时返回 sql.ErrNoRows
+func (s *Store) FetchOpenAlert(ruleID int64) (AlertHistory, error) {
+	return scanAlertHistory(s.db.QueryRow(`SELECT `+alertHistoryColumns+` FROM alert_history WHERE rule_id=? AND resolved_ts=0 ORDER BY id DESC LIMIT 1;`, ruleID))
+}
+
+func (s *Store) UpdateAlertNotified(id int64, value string, notifyCount, lastNotifyTS int64) error {
+	_, err := s.db.Exec(`UPDATE alert_history SET value=?, notify_count=?, last_notify_ts=? WHERE id=?;`, value, notifyCount, lastNotifyTS, id)
+	return err
+}
+
+func (s *Store) ResolveAlert(id int64, value string, resolvedTS int64) error {
+	_, err := s.db.Exec(`UPDATE alert_history SET value=?, resolved_ts=? WHERE id=?;`, value, resolvedTS, id)
+	return err
+}
+
+// 规则删除后关闭其未恢复的预警
+func (s *Store) ResolveAlertsForRule(ruleID int64, resolvedTS int64) error {
+	_, err := s.db.Exec(`UPDATE alert_history SET resolved_ts=? WHERE rule_id=? AND resolved_ts=0;`, resolvedTS, ruleID)
+	return err
+}
+
+// 确认预警，重复确认保留第一次的确认信息
+func (s *Store) AckAlert(id int64, ackedBy string) (AlertHistory, error) {
+	if _, err := s.db.Exec(`UPDATE alert_history SET acked_ts=?, acked_by=? WHERE id=? AND acked_ts=0;`, time.Now().Unix(), ackedBy, id); err != nil {
+		return AlertHistory{}, err
+	}
+	return scanAlertHistory(s.db.QueryRow(`SELECT `+alertHistoryColumns+` FROM alert_history WHERE id=?;`, id))
+}
+
+func (s *Store) FetchAlertHistory(ruleID int64, activeOnly bool, limit int) ([]AlertHistory, error) {
+	query := `SELECT ` + alertHistoryColumns + ` FROM alert_history WHERE 1=1`
+	var args []any
+	if ruleID > 0 {
+		query += ` AND rule_id=?`
+		args = append(args, ruleID)
+	}
+	if activeOnly {
+		query += ` AND resolved_ts=0`
+	}
+	query += ` ORDER BY fired_ts DESC, id DESC LIMIT ?;`
+	args = append(args, limit)
+
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var history []AlertHistory
+	for rows.Next() {
+		h, err := scanAlertHistory(rows)
+		if err != nil {
+			return nil, err
+		}
+		history = append(history, h)
+	}
+	return history, rows.Err()
+}
+
+func (s *Store) InsertTopup(t Topup) (int64, error) {
+	res, err := s.db.Exec(`INSERT INTO topups(ts, amount, source, note, created_by) VALUES(?, ?, ?, ?, ?);`, t.TS, t.Amount, t.Source, t.Note, t.CreatedBy)
+	if err != nil {
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
+func (s *Store) FetchTopups(limit int) ([]Topup, error) {
+	rows, err := s.db.Query(`SELECT id, ts, amount, source, note, created_by FROM topups ORDER BY ts DESC, id DESC LIMIT ?;`, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var topups []Topup
+	for rows.Next() {
+		var t Topup
+		if err := rows.Scan(&t.ID, &t.TS, &t.Amount, &t.Source, &t.Note, &t.CreatedBy); err != nil {
+			return nil, err
+		}
+		topups = append(topups, t)
+	}
+	return topups, rows.Err()
+}
+
+// 统计某时间之后（含）的充值总量，金额以文本保存以保留精度
+func (s *Store) SumTopupsSince(ts int64) (decimal.Decimal, error) {
+	rows, err := s.db.Query(`SELECT amount FROM topups WHERE ts >= ?;`, ts)
+	if err != nil {
+		return decimal.Zero, err
+	}
+	defer rows.Close()
+
+	total := decimal.Zero
+	for rows.Next() {
+		var raw string
+		if err := rows.Scan(&raw); err != nil {
+			return decimal.Zero, err
+		}
+		if v, err := decimal.NewFromString(raw); err == nil {
+			total = total.Add(v)
+		}
+	}
+	return total, rows.Err()
+}
+
+const notificationColumns = `id, channel, target, kind, message, status, attempts, next_attempt_ts, last_error, created_ts, sent_ts`
+
+func scanNotification(row rowScanner) (Notification, error) {
+	var n Notification
+	err := row.Scan(&n.ID, &n.Channel, &n.Target, &n.Kind, &n.Message, &n.Status, &n.Attempts, &n.NextAttemptTS, &n.LastError, &n.CreatedTS, &n.SentTS)
+	return n, err
+}
+
+func (s *Store) InsertNotification(n Notification) (int64, error) {
+	res, err := s.db.Exec(`INSERT INTO notifications(channel, target, kind, message, status, next_attempt_ts, created_ts) VALUES(?, ?, ?, ?, ?, ?, ?);`,
+		n.Channel, n.Target, n.Kind, n.Message, n.Status, n.NextAttemptTS, n.CreatedTS)
+	if err != nil {
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
+func (s *Store) FetchDueNotifications(now int64, limit int) ([]Notification, error) {
+	return s.queryNotifications(`SELECT `+notificationColumns+` FROM notifications WHERE status=? AND next_attempt_ts<=? ORDER BY next_attempt_ts ASC, id ASC LIMIT ?;`,
+		notificationPending, now, limit)
+}
+
+func (s *Store) FetchNotifications(status string, limit int) ([]Notification, error) {
+	if status != "" {
+		return s.queryNotifications(`SELECT `+notificationColumns+` FROM notifications WHERE status=? ORDER BY id DESC LIMIT ?;`, status, limit)
+	}
+	return s.queryNotifications(`SELECT `+notificationColumns+` FROM notifications ORDER BY id DESC LIMIT ?;`, limit)
+}
+
+func (s *Store) queryNotifications(query string, args ...any) ([]Notification, error) {
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var list []Notification
+	for rows.Next() {
+		n, err := scanNotification(rows)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, n)
+	}
+	return list, rows.Err()
+}
+
+// 通知详情，包含全部投递尝试
+func (s *Store) FetchNotification(id int64) (Notification, error) {
+	n, err := scanNotification(s.db.QueryRow(`SELECT `+notificationColumns+` FROM notifications WHERE id=?;`, id))
+	if err != nil {
+		return n, err
+	}
+	rows, err := s.db.Query(`SELECT id, notification_id, ts, success, error, duration_ms FROM notification_attempts WHERE notification_id=? ORDER BY id ASC;`, id)
+	if err != nil {
+		return n, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var a NotificationAttempt
+		if err := rows.Scan(&a.ID, &a.NotificationID, &a.TS, &a.Success, &a.Error, &a.DurationMS); err != nil {
+			return n, err
+		}
+		n.AttemptLog = append(n.AttemptLog, a)
+	}
+	return n, rows.Err()
+}
+
+// 记录一次投递尝试并更新通知状态
+func (s *Store) RecordNotificationAttempt(n Notification, a NotificationAttempt) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`INSERT INTO notification_attempts(notification_id, ts, success, error, duration_ms) VALUES(?, ?, ?, ?, ?);`,
+		a.NotificationID, a.TS, a.Success, a.Error, a.DurationMS); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if _, err := tx.Exec(`UPDATE notifications SET status=?, attempts=?, next_attempt_ts=?, last_error=?, sent_ts=? WHERE id=?;`,
+		n.Status, n.Attempts, n.NextAttemptTS, n.LastError, n.SentTS, n.ID); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// 失败的通知重新入队，重试次数重新计算
+func (s *Store) RequeueNotification(id int64, now int64) error {
+	res, err := s.db.Exec(`UPDATE notifications SET status=?, attempts=0, next_attempt_ts=? WHERE id=? AND status=?;`, notificationPending, now, id, notificationFailed)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+const userColumns = `id, username, password_hash, role, disabled, created_ts, updated_ts, last_login_ts,
+	COALESCE((SELECT enabled FROM user_mfa WHERE user_mfa.user_id = users.id), 0)`
+
+func scanUser(row rowScanner) (User, error) {
+	var u User
+	err := row.Scan(&u.ID, &u.Username, &u.PasswordHash, &u.Role, &u.Disabled, &u.CreatedTS, &u.UpdatedTS, &u.LastLoginTS, &u.MFAEnabled)
+	return u, err
+}
+
+func (s *Store) InsertUser(u User) (int64, error) {
+	now := time.Now().Unix()
+	res, err := s.db.Exec(`INSERT INTO users(username, password_hash, role, disabled, created_ts, updated_ts) VALUES(?, ?, ?, ?, ?, ?);`,
+		u.Username, u.PasswordHash, u.Role, u.Disabled, now, now)
+	if err != nil {
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
+func (s *Store) UpdateUser(u User) error {
+	res, err := s.db.Exec(`UPDATE users SET username=?, password_hash=?, role=?, disabled=?, updated_ts=? WHERE id=?;`,
+		u.Username, u.PasswordHash, u.Role, u.Disabled, time.Now().Unix(), u.ID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+func (s *Store) DeleteUser(id int64) error {
+	res, err := s.db.Exec(`DELETE FROM users WHERE id=?;`, id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+func (s *Store) TouchUserLogin(id int64) error {
+	_, err := s.db.Exec(`UPDATE users SET last_login_ts=? WHERE id=?;`, time.Now().Unix(), id)
+	return err
+}
+
+func (s *Store) FetchUser(id int64) (User, error) {
+	return scanUser(s.db.QueryRow(`SELECT `+userColumns+` FROM users WHERE id=?;`, id))
+}
+
+func (s *Store) FetchUserByName(username string) (User, error) {
+	return scanUser(s.db.QueryRow(`SELECT `+userColumns+` FROM users WHERE username=?;`, username))
+}
+
+func (s *Store) FetchUsers() ([]User, error) {
+	rows, err := s.db.Query(`SELECT ` + userColumns + ` FROM users ORDER BY id ASC;`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var users []User
+	for rows.Next() {
+		u, err := scanUser(rows)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, u)
+	}
+	return users, rows.Err()
+}
+
+// 启用状态的管理员数量，用于防止删除或降级最后一个管理员
+func (s *Store) CountActiveAdmins() (int, error) {
+	var n int
+	err := s.db.QueryRow(`SELECT COUNT(*) FROM users WHERE role=? AND disabled=0;`, roleAdmin).Scan(&n)
+	return n, err
+}
+
+// 按 (provider, subject) 查询关联的本地用户，未关联时返回 nil
+func (s *Store) FetchExternalLink(provider, subject string) (*ExternalLink, error) {
+	var l ExternalLink
+	err := s.db.QueryRow(`SELECT provider, subject, user_id, created_ts FROM external_identities WHERE provider=? AND subject=?;`, provider, subject).
+		Scan(&l.Provider, &l.Subject, &l.UserID, &l.CreatedTS)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &l, nil
+}
+
+func (s *Store) FetchUserExternalLinks(userID int64) ([]ExternalLink, error) {
+	rows, err := s.db.Query(`SELECT provider, subject, user_id, created_ts FROM external_identities WHERE user_id=? ORDER BY provider, subject;`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	links := []ExternalLink{}
+	for rows.Next() {
+		var l ExternalLink
+		if err := rows.Scan(&l.Provider, &l.Subject, &l.UserID, &l.CreatedTS); err != nil {
+			return nil, err
+		}
+		links = append(links, l)
+	}
+	return links, rows.Err()
+}
+
+// 关联外部身份；同一身份已关联其他用户时返回唯一约束错误
+func (s *Store) InsertExternalLink(l ExternalLink) error {
+	_, err := s.db.Exec(`INSERT INTO external_identities(provider, subject, user_id, created_ts) VALUES(?, ?, ?, ?);`,
+		l.Provider, l.Subject, l.UserID, l.CreatedTS)
+	return err
+}
+
+func (s *Store) DeleteExternalLink(userID int64, provider, subject string) error {
+	res, err := s.db.Exec(`DELETE FROM external_identities WHERE user_id=? AND provider=? AND subject=?;`, userID, provider, subject)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+func (s *Store) DeleteUserExternalLinks(userID int64) error {
+	_, err := s.db.Exec(`DELETE FROM external_identities WHERE user_id=?;`, userID)
+	return err
+}
+
+func (s *Store) InsertReading(rd Reading) (int64, error) {
+	res, err := s.db.Exec(`INSERT INTO readings(ts, meter_m3, system_m3, note, created_by) VALUES(?, ?, ?, ?, ?);`,
+		rd.TS, rd.MeterM3, rd.SystemM3, rd.Note, rd.CreatedBy)
+	if err != nil {
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
+func (s *Store) FetchReadings(limit int) ([]Reading, error) {
+	rows, err := s.db.Query(`SELECT id, ts, meter_m3, system_m3, note, created_by FROM readings ORDER BY ts DESC, id DESC LIMIT ?;`, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var readings []Reading
+	for rows.Next() {
+		var rd Reading
+		if err := rows.Scan(&rd.ID, &rd.TS, &rd.MeterM3, &rd.SystemM3, &rd.Note, &rd.CreatedBy); err != nil {
+			return nil, err
+		}
+		readings = append(readings, rd)
+	}
+	return readings, rows.Err()
+}
+
+// 签名密钥与敏感配置一样，启用加密后以密文保存
+func (s *Store) sealSigningSecret(secret string) (string, error) {
+	if s.secrets == nil {
+		return secret, nil
+	}
+	return s.secrets.seal(secret)
+}
+
+func (s *Store) openSigningKey(k SigningKey) (SigningKey, error) {
+	if !isSealed(k.Secret) {
+		return k, nil
+	}
+	if s.secrets == nil {
+		return k, fmt.Errorf("签名密钥 %s 已加密，但未加载主密钥", k.KID)
+	}
+	plain, err := s.secrets.open(k.Secret)
+	if err != nil {
+		return k, fmt.Errorf("解密签名密钥 %s 失败: %w", k.KID, err)
+	}
+	k.Secret = plain
+	return k, nil
+}
+
+func (s *Store) InsertSigningKey(k SigningKey) error {
+	secret, err := s.sealSigningSecret(k.Secret)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec(`INSERT INTO signing_keys(kid, secret, created_ts, retired_ts) VALUES(?, ?, ?, ?);`,
+		k.KID, secret, k.CreatedTS, k.RetiredTS)
+	return err
+}
+
+// 当前用于签发的密钥，即最新的未退役密钥
+func (s *Store) ActiveSigningKey() (SigningKey, error) {
+	var k SigningKey
+	err := s.db.QueryRow(`SELECT kid, secret, created_ts, retired_ts FROM signing_keys WHERE retired_ts=0 ORDER BY created_ts DESC, rowid DESC LIMIT 1;`).
+		Scan(&k.KID, &k.Secret, &k.CreatedTS, &k.RetiredTS)
+	if err != nil {
+		return k, err
+	}
+	return s.openSigningKey(k)
+}
+
+func (s *Store) FetchSigningKey(kid string) (SigningKey, error) {
+	var k SigningKey
+	err := s.db.QueryRow(`SELECT kid, secret, created_ts, retired_ts FROM signing_keys WHERE kid=?;`, kid).
+		Scan(&k.KID, &k.Secret, &k.CreatedTS, &k.RetiredTS)
+	if err != nil {
+		return k, err
+	}
+	return s.openSigningKey(k)
+}
+
+func (s *Store) FetchSigningKeys() ([]SigningKey, error) {
+	rows, err := s.db.Query(`SELECT kid, secret, created_ts, retired_ts FROM signing_keys ORDER BY created_ts DESC, rowid DESC;`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var keys []SigningKey
+	for rows.Next() {
+		var k SigningKey
+		if err := rows.Scan(&k.KID, &k.Secret, &k.CreatedTS, &k.RetiredTS); err != nil {
+			return nil, err
+		}
+		if k, err = s.openSigningKey(k); err != nil {
+			return nil, err
+		}
+		keys = append(keys, k)
+	}
+	return keys, rows.Err()
+}
+
+// 退役所有在用密钥并写入新密钥，同时删除宽限期已过的旧密钥
+func (s *Store) RotateSigningKey(next SigningKey, pruneBefore int64) error {
+	secret, err := s.sealSigningSecret(next.Secret)
+	if err != nil {
+		return err
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`UPDATE signing_keys SET retired_ts=? WHERE retired_ts=0;`, next.CreatedTS); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM signing_keys WHERE retired_ts>0 AND retired_ts<?;`, pruneBefore); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if _, err := tx.Exec(`INSERT INTO signing_keys(kid, secret, created_ts, retired_ts) VALUES(?, ?, ?, 0);`,
+		next.KID, secret, next.CreatedTS); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+const sessionColumns = `s.id, s.user_id, u.username, u.role, u.disabled, s.created_ts, s.expires_ts, s.revoked_ts, s.ip, s.user_agent`
+
+func scanSession(row rowScanner) (Session, error) {
+	var ss Session
+	err := row.Scan(&ss.ID, &ss.UserID, &ss.Username, &ss.Role, &ss.Disabled, &ss.CreatedTS, &ss.ExpiresTS, &ss.RevokedTS, &ss.IP, &ss.UserAgent)
+	return ss, err
+}
+
+func (s *Store) InsertSession(ss Session) error {
+	_, err := s.db.Exec(`INSERT INTO sessions(id, user_id, created_ts, expires_ts, ip, user_agent) VALUES(?, ?, ?, ?, ?, ?);`,
+		ss.ID, ss.UserID, ss.CreatedTS, ss.ExpiresTS, ss.IP, ss.UserAgent)
+	return err
+}
+
+// 查询会话及其所属用户的当前信息，用户已删除时返回 sql.ErrNoRows
+func (s *Store) FetchSession(id string) (Session, error) {
+	return scanSession(s.db.QueryRow(`SELECT `+sessionColumns+` FROM sessions s JOIN users u ON u.id = s.user_id WHERE s.id=?;`, id))
+}
+
+// 未撤销且未过期的会话
+func (s *Store) FetchActiveSessions(now int64) ([]Session, error) {
+	rows, err := s.db.Query(`SELECT `+sessionColumns+` FROM sessions s JOIN users u ON u.id = s.user_id
+		WHERE s.revoked_ts=0 AND s.expires_ts>? ORDER BY s.created_ts DESC;`, now)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var sessions []Session
+	for rows.Next() {
+		ss, err := scanSession(rows)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, ss)
+	}
+	return sessions, rows.Err()
+}
+
+func (s *Store) RevokeSession(id string, now int64) error {
+	res, err := s.db.Exec(`UPDATE sessions SET revoked_ts=? WHERE id=? AND revoked_ts=0;`, now, id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+func (s *Store) RevokeUserSessions(userID int64, now int64) error {
+	_, err := s.db.Exec(`UPDATE sessions SET revoked_ts=? WHERE user_id=? AND revoked_ts=0;`, now, userID)
+	return err
+}
+
+func (s *Store) RevokeAllSessions(now int64) error {
+	_, err := s.db.Exec(`UPDATE sessions SET revoked_ts=? WHERE revoked_ts=0;`, now)
+	return err
+}
+
+// 删除早已过期的会话记录
+func (s *Store) PruneSessions(before int64) error {
+	_, err := s.db.Exec(`DELETE FROM sessions WHERE expires_ts<?;`, before)
+	return err
+}
+
+const apiTokenColumns = `id, name, prefix, token_hash, scopes, created_by, created_ts, expires_ts, last_used_ts, last_used_ip, revoked_ts`
+
+func scanAPIToken(row rowScanner) (APIToken, error) {
+	var t APIToken
+	var scopes string
+	err := row.Scan(&t.ID, &t.Name, &t.Prefix, &t.TokenHash, &scopes, &t.CreatedBy, &t.CreatedTS, &t.ExpiresTS, &t.LastUsedTS, &t.LastUsedIP, &t.RevokedTS)
+	t.Scopes = splitList(scopes)
+	return t, err
+}
+
+func (s *Store) InsertAPIToken(t APIToken) (int64, error) {
+	res, err := s.db.Exec(`INSERT INTO api_tokens(name, prefix, token_hash, scopes, created_by, created_ts, expires_ts) VALUES(?, ?, ?, ?, ?, ?, ?);`,
+		t.Name, t.Prefix, t.TokenHash, strings.Join(t.Scopes, ","), t.CreatedBy, t.CreatedTS, t.ExpiresTS)
+	if err != nil {
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
+func (s *Store) FetchAPITokenByHash(hash string) (APIToken, error) {
+	return scanAPIToken(s.db.QueryRow(`SELECT `+apiTokenColumns+` FROM api_tokens WHERE token_hash=?;`, hash))
+}
+
+func (s *Store) FetchAPITokens() ([]APIToken, error) {
+	rows, err := s.db.Query(`SELECT ` + apiTokenColumns + ` FROM api_tokens ORDER BY created_ts DESC, id DESC;`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tokens []APIToken
+	for rows.Next() {
+		t, err := scanAPIToken(rows)
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, t)
+	}
+	return tokens, rows.Err()
+}
+
+func (s *Store) RevokeAPIToken(id int64, now int64) error {
+	res, err := s.db.Exec(`UPDATE api_tokens SET revoked_ts=? WHERE id=? AND revoked_ts=0;`, now, id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// 记录最近使用时间，同一分钟内的重复请求不再写库
+func (s *Store) TouchAPIToken(id int64, now int64, ip string) error {
+	_, err := s.db.Exec(`UPDATE api_tokens SET last_used_ts=?, last_used_ip=? WHERE id=? AND last_used_ts<?;`, now, ip, id, now-60)
+	return err
+}
+
+func (s *Store) InsertLoginAttempt(a LoginAttempt) error {
+	_, err := s.db.Exec(`INSERT INTO login_attempts(ts, username, ip, success, reason, user_agent) VALUES(?, ?, ?, ?, ?, ?);`,
+		a.TS, a.Username, a.IP, a.Success, a.Reason, a.UserAgent)
+	return err
+}
+
+// 账号在窗口内、最近一次成功登录之后的失败次数及最后失败时间；被限流拒绝、等待二次验证和单点登录失败的请求不计入
+func (s *Store) CountAccountLoginFailures(username string, since int64) (int, int64, error) {
+	var count int
+	var last int64
+	err := s.db.QueryRow(`SELECT COUNT(*), COALESCE(MAX(ts), 0) FROM login_attempts
+		WHERE username=? AND success=0 AND reason NOT IN (?, ?, ?) AND ts>=?
+		AND id > COALESCE((SELECT MAX(id) FROM login_attempts WHERE username=? AND success=1), 0);`,
+		username, loginReasonThrottled, loginReasonMFAWait, loginReasonSSO, since, username).Scan(&count, &last)
+	return count, last, err
+}
+
+// IP 在窗口内的失败次数及最后失败时间，成功登录不会清零
+func (s *Store) CountIPLoginFailures(ip string, since int64) (int, int64, error) {
+	var count int
+	var last int64
+	err := s.db.QueryRow(`SELECT COUNT(*), COALESCE(MAX(ts), 0) FROM login_attempts
+		WHERE ip=? AND success=0 AND reason NOT IN (?, ?, ?) AND ts>=?;`,
+		ip, loginReasonThrottled, loginReasonMFAWait, loginReasonSSO, since).Scan(&count, &last)
+	return count, last, err
+}
+
+func (s *Store) FetchLoginAttempts(limit int) ([]LoginAttempt, error) {
+	rows, err := s.db.Query(`SELECT id, ts, username, ip, success, reason, user_agent FROM login_attempts ORDER BY id DESC LIMIT ?;`, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var attempts []LoginAttempt
+	for rows.Next() {
+		var a LoginAttempt
+		if err := rows.Scan(&a.ID, &a.TS, &a.Username, &a.IP, &a.Success, &a.Reason, &a.UserAgent); err != nil {
+			return nil, err
+		}
+		attempts = append(attempts, a)
+	}
+	return attempts, rows.Err()
+}
+
+func (s *Store) PruneLoginAttempts(before int64) error {
+	_, err := s.db.Exec(`DELETE FROM login_attempts WHERE ts<?;`, before)
+	return err
+}
+
+// 用户未配置 TOTP 时返回零值
+func (s *Store) FetchUserMFA(userID int64) (UserMFA, error) {
+	m := UserMFA{UserID: userID}
+	err := s.db.QueryRow(`SELECT secret, enabled, last_step, created_ts FROM user_mfa WHERE user_id=?;`, userID).
+		Scan(&m.Secret, &m.Enabled, &m.LastStep, &m.CreatedTS)
+	if errors.Is(err, sql.ErrNoRows) {
+		return m, nil
+	}
+	return m, err
+}
+
+// 保存待确认的 TOTP 密钥，已启用时不允许覆盖
+func (s *Store) SavePendingMFA(userID int64, secret string) error {
+	res, err := s.db.Exec(`INSERT INTO user_mfa(user_id, secret, enabled, last_step, created_ts) VALUES(?, ?, 0, 0, ?)
+		ON CONFLICT(user_id) DO UPDATE SET secret=excluded.secret, last_step=0, created_ts=excluded.created_ts WHERE user_mfa.enabled=0;`,
+		userID, secret, time.Now().Unix())
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errors.New("已启用两步验证，请先停用")
+	}
+	return nil
+}
+
+func (s *Store) EnableMFA(userID int64, lastStep int64) error {
+	_, err := s.db.Exec(`UPDATE user_mfa SET enabled=1, last_step=? WHERE user_id=?;`, lastStep, userID)
+	return err
+}
+
+func (s *Store) UpdateMFALastStep(userID int64, step int64) error {
+	_, err := s.db.Exec(`UPDATE user_mfa SET last_step=? WHERE user_id=? AND last_step<?;`, step, userID, step)
+	return err
+}
+
+// 停用两步验证并删除恢复码
+func (s *Store) DeleteUserMFA(userID int64) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM user_mfa WHERE user_id=?;`, userID); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM mfa_recovery_codes WHERE user_id=?;`, userID); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *Store) ReplaceRecoveryCodes(userID int64, hashes []string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM mfa_recovery_codes WHERE user_id=?;`, userID); err != nil {
+		tx.Rollback()
+		return err
+	}
+	for _, h := range hashes {
+		if _, err := tx.Exec(`INSERT INTO mfa_recovery_codes(user_id, code_hash) VALUES(?, ?);`, userID, h); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// 使用一个恢复码，成功时标记为已使用
+func (s *Store) UseRecoveryCode(userID int64, hash string, now int64) (bool, error) {
+	res, err := s.db.Exec(`UPDATE mfa_recovery_codes SET used_ts=? WHERE id=(
+		SELECT id FROM mfa_recovery_codes WHERE user_id=? AND code_hash=? AND used_ts=0 LIMIT 1);`, now, userID, hash)
+	if err != nil {
+		return false, err
+	}
+	n, _ := res.RowsAffected()
+	return n > 0, nil
+}
+
+func (s *Store) CountRecoveryCodes(userID int64) (int, error) {
+	var n int
+	err := s.db.QueryRow(`SELECT COUNT(*) FROM mfa_recovery_codes WHERE user_id=? AND used_ts=0;`, userID).Scan(&n)
+	return n, err
+}
+
+func (s *Store) InsertAuditEntry(e AuditEntry) error {
+	_, err := s.db.Exec(`INSERT INTO audit_log(ts, actor, ip, request_id, action, target, before_json, after_json) VALUES(?, ?, ?, ?, ?, ?, ?, ?);`,
+		e.TS, e.Actor, e.IP, e.RequestID, e.Action, e.Target, string(e.Before), string(e.After))
+	return err
+}
+
+// 按条件查询审计日志，按时间倒序；action 以 . 结尾时按前缀匹配
+func (s *Store) FetchAuditLog(f AuditFilter) ([]AuditEntry, error) {
+	var where []string
+	var args []any
+	if f.Actor != "" {
+		where = append(where, "actor=?")
+		args = append(args, f.Actor)
+	}
+	if f.Action != "" {
+		if strings.HasSuffix(f.Action, ".") {
+			where = append(where, "substr(action, 1, ?)=?")
+			args = append(args, len(f.Action), f.Action)
+		} else {
+			where = append(where, "action=?")
+			args = append(args, f.Action)
+		}
+	}
+	if f.Target != "" {
+		where = append(where, "target=?")
+		args = append(args, f.Target)
+	}
+	if f.From > 0 {
+		where = append(where, "ts>=?")
+		args = append(args, f.From)
+	}
+	if f.To > 0 {
+		where = append(where, "ts<?")
+		args = append(args, f.To)
+	}
+	query := `SELECT id, ts, actor, ip, request_id, action, target, before_json, after_json FROM audit_log`
+	if len(where) > 0 {
+		query += ` WHERE ` + strings.Join(where, " AND ")
+	}
+	query += ` ORDER BY id DESC LIMIT ? OFFSET ?;`
+	args = append(args, f.Limit, f.Offset)
+
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []AuditEntry
+	for rows.Next() {
+		var e AuditEntry
+		var before, after string
+		if err := rows.Scan(&e.ID, &e.TS, &e.Actor, &e.IP, &e.RequestID, &e.Action, &e.Target, &before, &after); err != nil {
+			return nil, err
+		}
+		if before != "" {
+			e.Before = json.RawMessage(before)
+		}
+		if after != "" {
+			e.After = json.RawMessage(after)
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+func (s *Store) PruneAuditLog(before int64) error {
+	_, err := s.db.Exec(`DELETE FROM audit_log WHERE ts<?;`, before)
+	return err
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// 调试接口，仅在 GAS_DEBUG 开启时挂载到 /api/debug；
+// 日常的事件查询与更正使用 /api/events
+func debugRoutes(store *Store, hub *Hub, alerts *AlertEvaluator, gaps *GapDetector) func(chi.Router) {
+	return func(r chi.Router) {
+		r.Get("/events", func(w http.ResponseWriter, r *http.Request) {
+			events, err := store.FetchAllEvents()
+			if err != nil {
+				respondError(w, http.StatusInternalServerError, err)
+				return
+			}
+			respondJSON(w, map[string]interface{}{
+				"total_events": len(events),
+				"latest_event": func() interface{} {
+					if len(events) > 0 {
+						return events[len(events)-1]
+					}
+					return nil
+				}(),
+				"recent_events": func() []Event {
+					if len(events) > 10 {
+						return events[len(events)-10:]
+					}
+					return events
+				}(),
+			})
+		})
+
+		r.Get("/metrics", func(w http.ResponseWriter, r *http.Request) {
+			settings, err := loadSettings(store)
+			if err != nil {
+				respondError(w, http.StatusInternalServerError, err)
+				return
+			}
+			maskSecretSettings(&settings)
+
+			now := time.Now().In(loadLocation(settings.Timezone))
+			todayStart := startOfDay(now)
+
+			todayPulses, _ := calcUsagePulsesByDelta(store, todayStart, now)
+			totalPulses, _ := calcTotalPulsesByDelta(store)
+			hourly, _ := calcHourlyPulsesToday(store, now, gapModeNone)
+
+			respondJSON(w, map[string]interface{}{
+				"settings":     settings,
+				"now":          now.Format("2006-01-02 15:04:05"),
+				"today_start":  todayStart.Format("2006-01-02 15:04:05"),
+				"today_pulses": todayPulses,
+				"total_pulses": totalPulses,
+				"hourly_data":  hourly,
+			})
+		})
+
+		r.Post("/insert-event", func(w http.ResponseWriter, r *http.Request) {
+			var payload struct {
+				Timestamp int64 `json:"timestamp"`
+				Count     int64 `json:"count"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+				respondError(w, http.StatusBadRequest, err)
+				return
+			}
+			if err := validateEvent(Event{Timestamp: payload.Timestamp, Count: payload.Count}); err != nil {
+				respondError(w, http.StatusBadRequest, err)
+				return
+			}
+			if err := store.InsertEvent(payload.Timestamp, payload.Count); err != nil {
+				respondError(w, http.StatusInternalServerError, err)
+				return
+			}
+			hub.PublishEvent(store, Event{Timestamp: payload.Timestamp, Count: payload.Count})
+			recordAudit(store, r, "event.insert", "events", nil, payload)
+			alerts.Trigger()
+			gaps.Trigger()
+			respondJSON(w, map[string]string{"status": "success", "message": "数据插入成功"})
+		})
+
+		// 按时间戳和脉冲数删除，可能一次删除多条，需要二次确认并先创建快照
+		r.Post("/delete-event", func(w http.ResponseWriter, r *http.Request) {
+			var payload struct {
+				Timestamp int64 `json:"timestamp"`
+				Count     int64 `json:"count"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+				respondError(w, http.StatusBadRequest, err)
+				return
+			}
+			if payload.Timestamp == 0 {
+				respondError(w, http.StatusBadRequest, fmt.Errorf("缺少 timestamp"))
+				return
+			}
+			matched, err := store.CountEvents(payload.Timestamp, payload.Count)
+			if err != nil {
+				respondError(w, http.StatusInternalServerError, err)
+				return
+			}
+			if matched == 0 {
+				respondError(w, http.StatusNotFound, fmt.Errorf("没有匹配的事件"))
+				return
+			}
+			action := fmt.Sprintf("event.delete:%d:%d", payload.Timestamp, payload.Count)
+			if !requireConfirmation(w, r, action, matched) {
+				return
+			}
+			snapshot, err := snapshotDatabase(store, "delete-event")
+			if err != nil {
+				respondError(w, http.StatusInternalServerError, err)
+				return
+			}
+			deleted, err := store.DeleteEvents(payload.Timestamp, payload.Count)
+			if err != nil {
+				respondError(w, http.StatusInternalServerError, err)
+				return
+			}
+			recordAudit(store, r, "event.delete", "events", payload, map[string]interface{}{"deleted": deleted, "snapshot": snapshot})
+			alerts.Trigger()
+			hub.PublishMetrics(store)
+			gaps.Trigger()
+			respondJSON(w, map[string]interface{}{"status": "success", "message": "数据删除成功", "deleted": deleted, "snapshot": snapshot})
+		})
+
+		r.Post("/batch-insert-events", func(w http.ResponseWriter, r *http.Request) {
+			var payload struct {
+				Events []Event `json:"events"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+				respondError(w, http.StatusBadRequest, err)
+				return
+			}
+			if err := validateEventBatch(payload.Events); err != nil {
+				respondError(w, http.StatusBadRequest, err)
+				return
+			}
+			if err := store.InsertEvents(payload.Events); err != nil {
+				respondError(w, http.StatusInternalServerError, err)
+				return
+			}
+			n := len(payload.Events)
+			recordAudit(store, r, "event.batch_insert", "events", nil, map[string]int64{
+				"count": int64(n), "first_ts": payload.Events[0].Timestamp, "last_ts": payload.Events[n-1].Timestamp,
+			})
+			alerts.Trigger()
+			hub.PublishMetrics(store)
+			gaps.Trigger()
+
+			respondJSON(w, map[string]interface{}{
+				"status":  "success",
+				"message": "批量插入成功",
+				"count":   len(payload.Events),
+			})
+		})
+
+		r.Post("/clear-events", func(w http.ResponseWriter, r *http.Request) {
+			total, err := store.CountEvents(0, 0)
+			if err != nil {
+				respondError(w, http.StatusInternalServerError, err)
+				return
+			}
+			if !requireConfirmation(w, r, "event.clear", total) {
+				return
+			}
+			snapshot, err := snapshotDatabase(store, "clear-events")
+			if err != nil {
+				respondError(w, http.StatusInternalServerError, err)
+				return
+			}
+			deleted, err := store.DeleteEvents(0, 0)
+			if err != nil {
+				respondError(w, http.StatusInternalServerError, err)
+				return
+			}
+			recordAudit(store, r, "event.clear", "events", map[string]int64{"count": deleted}, map[string]string{"snapshot": snapshot})
+			alerts.Trigger()
+			hub.PublishMetrics(store)
+			gaps.Trigger()
+			respondJSON(w, map[string]interface{}{"status": "success", "message": "所有数据已清空", "deleted": deleted, "snapshot": snapshot})
+		})
+	}
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+const (
+	defaultDeviceCommandTimeout = 10 * time.Second
+	maxDeviceCommandTimeout     = 60 * time.Second
+)
+
+// 设备端支持的命令
+var deviceCommands = map[string]struct{}{
+	"reboot":       {},
+	"set_count":    {},
+	"set_debounce": {},
+	"status":       {},
+}
+
+type deviceCommandPayload struct {
+	ID      string                 `json:"id"`
+	Command string                 `json:"cmd"`
+	Params  map[string]interface{} `json:"params,omitempty"`
+}
+
+type deviceResponsePayload struct {
+	ID string `json:"id"`
+	// 回执主题模板不含 {device} 时，由设备在回执中带上自己的 ID
+	Device string          `json:"device"`
+	OK     bool            `json:"ok"`
+	Error  string          `json:"error"`
+	Data   json.RawMessage `json:"data"`
+}
+
+// 设备 ID 会拼进 MQTT 主题，不能包含通配符 + # 或层级分隔符 /
+var deviceIDPattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+func validateDeviceID(device string) error {
+	if !deviceIDPattern.MatchString(device) {
+		return errors.New("设备 ID 只能包含字母、数字、下划线和连字符")
+	}
+	return nil
+}
+
+// 将主题模板中的 {device} 替换为设备 ID
+func deviceTopic(template, device string) string {
+	return strings.ReplaceAll(template, "{device}", device)
+}
+
+// 从回执主题中取出设备 ID；模板不含 {device} 时返回 false
+func deviceFromTopic(template, topic string) (string, bool) {
+	prefix, suffix, ok := strings.Cut(template, "{device}")
+	if !ok || !strings.HasPrefix(topic, prefix) || !strings.HasSuffix(topic, suffix) || len(topic) < len(prefix)+len(suffix) {
+		return "", false
+	}
+	device := topic[len(prefix) : len(topic)-len(suffix)]
+	return device, validateDeviceID(device) == nil
+}
+
+// 回执所属的设备：优先按主题判断，主题模板不含 {device} 时使用回执中的 device 字段
+func (w *MQTTWorker) responseDevice(topic string, resp deviceResponsePayload) (string, bool) {
+	settings, err := w.config()
+	if err != nil {
+		return "", false
+	}
+	if strings.Contains(settings.MQTTRespTopic, "{device}") {
+		return deviceFromTopic(settings.MQTTRespTopic, topic)
+	}
+	return resp.Device, validateDeviceID(resp.Device) == nil
+}
+
+func validateDeviceCommand(command string, params map[string]interface{}) error {
+	if _, ok := deviceCommands[command]; !ok {
+		return fmt.Errorf("不支持的命令: %s", command)
+	}
+	switch command {
+	case "set_count":
+		value, ok := params["value"].(float64)
+		if !ok || value < 0 || value != float64(int64(value)) {
+			return errors.New("set_count 需要非负整数参数 value")
+		}
+	case "set_debounce":
+		debounce, ok := params["debounce_ms"].(float64)
+		if !ok || debounce < 1 || debounce > 5000 {
+			return errors.New("set_debounce 需要参数 debounce_ms (1-5000)")
+		}
+		if raw, exists := params["lockout_ms"]; exists {
+			lockout, ok := raw.(float64)
+			if !ok || lockout < 0 || lockout > 600000 {
+				return errors.New("lockout_ms 取值范围为 0-600000")
+			}
+		}
+	}
+	return nil
+}
+
+// 向设备下发命令，并在超时时间内等待设备回执
+func (w *MQTTWorker) SendDeviceCommand(device, command string, params map[string]interface{}, issuedBy, sourceIP string, timeout time.Duration) (DeviceCommand, error) {
+	if err := validateDeviceID(device); err != nil {
+		return DeviceCommand{}, err
+	}
+	if err := validateDeviceCommand(command, params); err != nil {
+		return DeviceCommand{}, err
+	}
+	if timeout <= 0 {
+		timeout = defaultDeviceCommandTimeout
+	}
+	if timeout > maxDeviceCommandTimeout {
+		timeout = maxDeviceCommandTimeout
+	}
+
+	settings, err := w.config()
+	if err != nil {
+		return DeviceCommand{}, err
+	}
+	client := w.client
+	if client == nil || !client.IsConnected() {
+		return DeviceCommand{}, errors.New("MQTT 未连接")
+	}
+
+	id, err := generateSecureKey(8)
+	if err != nil {
+		return DeviceCommand{}, err
+	}
+	paramsJSON := ""
+	if len(params) > 0 {
+		raw, err := json.Marshal(params)
+		if err != nil {
+			return DeviceCommand{}, err
+		}
+		paramsJSON = string(raw)
+	}
+
+	cmd := DeviceCommand{
+		ID:        id,
+		Device:    device,
+		Command:   command,
+		Params:    paramsJSON,
+		Status:    "pending",
+		IssuedBy:  issuedBy,
+		SourceIP:  sourceIP,
+		CreatedTS: time.Now().Unix(),
+	}
+	if err := w.store.InsertDeviceCommand(cmd); err != nil {
+		return DeviceCommand{}, err
+	}
+
+	body, err := json.Marshal(deviceCommandPayload{ID: id, Command: command, Params: params})
+	if err != nil {
+		return DeviceCommand{}, err
+	}
+
+	respCh := make(chan deviceResponsePayload, 1)
+	w.mu.Lock()
+	w.pending[id] = pendingCommand{device: device, ch: respCh}
+	w.mu.Unlock()
+	defer func() {
+		w.mu.Lock()
+		delete(w.pending, id)
+		w.mu.Unlock()
+	}()
+
+	topic := deviceTopic(settings.MQTTCmdTopic, device)
+	if token := client.Publish(topic, 1, false, body); !token.WaitTimeout(timeout) || token.Error() != nil {
+		errMsg := "发布命令超时"
+		if token.Error() != nil {
+			errMsg = token.Error().Error()
+		}
+		_ = w.store.UpdateDeviceCommandStatus(id, "failed", "", errMsg, 0)
+		return w.store.FetchDeviceCommand(id)
+	}
+	log.Printf("device command sent: id=%s device=%s cmd=%s by=%s", id, device, command, issuedBy)
+
+	select {
+	case resp := <-respCh:
+		status := "acked"
+		if !resp.OK {
+			status = "failed"
+		}
+		if err := w.store.UpdateDeviceCommandStatus(id, status, string(resp.Data), resp.Error, time.Now().Unix()); err != nil {
+			return DeviceCommand{}, err
+		}
+	case <-time.After(timeout):
+		if err := w.store.UpdateDeviceCommandStatus(id, "timeout", "", "等待设备回执超时", 0); err != nil {
+			return DeviceCommand{}, err
+		}
+	}
+	return w.store.FetchDeviceCommand(id)
+}
+
+// 处理设备回执消息
+func (w *MQTTWorker) handleDeviceResponse(_ mqtt.Client, msg mqtt.Message) {
+	var resp deviceResponsePayload
+	if err := json.Unmarshal(msg.Payload(), &resp); err != nil || resp.ID == "" {
+		log.Printf("device response parse error: %v, payload: %s", err, string(msg.Payload()))
+		return
+	}
+
+	// 回执必须来自命令的目标设备，避免其他设备伪造回执
+	device, ok := w.responseDevice(msg.Topic(), resp)
+	if !ok {
+		log.Printf("device response ignored: cannot determine device, topic: %s", msg.Topic())
+		return
+	}
+
+	w.mu.Lock()
+	pending, ok := w.pending[resp.ID]
+	w.mu.Unlock()
+	if ok {
+		if pending.device != device {
+			log.Printf("device response ignored: id=%s expected device %s, got %s", resp.ID, pending.device, device)
+			return
+		}
+		select {
+		case pending.ch <- resp:
+		default:
+		}
+		return
+	}
+
+	// 超时后才到达的回执，仍然记录下来
+	cmd, err := w.store.FetchDeviceCommand(resp.ID)
+	if err != nil {
+		return
+	}
+	if cmd.Device != device {
+		log.Printf("device response ignored: id=%s expected device %s, got %s", resp.ID, cmd.Device, device)
+		return
+	}
+	status := "acked"
+	if !resp.OK {
+		status = "failed"
+	}
+	_ = w.store.UpdateDeviceCommandStatus(cmd.ID, status, string(resp.Data), resp.Error, time.Now().Unix())
+}
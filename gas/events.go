@@ -0,0 +1,95 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+var errEventDeleted = errors.New("事件已删除，请先恢复")
+
+const (
+	// 单次批量写入的事件上限
+	maxBatchEvents = 10000
+	maxEventNote   = 500
+)
+
+// 手工写入的事件不能早于 2000 年或晚于当前时间太多，避免误填毫秒时间戳等错误
+func validateEvent(ev Event) error {
+	if ev.Timestamp < 946684800 || ev.Timestamp > time.Now().Add(24*time.Hour).Unix() {
+		return errors.New("时间戳无效（应为秒级 Unix 时间，且不晚于当前时间）")
+	}
+	if ev.Count < 0 {
+		return errors.New("累计脉冲数不能为负数")
+	}
+	return nil
+}
+
+// 批量写入：条数在 1 到 maxBatchEvents 之间，且每条事件都有效
+func validateEventBatch(events []Event) error {
+	if len(events) == 0 || len(events) > maxBatchEvents {
+		return fmt.Errorf("每次可写入 1-%d 条事件", maxBatchEvents)
+	}
+	for i, ev := range events {
+		if err := validateEvent(ev); err != nil {
+			return fmt.Errorf("第 %d 条: %v", i+1, err)
+		}
+	}
+	return nil
+}
+
+// 补录的漏计脉冲：区间必须有效且不晚于当前时间
+func validateMissingPulses(a EventAdjustment) error {
+	if err := validateEvent(Event{Timestamp: a.StartTS}); err != nil {
+		return fmt.Errorf("开始时间: %v", err)
+	}
+	if a.EndTS <= a.StartTS {
+		return errors.New("结束时间必须晚于开始时间")
+	}
+	if a.EndTS > time.Now().Unix() {
+		return errors.New("结束时间不能晚于当前时间")
+	}
+	if a.Pulses <= 0 {
+		return errors.New("补录的脉冲数必须大于 0")
+	}
+	if len([]rune(a.Note)) > maxEventNote {
+		return fmt.Errorf("备注不能超过 %d 个字符", maxEventNote)
+	}
+	return nil
+}
+
+// 解析路径中的事件 ID 并查询事件（含已删除的事件），失败时已写入错误响应
+func eventFromPath(w http.ResponseWriter, r *http.Request, store *Store) (*Event, bool) {
+	id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, fmt.Errorf("无效的事件 ID"))
+		return nil, false
+	}
+	ev, err := store.FetchEvent(id)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, err)
+		return nil, false
+	}
+	if ev == nil {
+		respondError(w, http.StatusNotFound, fmt.Errorf("事件不存在"))
+		return nil, false
+	}
+	return ev, true
+}
+
+// 查询未删除的事件：已删除的事件只能恢复，修改备注或读数时返回 409，失败时已写入错误响应
+func activeEventFromPath(w http.ResponseWriter, r *http.Request, store *Store) (*Event, bool) {
+	ev, ok := eventFromPath(w, r, store)
+	if !ok {
+		return nil, false
+	}
+	if ev.DeletedTS > 0 {
+		respondError(w, http.StatusConflict, errEventDeleted)
+		return nil, false
+	}
+	return ev, true
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+func TestDeletedEventMutations(t *testing.T) {
+	store, err := NewStore(filepath.Join(t.TempDir(), "gas.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	now := time.Now().Unix()
+	if err := store.InsertEvent(now-60, 10); err != nil {
+		t.Fatal(err)
+	}
+	var id int64
+	if err := store.db.QueryRow(`SELECT id FROM events;`).Scan(&id); err != nil {
+		t.Fatal(err)
+	}
+	request := func() *http.Request {
+		rctx := chi.NewRouteContext()
+		rctx.URLParams.Add("id", strconv.FormatInt(id, 10))
+		r := httptest.NewRequest("PUT", "/api/events/"+strconv.FormatInt(id, 10)+"/correction", nil)
+		return r.WithContext(context.WithValue(r.Context(), chi.RouteCtxKey, rctx))
+	}
+
+	if _, ok := activeEventFromPath(httptest.NewRecorder(), request(), store); !ok {
+		t.Fatal("active event rejected")
+	}
+	if err := store.SoftDeleteEvent(id, "admin", now); err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	if _, ok := activeEventFromPath(w, request(), store); ok || w.Code != http.StatusConflict {
+		t.Fatalf("deleted event: ok %v, status %d; want 409", ok, w.Code)
+	}
+
+	// 即使绕过接口层的检查，存储层也拒绝更正已删除的事件
+	if _, err := store.CorrectEvent(EventAdjustment{Kind: adjustmentCorrect, EventID: id, Count: 12, CreatedTS: now}); !errors.Is(err, errEventDeleted) {
+		t.Fatalf("CorrectEvent on deleted event: %v, want errEventDeleted", err)
+	}
+	if err := store.RestoreEvent(id); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.CorrectEvent(EventAdjustment{Kind: adjustmentCorrect, EventID: id, Count: 12, CreatedTS: now}); err != nil {
+		t.Fatalf("CorrectEvent after restore: %v", err)
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+const (
+	forecastHistoryDays = 365
+	forecastRecentDays  = 28
+	forecastMinDays     = 3
+	forecastMaxDays     = 3650
+	// 某月至少有这么多天数据才计算季节系数
+	forecastSeasonMinDays = 7
+)
+
+// 剩余燃气耗尽预测
+type Forecast struct {
+	Available      bool
+	DailyAvgGas    decimal.Decimal
+	DaysUntilEmpty float64
+	EmptyDate      time.Time
+}
+
+type dailyUsage struct {
+	day    time.Time
+	pulses int64
+}
+
+// 过去一年的逐日用量只包含已结束的日期，日期变化或事件写入后才重新计算
+var forecastCache = struct {
+	sync.Mutex
+	store   *Store
+	today   int64
+	version int64
+	edges   []time.Time
+	pulses  []int64
+}{}
+
+func forecastDailyPulses(store *Store, today time.Time) ([]time.Time, []int64, error) {
+	version := store.EventsVersion()
+	forecastCache.Lock()
+	defer forecastCache.Unlock()
+	if forecastCache.store == store && forecastCache.today == today.Unix() && forecastCache.version == version && forecastCache.pulses != nil {
+		return forecastCache.edges, forecastCache.pulses, nil
+	}
+
+	edges := make([]time.Time, 0, forecastHistoryDays+1)
+	for i := forecastHistoryDays; i >= 0; i-- {
+		edges = append(edges, today.AddDate(0, 0, -i))
+	}
+	pulses, err := calcBucketedPulses(store, edges, gapModeNone)
+	if err != nil {
+		return nil, nil, err
+	}
+	forecastCache.store = store
+	forecastCache.today = today.Unix()
+	forecastCache.version = version
+	forecastCache.edges = edges
+	forecastCache.pulses = pulses
+	return edges, pulses, nil
+}
+
+// 根据近期日均用量估算剩余燃气可用天数，
+// 并按工作日/周末比例及历史各月的季节系数加权
+func forecastDepletion(store *Store, settings Settings, remain decimal.Decimal, now time.Time) (Forecast, error) {
+	gasPerPulse := parseDecimal(settings.GasPerPulse, defaultGasPerPulse)
+	today := startOfDay(now)
+
+	edges, pulses, err := forecastDailyPulses(store, today)
+	if err != nil {
+		return Forecast{}, err
+	}
+
+	// 跳过首次有用量之前的日期，避免把未接入传感器的日子算作零用量
+	var history []dailyUsage
+	for i, p := range pulses {
+		if len(history) == 0 && p == 0 {
+			continue
+		}
+		history = append(history, dailyUsage{day: edges[i], pulses: p})
+	}
+	if len(history) < forecastMinDays {
+		return Forecast{}, nil
+	}
+
+	gasOf := func(p int64) float64 {
+		f, _ := pulsesToGas(p, gasPerPulse).Float64()
+		return f
+	}
+
+	var total float64
+	monthSum := map[time.Month]float64{}
+	monthDays := map[time.Month]int{}
+	var weekdaySum, weekendSum float64
+	var weekdays, weekends int
+	for _, d := range history {
+		g := gasOf(d.pulses)
+		total += g
+		monthSum[d.day.Month()] += g
+		monthDays[d.day.Month()]++
+		if isWeekend(d.day) {
+			weekendSum += g
+			weekends++
+		} else {
+			weekdaySum += g
+			weekdays++
+		}
+	}
+	overallAvg := total / float64(len(history))
+	if overallAvg <= 0 {
+		return Forecast{}, nil
+	}
+
+	season := func(m time.Month) float64 {
+		if monthDays[m] < forecastSeasonMinDays {
+			return 1
+		}
+		f := monthSum[m] / float64(monthDays[m]) / overallAvg
+		if f <= 0 {
+			return 1
+		}
+		return f
+	}
+	weekdayFactor, weekendFactor := 1.0, 1.0
+	if weekdays > 0 && weekends > 0 {
+		weekdayFactor = weekdaySum / float64(weekdays) / overallAvg
+		weekendFactor = weekendSum / float64(weekends) / overallAvg
+	}
+
+	recent := history
+	if len(recent) > forecastRecentDays {
+		recent = recent[len(recent)-forecastRecentDays:]
+	}
+	var recentSum float64
+	for _, d := range recent {
+		recentSum += gasOf(d.pulses)
+	}
+	recentAvg := recentSum / float64(len(recent))
+	if recentAvg <= 0 {
+		return Forecast{Available: true, DailyAvgGas: decimal.Zero, DaysUntilEmpty: -1}, nil
+	}
+	// 去季节化后的基准日用量
+	base := recentAvg / season(now.Month())
+
+	forecast := Forecast{
+		Available:   true,
+		DailyAvgGas: decimal.NewFromFloat(recentAvg),
+	}
+	left, _ := remain.Float64()
+	if left <= 0 {
+		forecast.EmptyDate = today
+		return forecast, nil
+	}
+	for i := 1; i <= forecastMaxDays; i++ {
+		day := today.AddDate(0, 0, i)
+		factor := weekdayFactor
+		if isWeekend(day) {
+			factor = weekendFactor
+		}
+		expected := base * season(day.Month()) * factor
+		if expected >= left {
+			forecast.DaysUntilEmpty = float64(i-1) + left/expected
+			forecast.EmptyDate = day
+			return forecast, nil
+		}
+		left -= expected
+	}
+	// 超出预测上限视为无法估算耗尽日期
+	forecast.DaysUntilEmpty = -1
+	return forecast, nil
+}
+
+func isWeekend(t time.Time) bool {
+	return t.Weekday() == time.Saturday || t.Weekday() == time.Sunday
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"strconv"
+	"time"
+)
+
+const (
+	defaultGapThresholdMinutes = 60
+	gapScanInterval            = time.Minute
+
+	// 断档增量的分配方式：none 计入重连时刻（原始行为），proportional 按时长均匀分布，
+	// profile 按近期“星期几 × 小时”的用气规律分布
+	gapModeNone         = "none"
+	gapModeProportional = "proportional"
+	gapModeProfile      = "profile"
+
+	// 用气规律取分布区间结束前的天数
+	gapProfileDays = 28
+)
+
+// 与上一条事件的间隔超过阈值且增量大于 1，视为传感器离线后重连时一次性上报的断档
+func isGap(prevTS, ts, delta, threshold int64) bool {
+	return threshold > 0 && ts-prevTS > threshold && delta > 1
+}
+
+// 断档判定阈值（秒），0 表示不检测
+func gapThreshold(store *Store) int64 {
+	minutes := int64(defaultGapThresholdMinutes)
+	if raw, err := store.GetSetting("gap_threshold_minutes", strconv.Itoa(defaultGapThresholdMinutes)); err == nil {
+		if v, err := strconv.ParseInt(raw, 10, 64); err == nil && v >= 0 {
+			minutes = v
+		}
+	}
+	return minutes * 60
+}
+
+func parseGapMode(raw string) (string, error) {
+	switch raw {
+	case "", gapModeNone:
+		return gapModeNone, nil
+	case gapModeProportional, gapModeProfile:
+		return raw, nil
+	}
+	return "", fmt.Errorf("gap_mode 仅支持 none|proportional|profile")
+}
+
+// 扫描 fromTS 及之后参与统计的事件找出断档，从 fromTS 之前的最后一个事件开始比较。
+// 返回的 start 为扫描起点，开始时间不早于 start 的断档都已重新检测
+func detectGaps(store *Store, threshold, fromTS int64) (gaps []EventGap, start int64, err error) {
+	start = math.MinInt64
+	prev, err := store.FetchPrevEventBefore(fromTS)
+	if err != nil {
+		return nil, 0, err
+	}
+	if prev != nil {
+		start = prev.Timestamp
+	}
+	rows, err := store.FetchEventsInRange(fromTS, math.MaxInt64)
+	if err != nil {
+		return nil, 0, err
+	}
+	for _, row := range rows {
+		if prev != nil {
+			delta := normalizeDelta(&prev.Count, row.Count)
+			if isGap(prev.Timestamp, row.Timestamp, delta, threshold) {
+				gaps = append(gaps, EventGap{StartTS: prev.Timestamp, EndTS: row.Timestamp, Pulses: delta})
+			}
+		}
+		row := row
+		prev = &row
+	}
+	return gaps, start, nil
+}
+
+// GapDetector 在后台检测断档并记录到 event_gaps：数据变化时触发，并由定时器兜底。
+// 启动和阈值变化时全量扫描，之后只扫描上次检测以来被修改的最早事件之后的部分。
+// 统计时的插值直接按事件计算，不依赖这里的记录
+type GapDetector struct {
+	store   *Store
+	trigger chan struct{}
+	stopCh  chan struct{}
+
+	// 只在检测协程中访问
+	scanned   bool
+	threshold int64
+}
+
+func NewGapDetector(store *Store) *GapDetector {
+	return &GapDetector{
+		store:   store,
+		trigger: make(chan struct{}, 1),
+		stopCh:  make(chan struct{}),
+	}
+}
+
+func (d *GapDetector) Start() {
+	go func() {
+		ticker := time.NewTicker(gapScanInterval)
+		defer ticker.Stop()
+		d.scan()
+		for {
+			select {
+			case <-d.stopCh:
+				return
+			case <-d.trigger:
+				d.scan()
+			case <-ticker.C:
+				d.scan()
+			}
+		}
+	}()
+}
+
+func (d *GapDetector) Stop() {
+	close(d.stopCh)
+}
+
+// 请求一次检测；已有待处理的请求时合并，不阻塞调用方
+func (d *GapDetector) Trigger() {
+	select {
+	case d.trigger <- struct{}{}:
+	default:
+	}
+}
+
+func (d *GapDetector) scan() {
+	threshold := gapThreshold(d.store)
+	from := d.store.TakeEventsDirtyFrom()
+	if !d.scanned || threshold != d.threshold {
+		from = math.MinInt64
+	}
+	if from == math.MaxInt64 {
+		return
+	}
+	gaps, start, err := detectGaps(d.store, threshold, from)
+	if err != nil {
+		// 失败时保留修改起点，下次重试
+		d.store.markEventsDirty(from)
+		log.Printf("gap detector: %v", err)
+		return
+	}
+	added, err := d.store.SyncGaps(start, gaps, time.Now().Unix())
+	if err != nil {
+		d.store.markEventsDirty(from)
+		log.Printf("gap detector: save gaps: %v", err)
+		return
+	}
+	d.scanned = true
+	d.threshold = threshold
+	for _, g := range added {
+		log.Printf("检测到数据断档: %s - %s，%d 个脉冲",
+			time.Unix(g.StartTS, 0).Format(time.RFC3339), time.Unix(g.EndTS, 0).Format(time.RFC3339), g.Pulses)
+	}
+}
+
+// 近期按“星期几 × 小时”统计的用气量，断档的增量不计入。
+// 历史不足两周时星期几的规律不可靠，只按小时统计
+type usageProfile struct {
+	week   [7 * 24]float64
+	hour   [24]float64
+	weekly bool
+}
+
+func (p *usageProfile) add(t time.Time, pulses int64) {
+	p.week[int(t.Weekday())*24+t.Hour()] += float64(pulses)
+	p.hour[t.Hour()] += float64(pulses)
+}
+
+func loadUsageProfile(store *Store, end time.Time, threshold int64) (*usageProfile, error) {
+	start := end.AddDate(0, 0, -gapProfileDays)
+	prev, err := store.FetchPrevEventBefore(start.Unix())
+	if err != nil {
+		return nil, err
+	}
+	rows, err := store.FetchEventsInRange(start.Unix(), end.Unix())
+	if err != nil {
+		return nil, err
+	}
+	var profile usageProfile
+	if len(rows) > 0 {
+		profile.weekly = end.Unix()-rows[0].Timestamp >= 14*86400
+	}
+	for _, row := range rows {
+		if prev != nil {
+			delta := normalizeDelta(&prev.Count, row.Count)
+			if !isGap(prev.Timestamp, row.Timestamp, delta, threshold) {
+				profile.add(time.Unix(row.Timestamp, 0).In(end.Location()), delta)
+			}
+		}
+		row := row
+		prev = &row
+	}
+	return &profile, nil
+}
+
+// 按用气规律把断档拆分为逐小时的片段。断档所在时段按星期几没有历史用量时改按小时，
+// 仍没有时返回 nil，由调用方按时长均匀分布
+func (p *usageProfile) split(gap pulseSpan, loc *time.Location) []pulseSpan {
+	weights := []func(time.Time) float64{func(t time.Time) float64 { return p.hour[t.Hour()] }}
+	if p.weekly {
+		weights = append([]func(time.Time) float64{func(t time.Time) float64 {
+			return p.week[int(t.Weekday())*24+t.Hour()]
+		}}, weights...)
+	}
+	for _, weight := range weights {
+		if spans := splitByWeight(gap, loc, weight); spans != nil {
+			return spans
+		}
+	}
+	return nil
+}
+
+func splitByWeight(gap pulseSpan, loc *time.Location, weight func(time.Time) float64) []pulseSpan {
+	type piece struct {
+		start, end int64
+		weight     float64
+	}
+	var pieces []piece
+	var total float64
+	for cur := gap.Start; cur < gap.End; {
+		t := time.Unix(cur, 0).In(loc)
+		next := min(truncateToBucket(t, "hour", PeriodRules{}).Add(time.Hour).Unix(), gap.End)
+		w := weight(t) * float64(next-cur) / 3600
+		pieces = append(pieces, piece{start: cur, end: next, weight: w})
+		total += w
+		cur = next
+	}
+	if total <= 0 {
+		return nil
+	}
+
+	// 按累计权重取整，各片段之和等于断档的总增量
+	spans := make([]pulseSpan, 0, len(pieces))
+	var cum float64
+	var assigned int64
+	for i, pc := range pieces {
+		cum += pc.weight
+		upto := int64(math.Floor(float64(gap.Pulses) * cum / total))
+		if i == len(pieces)-1 {
+			upto = gap.Pulses
+		}
+		if n := upto - assigned; n > 0 {
+			spans = append(spans, pulseSpan{Start: pc.start, End: pc.end, Pulses: n})
+		}
+		assigned = upto
+	}
+	return spans
+}
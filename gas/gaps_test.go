@@ -0,0 +1,63 @@
+package main
+
+import (
+	"math"
+	"path/filepath"
+	"testing"
+)
+
+func TestGapDetectorIncremental(t *testing.T) {
+	store, err := NewStore(filepath.Join(t.TempDir(), "gas.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	d := NewGapDetector(store)
+
+	const hour = int64(3600)
+	base := int64(1_700_000_000)
+	insert := func(ts, count int64) {
+		t.Helper()
+		if err := store.InsertEvent(ts, count); err != nil {
+			t.Fatal(err)
+		}
+	}
+	gaps := func() []EventGap {
+		t.Helper()
+		g, err := store.FetchGaps(0, 0, 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return g
+	}
+
+	insert(base, 10)
+	insert(base+600, 11)
+	insert(base+4*hour, 20) // 离线 3 小时后一次性上报 9 个脉冲
+	d.scan()
+	if g := gaps(); len(g) != 1 || g[0].StartTS != base+600 || g[0].Pulses != 9 {
+		t.Fatalf("after full scan: %+v", g)
+	}
+
+	// 追加新事件只扫描末尾，已有断档保留
+	insert(base+4*hour+600, 21)
+	insert(base+8*hour, 30)
+	d.scan()
+	if g := gaps(); len(g) != 2 || g[0].StartTS != base+4*hour+600 || g[1].StartTS != base+600 {
+		t.Fatalf("after append: %+v", g)
+	}
+
+	// 补录中间的事件后，被拆开的断档不再满足阈值
+	insert(base+2*hour, 15)
+	insert(base+hour, 13)
+	insert(base+3*hour, 18)
+	d.scan()
+	if g := gaps(); len(g) != 1 || g[0].StartTS != base+4*hour+600 {
+		t.Fatalf("after backfill: %+v", g)
+	}
+
+	// 没有修改时不重新检测
+	if from := store.TakeEventsDirtyFrom(); from != math.MaxInt64 {
+		t.Fatalf("dirty from = %d after scan", from)
+	}
+}
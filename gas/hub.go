@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const sseHeartbeatInterval = 25 * time.Second
+
+type hubMessage struct {
+	Event string
+	Data  []byte
+}
+
+// Hub 是进程内的发布/订阅中心，用于向 SSE 客户端推送实时数据
+type Hub struct {
+	mu   sync.Mutex
+	subs map[chan hubMessage]struct{}
+
+	// 指标在后台计算，连续的事件合并为一次，不阻塞 MQTT 回调和接口请求
+	metricsOnce    sync.Once
+	metricsTrigger chan struct{}
+}
+
+func NewHub() *Hub {
+	return &Hub{
+		subs:           make(map[chan hubMessage]struct{}),
+		metricsTrigger: make(chan struct{}, 1),
+	}
+}
+
+func (h *Hub) Subscribe() (<-chan hubMessage, func()) {
+	ch := make(chan hubMessage, 16)
+	h.mu.Lock()
+	h.subs[ch] = struct{}{}
+	h.mu.Unlock()
+	return ch, func() {
+		h.mu.Lock()
+		delete(h.subs, ch)
+		h.mu.Unlock()
+	}
+}
+
+func (h *Hub) HasSubscribers() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.subs) > 0
+}
+
+// 发布消息；慢速订阅者的缓冲区满时直接丢弃，避免阻塞采集路径
+func (h *Hub) Publish(event string, payload any) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		log.Printf("hub marshal %s: %v", event, err)
+		return
+	}
+	msg := hubMessage{Event: event, Data: data}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for ch := range h.subs {
+		select {
+		case ch <- msg:
+		default:
+		}
+	}
+}
+
+// 新事件入库后推送事件本身，最新指标由后台计算后推送
+func (h *Hub) PublishEvent(store *Store, ev Event) {
+	if !h.HasSubscribers() {
+		return
+	}
+	h.Publish("event", ev)
+	h.PublishMetrics(store)
+}
+
+// 数据或配置变化后请求推送最新指标；在后台计算，连续的请求合并为一次
+func (h *Hub) PublishMetrics(store *Store) {
+	if !h.HasSubscribers() {
+		return
+	}
+	h.metricsOnce.Do(func() { go h.publishMetricsLoop(store) })
+	select {
+	case h.metricsTrigger <- struct{}{}:
+	default:
+	}
+}
+
+func (h *Hub) publishMetricsLoop(store *Store) {
+	for range h.metricsTrigger {
+		if !h.HasSubscribers() {
+			continue
+		}
+		metrics, err := computeMetrics(store)
+		if err != nil {
+			log.Printf("hub compute metrics: %v", err)
+			continue
+		}
+		h.Publish("metrics", metrics)
+	}
+}
+
+// SSE 推送接口
+func (h *Hub) ServeSSE(store *Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			respondError(w, http.StatusInternalServerError, fmt.Errorf("streaming unsupported"))
+			return
+		}
+
+		ch, unsubscribe := h.Subscribe()
+		defer unsubscribe()
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Connection", "keep-alive")
+		w.Header().Set("X-Accel-Buffering", "no")
+
+		// 连接建立后先推送一次当前指标
+		if metrics, err := computeMetrics(store); err == nil {
+			if data, err := json.Marshal(metrics); err == nil {
+				writeSSE(w, hubMessage{Event: "metrics", Data: data})
+			}
+		}
+		flusher.Flush()
+
+		heartbeat := time.NewTicker(sseHeartbeatInterval)
+		defer heartbeat.Stop()
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case msg := <-ch:
+				writeSSE(w, msg)
+				flusher.Flush()
+			case <-heartbeat.C:
+				fmt.Fprint(w, ": ping\n\n")
+				flusher.Flush()
+			}
+		}
+	}
+}
+
+func writeSSE(w http.ResponseWriter, msg hubMessage) {
+	fmt.Fprintf(w, "event: %s\ndata: %s\n\n", msg.Event, msg.Data)
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	loginWindow          = 15 * time.Minute
+	loginLockout         = 15 * time.Minute
+	loginAccountFree     = 3
+	loginIPFree          = 10
+	loginMaxDelay        = 30 * time.Second
+	loginAccountLockAt   = 10
+	loginIPLockAt        = 50
+	loginAttemptKeepDays = 30
+
+	loginReasonOK        = "ok"
+	loginReasonBadCreds  = "bad_credentials"
+	loginReasonSetup     = "setup_denied"
+	loginReasonThrottled = "throttled"
+	loginReasonSSO       = "sso_failed"
+)
+
+// 正在处理的登录请求，按（用户名, IP）索引。同一账号同一来源同时只处理一个请求，
+// 避免并发请求在失败记录写入前绕过计数；锁只保护该集合，密码校验不在锁内进行，
+// 不同账号或来源的登录互不阻塞
+var loginInFlight = struct {
+	sync.Mutex
+	keys map[string]struct{}
+}{keys: make(map[string]struct{})}
+
+var errLoginInProgress = errors.New("上一次登录请求尚未处理完成，请稍后再试")
+
+// 占用（用户名, IP）的登录名额，返回释放函数；已有请求在处理时返回 false
+func acquireLogin(username, ip string) (release func(), ok bool) {
+	key := username + "\x00" + ip
+	loginInFlight.Lock()
+	defer loginInFlight.Unlock()
+	if _, busy := loginInFlight.keys[key]; busy {
+		return nil, false
+	}
+	loginInFlight.keys[key] = struct{}{}
+	return func() {
+		loginInFlight.Lock()
+		delete(loginInFlight.keys, key)
+		loginInFlight.Unlock()
+	}, true
+}
+
+// 客户端 IP，去掉端口部分。默认为 TCP 对端地址，只有对端在 trusted_proxy_cidrs 中时
+// 才由 trustedRealIP 替换为转发头中的地址，客户端无法伪造代理头绕过按 IP 的限流
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// 替代 middleware.RealIP：只接受来自可信代理的 X-Forwarded-For / X-Real-IP，必须放在 capturePeerAddr 之后
+func trustedRealIP(store *Store) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if raw, _ := store.GetSetting("trusted_proxy_cidrs", ""); raw != "" {
+				networks, _ := parseCIDRs(raw)
+				if ip := forwardedClientIP(r, peerIP(r), networks); ip != "" {
+					r.RemoteAddr = ip
+				}
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// 对端为可信代理时取转发头中的客户端地址。X-Forwarded-For 从右往左跳过可信代理，
+// 第一个不可信的地址即为客户端，左侧由客户端自行填写的部分不采信
+func forwardedClientIP(r *http.Request, peer net.IP, networks []*net.IPNet) string {
+	if !ipInNetworks(peer, networks) {
+		return ""
+	}
+	if xff := r.Header.Values("X-Forwarded-For"); len(xff) > 0 {
+		hops := strings.Split(strings.Join(xff, ","), ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			ip := net.ParseIP(strings.TrimSpace(hops[i]))
+			if ip == nil {
+				return ""
+			}
+			if !ipInNetworks(ip, networks) {
+				return ip.String()
+			}
+		}
+		return ""
+	}
+	if ip := net.ParseIP(strings.TrimSpace(r.Header.Get("X-Real-IP"))); ip != nil {
+		return ip.String()
+	}
+	return ""
+}
+
+func ipInNetworks(ip net.IP, networks []*net.IPNet) bool {
+	for _, network := range networks {
+		if ip != nil && network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// 连续失败超过免检次数后，每次失败等待时间翻倍，最长 30 秒
+func loginDelay(failures, free int) time.Duration {
+	if failures < free {
+		return 0
+	}
+	d := time.Second
+	for i := free; i < failures; i++ {
+		d *= 2
+		if d >= loginMaxDelay {
+			return loginMaxDelay
+		}
+	}
+	return d
+}
+
+// 根据失败次数和最后一次失败时间计算还需等待多久，locked 表示已触发锁定
+func loginWait(failures int, lastTS int64, free, lockAt int, now time.Time) (wait time.Duration, locked bool) {
+	if failures == 0 {
+		return 0, false
+	}
+	elapsed := now.Sub(time.Unix(lastTS, 0))
+	if failures >= lockAt {
+		return loginLockout - elapsed, elapsed < loginLockout
+	}
+	if d := loginDelay(failures, free); elapsed < d {
+		return d - elapsed, false
+	}
+	return 0, false
+}
+
+// 检查账号和 IP 是否需要等待或已被锁定，返回的错误可直接展示给用户
+func checkLoginAllowed(store *Store, username, ip string) (time.Duration, error) {
+	now := time.Now()
+	since := now.Add(-loginWindow).Unix()
+
+	accountFailures, accountLast, err := store.CountAccountLoginFailures(username, since)
+	if err != nil {
+		return 0, err
+	}
+	ipFailures, ipLast, err := store.CountIPLoginFailures(ip, since)
+	if err != nil {
+		return 0, err
+	}
+
+	accountWait, accountLocked := loginWait(accountFailures, accountLast, loginAccountFree, loginAccountLockAt, now)
+	ipWait, ipLocked := loginWait(ipFailures, ipLast, loginIPFree, loginIPLockAt, now)
+	wait := accountWait
+	if ipWait > wait {
+		wait = ipWait
+	}
+	if wait <= 0 {
+		return 0, nil
+	}
+	seconds := int(wait.Seconds()) + 1
+	if accountLocked || ipLocked {
+		return wait, fmt.Errorf("登录失败次数过多，已临时锁定，请 %d 分钟后再试", (seconds+59)/60)
+	}
+	return wait, fmt.Errorf("登录失败次数过多，请 %d 秒后再试", seconds)
+}
+
+func recordLoginAttempt(store *Store, r *http.Request, username string, success bool, reason string) {
+	now := time.Now()
+	if err := store.InsertLoginAttempt(LoginAttempt{
+		TS:        now.Unix(),
+		Username:  username,
+		IP:        clientIP(r),
+		Success:   success,
+		Reason:    reason,
+		UserAgent: r.UserAgent(),
+	}); err != nil {
+		log.Printf("login attempt log: %v", err)
+	}
+	_ = store.PruneLoginAttempts(now.AddDate(0, 0, -loginAttemptKeepDays).Unix())
+}
+
+// 一次性初始化令牌：未配置管理员且未设置 GAS_ADMIN_PASSWORD 时，
+// 启动时生成并打印到日志，创建管理员后立即作废
+var setupToken struct {
+	sync.Mutex
+	value string
+}
+
+func initSetupToken(store *Store, adminPassword string) error {
+	configured, err := isAdminConfigured(store)
+	if err != nil || configured || adminPassword != "" {
+		return err
+	}
+	token, err := generateSecureKey(12)
+	if err != nil {
+		return err
+	}
+	setupToken.Lock()
+	setupToken.value = token
+	setupToken.Unlock()
+	log.Printf("尚未创建管理员，初始化令牌: %s（在登录页填写以创建管理员账号）", token)
+	return nil
+}
+
+// 校验初始化凭据：设置了 GAS_ADMIN_PASSWORD 时密码必须一致，否则需要提供初始化令牌
+func checkSetupCredentials(adminPassword, password, token string) bool {
+	if adminPassword != "" {
+		return subtle.ConstantTimeCompare([]byte(adminPassword), []byte(password)) == 1
+	}
+	setupToken.Lock()
+	defer setupToken.Unlock()
+	return setupToken.value != "" && subtle.ConstantTimeCompare([]byte(setupToken.value), []byte(token)) == 1
+}
+
+// 创建管理员所需的凭据类型：password 表示使用 GAS_ADMIN_PASSWORD，token 表示使用初始化令牌
+func setupMode() string {
+	if os.Getenv("GAS_ADMIN_PASSWORD") != "" {
+		return "password"
+	}
+	return "token"
+}
+
+func consumeSetupToken() {
+	setupToken.Lock()
+	setupToken.value = ""
+	setupToken.Unlock()
+}
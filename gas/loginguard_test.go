@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestForwardedClientIP(t *testing.T) {
+	networks, err := parseCIDRs("10.0.0.0/8,127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		name    string
+		peer    string
+		headers map[string]string
+		want    string
+	}{
+		{"不可信对端的转发头被忽略", "203.0.113.9", map[string]string{"X-Forwarded-For": "1.2.3.4"}, ""},
+		{"可信代理", "10.0.0.2", map[string]string{"X-Forwarded-For": "198.51.100.7"}, "198.51.100.7"},
+		{"跳过可信的多级代理", "127.0.0.1", map[string]string{"X-Forwarded-For": "198.51.100.7, 10.1.2.3"}, "198.51.100.7"},
+		{"客户端伪造的左侧地址不采信", "10.0.0.2", map[string]string{"X-Forwarded-For": "1.2.3.4, 198.51.100.7"}, "198.51.100.7"},
+		{"X-Real-IP", "10.0.0.2", map[string]string{"X-Real-IP": "198.51.100.8"}, "198.51.100.8"},
+		{"无效地址", "10.0.0.2", map[string]string{"X-Forwarded-For": "unknown"}, ""},
+		{"没有转发头", "10.0.0.2", nil, ""},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest("POST", "/api/login", nil)
+		for k, v := range c.headers {
+			r.Header.Set(k, v)
+		}
+		if got := forwardedClientIP(r, net.ParseIP(c.peer), networks); got != c.want {
+			t.Errorf("%s: got %q, want %q", c.name, got, c.want)
+		}
+	}
+}
+
+func TestAcquireLoginConcurrent(t *testing.T) {
+	store, err := NewStore(filepath.Join(t.TempDir(), "gas.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	const users = 4
+	for i := 0; i < users; i++ {
+		hashed, err := hashPassword("secret-password")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := store.InsertUser(User{Username: fmt.Sprintf("user%d", i), PasswordHash: hashed, Role: roleViewer}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// 同一账号同一来源在处理中时拒绝，不同账号或不同来源不受影响
+	release, ok := acquireLogin("user0", "198.51.100.1")
+	if !ok {
+		t.Fatal("first login rejected")
+	}
+	if _, ok := acquireLogin("user0", "198.51.100.1"); ok {
+		t.Fatal("concurrent login for the same account and IP was allowed")
+	}
+	other, ok := acquireLogin("user0", "198.51.100.2")
+	if !ok {
+		t.Fatal("login from another IP was blocked")
+	}
+	other()
+	release()
+
+	// 不同账号的登录（含 bcrypt 校验）并行进行，互不阻塞
+	start := make(chan struct{})
+	var wg sync.WaitGroup
+	errs := make(chan error, users)
+	for i := 0; i < users; i++ {
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+			<-start
+			release, ok := acquireLogin(name, "198.51.100.1")
+			if !ok {
+				errs <- fmt.Errorf("%s: login rejected", name)
+				return
+			}
+			defer release()
+			if user, err := AuthenticateUser(store, name, "secret-password"); err != nil || user == nil {
+				errs <- fmt.Errorf("%s: authenticate: %v", name, err)
+			}
+		}(fmt.Sprintf("user%d", i))
+	}
+	close(start)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+	if n := len(loginInFlight.keys); n != 0 {
+		t.Errorf("%d login slots leaked", n)
+	}
+}
@@ -1,36 +1,94 @@
 package main
 
 import (
+	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"html/template"
+	"io"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
+	"github.com/shopspring/decimal"
 )
 
-var localTZ = time.FixedZone("CST", 8*3600)
-
 func main() {
-	dbPath := getenv("GAS_DB_PATH", defaultDBPath)
-	store, err := NewStore(dbPath)
+	cfg, err := loadStartupConfig()
+	if err != nil {
+		log.Fatalf("load config: %v", err)
+	}
+	if len(os.Args) > 1 {
+		if err := runCommand(cfg, os.Args[1], os.Args[2:]); err != nil {
+			log.Fatalf("%s: %v", os.Args[1], err)
+		}
+		return
+	}
+
+	store, err := NewStore(cfg.DBPath)
 	if err != nil {
 		log.Fatalf("init db: %v", err)
 	}
 	defer store.Close()
+	if err := initSecretEncryption(store, cfg.DBPath); err != nil {
+		log.Fatalf("init secret encryption: %v", err)
+	}
+	store.SetSettingOverrides(cfg.Overrides)
+	if cfg.Debug {
+		log.Printf("调试模式已开启，/api/debug 接口可用，请勿在生产环境中使用")
+	}
+	if len(cfg.Overrides) > 0 {
+		log.Printf("%d 项配置由配置文件或环境变量指定，界面中不可修改", len(cfg.Overrides))
+	}
+	if _, err := ensureSigningKey(store); err != nil {
+		log.Fatalf("init signing key: %v", err)
+	}
+	if err := initSetupToken(store, os.Getenv("GAS_ADMIN_PASSWORD")); err != nil {
+		log.Fatalf("init setup token: %v", err)
+	}
+
+	hub := NewHub()
+	outbox := NewNotificationOutbox(store)
+	outbox.Start()
+	defer outbox.Stop()
 
-	worker := NewMQTTWorker(store, func() (Settings, error) {
+	alerts := NewAlertEvaluator(store, outbox)
+	alerts.Start()
+	defer alerts.Stop()
+
+	gaps := NewGapDetector(store)
+	gaps.Start()
+	defer gaps.Stop()
+
+	worker := NewMQTTWorker(store, hub, alerts, gaps, func() (Settings, error) {
 		return loadSettings(store)
 	})
 	worker.Start()
 	defer worker.Stop()
 
+	// 配置变更后立即重新评估预警；MQTT 连接参数变化时重连以应用新配置；
+	// 断档阈值变化时重新检测
+	onSettingsChange(func(Settings) { alerts.Trigger() })
+	onSettingsChange(func(Settings) { hub.PublishMetrics(store) })
+	onSettingsChange(func(Settings) { worker.Reload() }, "mqtt_*")
+	onSettingsChange(func(Settings) { gaps.Trigger() }, "gap_threshold_minutes")
+
+	reports := NewReportScheduler(store, outbox)
+	reports.Start()
+	defer reports.Stop()
+
+	bot := NewTelegramBot(store, hub, alerts)
+	bot.Start()
+	defer bot.Stop()
+
 	templateDir, staticDir := resolveAssetDirs()
 	indexTmpl := mustParseTemplate(filepath.Join(templateDir, "index.html"))
 	loginTmpl := mustParseTemplate(filepath.Join(templateDir, "login.html"))
@@ -38,7 +96,8 @@ func main() {
 
 	r := chi.NewRouter()
 	r.Use(middleware.RequestID)
-	r.Use(middleware.RealIP)
+	r.Use(capturePeerAddr)
+	r.Use(trustedRealIP(store))
 	r.Use(middleware.Logger)
 	r.Use(middleware.Recoverer)
 	r.Use(AuthMiddleware(store))
@@ -60,20 +119,41 @@ func main() {
 			http.Redirect(w, r, "/login", http.StatusFound)
 			return
 		}
-		renderTemplate(w, dataImportTmpl, nil)
+		renderTemplate(w, dataImportTmpl, map[string]interface{}{"Debug": cfg.Debug})
 	})
 
 	r.Route("/api", func(r chi.Router) {
 		// 登录
 		r.Post("/login", func(w http.ResponseWriter, r *http.Request) {
 			var payload struct {
-				Username string `json:"username"`
-				Password string `json:"password"`
+				Username   string `json:"username"`
+				Password   string `json:"password"`
+				SetupToken string `json:"setup_token"`
 			}
 			if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
 				respondError(w, http.StatusBadRequest, err)
 				return
 			}
+			payload.Username = strings.TrimSpace(payload.Username)
+
+			release, acquired := acquireLogin(payload.Username, clientIP(r))
+			if !acquired {
+				w.Header().Set("Retry-After", "1")
+				respondError(w, http.StatusTooManyRequests, errLoginInProgress)
+				return
+			}
+			defer release()
+
+			if wait, err := checkLoginAllowed(store, payload.Username, clientIP(r)); err != nil {
+				if wait <= 0 {
+					respondError(w, http.StatusInternalServerError, err)
+					return
+				}
+				recordLoginAttempt(store, r, payload.Username, false, loginReasonThrottled)
+				w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+				respondError(w, http.StatusTooManyRequests, err)
+				return
+			}
 
 			configured, err := isAdminConfigured(store)
 			if err != nil {
@@ -81,73 +161,320 @@ func main() {
 				return
 			}
 
+			var user *User
 			if !configured {
 				if payload.Username == "" || payload.Password == "" {
 					respondError(w, http.StatusBadRequest, fmt.Errorf("请输入用户名和密码"))
 					return
 				}
-
-				initialPassword := os.Getenv("GAS_ADMIN_PASSWORD")
-				if initialPassword == "" {
-					if err := InitAdmin(store, payload.Username, payload.Password); err != nil {
-						respondError(w, http.StatusInternalServerError, err)
-						return
+				adminPassword := os.Getenv("GAS_ADMIN_PASSWORD")
+				if !checkSetupCredentials(adminPassword, payload.Password, payload.SetupToken) {
+					recordLoginAttempt(store, r, payload.Username, false, loginReasonSetup)
+					if adminPassword != "" {
+						respondError(w, http.StatusUnauthorized, fmt.Errorf("初始密码与 GAS_ADMIN_PASSWORD 不一致"))
+					} else {
+						respondError(w, http.StatusUnauthorized, fmt.Errorf("初始化令牌无效，请查看服务启动日志"))
 					}
-				} else {
-					if err := InitAdmin(store, payload.Username, initialPassword); err != nil {
+					return
+				}
+				admin, err := InitAdmin(store, payload.Username, payload.Password)
+				if err != nil {
+					respondError(w, http.StatusBadRequest, err)
+					return
+				}
+				consumeSetupToken()
+				recordAudit(store, r, "user.setup", fmt.Sprintf("user:%d", admin.ID), nil, admin)
+				user = &admin
+			} else {
+				user, err = AuthenticateUser(store, payload.Username, payload.Password)
+				if err != nil {
+					respondError(w, http.StatusInternalServerError, err)
+					return
+				}
+				if user == nil {
+					recordLoginAttempt(store, r, payload.Username, false, loginReasonBadCreds)
+					respondError(w, http.StatusUnauthorized, fmt.Errorf("用户名或密码错误"))
+					return
+				}
+				// 已启用两步验证：密码正确后只发放挑战，验证码通过后才签发 Token
+				if user.MFAEnabled {
+					challenge, err := createMFAChallenge(user.ID)
+					if err != nil {
 						respondError(w, http.StatusInternalServerError, err)
 						return
 					}
+					recordLoginAttempt(store, r, payload.Username, false, loginReasonMFAWait)
+					respondJSON(w, map[string]string{
+						"status":    "mfa_required",
+						"mfa_token": challenge,
+					})
+					return
 				}
+			}
+			recordLoginAttempt(store, r, payload.Username, true, loginReasonOK)
+			respondLogin(w, r, store, *user)
+		})
 
-				token, err := GenerateToken(store)
-				if err != nil {
+		// 两步验证：提交 TOTP 验证码或恢复码完成登录
+		r.Post("/login/mfa", func(w http.ResponseWriter, r *http.Request) {
+			var payload struct {
+				MFAToken string `json:"mfa_token"`
+				Code     string `json:"code"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+				respondError(w, http.StatusBadRequest, err)
+				return
+			}
+
+			userID, err := lookupMFAChallenge(payload.MFAToken)
+			if err != nil {
+				respondError(w, http.StatusUnauthorized, err)
+				return
+			}
+			user, err := store.FetchUser(userID)
+			if err != nil || user.Disabled {
+				finishMFAChallenge(payload.MFAToken)
+				respondError(w, http.StatusUnauthorized, fmt.Errorf("用户不存在或已停用"))
+				return
+			}
+			release, acquired := acquireLogin(user.Username, clientIP(r))
+			if !acquired {
+				w.Header().Set("Retry-After", "1")
+				respondError(w, http.StatusTooManyRequests, errLoginInProgress)
+				return
+			}
+			defer release()
+
+			if wait, err := checkLoginAllowed(store, user.Username, clientIP(r)); err != nil {
+				if wait <= 0 {
 					respondError(w, http.StatusInternalServerError, err)
 					return
 				}
+				recordLoginAttempt(store, r, user.Username, false, loginReasonThrottled)
+				w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+				respondError(w, http.StatusTooManyRequests, err)
+				return
+			}
+			ok, err := verifySecondFactor(store, user.ID, payload.Code)
+			if err != nil {
+				respondError(w, http.StatusInternalServerError, err)
+				return
+			}
+			if !ok {
+				recordLoginAttempt(store, r, user.Username, false, loginReasonMFA)
+				respondError(w, http.StatusUnauthorized, fmt.Errorf("验证码错误"))
+				return
+			}
+			finishMFAChallenge(payload.MFAToken)
+			recordLoginAttempt(store, r, user.Username, true, loginReasonOK)
+			recordAuditAs(store, r, user.Username, "auth.login_mfa", fmt.Sprintf("user:%d", user.ID), nil, nil)
+			respondLogin(w, r, store, user)
+		})
 
-				respondJSON(w, map[string]string{
-					"status":  "success",
-					"message": "管理员账号初始化成功",
-					"token":   token,
-				})
+		// 两步验证设置（针对当前登录用户）
+		r.Get("/mfa", func(w http.ResponseWriter, r *http.Request) {
+			user, err := currentUser(store, r)
+			if err != nil {
+				respondError(w, http.StatusBadRequest, err)
 				return
 			}
+			remaining, err := store.CountRecoveryCodes(user.ID)
+			if err != nil {
+				respondError(w, http.StatusInternalServerError, err)
+				return
+			}
+			respondJSON(w, map[string]interface{}{
+				"enabled":        user.MFAEnabled,
+				"recovery_codes": remaining,
+			})
+		})
 
-			valid, err := VerifyAdminPassword(store, payload.Password)
+		r.Post("/mfa/setup", func(w http.ResponseWriter, r *http.Request) {
+			user, err := currentUser(store, r)
+			if err != nil {
+				respondError(w, http.StatusBadRequest, err)
+				return
+			}
+			secret, err := generateTOTPSecret()
 			if err != nil {
 				respondError(w, http.StatusInternalServerError, err)
 				return
 			}
-			if !valid {
-				respondError(w, http.StatusUnauthorized, fmt.Errorf("密码错误"))
+			if err := store.SavePendingMFA(user.ID, secret); err != nil {
+				respondError(w, http.StatusBadRequest, err)
 				return
 			}
+			recordAudit(store, r, "mfa.setup", fmt.Sprintf("user:%d", user.ID), nil, nil)
+			respondJSON(w, map[string]string{
+				"secret": secret,
+				"uri":    totpProvisioningURI(user.Username, secret),
+			})
+		})
 
-			adminUsername, _ := store.GetSetting("admin_username", "admin")
-			if payload.Username != "" && payload.Username != adminUsername {
-				respondError(w, http.StatusUnauthorized, fmt.Errorf("用户名错误"))
+		r.Post("/mfa/enable", func(w http.ResponseWriter, r *http.Request) {
+			var payload struct {
+				Code string `json:"code"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+				respondError(w, http.StatusBadRequest, err)
+				return
+			}
+			user, err := currentUser(store, r)
+			if err != nil {
+				respondError(w, http.StatusBadRequest, err)
+				return
+			}
+			mfa, err := store.FetchUserMFA(user.ID)
+			if err != nil {
+				respondError(w, http.StatusInternalServerError, err)
+				return
+			}
+			if mfa.Secret == "" || mfa.Enabled {
+				respondError(w, http.StatusBadRequest, fmt.Errorf("请先生成两步验证密钥"))
+				return
+			}
+			step, ok := verifyTOTP(mfa.Secret, payload.Code, time.Now(), 0)
+			if !ok {
+				respondError(w, http.StatusBadRequest, fmt.Errorf("验证码错误，请检查手机时间是否准确"))
+				return
+			}
+			if err := store.EnableMFA(user.ID, step); err != nil {
+				respondError(w, http.StatusInternalServerError, err)
+				return
+			}
+			codes, err := regenerateRecoveryCodes(store, user.ID)
+			if err != nil {
+				respondError(w, http.StatusInternalServerError, err)
+				return
+			}
+			// 启用后此前仅凭密码建立的会话全部失效，为当前浏览器重新签发会话
+			if err := store.RevokeUserSessions(user.ID, time.Now().Unix()); err != nil {
+				respondError(w, http.StatusInternalServerError, err)
+				return
+			}
+			token, err := GenerateToken(store, user, r)
+			if err != nil {
+				respondError(w, http.StatusInternalServerError, err)
 				return
 			}
+			setAuthCookie(w, token)
+			recordAudit(store, r, "mfa.enable", fmt.Sprintf("user:%d", user.ID), nil, nil)
+			respondJSON(w, map[string]interface{}{
+				"status":         "enabled",
+				"recovery_codes": codes,
+				"token":          token,
+			})
+		})
 
-			token, err := GenerateToken(store)
+		r.Post("/mfa/recovery-codes", func(w http.ResponseWriter, r *http.Request) {
+			var payload struct {
+				Code string `json:"code"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+				respondError(w, http.StatusBadRequest, err)
+				return
+			}
+			user, err := currentUser(store, r)
+			if err != nil {
+				respondError(w, http.StatusBadRequest, err)
+				return
+			}
+			ok, err := verifySecondFactor(store, user.ID, payload.Code)
+			if err != nil {
+				respondError(w, http.StatusInternalServerError, err)
+				return
+			}
+			if !ok {
+				respondError(w, http.StatusBadRequest, fmt.Errorf("验证码错误"))
+				return
+			}
+			codes, err := regenerateRecoveryCodes(store, user.ID)
 			if err != nil {
 				respondError(w, http.StatusInternalServerError, err)
 				return
 			}
+			recordAudit(store, r, "mfa.recovery_codes", fmt.Sprintf("user:%d", user.ID), nil, nil)
+			respondJSON(w, map[string]interface{}{"recovery_codes": codes})
+		})
 
-			http.SetCookie(w, &http.Cookie{
-				Name:     "auth_token",
-				Value:    token,
-				Path:     "/",
-				HttpOnly: true,
-				SameSite: http.SameSiteLaxMode,
-				Expires:  time.Now().Add(time.Hour * tokenExpiryHours),
-			})
+		r.Post("/mfa/disable", func(w http.ResponseWriter, r *http.Request) {
+			var payload struct {
+				Password string `json:"password"`
+				Code     string `json:"code"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+				respondError(w, http.StatusBadRequest, err)
+				return
+			}
+			user, err := currentUser(store, r)
+			if err != nil {
+				respondError(w, http.StatusBadRequest, err)
+				return
+			}
+			if checked, err := AuthenticateUser(store, user.Username, payload.Password); err != nil || checked == nil {
+				respondError(w, http.StatusBadRequest, fmt.Errorf("密码错误"))
+				return
+			}
+			if user.MFAEnabled {
+				ok, err := verifySecondFactor(store, user.ID, payload.Code)
+				if err != nil {
+					respondError(w, http.StatusInternalServerError, err)
+					return
+				}
+				if !ok {
+					respondError(w, http.StatusBadRequest, fmt.Errorf("验证码错误"))
+					return
+				}
+			}
+			if err := store.DeleteUserMFA(user.ID); err != nil {
+				respondError(w, http.StatusInternalServerError, err)
+				return
+			}
+			recordAudit(store, r, "mfa.disable", fmt.Sprintf("user:%d", user.ID), nil, nil)
+			respondJSON(w, map[string]string{"status": "disabled"})
+		})
 
+		// 修改当前登录用户自己的密码，所有角色可用
+		r.Post("/account/password", func(w http.ResponseWriter, r *http.Request) {
+			var payload struct {
+				CurrentPassword string `json:"current_password"`
+				NewPassword     string `json:"new_password"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+				respondError(w, http.StatusBadRequest, err)
+				return
+			}
+			user, err := currentUser(store, r)
+			if err != nil {
+				respondError(w, http.StatusBadRequest, err)
+				return
+			}
+			if payload.NewPassword == "" {
+				respondError(w, http.StatusBadRequest, fmt.Errorf("请输入新密码"))
+				return
+			}
+			checked, err := AuthenticateUser(store, user.Username, payload.CurrentPassword)
+			if err != nil {
+				respondError(w, http.StatusInternalServerError, err)
+				return
+			}
+			if checked == nil {
+				respondError(w, http.StatusUnauthorized, fmt.Errorf("当前密码错误"))
+				return
+			}
+			if err := UpdateUserCredentials(store, *checked, checked.Username, payload.NewPassword); err != nil {
+				respondError(w, http.StatusBadRequest, err)
+				return
+			}
+			// 密码变更后该用户的所有会话失效
+			if err := store.RevokeUserSessions(checked.ID, time.Now().Unix()); err != nil {
+				respondError(w, http.StatusInternalServerError, err)
+				return
+			}
+			recordAudit(store, r, "account.password", fmt.Sprintf("user:%d", checked.ID), nil, nil)
 			respondJSON(w, map[string]string{
-				"status": "success",
-				"token":  token,
+				"status":  "success",
+				"message": "密码已修改，请重新登录",
 			})
 		})
 
@@ -185,20 +512,45 @@ func main() {
 				return
 			}
 
-			valid, err := VerifyAdminPassword(store, payload.CurrentPassword)
+			// 修改当前登录用户；未启用认证时修改第一个管理员
+			var username string
+			if claims := claimsFromRequest(r); claims != nil {
+				username = claims.Subject
+			} else {
+				users, err := store.FetchUsers()
+				if err != nil {
+					respondError(w, http.StatusInternalServerError, err)
+					return
+				}
+				for _, u := range users {
+					if u.Role == roleAdmin && !u.Disabled {
+						username = u.Username
+						break
+					}
+				}
+			}
+			user, err := AuthenticateUser(store, username, payload.CurrentPassword)
 			if err != nil {
 				respondError(w, http.StatusInternalServerError, err)
 				return
 			}
-			if !valid {
+			if user == nil {
 				respondError(w, http.StatusUnauthorized, fmt.Errorf("当前密码错误"))
 				return
 			}
 
-			if err := UpdateAdminCredentials(store, payload.NewUsername, payload.NewPassword); err != nil {
+			if err := UpdateUserCredentials(store, *user, payload.NewUsername, payload.NewPassword); err != nil {
+				respondError(w, http.StatusBadRequest, err)
+				return
+			}
+			// 管理员凭据变更后所有已登录会话全部失效
+			if err := store.RevokeAllSessions(time.Now().Unix()); err != nil {
 				respondError(w, http.StatusInternalServerError, err)
 				return
 			}
+			recordAudit(store, r, "admin.update", fmt.Sprintf("user:%d", user.ID),
+				map[string]string{"username": user.Username},
+				map[string]string{"username": payload.NewUsername})
 
 			respondJSON(w, map[string]string{
 				"status":  "success",
@@ -208,6 +560,11 @@ func main() {
 
 		// 退出登录
 		r.Post("/logout", func(w http.ResponseWriter, r *http.Request) {
+			if tokenStr, err := extractToken(r); err == nil {
+				if claims, err := RevokeToken(store, tokenStr); err == nil {
+					recordAuditAs(store, r, claims.Subject, "auth.logout", "session:"+claims.ID, nil, nil)
+				}
+			}
 			http.SetCookie(w, &http.Cookie{
 				Name:     "auth_token",
 				Value:    "",
@@ -223,333 +580,1704 @@ func main() {
 			enabled, _ := isAuthEnabled(store)
 			configured, _ := isAdminConfigured(store)
 			authenticated := false
+			username, role := "", ""
 
 			if enabled && configured {
-				// 优先用 Authorization，其次用 Cookie
-				if tokenStr, err := extractToken(r); err == nil {
-					if _, err := ValidateToken(tokenStr); err == nil {
-						authenticated = true
-					}
+				// 优先用 Authorization，其次用 Cookie，最后是代理头认证
+				if claims, err := requestClaims(store, r); err == nil {
+					authenticated = true
+					username, role = claims.Subject, claims.Role
 				}
 			}
+			var providers Settings
+			_ = loadAuthProviderSettings(store, &providers)
 
 			respondJSON(w, map[string]interface{}{
-				"enabled":       enabled,
-				"configured":    configured,
-				"authenticated": authenticated,
+				"enabled":          enabled,
+				"configured":       configured,
+				"authenticated":    authenticated,
+				"username":         username,
+				"role":             role,
+				"public_dashboard": isDashboardPublic(store),
+				"setup_mode":       setupMode(),
+				"oidc_enabled":     providers.OIDCEnabled,
 			})
 		})
 
-		r.Get("/settings", func(w http.ResponseWriter, r *http.Request) {
-			settings, err := loadSettings(store)
+		// 单点登录：跳转到 IdP
+		r.Get("/auth/{provider}/login", func(w http.ResponseWriter, r *http.Request) {
+			var settings Settings
+			if err := loadAuthProviderSettings(store, &settings); err != nil {
+				respondError(w, http.StatusInternalServerError, err)
+				return
+			}
+			provider, err := redirectAuthProvider(settings, chi.URLParam(r, "provider"))
+			if err != nil {
+				respondError(w, http.StatusNotFound, err)
+				return
+			}
+			target, err := provider.LoginURL(r)
+			if err != nil {
+				log.Printf("sso login: %v", err)
+				http.Redirect(w, r, "/login?sso_error="+url.QueryEscape(err.Error()), http.StatusFound)
+				return
+			}
+			http.Redirect(w, r, target, http.StatusFound)
+		})
+
+		// 单点登录回调：校验身份、映射本地用户并签发会话
+		r.Get("/auth/{provider}/callback", func(w http.ResponseWriter, r *http.Request) {
+			fail := func(username string, err error) {
+				log.Printf("sso callback: %v", err)
+				if username != "" {
+					recordLoginAttempt(store, r, username, false, loginReasonSSO)
+				}
+				http.Redirect(w, r, "/login?sso_error="+url.QueryEscape(err.Error()), http.StatusFound)
+			}
+			var settings Settings
+			if err := loadAuthProviderSettings(store, &settings); err != nil {
+				fail("", err)
+				return
+			}
+			provider, err := redirectAuthProvider(settings, chi.URLParam(r, "provider"))
+			if err != nil {
+				fail("", err)
+				return
+			}
+			identity, err := provider.CompleteLogin(r)
+			if err != nil {
+				fail("", err)
+				return
+			}
+			user, err := resolveExternalUser(store, settings, identity)
+			if err != nil {
+				fail(identity.Username, err)
+				return
+			}
+			// 已启用两步验证的账号同样需要通过本地验证码，挑战放在 URL 片段中，不会出现在服务端日志
+			if user.MFAEnabled {
+				challenge, err := createMFAChallenge(user.ID)
+				if err != nil {
+					fail(user.Username, err)
+					return
+				}
+				recordLoginAttempt(store, r, user.Username, false, loginReasonMFAWait)
+				http.Redirect(w, r, "/login#mfa_token="+url.QueryEscape(challenge), http.StatusFound)
+				return
+			}
+			token, err := GenerateToken(store, user, r)
+			if err != nil {
+				fail(user.Username, err)
+				return
+			}
+			_ = store.TouchUserLogin(user.ID)
+			recordLoginAttempt(store, r, user.Username, true, provider.Name())
+			setAuthCookie(w, token)
+			http.Redirect(w, r, "/login?sso=1", http.StatusFound)
+		})
+
+		r.Get("/settings", func(w http.ResponseWriter, r *http.Request) {
+			settings, err := loadSettings(store)
+			if err != nil {
+				respondError(w, http.StatusInternalServerError, err)
+				return
+			}
+			maskSecretSettings(&settings)
+			respondJSON(w, settings)
+		})
+
+		// 被配置文件或环境变量锁定的配置项及来源
+		r.Get("/settings/locked", func(w http.ResponseWriter, r *http.Request) {
+			locked := store.SettingOverrides()
+			if locked == nil {
+				locked = map[string]settingOverride{}
+			}
+			respondJSON(w, locked)
+		})
+
+		r.Put("/settings", settingsUpdateHandler(store, true))
+		r.Patch("/settings", settingsUpdateHandler(store, false))
+
+		r.Get("/metrics", func(w http.ResponseWriter, r *http.Request) {
+			metrics, err := computeMetrics(store)
+			if err != nil {
+				respondError(w, http.StatusInternalServerError, err)
+				return
+			}
+			respondJSON(w, metrics)
+		})
+
+		// 实时推送（SSE）
+		r.Get("/stream", hub.ServeSSE(store))
+
+		// gap_mode 可选 none|proportional|profile，指定断档增量的分配方式
+		r.Get("/hourly", func(w http.ResponseWriter, r *http.Request) {
+			gapMode, err := parseGapMode(r.URL.Query().Get("gap_mode"))
+			if err != nil {
+				respondError(w, http.StatusBadRequest, err)
+				return
+			}
+			now := time.Now().In(storeLocation(store))
+			hourly, err := calcHourlyPulsesToday(store, now, gapMode)
+			if err != nil {
+				respondError(w, http.StatusInternalServerError, err)
+				return
+			}
+			respondJSON(w, hourly)
+		})
+
+		r.Get("/monthly", func(w http.ResponseWriter, r *http.Request) {
+			gapMode, err := parseGapMode(r.URL.Query().Get("gap_mode"))
+			if err != nil {
+				respondError(w, http.StatusBadRequest, err)
+				return
+			}
+			now := time.Now().In(storeLocation(store))
+			monthly, err := calcMonthlyPulsesCurrentYear(store, now, gapMode)
+			if err != nil {
+				respondError(w, http.StatusInternalServerError, err)
+				return
+			}
+			respondJSON(w, monthly)
+		})
+
+		// 任意时间范围与粒度的用气统计
+		r.Get("/usage", func(w http.ResponseWriter, r *http.Request) {
+			settings, err := loadSettings(store)
+			if err != nil {
+				respondError(w, http.StatusInternalServerError, err)
+				return
+			}
+
+			q := r.URL.Query()
+			loc := loadLocation(settings.Timezone)
+			now := time.Now().In(loc)
+			bucket := q.Get("bucket")
+			if bucket == "" {
+				bucket = "hour"
+			}
+			if _, ok := usageBuckets[bucket]; !ok {
+				respondError(w, http.StatusBadRequest, fmt.Errorf("bucket 仅支持 minute|hour|day|week|month|bill|year"))
+				return
+			}
+			gapMode, err := parseGapMode(q.Get("gap_mode"))
+			if err != nil {
+				respondError(w, http.StatusBadRequest, err)
+				return
+			}
+			from := startOfDay(now)
+			if raw := q.Get("from"); raw != "" {
+				if from, err = parseTimeParam(raw, loc); err != nil {
+					respondError(w, http.StatusBadRequest, err)
+					return
+				}
+			}
+			to := now
+			if raw := q.Get("to"); raw != "" {
+				if to, err = parseTimeParam(raw, loc); err != nil {
+					respondError(w, http.StatusBadRequest, err)
+					return
+				}
+			}
+
+			gasPerPulse := parseDecimal(settings.GasPerPulse, defaultGasPerPulse)
+			price := parseDecimal(settings.GasPrice, defaultGasPrice)
+			rules := periodRulesFromSettings(settings)
+			series, err := calcUsageSeries(store, from, to, bucket, rules, gapMode, gasPerPulse, price)
+			if err != nil {
+				respondError(w, http.StatusBadRequest, err)
+				return
+			}
+			resp := UsageResponse{UsageSeries: series}
+
+			if parseBoolSetting(q.Get("compare"), false) {
+				prevFrom, prevTo := previousRange(from, to)
+				previous, err := calcUsageSeries(store, prevFrom, prevTo, bucket, rules, gapMode, gasPerPulse, price)
+				if err != nil {
+					respondError(w, http.StatusBadRequest, err)
+					return
+				}
+				resp.Previous = &previous
+			}
+			respondJSON(w, resp)
+		})
+
+		// 导入日均气温 CSV（请求体或 multipart 的 file 字段）
+		r.Post("/weather/import", func(w http.ResponseWriter, r *http.Request) {
+			var body io.Reader = r.Body
+			if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+				file, _, err := r.FormFile("file")
+				if err != nil {
+					respondError(w, http.StatusBadRequest, err)
+					return
+				}
+				defer file.Close()
+				body = file
+			}
+			temps, problems, err := parseTemperatureCSV(io.LimitReader(body, 10<<20))
+			if err != nil {
+				respondError(w, http.StatusBadRequest, err)
+				return
+			}
+			if err := store.UpsertDailyTemperatures(temps, "csv"); err != nil {
+				respondError(w, http.StatusInternalServerError, err)
+				return
+			}
+			recordAudit(store, r, "weather.import", "temperatures", nil, map[string]int{"imported": len(temps), "errors": len(problems)})
+			respondJSON(w, map[string]interface{}{
+				"status":   "success",
+				"imported": len(temps),
+				"errors":   problems,
+			})
+		})
+
+		r.Get("/weather/temperatures", func(w http.ResponseWriter, r *http.Request) {
+			now := time.Now().In(storeLocation(store))
+			from := r.URL.Query().Get("from")
+			if from == "" {
+				from = now.AddDate(0, 0, -30).Format(dayLayout)
+			}
+			to := r.URL.Query().Get("to")
+			if to == "" {
+				to = now.Format(dayLayout)
+			}
+			temps, err := store.FetchDailyTemperatures(from, to)
+			if err != nil {
+				respondError(w, http.StatusInternalServerError, err)
+				return
+			}
+			respondJSON(w, temps)
+		})
+
+		// 按月的采暖度日及单位度日用气量
+		r.Get("/weather/monthly", func(w http.ResponseWriter, r *http.Request) {
+			settings, err := loadSettings(store)
+			if err != nil {
+				respondError(w, http.StatusInternalServerError, err)
+				return
+			}
+			loc := loadLocation(settings.Timezone)
+			year := time.Now().In(loc).Year()
+			if raw := r.URL.Query().Get("year"); raw != "" {
+				if year, err = strconv.Atoi(raw); err != nil {
+					respondError(w, http.StatusBadRequest, err)
+					return
+				}
+			}
+			monthly, err := calcMonthlyHDD(store, settings, year, loc)
+			if err != nil {
+				respondError(w, http.StatusInternalServerError, err)
+				return
+			}
+			respondJSON(w, monthly)
+		})
+
+		r.Get("/recent", func(w http.ResponseWriter, r *http.Request) {
+			limit := 100
+			if raw := r.URL.Query().Get("limit"); raw != "" {
+				if v, err := strconv.Atoi(raw); err == nil {
+					limit = v
+				}
+			}
+			recent, err := store.FetchRecentEvents(limit)
+			if err != nil {
+				respondError(w, http.StatusInternalServerError, err)
+				return
+			}
+			respondJSON(w, recent)
+		})
+
+		// 事件数据的查询与更正。原始读数不会被修改：删除为软删除，
+		// 更正和补录记录在 event_adjustments 中，统计时叠加
+		r.Get("/events", func(w http.ResponseWriter, r *http.Request) {
+			q := r.URL.Query()
+			filter := EventFilter{Limit: 100}
+			if raw := q.Get("limit"); raw != "" {
+				if v, err := strconv.Atoi(raw); err == nil && v > 0 {
+					filter.Limit = v
+				}
+			}
+			if filter.Limit > 1000 {
+				filter.Limit = 1000
+			}
+			if raw := q.Get("offset"); raw != "" {
+				if v, err := strconv.Atoi(raw); err == nil && v > 0 {
+					filter.Offset = v
+				}
+			}
+			filter.IncludeDeleted = q.Get("include_deleted") == "1" || q.Get("include_deleted") == "true"
+			loc := storeLocation(store)
+			for param, dst := range map[string]*int64{"from": &filter.From, "to": &filter.To} {
+				if raw := q.Get(param); raw != "" {
+					t, err := parseTimeParam(raw, loc)
+					if err != nil {
+						respondError(w, http.StatusBadRequest, err)
+						return
+					}
+					*dst = t.Unix()
+				}
+			}
+			events, err := store.FetchEvents(filter)
+			if err != nil {
+				respondError(w, http.StatusInternalServerError, err)
+				return
+			}
+			if events == nil {
+				events = []Event{}
+			}
+			respondJSON(w, events)
+		})
+
+		r.Post("/events", func(w http.ResponseWriter, r *http.Request) {
+			var payload Event
+			if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+				respondError(w, http.StatusBadRequest, err)
+				return
+			}
+			if err := validateEvent(payload); err != nil {
+				respondError(w, http.StatusBadRequest, err)
+				return
+			}
+			if err := store.InsertEvent(payload.Timestamp, payload.Count); err != nil {
+				respondError(w, http.StatusInternalServerError, err)
+				return
+			}
+			hub.PublishEvent(store, Event{Timestamp: payload.Timestamp, Count: payload.Count})
+			recordAudit(store, r, "event.insert", "events", nil, payload)
+			alerts.Trigger()
+			gaps.Trigger()
+			respondJSON(w, map[string]string{"status": "success", "message": "数据插入成功"})
+		})
+
+		r.Post("/events/batch", func(w http.ResponseWriter, r *http.Request) {
+			var payload struct {
+				Events []Event `json:"events"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+				respondError(w, http.StatusBadRequest, err)
+				return
+			}
+			if err := validateEventBatch(payload.Events); err != nil {
+				respondError(w, http.StatusBadRequest, err)
+				return
+			}
+			if err := store.InsertEvents(payload.Events); err != nil {
+				respondError(w, http.StatusInternalServerError, err)
+				return
+			}
+			n := len(payload.Events)
+			recordAudit(store, r, "event.batch_insert", "events", nil, map[string]int64{
+				"count": int64(n), "first_ts": payload.Events[0].Timestamp, "last_ts": payload.Events[n-1].Timestamp,
+			})
+			alerts.Trigger()
+			hub.PublishMetrics(store)
+			gaps.Trigger()
+			respondJSON(w, map[string]interface{}{
+				"status":  "success",
+				"message": "批量插入成功",
+				"count":   n,
+			})
+		})
+
+		// 更正记录：correct 覆盖单条事件的读数，missing 补录一段时间内漏计的脉冲
+		r.Get("/events/adjustments", func(w http.ResponseWriter, r *http.Request) {
+			q := r.URL.Query()
+			filter := AdjustmentFilter{
+				Kind:           q.Get("kind"),
+				IncludeRevoked: q.Get("include_revoked") == "1" || q.Get("include_revoked") == "true",
+				Limit:          100,
+			}
+			if filter.Kind != "" && filter.Kind != adjustmentCorrect && filter.Kind != adjustmentMissing {
+				respondError(w, http.StatusBadRequest, fmt.Errorf("kind 只能是 correct 或 missing"))
+				return
+			}
+			if raw := q.Get("event_id"); raw != "" {
+				if v, err := strconv.ParseInt(raw, 10, 64); err == nil {
+					filter.EventID = v
+				}
+			}
+			if raw := q.Get("limit"); raw != "" {
+				if v, err := strconv.Atoi(raw); err == nil && v > 0 && v <= 1000 {
+					filter.Limit = v
+				}
+			}
+			list, err := store.FetchAdjustments(filter)
+			if err != nil {
+				respondError(w, http.StatusInternalServerError, err)
+				return
+			}
+			if list == nil {
+				list = []EventAdjustment{}
+			}
+			respondJSON(w, list)
+		})
+
+		// 传感器离线等已知的漏计：在 [from, to) 内按时长均匀补录脉冲
+		r.Post("/events/missing", func(w http.ResponseWriter, r *http.Request) {
+			var payload struct {
+				From   string `json:"from"`
+				To     string `json:"to"`
+				Pulses int64  `json:"pulses"`
+				Note   string `json:"note"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+				respondError(w, http.StatusBadRequest, err)
+				return
+			}
+			loc := storeLocation(store)
+			from, err := parseTimeParam(payload.From, loc)
+			if err != nil {
+				respondError(w, http.StatusBadRequest, err)
+				return
+			}
+			to, err := parseTimeParam(payload.To, loc)
+			if err != nil {
+				respondError(w, http.StatusBadRequest, err)
+				return
+			}
+			adj := EventAdjustment{
+				Kind:      adjustmentMissing,
+				StartTS:   from.Unix(),
+				EndTS:     to.Unix(),
+				Pulses:    payload.Pulses,
+				Note:      strings.TrimSpace(payload.Note),
+				CreatedBy: auditActor(r),
+				CreatedTS: time.Now().Unix(),
+			}
+			if err := validateMissingPulses(adj); err != nil {
+				respondError(w, http.StatusBadRequest, err)
+				return
+			}
+			id, err := store.InsertMissingPulses(adj)
+			if err != nil {
+				respondError(w, http.StatusInternalServerError, err)
+				return
+			}
+			adj.ID = id
+			recordAudit(store, r, "event.missing_insert", fmt.Sprintf("adjustment:%d", id), nil, adj)
+			alerts.Trigger()
+			hub.PublishMetrics(store)
+			respondJSON(w, adj)
+		})
+
+		// 撤销更正记录，原始事件恢复参与统计
+		r.Delete("/events/adjustments/{id}", func(w http.ResponseWriter, r *http.Request) {
+			id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+			if err != nil {
+				respondError(w, http.StatusBadRequest, fmt.Errorf("无效的更正记录 ID"))
+				return
+			}
+			adj, err := store.FetchAdjustment(id)
+			if err != nil {
+				respondError(w, http.StatusInternalServerError, err)
+				return
+			}
+			if adj == nil || adj.RevokedTS > 0 {
+				respondError(w, http.StatusNotFound, fmt.Errorf("更正记录不存在或已撤销"))
+				return
+			}
+			if err := store.RevokeAdjustment(id, auditActor(r), time.Now().Unix()); err != nil {
+				respondError(w, http.StatusInternalServerError, err)
+				return
+			}
+			recordAudit(store, r, "event.adjustment_revoke", fmt.Sprintf("adjustment:%d", id), adj, nil)
+			alerts.Trigger()
+			hub.PublishMetrics(store)
+			gaps.Trigger()
+			respondJSON(w, map[string]string{"status": "ok"})
+		})
+
+		// 单条事件及其全部更正历史
+		r.Get("/events/{id}", func(w http.ResponseWriter, r *http.Request) {
+			ev, ok := eventFromPath(w, r, store)
+			if !ok {
+				return
+			}
+			history, err := store.FetchAdjustments(AdjustmentFilter{EventID: ev.ID, IncludeRevoked: true, Limit: 1000})
+			if err != nil {
+				respondError(w, http.StatusInternalServerError, err)
+				return
+			}
+			if history == nil {
+				history = []EventAdjustment{}
+			}
+			respondJSON(w, map[string]interface{}{"event": ev, "adjustments": history})
+		})
+
+		// 修改事件备注，原始读数不可修改，需要时使用更正
+		r.Patch("/events/{id}", func(w http.ResponseWriter, r *http.Request) {
+			ev, ok := activeEventFromPath(w, r, store)
+			if !ok {
+				return
+			}
+			var payload struct {
+				Note *string `json:"note"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+				respondError(w, http.StatusBadRequest, err)
+				return
+			}
+			if payload.Note == nil {
+				respondError(w, http.StatusBadRequest, fmt.Errorf("只能修改备注，读数请使用更正"))
+				return
+			}
+			note := strings.TrimSpace(*payload.Note)
+			if len([]rune(note)) > maxEventNote {
+				respondError(w, http.StatusBadRequest, fmt.Errorf("备注不能超过 %d 个字符", maxEventNote))
+				return
+			}
+			if err := store.UpdateEventNote(ev.ID, note); err != nil {
+				respondError(w, http.StatusInternalServerError, err)
+				return
+			}
+			recordAudit(store, r, "event.annotate", fmt.Sprintf("event:%d", ev.ID),
+				map[string]string{"note": ev.Note}, map[string]string{"note": note})
+			ev.Note = note
+			respondJSON(w, ev)
+		})
+
+		// 软删除：事件保留，不再参与统计，可通过 restore 恢复
+		r.Delete("/events/{id}", func(w http.ResponseWriter, r *http.Request) {
+			ev, ok := activeEventFromPath(w, r, store)
+			if !ok {
+				return
+			}
+			if err := store.SoftDeleteEvent(ev.ID, auditActor(r), time.Now().Unix()); err != nil {
+				respondError(w, http.StatusInternalServerError, err)
+				return
+			}
+			recordAudit(store, r, "event.delete", fmt.Sprintf("event:%d", ev.ID), ev, nil)
+			alerts.Trigger()
+			hub.PublishMetrics(store)
+			gaps.Trigger()
+			respondJSON(w, map[string]string{"status": "success", "message": "数据删除成功"})
+		})
+
+		r.Post("/events/{id}/restore", func(w http.ResponseWriter, r *http.Request) {
+			ev, ok := eventFromPath(w, r, store)
+			if !ok {
+				return
+			}
+			if ev.DeletedTS == 0 {
+				respondError(w, http.StatusConflict, fmt.Errorf("事件未删除"))
+				return
+			}
+			if err := store.RestoreEvent(ev.ID); err != nil {
+				respondError(w, http.StatusInternalServerError, err)
+				return
+			}
+			recordAudit(store, r, "event.restore", fmt.Sprintf("event:%d", ev.ID), nil, ev)
+			alerts.Trigger()
+			hub.PublishMetrics(store)
+			gaps.Trigger()
+			respondJSON(w, map[string]string{"status": "ok"})
+		})
+
+		// 更正事件读数：统计时使用更正值，原始读数保留；再次更正会替换之前的更正
+		r.Put("/events/{id}/correction", func(w http.ResponseWriter, r *http.Request) {
+			ev, ok := activeEventFromPath(w, r, store)
+			if !ok {
+				return
+			}
+			var payload struct {
+				Count *int64 `json:"count"`
+				Note  string `json:"note"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+				respondError(w, http.StatusBadRequest, err)
+				return
+			}
+			if payload.Count == nil || *payload.Count < 0 {
+				respondError(w, http.StatusBadRequest, fmt.Errorf("请填写更正后的累计脉冲数"))
+				return
+			}
+			adj := EventAdjustment{
+				Kind:      adjustmentCorrect,
+				EventID:   ev.ID,
+				Count:     *payload.Count,
+				Note:      strings.TrimSpace(payload.Note),
+				CreatedBy: auditActor(r),
+				CreatedTS: time.Now().Unix(),
+			}
+			if len([]rune(adj.Note)) > maxEventNote {
+				respondError(w, http.StatusBadRequest, fmt.Errorf("备注不能超过 %d 个字符", maxEventNote))
+				return
+			}
+			id, err := store.CorrectEvent(adj)
+			if errors.Is(err, errEventDeleted) {
+				respondError(w, http.StatusConflict, err)
+				return
+			}
+			if err != nil {
+				respondError(w, http.StatusInternalServerError, err)
+				return
+			}
+			adj.ID = id
+			recordAudit(store, r, "event.correct", fmt.Sprintf("event:%d", ev.ID), ev, adj)
+			alerts.Trigger()
+			hub.PublishMetrics(store)
+			gaps.Trigger()
+			respondJSON(w, adj)
+		})
+
+		r.Delete("/events/{id}/correction", func(w http.ResponseWriter, r *http.Request) {
+			ev, ok := activeEventFromPath(w, r, store)
+			if !ok {
+				return
+			}
+			active, err := store.FetchAdjustments(AdjustmentFilter{Kind: adjustmentCorrect, EventID: ev.ID, Limit: 1})
+			if err != nil {
+				respondError(w, http.StatusInternalServerError, err)
+				return
+			}
+			if len(active) == 0 {
+				respondError(w, http.StatusNotFound, fmt.Errorf("该事件没有生效的更正"))
+				return
+			}
+			if err := store.RevokeAdjustment(active[0].ID, auditActor(r), time.Now().Unix()); err != nil {
+				respondError(w, http.StatusInternalServerError, err)
+				return
+			}
+			recordAudit(store, r, "event.adjustment_revoke", fmt.Sprintf("adjustment:%d", active[0].ID), active[0], nil)
+			alerts.Trigger()
+			hub.PublishMetrics(store)
+			gaps.Trigger()
+			respondJSON(w, map[string]string{"status": "ok"})
+		})
+
+		// 检测到的数据断档（传感器离线后重连时一次性上报的用量）
+		r.Get("/gaps", func(w http.ResponseWriter, r *http.Request) {
+			q := r.URL.Query()
+			limit := 100
+			if raw := q.Get("limit"); raw != "" {
+				if v, err := strconv.Atoi(raw); err == nil && v > 0 && v <= 1000 {
+					limit = v
+				}
+			}
+			loc := storeLocation(store)
+			var from, to int64
+			for param, dst := range map[string]*int64{"from": &from, "to": &to} {
+				if raw := q.Get(param); raw != "" {
+					t, err := parseTimeParam(raw, loc)
+					if err != nil {
+						respondError(w, http.StatusBadRequest, err)
+						return
+					}
+					*dst = t.Unix()
+				}
+			}
+			gapList, err := store.FetchGaps(from, to, limit)
+			if err != nil {
+				respondError(w, http.StatusInternalServerError, err)
+				return
+			}
+			if gapList == nil {
+				gapList = []EventGap{}
+			}
+			respondJSON(w, gapList)
+		})
+
+		// 调试接口仅在调试模式下开放
+		if cfg.Debug {
+			r.Route("/debug", debugRoutes(store, hub, alerts, gaps))
+		}
+
+		r.Post("/calibrate", func(w http.ResponseWriter, r *http.Request) {
+			var payload struct {
+				InitialGas     string `json:"initial_gas"`
+				MeterBaseM3    string `json:"meter_base_m3"`
+				DesiredMeterM3 string `json:"desired_meter_m3"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+				respondError(w, http.StatusBadRequest, err)
+				return
+			}
+			// 校准会改写以下配置，被配置文件或环境变量锁定时写入数据库也不会生效
+			for _, name := range []string{"initial_base_pulses", "initial_gas", "meter_base_m3", "desired_meter_m3"} {
+				if override, ok := store.SettingOverrides()[name]; ok {
+					respondError(w, http.StatusConflict, fmt.Errorf("%s 已由%s 锁定，无法校准", name, override))
+					return
+				}
+			}
+
+			settings, err := loadSettings(store)
+			if err != nil {
+				respondError(w, http.StatusInternalServerError, fmt.Errorf("加载设置失败: %v", err))
+				return
+			}
+
+			totalPulses, err := calcTotalPulsesByDelta(store)
+			if err != nil {
+				respondError(w, http.StatusInternalServerError, fmt.Errorf("计算总脉冲失败: %v", err))
+				return
+			}
+
+			if err := store.SetSetting("initial_gas_base_pulses", fmt.Sprintf("%d", totalPulses)); err != nil {
+				respondError(w, http.StatusInternalServerError, fmt.Errorf("更新基准脉冲失败: %v", err))
+				return
+			}
+			if err := store.SetSetting("calibrate_base_pulses", fmt.Sprintf("%d", totalPulses)); err != nil {
+				respondError(w, http.StatusInternalServerError, fmt.Errorf("保存校准基准脉冲失败: %v", err))
+				return
+			}
+
+			baseGasDecimal := parseDecimal(settings.InitialGas, defaultInitialGas)
+			if payload.InitialGas != "" {
+				baseGasDecimal = parseDecimal(payload.InitialGas, defaultInitialGas)
+				if err := store.SetSetting("initial_gas", payload.InitialGas); err != nil {
+					respondError(w, http.StatusInternalServerError, fmt.Errorf("更新初始燃气量失败: %v", err))
+					return
+				}
+			}
+
+			if payload.MeterBaseM3 != "" {
+				if err := store.SetSetting("meter_base_m3", payload.MeterBaseM3); err != nil {
+					respondError(w, http.StatusInternalServerError, fmt.Errorf("更新表底数失败: %v", err))
+					return
+				}
+			}
+
+			if payload.DesiredMeterM3 != "" {
+				if err := store.SetSetting("desired_meter_m3", payload.DesiredMeterM3); err != nil {
+					respondError(w, http.StatusInternalServerError, fmt.Errorf("更新目标读数失败: %v", err))
+					return
+				}
+			}
+
+			if payload.DesiredMeterM3 == "" && payload.MeterBaseM3 != "" {
+				if err := store.SetSetting("desired_meter_m3", payload.MeterBaseM3); err != nil {
+					respondError(w, http.StatusInternalServerError, fmt.Errorf("同步目标读数失败: %v", err))
+					return
+				}
+			}
+
+			if err := store.SetSetting("calibrate_base_gas", baseGasDecimal.String()); err != nil {
+				respondError(w, http.StatusInternalServerError, fmt.Errorf("保存校准基准燃气量失败: %v", err))
+				return
+			}
+
+			if err := store.SetSetting("calibrate_time", fmt.Sprintf("%d", time.Now().Unix())); err != nil {
+				respondError(w, http.StatusInternalServerError, fmt.Errorf("保存校准时间失败: %v", err))
+				return
+			}
+			calibrated := map[string]interface{}{
+				"base_pulses": totalPulses,
+				"base_gas":    baseGasDecimal.String(),
+			}
+			for key, value := range map[string]string{
+				"initial_gas":      payload.InitialGas,
+				"meter_base_m3":    payload.MeterBaseM3,
+				"desired_meter_m3": payload.DesiredMeterM3,
+			} {
+				if value != "" {
+					calibrated[key] = value
+				}
+			}
+			recordAudit(store, r, "calibrate", "settings", map[string]string{
+				"initial_gas":      settings.InitialGas,
+				"meter_base_m3":    settings.MeterBaseM3,
+				"desired_meter_m3": settings.DesiredMeterM3,
+			}, calibrated)
+			alerts.Trigger()
+			hub.PublishMetrics(store)
+
+			respondJSON(w, map[string]string{
+				"status":  "success",
+				"message": "校准完成",
+				"info":    fmt.Sprintf("校准基准已设置：基准脉冲=%d，基准燃气量=%s", totalPulses, baseGasDecimal.String()),
+			})
+		})
+
+		r.Post("/notify/test", func(w http.ResponseWriter, r *http.Request) {
+			settings, err := loadSettings(store)
+			if err != nil {
+				respondError(w, http.StatusInternalServerError, err)
+				return
+			}
+
+			if settings.TGBotToken == "" || settings.TGChatID == "" {
+				var missing []string
+				if settings.TGBotToken == "" {
+					missing = append(missing, "Bot Token")
+				}
+				if settings.TGChatID == "" {
+					missing = append(missing, "Chat ID")
+				}
+				respondError(w, http.StatusBadRequest, fmt.Errorf("telegram 未配置完整，缺少: %v", missing))
+				return
+			}
+
+			if !settings.TGEnabled {
+				respondError(w, http.StatusBadRequest, fmt.Errorf("telegram 通知未开启"))
+				return
+			}
+
+			msg := fmt.Sprintf("🧪 <b>测试通知</b>\n\n这是一条测试消息，用于验证 Telegram 通知配置是否正确。\n\n⏰ 发送时间：%s",
+				time.Now().In(loadLocation(settings.Timezone)).Format("2006-01-02 15:04:05"))
+			if err := outbox.SendNow(settings, channelTelegram, settings.TGChatID, notificationKindTest, msg); err != nil {
+				respondError(w, http.StatusBadRequest, fmt.Errorf("failed to send telegram notification: %v", err))
+				return
+			}
+			recordAudit(store, r, "notify.test", "telegram", nil, nil)
+			respondJSON(w, map[string]string{"status": "sent", "message": "测试通知已发送"})
+		})
+
+		// 预览或立即发送定期报告
+		r.Get("/reports/{kind}/preview", func(w http.ResponseWriter, r *http.Request) {
+			settings, err := loadSettings(store)
+			if err != nil {
+				respondError(w, http.StatusInternalServerError, err)
+				return
+			}
+			kind := chi.URLParam(r, "kind")
+			if kind != reportKindDaily && kind != reportKindWeekly && kind != reportKindMonthly {
+				respondError(w, http.StatusNotFound, fmt.Errorf("未知的报告类型: %s", kind))
+				return
+			}
+			message, err := renderReport(store, settings, kind, time.Now().In(loadLocation(settings.Timezone)))
+			if err != nil {
+				respondError(w, http.StatusBadRequest, err)
+				return
+			}
+			respondJSON(w, map[string]string{"kind": kind, "message": message})
+		})
+
+		r.Post("/reports/{kind}/send", func(w http.ResponseWriter, r *http.Request) {
+			settings, err := loadSettings(store)
+			if err != nil {
+				respondError(w, http.StatusInternalServerError, err)
+				return
+			}
+			kind := chi.URLParam(r, "kind")
+			if kind != reportKindDaily && kind != reportKindWeekly && kind != reportKindMonthly {
+				respondError(w, http.StatusNotFound, fmt.Errorf("未知的报告类型: %s", kind))
+				return
+			}
+			message, err := renderReport(store, settings, kind, time.Now().In(loadLocation(settings.Timezone)))
+			if err != nil {
+				respondError(w, http.StatusBadRequest, err)
+				return
+			}
+			if err := outbox.Enqueue(settings, []string{channelTelegram}, "report_"+kind, message); err != nil {
+				respondError(w, http.StatusBadRequest, err)
+				return
+			}
+			recordAudit(store, r, "report.send", "report:"+kind, nil, nil)
+			respondJSON(w, map[string]string{"status": "queued", "message": "报告已加入发送队列"})
+		})
+
+		// 设备远程命令：要求启用登录认证，所有命令记录在 device_commands 表中
+		r.Post("/devices/{device}/commands", func(w http.ResponseWriter, r *http.Request) {
+			claims := claimsFromRequest(r)
+			if claims == nil {
+				respondError(w, http.StatusForbidden, fmt.Errorf("设备命令需要启用登录认证并登录后使用"))
+				return
+			}
+
+			var payload struct {
+				Command    string                 `json:"command"`
+				Params     map[string]interface{} `json:"params"`
+				TimeoutSec int                    `json:"timeout_sec"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+				respondError(w, http.StatusBadRequest, err)
+				return
+			}
+			if err := validateDeviceCommand(payload.Command, payload.Params); err != nil {
+				respondError(w, http.StatusBadRequest, err)
+				return
+			}
+
+			device := chi.URLParam(r, "device")
+			if err := validateDeviceID(device); err != nil {
+				respondError(w, http.StatusBadRequest, err)
+				return
+			}
+			timeout := time.Duration(payload.TimeoutSec) * time.Second
+			cmd, err := worker.SendDeviceCommand(device, payload.Command, payload.Params, claims.Subject, r.RemoteAddr, timeout)
+			if err != nil {
+				respondError(w, http.StatusServiceUnavailable, err)
+				return
+			}
+			recordAudit(store, r, "device.command", "device:"+device, nil, cmd)
+			if cmd.Status == "timeout" {
+				w.Header().Set("Content-Type", "application/json; charset=utf-8")
+				w.WriteHeader(http.StatusGatewayTimeout)
+				_ = json.NewEncoder(w).Encode(cmd)
+				return
+			}
+			respondJSON(w, cmd)
+		})
+
+		r.Get("/devices/{device}/commands", func(w http.ResponseWriter, r *http.Request) {
+			if claimsFromRequest(r) == nil {
+				respondError(w, http.StatusForbidden, fmt.Errorf("设备命令需要启用登录认证并登录后使用"))
+				return
+			}
+			limit := 50
+			if raw := r.URL.Query().Get("limit"); raw != "" {
+				if v, err := strconv.Atoi(raw); err == nil && v > 0 {
+					limit = v
+				}
+			}
+			device := chi.URLParam(r, "device")
+			if err := validateDeviceID(device); err != nil {
+				respondError(w, http.StatusBadRequest, err)
+				return
+			}
+			cmds, err := store.FetchDeviceCommands(device, limit)
+			if err != nil {
+				respondError(w, http.StatusInternalServerError, err)
+				return
+			}
+			respondJSON(w, cmds)
+		})
+
+		// 用户管理
+		r.Get("/users", func(w http.ResponseWriter, r *http.Request) {
+			users, err := store.FetchUsers()
+			if err != nil {
+				respondError(w, http.StatusInternalServerError, err)
+				return
+			}
+			if users == nil {
+				users = []User{}
+			}
+			respondJSON(w, users)
+		})
+
+		r.Post("/users", func(w http.ResponseWriter, r *http.Request) {
+			var payload struct {
+				Username string `json:"username"`
+				Password string `json:"password"`
+				Role     string `json:"role"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+				respondError(w, http.StatusBadRequest, err)
+				return
+			}
+			payload.Username = strings.TrimSpace(payload.Username)
+			if err := validateUsername(payload.Username); err != nil {
+				respondError(w, http.StatusBadRequest, err)
+				return
+			}
+			if _, ok := roleRanks[payload.Role]; !ok {
+				respondError(w, http.StatusBadRequest, fmt.Errorf("无效的角色: %s", payload.Role))
+				return
+			}
+			if _, err := store.FetchUserByName(payload.Username); err == nil {
+				respondError(w, http.StatusConflict, fmt.Errorf("用户名已存在"))
+				return
+			}
+			hashed, err := hashPassword(payload.Password)
+			if err != nil {
+				respondError(w, http.StatusBadRequest, err)
+				return
+			}
+			user := User{Username: payload.Username, PasswordHash: hashed, Role: payload.Role}
+			if user.ID, err = store.InsertUser(user); err != nil {
+				respondError(w, http.StatusInternalServerError, err)
+				return
+			}
+			created, err := store.FetchUser(user.ID)
+			if err != nil {
+				respondError(w, http.StatusInternalServerError, err)
+				return
+			}
+			recordAudit(store, r, "user.create", fmt.Sprintf("user:%d", created.ID), nil, created)
+			respondJSON(w, created)
+		})
+
+		r.Put("/users/{id}", func(w http.ResponseWriter, r *http.Request) {
+			id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+			if err != nil {
+				respondError(w, http.StatusBadRequest, fmt.Errorf("无效的用户 ID"))
+				return
+			}
+			var payload struct {
+				Role     *string `json:"role"`
+				Password string  `json:"password"`
+				Disabled *bool   `json:"disabled"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+				respondError(w, http.StatusBadRequest, err)
+				return
+			}
+			user, err := store.FetchUser(id)
+			if err != nil {
+				if errors.Is(err, sql.ErrNoRows) {
+					respondError(w, http.StatusNotFound, fmt.Errorf("用户不存在"))
+					return
+				}
+				respondError(w, http.StatusInternalServerError, err)
+				return
+			}
+			original := user
+			wasActiveAdmin := user.Role == roleAdmin && !user.Disabled
+			if payload.Role != nil {
+				if _, ok := roleRanks[*payload.Role]; !ok {
+					respondError(w, http.StatusBadRequest, fmt.Errorf("无效的角色: %s", *payload.Role))
+					return
+				}
+				user.Role = *payload.Role
+			}
+			if payload.Disabled != nil {
+				user.Disabled = *payload.Disabled
+			}
+			if payload.Password != "" {
+				if user.PasswordHash, err = hashPassword(payload.Password); err != nil {
+					respondError(w, http.StatusBadRequest, err)
+					return
+				}
+			}
+			if wasActiveAdmin && (user.Role != roleAdmin || user.Disabled) {
+				if n, err := store.CountActiveAdmins(); err != nil || n <= 1 {
+					respondError(w, http.StatusBadRequest, fmt.Errorf("至少需要保留一个启用的管理员"))
+					return
+				}
+			}
+			if err := store.UpdateUser(user); err != nil {
+				respondError(w, http.StatusInternalServerError, err)
+				return
+			}
+			// 重置密码或停用后，该用户已有的会话全部失效
+			if payload.Password != "" || user.Disabled {
+				if err := store.RevokeUserSessions(id, time.Now().Unix()); err != nil {
+					respondError(w, http.StatusInternalServerError, err)
+					return
+				}
+			}
+			updated, err := store.FetchUser(id)
+			if err != nil {
+				respondError(w, http.StatusInternalServerError, err)
+				return
+			}
+			recordAuditDiff(store, r, "user.update", fmt.Sprintf("user:%d", id), original, struct {
+				User
+				Password string `json:"password,omitempty"`
+			}{updated, payload.Password})
+			respondJSON(w, updated)
+		})
+
+		// 外部身份关联：同名本地账号已存在时，外部登录需由管理员在此关联
+		r.Get("/users/{id}/identities", func(w http.ResponseWriter, r *http.Request) {
+			id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+			if err != nil {
+				respondError(w, http.StatusBadRequest, fmt.Errorf("无效的用户 ID"))
+				return
+			}
+			links, err := store.FetchUserExternalLinks(id)
+			if err != nil {
+				respondError(w, http.StatusInternalServerError, err)
+				return
+			}
+			respondJSON(w, links)
+		})
+
+		r.Post("/users/{id}/identities", func(w http.ResponseWriter, r *http.Request) {
+			id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+			if err != nil {
+				respondError(w, http.StatusBadRequest, fmt.Errorf("无效的用户 ID"))
+				return
+			}
+			var payload struct {
+				Provider string `json:"provider"`
+				Subject  string `json:"subject"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+				respondError(w, http.StatusBadRequest, err)
+				return
+			}
+			payload.Subject = strings.TrimSpace(payload.Subject)
+			if payload.Provider != "oidc" && payload.Provider != "proxy" {
+				respondError(w, http.StatusBadRequest, fmt.Errorf("provider 仅支持 oidc|proxy"))
+				return
+			}
+			if payload.Subject == "" {
+				respondError(w, http.StatusBadRequest, fmt.Errorf("请输入外部身份标识"))
+				return
+			}
+			if _, err := store.FetchUser(id); err != nil {
+				if errors.Is(err, sql.ErrNoRows) {
+					respondError(w, http.StatusNotFound, fmt.Errorf("用户不存在"))
+					return
+				}
+				respondError(w, http.StatusInternalServerError, err)
+				return
+			}
+			if existing, err := store.FetchExternalLink(payload.Provider, payload.Subject); err != nil {
+				respondError(w, http.StatusInternalServerError, err)
+				return
+			} else if existing != nil {
+				respondError(w, http.StatusConflict, fmt.Errorf("该外部身份已关联用户 %d", existing.UserID))
+				return
+			}
+			link := ExternalLink{Provider: payload.Provider, Subject: payload.Subject, UserID: id, CreatedTS: time.Now().Unix()}
+			if err := store.InsertExternalLink(link); err != nil {
+				respondError(w, http.StatusInternalServerError, err)
+				return
+			}
+			recordAudit(store, r, "user.identity_link", fmt.Sprintf("user:%d", id), nil, link)
+			respondJSON(w, link)
+		})
+
+		r.Delete("/users/{id}/identities/{provider}/{subject}", func(w http.ResponseWriter, r *http.Request) {
+			id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+			if err != nil {
+				respondError(w, http.StatusBadRequest, fmt.Errorf("无效的用户 ID"))
+				return
+			}
+			provider, subject := chi.URLParam(r, "provider"), chi.URLParam(r, "subject")
+			if err := store.DeleteExternalLink(id, provider, subject); err != nil {
+				if errors.Is(err, sql.ErrNoRows) {
+					respondError(w, http.StatusNotFound, fmt.Errorf("关联不存在"))
+					return
+				}
+				respondError(w, http.StatusInternalServerError, err)
+				return
+			}
+			_ = store.RevokeUserSessions(id, time.Now().Unix())
+			recordAudit(store, r, "user.identity_unlink", fmt.Sprintf("user:%d", id),
+				map[string]string{"provider": provider, "subject": subject}, nil)
+			respondJSON(w, map[string]string{"status": "ok"})
+		})
+
+		// 管理员为丢失手机的用户重置两步验证
+		r.Delete("/users/{id}/mfa", func(w http.ResponseWriter, r *http.Request) {
+			id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+			if err != nil {
+				respondError(w, http.StatusBadRequest, fmt.Errorf("无效的用户 ID"))
+				return
+			}
+			if _, err := store.FetchUser(id); err != nil {
+				if errors.Is(err, sql.ErrNoRows) {
+					respondError(w, http.StatusNotFound, fmt.Errorf("用户不存在"))
+					return
+				}
+				respondError(w, http.StatusInternalServerError, err)
+				return
+			}
+			if err := store.DeleteUserMFA(id); err != nil {
+				respondError(w, http.StatusInternalServerError, err)
+				return
+			}
+			_ = store.RevokeUserSessions(id, time.Now().Unix())
+			recordAudit(store, r, "user.mfa_reset", fmt.Sprintf("user:%d", id), nil, nil)
+			respondJSON(w, map[string]string{"status": "ok"})
+		})
+
+		r.Delete("/users/{id}", func(w http.ResponseWriter, r *http.Request) {
+			id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+			if err != nil {
+				respondError(w, http.StatusBadRequest, fmt.Errorf("无效的用户 ID"))
+				return
+			}
+			user, err := store.FetchUser(id)
+			if err != nil {
+				if errors.Is(err, sql.ErrNoRows) {
+					respondError(w, http.StatusNotFound, fmt.Errorf("用户不存在"))
+					return
+				}
+				respondError(w, http.StatusInternalServerError, err)
+				return
+			}
+			if user.Role == roleAdmin && !user.Disabled {
+				if n, err := store.CountActiveAdmins(); err != nil || n <= 1 {
+					respondError(w, http.StatusBadRequest, fmt.Errorf("至少需要保留一个启用的管理员"))
+					return
+				}
+			}
+			if err := store.DeleteUser(id); err != nil {
+				respondError(w, http.StatusInternalServerError, err)
+				return
+			}
+			_ = store.RevokeUserSessions(id, time.Now().Unix())
+			_ = store.DeleteUserMFA(id)
+			_ = store.DeleteUserExternalLinks(id)
+			recordAudit(store, r, "user.delete", fmt.Sprintf("user:%d", id), user, nil)
+			respondJSON(w, map[string]string{"status": "ok"})
+		})
+
+		// 登录尝试记录
+		r.Get("/login-attempts", func(w http.ResponseWriter, r *http.Request) {
+			limit := 100
+			if raw := r.URL.Query().Get("limit"); raw != "" {
+				if v, err := strconv.Atoi(raw); err == nil && v > 0 {
+					limit = v
+				}
+			}
+			attempts, err := store.FetchLoginAttempts(limit)
+			if err != nil {
+				respondError(w, http.StatusInternalServerError, err)
+				return
+			}
+			if attempts == nil {
+				attempts = []LoginAttempt{}
+			}
+			respondJSON(w, attempts)
+		})
+
+		// 审计日志：actor/action/target 精确匹配（action 以 . 结尾时按前缀匹配），from/to 为时间范围
+		r.Get("/audit", func(w http.ResponseWriter, r *http.Request) {
+			q := r.URL.Query()
+			filter := AuditFilter{
+				Actor:  strings.TrimSpace(q.Get("actor")),
+				Action: strings.TrimSpace(q.Get("action")),
+				Target: strings.TrimSpace(q.Get("target")),
+				Limit:  100,
+			}
+			if raw := q.Get("limit"); raw != "" {
+				if v, err := strconv.Atoi(raw); err == nil && v > 0 {
+					filter.Limit = v
+				}
+			}
+			if filter.Limit > 1000 {
+				filter.Limit = 1000
+			}
+			if raw := q.Get("offset"); raw != "" {
+				if v, err := strconv.Atoi(raw); err == nil && v > 0 {
+					filter.Offset = v
+				}
+			}
+			loc := storeLocation(store)
+			for param, dst := range map[string]*int64{"from": &filter.From, "to": &filter.To} {
+				if raw := q.Get(param); raw != "" {
+					t, err := parseTimeParam(raw, loc)
+					if err != nil {
+						respondError(w, http.StatusBadRequest, err)
+						return
+					}
+					*dst = t.Unix()
+				}
+			}
+			entries, err := store.FetchAuditLog(filter)
+			if err != nil {
+				respondError(w, http.StatusInternalServerError, err)
+				return
+			}
+			if entries == nil {
+				entries = []AuditEntry{}
+			}
+			respondJSON(w, entries)
+		})
+
+		// 登录会话
+		r.Get("/sessions", func(w http.ResponseWriter, r *http.Request) {
+			sessions, err := store.FetchActiveSessions(time.Now().Unix())
+			if err != nil {
+				respondError(w, http.StatusInternalServerError, err)
+				return
+			}
+			if sessions == nil {
+				sessions = []Session{}
+			}
+			respondJSON(w, sessions)
+		})
+
+		r.Delete("/sessions/{id}", func(w http.ResponseWriter, r *http.Request) {
+			if err := store.RevokeSession(chi.URLParam(r, "id"), time.Now().Unix()); err != nil {
+				if errors.Is(err, sql.ErrNoRows) {
+					respondError(w, http.StatusNotFound, fmt.Errorf("会话不存在或已撤销"))
+					return
+				}
+				respondError(w, http.StatusInternalServerError, err)
+				return
+			}
+			recordAudit(store, r, "session.revoke", "session:"+chi.URLParam(r, "id"), nil, nil)
+			respondJSON(w, map[string]string{"status": "ok"})
+		})
+
+		// API Token
+		r.Get("/tokens", func(w http.ResponseWriter, r *http.Request) {
+			tokens, err := store.FetchAPITokens()
+			if err != nil {
+				respondError(w, http.StatusInternalServerError, err)
+				return
+			}
+			if tokens == nil {
+				tokens = []APIToken{}
+			}
+			respondJSON(w, tokens)
+		})
+
+		r.Post("/tokens", func(w http.ResponseWriter, r *http.Request) {
+			var payload struct {
+				Name        string   `json:"name"`
+				Scopes      []string `json:"scopes"`
+				ExpiresDays int      `json:"expires_days"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+				respondError(w, http.StatusBadRequest, err)
+				return
+			}
+			createdBy := ""
+			if claims := claimsFromRequest(r); claims != nil {
+				createdBy = claims.Subject
+			}
+			token, plain, err := CreateAPIToken(store, payload.Name, payload.Scopes, payload.ExpiresDays, createdBy)
+			if err != nil {
+				respondError(w, http.StatusBadRequest, err)
+				return
+			}
+			recordAudit(store, r, "api_token.create", fmt.Sprintf("api_token:%d", token.ID), nil, token)
+			respondJSON(w, map[string]interface{}{
+				"token":   plain,
+				"details": token,
+			})
+		})
+
+		r.Delete("/tokens/{id}", func(w http.ResponseWriter, r *http.Request) {
+			id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+			if err != nil {
+				respondError(w, http.StatusBadRequest, fmt.Errorf("无效的 Token ID"))
+				return
+			}
+			if err := store.RevokeAPIToken(id, time.Now().Unix()); err != nil {
+				if errors.Is(err, sql.ErrNoRows) {
+					respondError(w, http.StatusNotFound, fmt.Errorf("Token 不存在或已撤销"))
+					return
+				}
+				respondError(w, http.StatusInternalServerError, err)
+				return
+			}
+			recordAudit(store, r, "api_token.revoke", fmt.Sprintf("api_token:%d", id), nil, nil)
+			respondJSON(w, map[string]string{"status": "ok"})
+		})
+
+		// JWT 签名密钥
+		r.Get("/admin/signing-keys", func(w http.ResponseWriter, r *http.Request) {
+			keys, err := store.FetchSigningKeys()
 			if err != nil {
 				respondError(w, http.StatusInternalServerError, err)
 				return
 			}
-			respondJSON(w, settings)
+			respondJSON(w, keys)
 		})
 
-		r.Put("/settings", func(w http.ResponseWriter, r *http.Request) {
-			var payload Settings
-			if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
-				respondError(w, http.StatusBadRequest, err)
-				return
-			}
-			if err := saveSettings(store, payload); err != nil {
+		r.Post("/admin/signing-keys/rotate", func(w http.ResponseWriter, r *http.Request) {
+			key, err := RotateSigningKey(store)
+			if err != nil {
 				respondError(w, http.StatusInternalServerError, err)
 				return
 			}
-			respondJSON(w, map[string]string{"status": "ok"})
+			recordAudit(store, r, "signing_key.rotate", "signing_key:"+key.KID, nil, key)
+			respondJSON(w, key)
 		})
 
-		r.Get("/metrics", func(w http.ResponseWriter, r *http.Request) {
-			metrics, err := computeMetrics(store)
+		// 人工抄表记录
+		r.Get("/readings", func(w http.ResponseWriter, r *http.Request) {
+			limit := 100
+			if raw := r.URL.Query().Get("limit"); raw != "" {
+				if v, err := strconv.Atoi(raw); err == nil && v > 0 {
+					limit = v
+				}
+			}
+			readings, err := store.FetchReadings(limit)
 			if err != nil {
 				respondError(w, http.StatusInternalServerError, err)
 				return
 			}
-			respondJSON(w, metrics)
+			for i := range readings {
+				drift := parseDecimal(readings[i].MeterM3, "0").Sub(parseDecimal(readings[i].SystemM3, "0"))
+				readings[i].DriftM3 = quantize3(drift).StringFixed(3)
+			}
+			if readings == nil {
+				readings = []Reading{}
+			}
+			respondJSON(w, readings)
 		})
 
-		r.Get("/hourly", func(w http.ResponseWriter, r *http.Request) {
-			now := time.Now().In(localTZ)
-			hourly, err := calcHourlyPulsesToday(store, now)
+		r.Post("/readings", func(w http.ResponseWriter, r *http.Request) {
+			var payload struct {
+				MeterM3 string `json:"meter_m3"`
+				Note    string `json:"note"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+				respondError(w, http.StatusBadRequest, err)
+				return
+			}
+			meter, err := decimal.NewFromString(strings.TrimSpace(payload.MeterM3))
+			if err != nil || meter.IsNegative() {
+				respondError(w, http.StatusBadRequest, fmt.Errorf("燃气表读数必须是非负数"))
+				return
+			}
+			settings, err := loadSettings(store)
 			if err != nil {
 				respondError(w, http.StatusInternalServerError, err)
 				return
 			}
-			respondJSON(w, hourly)
-		})
-
-		r.Get("/monthly", func(w http.ResponseWriter, r *http.Request) {
-			now := time.Now().In(localTZ)
-			monthly, err := calcMonthlyPulsesCurrentYear(store, now)
+			balance, err := computeGasBalance(store, settings)
 			if err != nil {
 				respondError(w, http.StatusInternalServerError, err)
 				return
 			}
-			respondJSON(w, monthly)
+			reading := Reading{
+				TS:       time.Now().Unix(),
+				MeterM3:  meter.String(),
+				SystemM3: balance.MeterReading.StringFixed(3),
+				DriftM3:  quantize3(meter.Sub(balance.MeterReading)).StringFixed(3),
+				Note:     payload.Note,
+			}
+			if claims := claimsFromRequest(r); claims != nil {
+				reading.CreatedBy = claims.Subject
+			}
+			if reading.ID, err = store.InsertReading(reading); err != nil {
+				respondError(w, http.StatusInternalServerError, err)
+				return
+			}
+			recordAudit(store, r, "reading.create", fmt.Sprintf("reading:%d", reading.ID), nil, reading)
+			respondJSON(w, reading)
 		})
 
-		r.Get("/recent", func(w http.ResponseWriter, r *http.Request) {
+		// 通知发送历史
+		r.Get("/notifications", func(w http.ResponseWriter, r *http.Request) {
+			q := r.URL.Query()
 			limit := 100
-			if raw := r.URL.Query().Get("limit"); raw != "" {
-				if v, err := strconv.Atoi(raw); err == nil {
+			if raw := q.Get("limit"); raw != "" {
+				if v, err := strconv.Atoi(raw); err == nil && v > 0 {
 					limit = v
 				}
 			}
-			recent, err := store.FetchRecentEvents(limit)
+			list, err := store.FetchNotifications(q.Get("status"), limit)
 			if err != nil {
 				respondError(w, http.StatusInternalServerError, err)
 				return
 			}
-			respondJSON(w, recent)
+			if list == nil {
+				list = []Notification{}
+			}
+			respondJSON(w, list)
 		})
 
-		r.Get("/debug/events", func(w http.ResponseWriter, r *http.Request) {
-			events, err := store.FetchAllEvents()
+		r.Get("/notifications/{id}", func(w http.ResponseWriter, r *http.Request) {
+			id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
 			if err != nil {
-				respondError(w, http.StatusInternalServerError, err)
+				respondError(w, http.StatusBadRequest, fmt.Errorf("无效的通知 ID"))
 				return
 			}
-			respondJSON(w, map[string]interface{}{
-				"total_events": len(events),
-				"latest_event": func() interface{} {
-					if len(events) > 0 {
-						return events[len(events)-1]
-					}
-					return nil
-				}(),
-				"recent_events": func() []Event {
-					if len(events) > 10 {
-						return events[len(events)-10:]
-					}
-					return events
-				}(),
-			})
-		})
-
-		r.Get("/debug/metrics", func(w http.ResponseWriter, r *http.Request) {
-			settings, err := loadSettings(store)
+			n, err := store.FetchNotification(id)
 			if err != nil {
+				if errors.Is(err, sql.ErrNoRows) {
+					respondError(w, http.StatusNotFound, fmt.Errorf("通知不存在"))
+					return
+				}
 				respondError(w, http.StatusInternalServerError, err)
 				return
 			}
-
-			now := time.Now().In(localTZ)
-			todayStart := startOfDay(now)
-
-			todayPulses, _ := calcUsagePulsesByDelta(store, todayStart, now)
-			totalPulses, _ := calcTotalPulsesByDelta(store)
-			hourly, _ := calcHourlyPulsesToday(store, now)
-
-			respondJSON(w, map[string]interface{}{
-				"settings":     settings,
-				"now":          now.Format("2006-01-02 15:04:05"),
-				"today_start":  todayStart.Format("2006-01-02 15:04:05"),
-				"today_pulses": todayPulses,
-				"total_pulses": totalPulses,
-				"hourly_data":  hourly,
-			})
+			respondJSON(w, n)
 		})
 
-		r.Post("/debug/insert-event", func(w http.ResponseWriter, r *http.Request) {
-			var payload struct {
-				Timestamp int64 `json:"timestamp"`
-				Count     int64 `json:"count"`
-			}
-			if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
-				respondError(w, http.StatusBadRequest, err)
+		r.Post("/notifications/{id}/retry", func(w http.ResponseWriter, r *http.Request) {
+			id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+			if err != nil {
+				respondError(w, http.StatusBadRequest, fmt.Errorf("无效的通知 ID"))
 				return
 			}
-			if err := store.InsertEvent(payload.Timestamp, payload.Count); err != nil {
+			if err := outbox.Retry(id); err != nil {
+				if errors.Is(err, sql.ErrNoRows) {
+					respondError(w, http.StatusNotFound, fmt.Errorf("通知不存在或不是失败状态"))
+					return
+				}
 				respondError(w, http.StatusInternalServerError, err)
 				return
 			}
-			respondJSON(w, map[string]string{"status": "success", "message": "数据插入成功"})
+			recordAudit(store, r, "notification.retry", fmt.Sprintf("notification:%d", id), nil, nil)
+			respondJSON(w, map[string]string{"status": "queued"})
 		})
 
-		r.Post("/debug/delete-event", func(w http.ResponseWriter, r *http.Request) {
-			var payload struct {
-				Timestamp int64 `json:"timestamp"`
-				Count     int64 `json:"count"`
-			}
-			if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
-				respondError(w, http.StatusBadRequest, err)
-				return
+		// 充值记录
+		r.Get("/topups", func(w http.ResponseWriter, r *http.Request) {
+			limit := 100
+			if raw := r.URL.Query().Get("limit"); raw != "" {
+				if v, err := strconv.Atoi(raw); err == nil && v > 0 {
+					limit = v
+				}
 			}
-			_, err := store.db.Exec(`DELETE FROM events WHERE ts = ? AND count = ?`, payload.Timestamp, payload.Count)
+			topups, err := store.FetchTopups(limit)
 			if err != nil {
 				respondError(w, http.StatusInternalServerError, err)
 				return
 			}
-			respondJSON(w, map[string]string{"status": "success", "message": "数据删除成功"})
+			if topups == nil {
+				topups = []Topup{}
+			}
+			respondJSON(w, topups)
 		})
 
-		r.Post("/debug/batch-insert-events", func(w http.ResponseWriter, r *http.Request) {
+		r.Post("/topups", func(w http.ResponseWriter, r *http.Request) {
 			var payload struct {
-				Events []struct {
-					Timestamp int64 `json:"timestamp"`
-					Count     int64 `json:"count"`
-				} `json:"events"`
+				Amount string `json:"amount"`
+				Note   string `json:"note"`
+				TS     int64  `json:"ts"`
 			}
 			if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
 				respondError(w, http.StatusBadRequest, err)
 				return
 			}
-
-			tx, err := store.db.Begin()
-			if err != nil {
-				respondError(w, http.StatusInternalServerError, err)
+			amount, err := decimal.NewFromString(strings.TrimSpace(payload.Amount))
+			if err != nil || !amount.IsPositive() || amount.GreaterThan(decimal.NewFromInt(maxTopupAmount)) {
+				respondError(w, http.StatusBadRequest, fmt.Errorf("充值量必须是 0 到 %d 之间的数字", maxTopupAmount))
 				return
 			}
-
-			for _, event := range payload.Events {
-				if _, err := tx.Exec(`INSERT INTO events(ts, count, received_ts) VALUES(?, ?, ?)`,
-					event.Timestamp, event.Count, time.Now().Unix()); err != nil {
-					tx.Rollback()
-					respondError(w, http.StatusInternalServerError, err)
-					return
-				}
+			if payload.TS == 0 {
+				payload.TS = time.Now().Unix()
 			}
-
-			if err := tx.Commit(); err != nil {
+			topup := Topup{TS: payload.TS, Amount: amount.String(), Source: "web", Note: payload.Note}
+			if claims := claimsFromRequest(r); claims != nil {
+				topup.CreatedBy = claims.Subject
+			}
+			if topup.ID, err = store.InsertTopup(topup); err != nil {
 				respondError(w, http.StatusInternalServerError, err)
 				return
 			}
-
-			respondJSON(w, map[string]interface{}{
-				"status":  "success",
-				"message": "批量插入成功",
-				"count":   len(payload.Events),
-			})
+			recordAudit(store, r, "topup.create", fmt.Sprintf("topup:%d", topup.ID), nil, topup)
+			alerts.Trigger()
+			hub.PublishMetrics(store)
+			respondJSON(w, topup)
 		})
 
-		r.Post("/debug/clear-events", func(w http.ResponseWriter, r *http.Request) {
-			_, err := store.db.Exec(`DELETE FROM events`)
+		// 预警规则
+		r.Get("/alerts/rules", func(w http.ResponseWriter, r *http.Request) {
+			rules, err := store.FetchAlertRules()
 			if err != nil {
 				respondError(w, http.StatusInternalServerError, err)
 				return
 			}
-			respondJSON(w, map[string]string{"status": "success", "message": "所有数据已清空"})
+			if rules == nil {
+				rules = []AlertRule{}
+			}
+			respondJSON(w, rules)
 		})
 
-		r.Post("/calibrate", func(w http.ResponseWriter, r *http.Request) {
-			var payload struct {
-				InitialGas     string `json:"initial_gas"`
-				MeterBaseM3    string `json:"meter_base_m3"`
-				DesiredMeterM3 string `json:"desired_meter_m3"`
+		r.Post("/alerts/rules", func(w http.ResponseWriter, r *http.Request) {
+			rule := AlertRule{Enabled: true}
+			if err := json.NewDecoder(r.Body).Decode(&rule); err != nil {
+				respondError(w, http.StatusBadRequest, err)
+				return
 			}
-			if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			if err := normalizeAlertRule(&rule); err != nil {
 				respondError(w, http.StatusBadRequest, err)
 				return
 			}
-
-			settings, err := loadSettings(store)
+			id, err := store.InsertAlertRule(rule)
 			if err != nil {
-				respondError(w, http.StatusInternalServerError, fmt.Errorf("加载设置失败: %v", err))
+				respondError(w, http.StatusInternalServerError, err)
 				return
 			}
-
-			totalPulses, err := calcTotalPulsesByDelta(store)
+			created, err := store.FetchAlertRule(id)
 			if err != nil {
-				respondError(w, http.StatusInternalServerError, fmt.Errorf("计算总脉冲失败: %v", err))
+				respondError(w, http.StatusInternalServerError, err)
 				return
 			}
+			recordAudit(store, r, "alert_rule.create", fmt.Sprintf("alert_rule:%d", id), nil, created)
+			alerts.Trigger()
+			respondJSON(w, created)
+		})
 
-			if err := store.SetSetting("initial_gas_base_pulses", fmt.Sprintf("%d", totalPulses)); err != nil {
-				respondError(w, http.StatusInternalServerError, fmt.Errorf("更新基准脉冲失败: %v", err))
+		r.Put("/alerts/rules/{id}", func(w http.ResponseWriter, r *http.Request) {
+			id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+			if err != nil {
+				respondError(w, http.StatusBadRequest, fmt.Errorf("无效的规则 ID"))
 				return
 			}
-			if err := store.SetSetting("calibrate_base_pulses", fmt.Sprintf("%d", totalPulses)); err != nil {
-				respondError(w, http.StatusInternalServerError, fmt.Errorf("保存校准基准脉冲失败: %v", err))
+			var rule AlertRule
+			if err := json.NewDecoder(r.Body).Decode(&rule); err != nil {
+				respondError(w, http.StatusBadRequest, err)
 				return
 			}
-
-			baseGasDecimal := parseDecimal(settings.InitialGas, defaultInitialGas)
-			if payload.InitialGas != "" {
-				baseGasDecimal = parseDecimal(payload.InitialGas, defaultInitialGas)
-				if err := store.SetSetting("initial_gas", payload.InitialGas); err != nil {
-					respondError(w, http.StatusInternalServerError, fmt.Errorf("更新初始燃气量失败: %v", err))
-					return
-				}
+			rule.ID = id
+			if err := normalizeAlertRule(&rule); err != nil {
+				respondError(w, http.StatusBadRequest, err)
+				return
 			}
-
-			if payload.MeterBaseM3 != "" {
-				if err := store.SetSetting("meter_base_m3", payload.MeterBaseM3); err != nil {
-					respondError(w, http.StatusInternalServerError, fmt.Errorf("更新表底数失败: %v", err))
+			original, _ := store.FetchAlertRule(id)
+			if err := store.UpdateAlertRule(rule); err != nil {
+				if errors.Is(err, sql.ErrNoRows) {
+					respondError(w, http.StatusNotFound, fmt.Errorf("规则不存在"))
 					return
 				}
+				respondError(w, http.StatusInternalServerError, err)
+				return
 			}
-
-			if payload.DesiredMeterM3 != "" {
-				if err := store.SetSetting("desired_meter_m3", payload.DesiredMeterM3); err != nil {
-					respondError(w, http.StatusInternalServerError, fmt.Errorf("更新目标读数失败: %v", err))
-					return
-				}
+			updated, err := store.FetchAlertRule(id)
+			if err != nil {
+				respondError(w, http.StatusInternalServerError, err)
+				return
 			}
+			recordAuditDiff(store, r, "alert_rule.update", fmt.Sprintf("alert_rule:%d", id), original, updated)
+			alerts.Trigger()
+			respondJSON(w, updated)
+		})
 
-			if payload.DesiredMeterM3 == "" && payload.MeterBaseM3 != "" {
-				if err := store.SetSetting("desired_meter_m3", payload.MeterBaseM3); err != nil {
-					respondError(w, http.StatusInternalServerError, fmt.Errorf("同步目标读数失败: %v", err))
+		r.Delete("/alerts/rules/{id}", func(w http.ResponseWriter, r *http.Request) {
+			id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+			if err != nil {
+				respondError(w, http.StatusBadRequest, fmt.Errorf("无效的规则 ID"))
+				return
+			}
+			original, _ := store.FetchAlertRule(id)
+			if err := store.DeleteAlertRule(id); err != nil {
+				if errors.Is(err, sql.ErrNoRows) {
+					respondError(w, http.StatusNotFound, fmt.Errorf("规则不存在"))
 					return
 				}
-			}
-
-			if err := store.SetSetting("calibrate_base_gas", baseGasDecimal.String()); err != nil {
-				respondError(w, http.StatusInternalServerError, fmt.Errorf("保存校准基准燃气量失败: %v", err))
+				respondError(w, http.StatusInternalServerError, err)
 				return
 			}
-
-			if err := store.SetSetting("calibrate_time", fmt.Sprintf("%d", time.Now().Unix())); err != nil {
-				respondError(w, http.StatusInternalServerError, fmt.Errorf("保存校准时间失败: %v", err))
+			if err := store.ResolveAlertsForRule(id, time.Now().Unix()); err != nil {
+				respondError(w, http.StatusInternalServerError, err)
 				return
 			}
-
-			respondJSON(w, map[string]string{
-				"status":  "success",
-				"message": "校准完成",
-				"info":    fmt.Sprintf("校准基准已设置：基准脉冲=%d，基准燃气量=%s", totalPulses, baseGasDecimal.String()),
-			})
+			recordAudit(store, r, "alert_rule.delete", fmt.Sprintf("alert_rule:%d", id), original, nil)
+			respondJSON(w, map[string]string{"status": "ok"})
 		})
 
-		r.Post("/notify/test", func(w http.ResponseWriter, r *http.Request) {
-			settings, err := loadSettings(store)
+		r.Get("/alerts/history", func(w http.ResponseWriter, r *http.Request) {
+			q := r.URL.Query()
+			limit := 100
+			if raw := q.Get("limit"); raw != "" {
+				if v, err := strconv.Atoi(raw); err == nil && v > 0 {
+					limit = v
+				}
+			}
+			ruleID, _ := strconv.ParseInt(q.Get("rule_id"), 10, 64)
+			history, err := store.FetchAlertHistory(ruleID, q.Get("active") == "1" || q.Get("active") == "true", limit)
 			if err != nil {
 				respondError(w, http.StatusInternalServerError, err)
 				return
 			}
-
-			if settings.TGBotToken == "" || settings.TGChatID == "" {
-				var missing []string
-				if settings.TGBotToken == "" {
-					missing = append(missing, "Bot Token")
-				}
-				if settings.TGChatID == "" {
-					missing = append(missing, "Chat ID")
-				}
-				respondError(w, http.StatusBadRequest, fmt.Errorf("telegram 未配置完整，缺少: %v", missing))
-				return
+			if history == nil {
+				history = []AlertHistory{}
 			}
+			respondJSON(w, history)
+		})
 
-			if !settings.TGEnabled {
-				respondError(w, http.StatusBadRequest, fmt.Errorf("telegram 通知未开启"))
+		r.Post("/alerts/history/{id}/ack", func(w http.ResponseWriter, r *http.Request) {
+			id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+			if err != nil {
+				respondError(w, http.StatusBadRequest, fmt.Errorf("无效的预警 ID"))
 				return
 			}
-
-			msg := fmt.Sprintf("🧪 <b>测试通知</b>\n\n这是一条测试消息，用于验证 Telegram 通知配置是否正确。\n\n⏰ 发送时间：%s",
-				time.Now().In(localTZ).Format("2006-01-02 15:04:05"))
-			if err := sendTelegramNotification(settings.TGBotToken, settings.TGChatID, msg, settings.TGAPIEndpoint); err != nil {
-				respondError(w, http.StatusBadRequest, fmt.Errorf("failed to send telegram notification: %v", err))
+			ackedBy := "anonymous"
+			if claims := claimsFromRequest(r); claims != nil {
+				ackedBy = claims.Subject
+			}
+			h, err := store.AckAlert(id, ackedBy)
+			if err != nil {
+				if errors.Is(err, sql.ErrNoRows) {
+					respondError(w, http.StatusNotFound, fmt.Errorf("预警记录不存在"))
+					return
+				}
+				respondError(w, http.StatusInternalServerError, err)
 				return
 			}
-			respondJSON(w, map[string]string{"status": "sent", "message": "测试通知已发送"})
+			recordAudit(store, r, "alert.ack", fmt.Sprintf("alert:%d", id), nil, nil)
+			respondJSON(w, h)
 		})
 	})
 
-	addr := getenv("GAS_SERVER_ADDR", ":8080")
-	log.Printf("server listening on %s", addr)
-	if err := http.ListenAndServe(addr, r); err != nil {
+	log.Printf("server listening on %s", cfg.ServerAddr)
+	if err := http.ListenAndServe(cfg.ServerAddr, r); err != nil {
 		log.Fatalf("server error: %v", err)
 	}
 }
@@ -605,12 +2333,15 @@ func computeMetrics(store *Store) (Metrics, error) {
 		return Metrics{}, err
 	}
 	gasPerPulse := parseDecimal(settings.GasPerPulse, defaultGasPerPulse)
-	initialGas := parseDecimal(settings.InitialGas, defaultInitialGas)
 
-	now := time.Now().In(localTZ)
+	loc := loadLocation(settings.Timezone)
+	now := time.Now().In(loc)
+	rules := periodRulesFromSettings(settings)
 	todayStart := startOfDay(now)
-	weekStart := startOfWeek(now)
+	weekStart := startOfWeek(now, rules.WeekStart)
 	monthStart := startOfMonth(now)
+	bill := billingPeriodFor(now, rules)
+	tierYear := billingYearFor(now, rules)
 
 	todayPulses, err := calcUsagePulsesByDelta(store, todayStart, now)
 	if err != nil {
@@ -624,128 +2355,122 @@ func computeMetrics(store *Store) (Metrics, error) {
 	if err != nil {
 		return Metrics{}, err
 	}
-	totalPulses, err := calcTotalPulsesByDelta(store)
+	billPulses, err := calcUsagePulsesByDelta(store, bill.Start, now)
 	if err != nil {
 		return Metrics{}, err
 	}
-
-	calibrateTimeStr, _ := store.GetSetting("calibrate_time", "0")
-	calibrateTime, _ := strconv.ParseInt(calibrateTimeStr, 10, 64)
-
-	baseGas := initialGas
-	if calibrateTime > 0 {
-		if baseGasStr, err := store.GetSetting("calibrate_base_gas", baseGas.String()); err == nil {
-			baseGas = parseDecimal(baseGasStr, baseGas.String())
-		}
-	}
-
-	basePulses := settings.InitialBasePulses
-	if calibrateTime > 0 {
-		if basePulsesStr, err := store.GetSetting("calibrate_base_pulses", fmt.Sprintf("%d", basePulses)); err == nil {
-			if v, err := strconv.ParseInt(basePulsesStr, 10, 64); err == nil {
-				basePulses = v
-			}
-		}
+	tierYearPulses, err := calcUsagePulsesByDelta(store, tierYear.Start, now)
+	if err != nil {
+		return Metrics{}, err
 	}
-
-	usedSinceBase := totalPulses - basePulses
-	if usedSinceBase < 0 {
-		usedSinceBase = 0
+	balance, err := computeGasBalance(store, settings)
+	if err != nil {
+		return Metrics{}, err
 	}
-	usedSinceBaseGas := quantize3(pulsesToGas(usedSinceBase, gasPerPulse))
-
-	desiredMeter := parseDecimal(settings.DesiredMeterM3, defaultMeterBase)
-	meterReading := quantize3(desiredMeter.Add(usedSinceBaseGas))
-	remain := quantize3(baseGas.Sub(usedSinceBaseGas))
+	remain := balance.Remain
 
 	mqttStatus, _ := store.GetSetting("mqtt_status", "not_started")
 	lastMsgTS, _ := store.GetSetting("last_msg_ts", "")
 	lastMsgTime := ""
 	if lastMsgTS != "" {
 		if ts, err := strconv.ParseInt(lastMsgTS, 10, 64); err == nil {
-			lastMsgTime = time.Unix(ts, 0).In(localTZ).Format("2006-01-02 15:04:05")
+			lastMsgTime = time.Unix(ts, 0).In(loc).Format("2006-01-02 15:04:05")
+		}
+	}
+
+	forecast, err := forecastDepletion(store, settings, remain, now)
+	if err != nil {
+		return Metrics{}, err
+	}
+	dailyAvgGas, daysLeft, emptyDate := "", "", ""
+	if forecast.Available {
+		dailyAvgGas = quantize3(forecast.DailyAvgGas).StringFixed(3)
+		if forecast.DaysUntilEmpty >= 0 {
+			daysLeft = decimal.NewFromFloat(forecast.DaysUntilEmpty).StringFixed(1)
+			emptyDate = forecast.EmptyDate.Format("2006-01-02")
 		}
 	}
 
+	billGas := quantize3(pulsesToGas(billPulses, gasPerPulse))
 	metrics := Metrics{
 		TodayGas:     quantize3(pulsesToGas(todayPulses, gasPerPulse)).StringFixed(3),
 		WeekGas:      quantize3(pulsesToGas(weekPulses, gasPerPulse)).StringFixed(3),
 		MonthGas:     quantize3(pulsesToGas(monthPulses, gasPerPulse)).StringFixed(3),
-		TotalUsedGas: quantize3(pulsesToGas(totalPulses, gasPerPulse)).StringFixed(3),
-		MeterReading: meterReading.StringFixed(3),
+		BillGas:      billGas.StringFixed(3),
+		BillCost:     billGas.Mul(parseDecimal(settings.GasPrice, defaultGasPrice)).StringFixed(2),
+		BillStart:    bill.Start.Format("2006-01-02"),
+		BillEnd:      bill.End.AddDate(0, 0, -1).Format("2006-01-02"),
+		TierYearGas:  quantize3(pulsesToGas(tierYearPulses, gasPerPulse)).StringFixed(3),
+		TotalUsedGas: quantize3(pulsesToGas(balance.TotalPulses, gasPerPulse)).StringFixed(3),
+		MeterReading: balance.MeterReading.StringFixed(3),
 		RemainGas:    remain.StringFixed(3),
+		DailyAvgGas:  dailyAvgGas,
+		DaysLeft:     daysLeft,
+		EmptyDate:    emptyDate,
 		MQTTStatus:   mqttStatus,
 		LastMsgTime:  lastMsgTime,
 	}
 
-	checkAndNotifyLowGas(store, settings, remain)
-
 	return metrics, nil
 }
 
-func saveSettings(store *Store, payload Settings) error {
-	if err := store.SetSetting("gas_per_pulse", payload.GasPerPulse); err != nil {
-		return err
-	}
-	if err := store.SetSetting("initial_gas", payload.InitialGas); err != nil {
-		return err
-	}
-	if err := store.SetSetting("initial_gas_base_pulses", fmt.Sprintf("%d", payload.InitialBasePulses)); err != nil {
-		return err
-	}
-	if err := store.SetSetting("meter_base_m3", payload.MeterBaseM3); err != nil {
-		return err
-	}
-	if err := store.SetSetting("desired_meter_m3", payload.DesiredMeterM3); err != nil {
-		return err
-	}
-	if err := store.SetSetting("auth_enabled", boolToString(payload.AuthEnabled)); err != nil {
-		return err
-	}
-	if err := store.SetSetting("mqtt_host", payload.MQTTHost); err != nil {
-		return err
-	}
-	if err := store.SetSetting("mqtt_port", fmt.Sprintf("%d", payload.MQTTPort)); err != nil {
-		return err
-	}
-	if err := store.SetSetting("mqtt_user", payload.MQTTUser); err != nil {
-		return err
-	}
-	if err := store.SetSetting("mqtt_pass", payload.MQTTPassword); err != nil {
-		return err
-	}
-	if err := store.SetSetting("mqtt_topic", payload.MQTTTopic); err != nil {
-		return err
-	}
-	if err := store.SetSetting("mqtt_tls", boolToString(payload.MQTTTLS)); err != nil {
-		return err
-	}
-	if err := store.SetSetting("mqtt_tls_insecure", boolToString(payload.MQTTTLSInsecure)); err != nil {
-		return err
-	}
-	if err := store.SetSetting("tg_notify_enabled", boolToString(payload.TGEnabled)); err != nil {
-		return err
-	}
-	if err := store.SetSetting("tg_bot_token", payload.TGBotToken); err != nil {
-		return err
-	}
-	if err := store.SetSetting("tg_chat_id", payload.TGChatID); err != nil {
-		return err
-	}
-	if err := store.SetSetting("tg_api_endpoint", payload.TGAPIEndpoint); err != nil {
-		return err
-	}
-	if err := store.SetSetting("tg_threshold", payload.TGThreshold); err != nil {
-		return err
-	}
-	if err := store.SetSetting("tg_notify_times", fmt.Sprintf("%d", payload.TGNotifyTimes)); err != nil {
-		return err
-	}
-	if err := store.SetSetting("tg_notify_interval_hours", payload.TGNotifyIntervalHour); err != nil {
-		return err
+// PUT 完整替换、PATCH 部分更新配置；校验失败时返回 400 和逐字段的错误信息
+func settingsUpdateHandler(store *Store, replace bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]json.RawMessage
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			respondError(w, http.StatusBadRequest, err)
+			return
+		}
+		before, err := loadSettings(store)
+		if err != nil {
+			respondError(w, http.StatusInternalServerError, err)
+			return
+		}
+		after, errs := applySettingsPatch(before, body, replace, store.SettingOverrides())
+		for name, msg := range validateSettings(before, after) {
+			if _, ok := errs[name]; !ok {
+				if errs == nil {
+					errs = settingsErrors{}
+				}
+				errs[name] = msg
+			}
+		}
+		if errs != nil {
+			respondSettingsErrors(w, errs)
+			return
+		}
+		changed, err := saveSettings(store, before, after)
+		if err != nil {
+			respondError(w, http.StatusInternalServerError, err)
+			return
+		}
+		if len(changed) > 0 {
+			recordAuditDiff(store, r, "settings.update", "settings", before, after)
+			notifySettingsChange(changed, after)
+		}
+		if changed == nil {
+			changed = []string{}
+		}
+		respondJSON(w, map[string]interface{}{"status": "ok", "changed": changed})
 	}
+}
 
-	return nil
+func respondSettingsErrors(w http.ResponseWriter, errs settingsErrors) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(http.StatusBadRequest)
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{"error": errs.Error(), "fields": errs})
+}
+
+// 命令行子命令，执行完毕后退出而不启动服务
+func runCommand(cfg startupConfig, name string, args []string) error {
+	switch name {
+	case "rotate-master-key":
+		return rotateMasterKey(cfg.DBPath, args)
+	case "dump-config":
+		return dumpConfig(cfg, args)
+	}
+	return fmt.Errorf("未知命令，可用命令: rotate-master-key, dump-config")
 }
 
 func boolToString(v bool) string {
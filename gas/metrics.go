@@ -1,6 +1,9 @@
 package main
 
 import (
+	"fmt"
+	"sort"
+	"strconv"
 	"time"
 
 	"github.com/shopspring/decimal"
@@ -17,31 +20,121 @@ func normalizeDelta(prev *int64, cur int64) int64 {
 	return delta
 }
 
-func calcUsagePulsesByDelta(store *Store, start, end time.Time) (int64, error) {
-	startTS := start.Unix()
-	endTS := end.Unix()
+// 一段时间内的用气脉冲：事件增量落在事件时刻（Start == End），
+// 补录的漏计脉冲均匀分布在 [Start, End)
+type pulseSpan struct {
+	Start  int64
+	End    int64
+	Pulses int64
+}
 
-	prev, err := store.FetchPrevCountBefore(startTS)
+// 统计 [start, end) 所需的脉冲来源：区间内的事件增量及与区间重叠的补录脉冲。
+// gapMode 不为 none 时，断档的增量分布到整个离线期间，包括从区间外开始或结束的断档
+func loadPulseSpans(store *Store, start, end time.Time, gapMode string) ([]pulseSpan, error) {
+	startTS, endTS := start.Unix(), end.Unix()
+	prev, err := store.FetchPrevEventBefore(startTS)
 	if err != nil {
-		return 0, err
+		return nil, err
 	}
 	rows, err := store.FetchEventsInRange(startTS, endTS)
 	if err != nil {
-		return 0, err
+		return nil, err
+	}
+	missing, err := store.FetchMissingPulses(startTS, endTS)
+	if err != nil {
+		return nil, err
+	}
+
+	var threshold int64
+	var profile *usageProfile
+	if gapMode != gapModeNone {
+		threshold = gapThreshold(store)
+		// 结束于区间之后的断档也有一部分属于本区间
+		next, err := store.FetchNextEventFrom(endTS)
+		if err != nil {
+			return nil, err
+		}
+		if next != nil {
+			rows = append(rows, *next)
+		}
+		if gapMode == gapModeProfile {
+			profileEnd := end
+			if now := time.Now().In(end.Location()); now.Before(profileEnd) {
+				profileEnd = now
+			}
+			if profile, err = loadUsageProfile(store, profileEnd, threshold); err != nil {
+				return nil, err
+			}
+		}
 	}
 
-	var pulses int64
-	prevCount := prev
+	spans := make([]pulseSpan, 0, len(rows)+len(missing))
 	for _, row := range rows {
-		d := normalizeDelta(prevCount, row.Count)
-		pulses += d
-		c := row.Count
-		prevCount = &c
+		var d int64
+		if prev != nil {
+			d = normalizeDelta(&prev.Count, row.Count)
+		}
+		switch {
+		case d == 0:
+		case gapMode != gapModeNone && isGap(prev.Timestamp, row.Timestamp, d, threshold):
+			gap := pulseSpan{Start: prev.Timestamp, End: row.Timestamp, Pulses: d}
+			if profile != nil {
+				if parts := profile.split(gap, start.Location()); parts != nil {
+					spans = append(spans, parts...)
+					break
+				}
+			}
+			spans = append(spans, gap)
+		default:
+			spans = append(spans, pulseSpan{Start: row.Timestamp, End: row.Timestamp, Pulses: d})
+		}
+		row := row
+		prev = &row
 	}
-	if pulses < 0 {
+	for _, adj := range missing {
+		spans = append(spans, pulseSpan{Start: adj.StartTS, End: adj.EndTS, Pulses: adj.Pulses})
+	}
+	return spans, nil
+}
+
+// 将脉冲分配到 edges 划分的桶中，edges 之外的部分舍弃。跨桶的脉冲按时长比例分配，
+// 按累计值取整，整段落在 edges 内时各桶之和等于总数
+func distributePulses(spans []pulseSpan, edges []int64) []int64 {
+	if len(edges) < 2 {
+		return nil
+	}
+	buckets := make([]int64, len(edges)-1)
+	for _, sp := range spans {
+		// 第一个结束边界大于起点的桶
+		idx := sort.Search(len(buckets), func(i int) bool {
+			return edges[i+1] > sp.Start
+		})
+		if sp.End <= sp.Start {
+			if idx < len(buckets) && sp.Start >= edges[0] {
+				buckets[idx] += sp.Pulses
+			}
+			continue
+		}
+		dur := sp.End - sp.Start
+		for i := idx; i < len(buckets) && edges[i] < sp.End; i++ {
+			lo, hi := max(edges[i], sp.Start), min(edges[i+1], sp.End)
+			if hi > lo {
+				buckets[i] += sp.Pulses*(hi-sp.Start)/dur - sp.Pulses*(lo-sp.Start)/dur
+			}
+		}
+	}
+	return buckets
+}
+
+func calcUsagePulsesByDelta(store *Store, start, end time.Time) (int64, error) {
+	buckets, err := calcBucketedPulses(store, []time.Time{start, end}, gapModeNone)
+	if err != nil || len(buckets) == 0 {
+		return 0, err
+	}
+	if buckets[0] < 0 {
 		return 0, nil
 	}
-	return pulses, nil
+	return buckets[0], nil
 }
 
 func calcTotalPulsesByDelta(store *Store) (int64, error) {
@@ -49,11 +142,12 @@ func calcTotalPulsesByDelta(store *Store) (int64, error) {
 	if err != nil {
 		return 0, err
 	}
-	if len(rows) == 0 {
-		return 0, nil
+	missing, err := store.SumMissingPulses()
+	if err != nil {
+		return 0, err
 	}
 
-	var pulses int64
+	pulses := missing
 	var prev *int64
 	for _, row := range rows {
 		d := normalizeDelta(prev, row.Count)
@@ -75,61 +169,101 @@ func startOfDay(t time.Time) time.Time {
 	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
 }
 
-func startOfWeek(t time.Time) time.Time {
+func startOfWeek(t time.Time, weekStart time.Weekday) time.Time {
 	sod := startOfDay(t)
-	weekday := int(sod.Weekday())
-	if weekday == 0 {
-		weekday = 7
-	}
-	return sod.AddDate(0, 0, -(weekday - 1))
+	offset := (int(sod.Weekday()) - int(weekStart) + 7) % 7
+	return sod.AddDate(0, 0, -offset)
 }
 
 func startOfMonth(t time.Time) time.Time {
 	return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, t.Location())
 }
 
-func calcHourlyPulsesToday(store *Store, now time.Time) ([]int64, error) {
+func calcHourlyPulsesToday(store *Store, now time.Time, gapMode string) ([]int64, error) {
+	// 夏令时切换日只有 23 或 25 小时，按日历日计算结束时间
 	dayStart := startOfDay(now)
-	dayEnd := dayStart.Add(24 * time.Hour)
+	dayEnd := dayStart.AddDate(0, 0, 1)
 
-	prev, err := store.FetchPrevCountBefore(dayStart.Unix())
+	edges, err := usageBucketEdges(dayStart, dayEnd, "hour", PeriodRules{})
 	if err != nil {
 		return nil, err
 	}
-	rows, err := store.FetchEventsInRange(dayStart.Unix(), dayEnd.Unix())
+	pulses, err := calcBucketedPulses(store, edges, gapMode)
 	if err != nil {
 		return nil, err
 	}
 
+	// 按本地时钟小时归档，结果固定为 24 个小时：夏令时结束的 25 小时日，重复的小时
+	// （如欧洲的两个 02:00）合并计入同一小时；夏令时开始的 23 小时日，跳过的小时为 0。
+	// 需要逐个真实小时的数据时使用 /api/usage?bucket=hour
 	hourly := make([]int64, 24)
-	prevCount := prev
-	for _, row := range rows {
-		delta := normalizeDelta(prevCount, row.Count)
-		hour := time.Unix(row.Timestamp, 0).In(now.Location()).Hour()
-		if hour >= 0 && hour < 24 {
-			hourly[hour] += delta
-		}
-		c := row.Count
-		prevCount = &c
+	for i, p := range pulses {
+		hourly[edges[i].In(now.Location()).Hour()] += p
 	}
 	return hourly, nil
 }
 
-func calcMonthlyPulsesCurrentYear(store *Store, now time.Time) ([]int64, error) {
-	monthly := make([]int64, 12)
-	for month := 1; month <= 12; month++ {
-		monthStart := time.Date(now.Year(), time.Month(month), 1, 0, 0, 0, 0, now.Location())
-		var monthEnd time.Time
-		if month < 12 {
-			monthEnd = time.Date(now.Year(), time.Month(month+1), 1, 0, 0, 0, 0, now.Location())
-		} else {
-			monthEnd = time.Date(now.Year()+1, time.January, 1, 0, 0, 0, 0, now.Location())
+func calcMonthlyPulsesCurrentYear(store *Store, now time.Time, gapMode string) ([]int64, error) {
+	edges := make([]time.Time, 0, 13)
+	for month := 1; month <= 13; month++ {
+		edges = append(edges, time.Date(now.Year(), time.Month(month), 1, 0, 0, 0, 0, now.Location()))
+	}
+	return calcBucketedPulses(store, edges, gapMode)
+}
+
+// 燃气余额：燃气表读数与剩余燃气
+type GasBalance struct {
+	TotalPulses  int64
+	MeterReading decimal.Decimal
+	Topups       decimal.Decimal
+	Remain       decimal.Decimal
+}
+
+func computeGasBalance(store *Store, settings Settings) (GasBalance, error) {
+	gasPerPulse := parseDecimal(settings.GasPerPulse, defaultGasPerPulse)
+	initialGas := parseDecimal(settings.InitialGas, defaultInitialGas)
+
+	totalPulses, err := calcTotalPulsesByDelta(store)
+	if err != nil {
+		return GasBalance{}, err
+	}
+
+	calibrateTimeStr, _ := store.GetSetting("calibrate_time", "0")
+	calibrateTime, _ := strconv.ParseInt(calibrateTimeStr, 10, 64)
+
+	baseGas := initialGas
+	if calibrateTime > 0 {
+		if baseGasStr, err := store.GetSetting("calibrate_base_gas", baseGas.String()); err == nil {
+			baseGas = parseDecimal(baseGasStr, baseGas.String())
 		}
-		pulses, err := calcUsagePulsesByDelta(store, monthStart, monthEnd)
-		if err != nil {
-			return nil, err
+	}
+
+	basePulses := settings.InitialBasePulses
+	if calibrateTime > 0 {
+		if basePulsesStr, err := store.GetSetting("calibrate_base_pulses", fmt.Sprintf("%d", basePulses)); err == nil {
+			if v, err := strconv.ParseInt(basePulsesStr, 10, 64); err == nil {
+				basePulses = v
+			}
 		}
-		monthly[month-1] = pulses
 	}
-	return monthly, nil
-}
\ No newline at end of file
+
+	// 校准时录入的是当时的剩余量，之前的充值已包含在内
+	topups, err := store.SumTopupsSince(calibrateTime)
+	if err != nil {
+		return GasBalance{}, err
+	}
+
+	usedSinceBase := totalPulses - basePulses
+	if usedSinceBase < 0 {
+		usedSinceBase = 0
+	}
+	usedSinceBaseGas := quantize3(pulsesToGas(usedSinceBase, gasPerPulse))
+
+	desiredMeter := parseDecimal(settings.DesiredMeterM3, defaultMeterBase)
+	return GasBalance{
+		TotalPulses:  totalPulses,
+		MeterReading: quantize3(desiredMeter.Add(usedSinceBaseGas)),
+		Topups:       topups,
+		Remain:       quantize3(baseGas.Add(topups).Sub(usedSinceBaseGas)),
+	}, nil
+}
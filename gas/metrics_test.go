@@ -0,0 +1,146 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// 欧洲 2024 年夏令时：3 月 31 日 02:00 跳到 03:00（23 小时），10 月 27 日 03:00 回拨到 02:00（25 小时）
+func berlin(t *testing.T) *time.Location {
+	t.Helper()
+	loc, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Skip(err)
+	}
+	return loc
+}
+
+func TestStartOfDayDST(t *testing.T) {
+	loc := berlin(t)
+	cases := []struct {
+		name string
+		t    time.Time
+		want string
+	}{
+		{"夏令时开始日", time.Date(2024, 3, 31, 12, 0, 0, 0, loc), "2024-03-31T00:00:00+01:00"},
+		{"夏令时开始后", time.Date(2024, 3, 31, 3, 30, 0, 0, loc), "2024-03-31T00:00:00+01:00"},
+		{"夏令时结束日", time.Date(2024, 10, 27, 12, 0, 0, 0, loc), "2024-10-27T00:00:00+02:00"},
+		{"重复的 02:30", time.Unix(time.Date(2024, 10, 27, 1, 30, 0, 0, time.UTC).Unix(), 0).In(loc), "2024-10-27T00:00:00+02:00"},
+	}
+	for _, c := range cases {
+		if got := startOfDay(c.t).Format(time.RFC3339); got != c.want {
+			t.Errorf("%s: startOfDay(%s) = %s, want %s", c.name, c.t.Format(time.RFC3339), got, c.want)
+		}
+	}
+}
+
+func TestUsageBucketEdgesDST(t *testing.T) {
+	loc := berlin(t)
+	cases := []struct {
+		name      string
+		from, to  time.Time
+		bucket    string
+		durations []time.Duration // 每个桶的实际时长
+	}{
+		{"夏令时开始日按小时", time.Date(2024, 3, 31, 0, 0, 0, 0, loc), time.Date(2024, 4, 1, 0, 0, 0, 0, loc), "hour", repeatDuration(time.Hour, 23)},
+		{"夏令时结束日按小时", time.Date(2024, 10, 27, 0, 0, 0, 0, loc), time.Date(2024, 10, 28, 0, 0, 0, 0, loc), "hour", repeatDuration(time.Hour, 25)},
+		{"夏令时开始前后按天", time.Date(2024, 3, 30, 0, 0, 0, 0, loc), time.Date(2024, 4, 2, 0, 0, 0, 0, loc), "day", []time.Duration{24 * time.Hour, 23 * time.Hour, 24 * time.Hour}},
+		{"夏令时结束前后按天", time.Date(2024, 10, 26, 0, 0, 0, 0, loc), time.Date(2024, 10, 29, 0, 0, 0, 0, loc), "day", []time.Duration{24 * time.Hour, 25 * time.Hour, 24 * time.Hour}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			edges, err := usageBucketEdges(c.from, c.to, c.bucket, PeriodRules{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(edges) != len(c.durations)+1 {
+				t.Fatalf("got %d buckets, want %d", len(edges)-1, len(c.durations))
+			}
+			for i, want := range c.durations {
+				if got := edges[i+1].Sub(edges[i]); got != want {
+					t.Errorf("bucket %d (%s): duration %s, want %s", i, edges[i].Format(time.RFC3339), got, want)
+				}
+			}
+			if c.bucket == "day" {
+				for _, e := range edges {
+					if e.Hour() != 0 || e.Minute() != 0 {
+						t.Errorf("day edge %s is not local midnight", e.Format(time.RFC3339))
+					}
+				}
+			}
+		})
+	}
+}
+
+func repeatDuration(d time.Duration, n int) []time.Duration {
+	out := make([]time.Duration, n)
+	for i := range out {
+		out[i] = d
+	}
+	return out
+}
+
+func TestCalcHourlyPulsesTodayDST(t *testing.T) {
+	loc := berlin(t)
+	utc := func(month time.Month, day, hour, min int) int64 {
+		return time.Date(2024, month, day, hour, min, 0, 0, time.UTC).Unix()
+	}
+	cases := []struct {
+		name   string
+		now    time.Time
+		events []Event
+		want   map[int]int64 // 本地小时 -> 脉冲数，其余小时为 0
+	}{
+		{
+			// 01:30 → 03:30 之间只有 1 个真实小时，02 点不存在
+			name: "23 小时日跳过的小时为 0",
+			now:  time.Date(2024, 3, 31, 23, 0, 0, 0, loc),
+			events: []Event{
+				{Timestamp: utc(3, 30, 22, 0), Count: 10}, // 03-30 23:00 +01:00
+				{Timestamp: utc(3, 31, 0, 30), Count: 11}, // 01:30 +01:00
+				{Timestamp: utc(3, 31, 1, 30), Count: 13}, // 03:30 +02:00
+			},
+			want: map[int]int64{1: 1, 3: 2},
+		},
+		{
+			// 两个 02:30 分别在夏令时和冬令时，合并计入 02 点
+			name: "25 小时日重复的小时合并",
+			now:  time.Date(2024, 10, 27, 23, 0, 0, 0, loc),
+			events: []Event{
+				{Timestamp: utc(10, 26, 21, 0), Count: 10}, // 10-26 23:00 +02:00
+				{Timestamp: utc(10, 27, 0, 30), Count: 11}, // 02:30 +02:00
+				{Timestamp: utc(10, 27, 1, 30), Count: 14}, // 02:30 +01:00
+				{Timestamp: utc(10, 27, 4, 0), Count: 15},  // 05:00 +01:00
+			},
+			want: map[int]int64{2: 4, 5: 1},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			store, err := NewStore(filepath.Join(t.TempDir(), "gas.db"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer store.Close()
+			for _, ev := range c.events {
+				if err := store.InsertEvent(ev.Timestamp, ev.Count); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			hourly, err := calcHourlyPulsesToday(store, c.now, gapModeNone)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(hourly) != 24 {
+				t.Fatalf("got %d hours, want 24", len(hourly))
+			}
+			for h, got := range hourly {
+				if got != c.want[h] {
+					t.Errorf("hour %02d: got %d, want %d", h, got, c.want[h])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	totpIssuer         = "GasMonitor"
+	totpSecretBytes    = 20
+	totpPeriod         = 30
+	totpDigits         = 6
+	totpSkewSteps      = 1
+	recoveryCodeCount  = 10
+	mfaChallengeTTL    = 5 * time.Minute
+	mfaChallengeTries  = 5
+	loginReasonMFA     = "mfa_failed"
+	loginReasonMFAWait = "mfa_required"
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+func generateTOTPSecret() (string, error) {
+	buf := make([]byte, totpSecretBytes)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return totpEncoding.EncodeToString(buf), nil
+}
+
+// RFC 6238：HMAC-SHA1、30 秒步长、6 位数字
+func totpCode(secret string, step int64) (string, error) {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return "", err
+	}
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, value%1000000), nil
+}
+
+// 校验验证码，允许前后各一个步长的时钟偏差；返回匹配的步长，
+// 调用方需拒绝不大于上次使用步长的验证码以防重放
+func verifyTOTP(secret, code string, now time.Time, lastStep int64) (int64, bool) {
+	code = strings.TrimSpace(code)
+	if len(code) != totpDigits {
+		return 0, false
+	}
+	current := now.Unix() / totpPeriod
+	for step := current - totpSkewSteps; step <= current+totpSkewSteps; step++ {
+		if step <= lastStep {
+			continue
+		}
+		expected, err := totpCode(secret, step)
+		if err != nil {
+			return 0, false
+		}
+		if hmac.Equal([]byte(expected), []byte(code)) {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// 供身份验证器 App 使用的 otpauth 链接，可生成二维码扫描
+func totpProvisioningURI(username, secret string) string {
+	label := url.PathEscape(totpIssuer + ":" + username)
+	query := url.Values{}
+	query.Set("secret", secret)
+	query.Set("issuer", totpIssuer)
+	query.Set("algorithm", "SHA1")
+	query.Set("digits", fmt.Sprint(totpDigits))
+	query.Set("period", fmt.Sprint(totpPeriod))
+	return "otpauth://totp/" + label + "?" + query.Encode()
+}
+
+func normalizeRecoveryCode(code string) string {
+	return strings.ToLower(strings.ReplaceAll(strings.TrimSpace(code), "-", ""))
+}
+
+func hashRecoveryCode(code string) string {
+	sum := sha256.Sum256([]byte(normalizeRecoveryCode(code)))
+	return hex.EncodeToString(sum[:])
+}
+
+// 生成一组新的恢复码（替换旧的），明文只返回这一次
+func regenerateRecoveryCodes(store *Store, userID int64) ([]string, error) {
+	codes := make([]string, 0, recoveryCodeCount)
+	hashes := make([]string, 0, recoveryCodeCount)
+	for i := 0; i < recoveryCodeCount; i++ {
+		raw, err := generateSecureKey(5)
+		if err != nil {
+			return nil, err
+		}
+		code := raw[:5] + "-" + raw[5:]
+		codes = append(codes, code)
+		hashes = append(hashes, hashRecoveryCode(code))
+	}
+	if err := store.ReplaceRecoveryCodes(userID, hashes); err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// 校验第二因素：6 位数字按 TOTP 处理，其余按恢复码处理（恢复码一次有效）
+func verifySecondFactor(store *Store, userID int64, code string) (bool, error) {
+	mfa, err := store.FetchUserMFA(userID)
+	if err != nil {
+		return false, err
+	}
+	if !mfa.Enabled {
+		return false, nil
+	}
+	if trimmed := strings.TrimSpace(code); len(trimmed) == totpDigits && strings.Trim(trimmed, "0123456789") == "" {
+		step, ok := verifyTOTP(mfa.Secret, trimmed, time.Now(), mfa.LastStep)
+		if !ok {
+			return false, nil
+		}
+		return true, store.UpdateMFALastStep(userID, step)
+	}
+	return store.UseRecoveryCode(userID, hashRecoveryCode(code), time.Now().Unix())
+}
+
+// 密码验证通过、等待第二因素的登录挑战，仅保存在内存中
+type mfaChallenge struct {
+	userID  int64
+	expires time.Time
+	tries   int
+}
+
+var mfaChallenges = struct {
+	sync.Mutex
+	items map[string]*mfaChallenge
+}{items: make(map[string]*mfaChallenge)}
+
+func createMFAChallenge(userID int64) (string, error) {
+	id, err := generateSecureKey(16)
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	mfaChallenges.Lock()
+	defer mfaChallenges.Unlock()
+	for key, c := range mfaChallenges.items {
+		if now.After(c.expires) {
+			delete(mfaChallenges.items, key)
+		}
+	}
+	mfaChallenges.items[id] = &mfaChallenge{userID: userID, expires: now.Add(mfaChallengeTTL)}
+	return id, nil
+}
+
+// 取出挑战对应的用户；超时或失败次数过多的挑战直接作废
+func lookupMFAChallenge(id string) (int64, error) {
+	mfaChallenges.Lock()
+	defer mfaChallenges.Unlock()
+	c, ok := mfaChallenges.items[id]
+	if !ok || time.Now().After(c.expires) {
+		delete(mfaChallenges.items, id)
+		return 0, errors.New("验证已过期，请重新登录")
+	}
+	c.tries++
+	if c.tries > mfaChallengeTries {
+		delete(mfaChallenges.items, id)
+		return 0, errors.New("验证码错误次数过多，请重新登录")
+	}
+	return c.userID, nil
+}
+
+func finishMFAChallenge(id string) {
+	mfaChallenges.Lock()
+	delete(mfaChallenges.items, id)
+	mfaChallenges.Unlock()
+}
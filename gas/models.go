@@ -1,40 +1,350 @@
 package main
 
+import "encoding/json"
+
 type Event struct {
-	Timestamp int64 `json:"timestamp"`
-	Count     int64 `json:"count"`
+	ID         int64  `json:"id,omitempty"`
+	Timestamp  int64  `json:"timestamp"`
+	Count      int64  `json:"count"`
+	ReceivedTS int64  `json:"received_ts,omitempty"`
+	Note       string `json:"note,omitempty"`
+	DeletedTS  int64  `json:"deleted_ts,omitempty"`
+	DeletedBy  string `json:"deleted_by,omitempty"`
+	// 生效的更正读数，统计时代替 Count
+	CorrectedCount *int64 `json:"corrected_count,omitempty"`
+}
+
+type EventFilter struct {
+	From           int64
+	To             int64
+	Limit          int
+	Offset         int
+	IncludeDeleted bool
+}
+
+const (
+	adjustmentCorrect = "correct" // 更正单条事件的读数
+	adjustmentMissing = "missing" // 补录一段时间内漏计的脉冲
+)
+
+// 事件更正记录，叠加在原始事件之上，原始数据保持不变；撤销后不再参与统计
+type EventAdjustment struct {
+	ID        int64  `json:"id"`
+	Kind      string `json:"kind"`
+	EventID   int64  `json:"event_id,omitempty"`
+	Count     int64  `json:"count"`
+	StartTS   int64  `json:"start_ts,omitempty"`
+	EndTS     int64  `json:"end_ts,omitempty"`
+	Pulses    int64  `json:"pulses"`
+	Note      string `json:"note"`
+	CreatedBy string `json:"created_by"`
+	CreatedTS int64  `json:"created_ts"`
+	RevokedTS int64  `json:"revoked_ts,omitempty"`
+	RevokedBy string `json:"revoked_by,omitempty"`
+}
+
+// 数据断档：传感器离线期间的用量在 EndTS 重连时一次性上报
+type EventGap struct {
+	ID         int64 `json:"id"`
+	StartTS    int64 `json:"start_ts"`
+	EndTS      int64 `json:"end_ts"`
+	Pulses     int64 `json:"pulses"`
+	DetectedTS int64 `json:"detected_ts"`
+}
+
+type AdjustmentFilter struct {
+	Kind           string
+	EventID        int64
+	IncludeRevoked bool
+	Limit          int
 }
 
 type Settings struct {
-	GasPerPulse          string `json:"gas_per_pulse"`
-	InitialGas           string `json:"initial_gas"`
-	InitialBasePulses    int64  `json:"initial_base_pulses"`
-	MeterBaseM3          string `json:"meter_base_m3"`
-	DesiredMeterM3       string `json:"desired_meter_m3"`
-	AuthEnabled          bool   `json:"auth_enabled"`
-	MQTTHost             string `json:"mqtt_host"`
-	MQTTPort             int    `json:"mqtt_port"`
-	MQTTUser             string `json:"mqtt_user"`
-	MQTTPassword         string `json:"mqtt_password"`
-	MQTTTopic            string `json:"mqtt_topic"`
-	MQTTTLS              bool   `json:"mqtt_tls"`
-	MQTTTLSInsecure      bool   `json:"mqtt_tls_insecure"`
-	TGEnabled            bool   `json:"tg_enabled"`
-	TGBotToken           string `json:"tg_bot_token"`
-	TGChatID             string `json:"tg_chat_id"`
-	TGAPIEndpoint        string `json:"tg_api_endpoint"`
-	TGThreshold          string `json:"tg_threshold"`
-	TGNotifyTimes        int    `json:"tg_notify_times"`
-	TGNotifyIntervalHour string `json:"tg_notify_interval_hours"`
+	GasPerPulse           string `json:"gas_per_pulse"`
+	InitialGas            string `json:"initial_gas"`
+	InitialBasePulses     int64  `json:"initial_base_pulses"`
+	MeterBaseM3           string `json:"meter_base_m3"`
+	DesiredMeterM3        string `json:"desired_meter_m3"`
+	GasPrice              string `json:"gas_price"`
+	Timezone              string `json:"timezone"`
+	WeekStart             int    `json:"week_start"`
+	BillingCycleDay       int    `json:"billing_cycle_day"`
+	BillingYearMonth      int    `json:"billing_year_start_month"`
+	AuthEnabled           bool   `json:"auth_enabled"`
+	PublicDashboard       bool   `json:"public_dashboard"`
+	MQTTHost              string `json:"mqtt_host"`
+	MQTTPort              int    `json:"mqtt_port"`
+	MQTTUser              string `json:"mqtt_user"`
+	MQTTPassword          string `json:"mqtt_password"`
+	MQTTTopic             string `json:"mqtt_topic"`
+	MQTTTLS               bool   `json:"mqtt_tls"`
+	MQTTTLSInsecure       bool   `json:"mqtt_tls_insecure"`
+	MQTTDeviceID          string `json:"mqtt_device_id"`
+	MQTTCmdTopic          string `json:"mqtt_cmd_topic"`
+	MQTTRespTopic         string `json:"mqtt_resp_topic"`
+	MQTTTempTopic         string `json:"mqtt_temp_topic"`
+	HDDBaseTemp           string `json:"hdd_base_temp"`
+	TGEnabled             bool   `json:"tg_enabled"`
+	TGBotToken            string `json:"tg_bot_token"`
+	TGChatID              string `json:"tg_chat_id"`
+	TGAPIEndpoint         string `json:"tg_api_endpoint"`
+	TGThreshold           string `json:"tg_threshold"`
+	TGNotifyTimes         int    `json:"tg_notify_times"`
+	TGNotifyIntervalHour  string `json:"tg_notify_interval_hours"`
+	TGAlertMode           string `json:"tg_alert_mode"`
+	TGForecastDays        string `json:"tg_forecast_days"`
+	TGBotEnabled          bool   `json:"tg_bot_enabled"`
+	TGAllowedChatIDs      string `json:"tg_allowed_chat_ids"`
+	TGAllowedUserIDs      string `json:"tg_allowed_user_ids"`
+	ReportDailyEnabled    bool   `json:"report_daily_enabled"`
+	ReportWeeklyEnabled   bool   `json:"report_weekly_enabled"`
+	ReportMonthlyEnabled  bool   `json:"report_monthly_enabled"`
+	ReportTime            string `json:"report_time"`
+	ReportDailyTemplate   string `json:"report_daily_template"`
+	ReportWeeklyTemplate  string `json:"report_weekly_template"`
+	ReportMonthlyTemplate string `json:"report_monthly_template"`
+	AuthProxyEnabled      bool   `json:"auth_proxy_enabled"`
+	AuthProxyCIDRs        string `json:"auth_proxy_cidrs"`
+	AuthProxyUserHeader   string `json:"auth_proxy_user_header"`
+	AuthProxyGroupsHeader string `json:"auth_proxy_groups_header"`
+	TrustedProxyCIDRs     string `json:"trusted_proxy_cidrs"`
+	OIDCEnabled           bool   `json:"oidc_enabled"`
+	OIDCIssuer            string `json:"oidc_issuer"`
+	OIDCClientID          string `json:"oidc_client_id"`
+	OIDCClientSecret      string `json:"oidc_client_secret"`
+	OIDCRedirectURL       string `json:"oidc_redirect_url"`
+	OIDCScopes            string `json:"oidc_scopes"`
+	OIDCUsernameClaim     string `json:"oidc_username_claim"`
+	OIDCGroupsClaim       string `json:"oidc_groups_claim"`
+	AuthGroupRoles        string `json:"auth_group_roles"`
+	AuthDefaultRole       string `json:"auth_default_role"`
+	AuditRetentionDays    int    `json:"audit_retention_days"`
+	GapThresholdMinutes   int    `json:"gap_threshold_minutes"`
 }
 
 type Metrics struct {
 	TodayGas     string `json:"today_gas"`
 	WeekGas      string `json:"week_gas"`
 	MonthGas     string `json:"month_gas"`
+	BillGas      string `json:"bill_gas"`
+	BillCost     string `json:"bill_cost"`
+	BillStart    string `json:"bill_start"`
+	BillEnd      string `json:"bill_end"`
+	TierYearGas  string `json:"tier_year_gas"`
 	TotalUsedGas string `json:"total_used_gas"`
 	MeterReading string `json:"meter_reading"`
 	RemainGas    string `json:"remain_gas"`
+	DailyAvgGas  string `json:"daily_avg_gas"`
+	DaysLeft     string `json:"days_until_empty"`
+	EmptyDate    string `json:"projected_empty_date"`
 	MQTTStatus   string `json:"mqtt_status"`
 	LastMsgTime  string `json:"last_msg_time"`
 }
+
+type DeviceCommand struct {
+	ID        string `json:"id"`
+	Device    string `json:"device"`
+	Command   string `json:"command"`
+	Params    string `json:"params"`
+	Status    string `json:"status"`
+	Response  string `json:"response"`
+	Error     string `json:"error"`
+	IssuedBy  string `json:"issued_by"`
+	SourceIP  string `json:"source_ip"`
+	CreatedTS int64  `json:"created_ts"`
+	AckedTS   int64  `json:"acked_ts"`
+}
+
+// 预警状态，每种预警一行
+type AlertState struct {
+	Name          string `json:"name"`
+	Active        bool   `json:"active"`
+	NotifyCount   int64  `json:"notify_count"`
+	FirstNotifyTS int64  `json:"first_notify_ts"`
+	LastNotifyTS  int64  `json:"last_notify_ts"`
+	UpdatedTS     int64  `json:"updated_ts"`
+}
+
+// 用户自定义预警规则
+type AlertRule struct {
+	ID              int64    `json:"id"`
+	Name            string   `json:"name"`
+	Kind            string   `json:"kind"`
+	Threshold       string   `json:"threshold"`
+	Hysteresis      string   `json:"hysteresis"`
+	Severity        string   `json:"severity"`
+	RepeatMinutes   int      `json:"repeat_minutes"`
+	MaxRepeats      int      `json:"max_repeats"`
+	QuietStart      string   `json:"quiet_start"`
+	QuietEnd        string   `json:"quiet_end"`
+	Channels        []string `json:"channels"`
+	Enabled         bool     `json:"enabled"`
+	NotifyOnResolve bool     `json:"notify_on_resolve"`
+	CreatedTS       int64    `json:"created_ts"`
+	UpdatedTS       int64    `json:"updated_ts"`
+}
+
+// 预警历史：一次触发到恢复的完整记录
+type AlertHistory struct {
+	ID           int64  `json:"id"`
+	RuleID       int64  `json:"rule_id"`
+	RuleName     string `json:"rule_name"`
+	Kind         string `json:"kind"`
+	Severity     string `json:"severity"`
+	Value        string `json:"value"`
+	Threshold    string `json:"threshold"`
+	FiredTS      int64  `json:"fired_ts"`
+	ResolvedTS   int64  `json:"resolved_ts"`
+	AckedTS      int64  `json:"acked_ts"`
+	AckedBy      string `json:"acked_by"`
+	NotifyCount  int64  `json:"notify_count"`
+	LastNotifyTS int64  `json:"last_notify_ts"`
+}
+
+// 充值记录，计入剩余燃气
+type Topup struct {
+	ID        int64  `json:"id"`
+	TS        int64  `json:"ts"`
+	Amount    string `json:"amount"`
+	Source    string `json:"source"`
+	Note      string `json:"note"`
+	CreatedBy string `json:"created_by"`
+}
+
+// 发件箱中的一条通知
+type Notification struct {
+	ID            int64                 `json:"id"`
+	Channel       string                `json:"channel"`
+	Target        string                `json:"target"`
+	Kind          string                `json:"kind"`
+	Message       string                `json:"message"`
+	Status        string                `json:"status"`
+	Attempts      int                   `json:"attempts"`
+	NextAttemptTS int64                 `json:"next_attempt_ts"`
+	LastError     string                `json:"last_error"`
+	CreatedTS     int64                 `json:"created_ts"`
+	SentTS        int64                 `json:"sent_ts"`
+	AttemptLog    []NotificationAttempt `json:"attempt_log,omitempty"`
+}
+
+type NotificationAttempt struct {
+	ID             int64  `json:"id"`
+	NotificationID int64  `json:"notification_id"`
+	TS             int64  `json:"ts"`
+	Success        bool   `json:"success"`
+	Error          string `json:"error"`
+	DurationMS     int64  `json:"duration_ms"`
+}
+
+// 登录用户，密码以 bcrypt 哈希保存
+type User struct {
+	ID           int64  `json:"id"`
+	Username     string `json:"username"`
+	PasswordHash string `json:"-"`
+	Role         string `json:"role"`
+	Disabled     bool   `json:"disabled"`
+	CreatedTS    int64  `json:"created_ts"`
+	UpdatedTS    int64  `json:"updated_ts"`
+	LastLoginTS  int64  `json:"last_login_ts"`
+	MFAEnabled   bool   `json:"mfa_enabled"`
+}
+
+// 外部身份与本地用户的关联，Subject 为 OIDC 的 sub 声明或代理头中的用户名
+type ExternalLink struct {
+	Provider  string `json:"provider"`
+	Subject   string `json:"subject"`
+	UserID    int64  `json:"user_id"`
+	CreatedTS int64  `json:"created_ts"`
+}
+
+// 用户的 TOTP 配置；Secret 在启用前为待确认状态
+type UserMFA struct {
+	UserID    int64
+	Secret    string
+	Enabled   bool
+	LastStep  int64
+	CreatedTS int64
+}
+
+// JWT 签名密钥，轮换后旧密钥在宽限期内仍可用于校验
+type SigningKey struct {
+	KID       string `json:"kid"`
+	Secret    string `json:"-"`
+	CreatedTS int64  `json:"created_ts"`
+	RetiredTS int64  `json:"retired_ts"`
+}
+
+// 登录会话，Token 中的 jti 对应会话 ID，撤销后 Token 立即失效
+type Session struct {
+	ID        string `json:"id"`
+	UserID    int64  `json:"user_id"`
+	Username  string `json:"username"`
+	Role      string `json:"role"`
+	Disabled  bool   `json:"-"`
+	CreatedTS int64  `json:"created_ts"`
+	ExpiresTS int64  `json:"expires_ts"`
+	RevokedTS int64  `json:"revoked_ts"`
+	IP        string `json:"ip"`
+	UserAgent string `json:"user_agent"`
+}
+
+// 供脚本和第三方集成使用的长期 API Token，只保存哈希值
+type APIToken struct {
+	ID         int64    `json:"id"`
+	Name       string   `json:"name"`
+	Prefix     string   `json:"prefix"`
+	TokenHash  string   `json:"-"`
+	Scopes     []string `json:"scopes"`
+	CreatedBy  string   `json:"created_by"`
+	CreatedTS  int64    `json:"created_ts"`
+	ExpiresTS  int64    `json:"expires_ts"`
+	LastUsedTS int64    `json:"last_used_ts"`
+	LastUsedIP string   `json:"last_used_ip"`
+	RevokedTS  int64    `json:"revoked_ts"`
+}
+
+// 登录尝试记录，用于限流判断与审计
+type LoginAttempt struct {
+	ID        int64  `json:"id"`
+	TS        int64  `json:"ts"`
+	Username  string `json:"username"`
+	IP        string `json:"ip"`
+	Success   bool   `json:"success"`
+	Reason    string `json:"reason"`
+	UserAgent string `json:"user_agent"`
+}
+
+// 人工抄表记录，同时保存当时系统计算的读数以便对比偏差
+type Reading struct {
+	ID        int64  `json:"id"`
+	TS        int64  `json:"ts"`
+	MeterM3   string `json:"meter_m3"`
+	SystemM3  string `json:"system_m3"`
+	DriftM3   string `json:"drift_m3"`
+	Note      string `json:"note"`
+	CreatedBy string `json:"created_by"`
+}
+
+// 审计日志，只追加不修改；Before/After 为变更前后的值（敏感字段已打码）
+type AuditEntry struct {
+	ID        int64           `json:"id"`
+	TS        int64           `json:"ts"`
+	Actor     string          `json:"actor"`
+	IP        string          `json:"ip"`
+	RequestID string          `json:"request_id"`
+	Action    string          `json:"action"`
+	Target    string          `json:"target"`
+	Before    json.RawMessage `json:"before,omitempty"`
+	After     json.RawMessage `json:"after,omitempty"`
+}
+
+// 审计日志查询条件，零值表示不限制
+type AuditFilter struct {
+	Actor  string
+	Action string
+	Target string
+	From   int64
+	To     int64
+	Limit  int
+	Offset int
+}
@@ -4,25 +4,44 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
+	"sync"
 	"time"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
 )
 
 type MQTTWorker struct {
-	store  *Store
-	config func() (Settings, error)
-	client mqtt.Client
-	stopCh chan struct{}
-	status string
+	store    *Store
+	hub      *Hub
+	alerts   *AlertEvaluator
+	gaps     *GapDetector
+	config   func() (Settings, error)
+	client   mqtt.Client
+	stopCh   chan struct{}
+	reloadCh chan struct{}
+	status   string
+
+	mu      sync.Mutex
+	pending map[string]pendingCommand
 }
 
-func NewMQTTWorker(store *Store, config func() (Settings, error)) *MQTTWorker {
+// 等待回执的命令及其目标设备
+type pendingCommand struct {
+	device string
+	ch     chan deviceResponsePayload
+}
+
+func NewMQTTWorker(store *Store, hub *Hub, alerts *AlertEvaluator, gaps *GapDetector, config func() (Settings, error)) *MQTTWorker {
 	return &MQTTWorker{
-		store:  store,
-		config: config,
-		stopCh: make(chan struct{}),
-		status: "not_started",
+		store:    store,
+		hub:      hub,
+		alerts:   alerts,
+		gaps:     gaps,
+		config:   config,
+		stopCh:   make(chan struct{}),
+		reloadCh: make(chan struct{}, 1),
+		status:   "not_started",
+		pending:  make(map[string]pendingCommand),
 	}
 }
 
@@ -30,6 +49,15 @@ func (w *MQTTWorker) Status() string {
 	return w.status
 }
 
+// 更新连接状态，状态变化时推送给实时订阅者
+func (w *MQTTWorker) setStatus(status string) {
+	if w.status == status {
+		return
+	}
+	w.status = status
+	w.hub.Publish("mqtt_status", map[string]string{"mqtt_status": status})
+}
+
 func (w *MQTTWorker) Start() {
 	go func() {
 		for {
@@ -39,9 +67,15 @@ func (w *MQTTWorker) Start() {
 			default:
 			}
 
+			// 即将读取最新配置，之前积压的重连请求已无意义
+			select {
+			case <-w.reloadCh:
+			default:
+			}
+
 			settings, err := w.config()
 			if err != nil {
-				w.status = fmt.Sprintf("config_error: %v", err)
+				w.setStatus(fmt.Sprintf("config_error: %v", err))
 				time.Sleep(5 * time.Second)
 				continue
 			}
@@ -63,42 +97,77 @@ func (w *MQTTWorker) Start() {
 			}
 
 			opts.OnConnect = func(c mqtt.Client) {
-				w.status = "connected"
+				w.setStatus("connected")
 				if token := c.Subscribe(settings.MQTTTopic, 0, w.handleMessage); token.Wait() && token.Error() != nil {
 					_ = w.store.SetSetting("last_mqtt_error", token.Error().Error())
 				}
 				_ = w.store.SetSetting("mqtt_topic_subscribed", settings.MQTTTopic)
+				if settings.MQTTTempTopic != "" {
+					if token := c.Subscribe(settings.MQTTTempTopic, 0, w.handleTemperature); token.Wait() && token.Error() != nil {
+						_ = w.store.SetSetting("last_mqtt_error", token.Error().Error())
+					}
+				}
+				if settings.MQTTRespTopic != "" {
+					respTopic := deviceTopic(settings.MQTTRespTopic, "+")
+					if token := c.Subscribe(respTopic, 1, w.handleDeviceResponse); token.Wait() && token.Error() != nil {
+						_ = w.store.SetSetting("last_mqtt_error", token.Error().Error())
+					}
+				}
 			}
 			opts.OnConnectionLost = func(_ mqtt.Client, err error) {
-				w.status = fmt.Sprintf("connection_lost: %v", err)
+				w.setStatus(fmt.Sprintf("connection_lost: %v", err))
 				_ = w.store.SetSetting("last_mqtt_error", err.Error())
 			}
 
-			w.status = "connecting"
+			w.setStatus("connecting")
 			client := mqtt.NewClient(opts)
 			w.client = client
-			if token := client.Connect(); token.Wait() && token.Error() != nil {
-				w.status = fmt.Sprintf("connect_failed: %v", token.Error())
+			// 启用了连接重试，Broker 不可达时会一直等待；期间也要响应停止和重连
+			token := client.Connect()
+			select {
+			case <-token.Done():
+			case <-w.stopCh:
+				client.Disconnect(250)
+				return
+			case <-w.reloadCh:
+				client.Disconnect(250)
+				w.setStatus("reloading")
+				continue
+			}
+			if token.Error() != nil {
+				w.setStatus(fmt.Sprintf("connect_failed: %v", token.Error()))
 				_ = w.store.SetSetting("mqtt_status", w.status)
 				time.Sleep(5 * time.Second)
 				continue
 			}
 			_ = w.store.SetSetting("mqtt_status", "connected")
 
+		connected:
 			for {
 				select {
 				case <-w.stopCh:
 					client.Disconnect(250)
 					return
-				default:
+				case <-w.reloadCh:
+					client.Disconnect(250)
+					w.setStatus("reloading")
+					break connected
+				case <-time.After(5 * time.Second):
 					_ = w.store.SetSetting("mqtt_status", w.status)
-					time.Sleep(5 * time.Second)
 				}
 			}
 		}
 	}()
 }
 
+// 断开当前连接并按最新配置重新连接
+func (w *MQTTWorker) Reload() {
+	select {
+	case w.reloadCh <- struct{}{}:
+	default:
+	}
+}
+
 func (w *MQTTWorker) Stop() {
 	close(w.stopCh)
 	if w.client != nil && w.client.IsConnected() {
@@ -121,19 +190,23 @@ func (w *MQTTWorker) handleMessage(_ mqtt.Client, msg mqtt.Message) {
 	if payload.Timestamp == 0 {
 		payload.Timestamp = time.Now().Unix()
 	}
-	
+
 	// 添加调试日志
 	log.Printf("MQTT received: count=%d, timestamp=%d", payload.Count, payload.Timestamp)
-	
+
 	if err := w.store.InsertEvent(payload.Timestamp, payload.Count); err != nil {
 		_ = w.store.SetSetting("last_mqtt_error", err.Error())
 		log.Printf("DB insert error: %v", err)
 		return
 	}
-	
+
 	_ = w.store.SetSetting("last_msg_ts", fmt.Sprintf("%d", payload.Timestamp))
 	_ = w.store.SetSetting("last_msg_count", fmt.Sprintf("%d", payload.Count))
 	log.Printf("MQTT data saved to database")
+
+	w.hub.PublishEvent(w.store, Event{Timestamp: payload.Timestamp, Count: payload.Count})
+	w.alerts.Trigger()
+	w.gaps.Trigger()
 }
 
 func brokerScheme(useTLS bool) string {
@@ -141,4 +214,4 @@ func brokerScheme(useTLS bool) string {
 		return "ssl"
 	}
 	return "tcp"
-}
\ No newline at end of file
+}
@@ -4,8 +4,10 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"log"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/shopspring/decimal"
@@ -17,31 +19,79 @@ type telegramPayload struct {
 	ParseMode string `json:"parse_mode"`
 }
 
-func sendTelegramNotification(botToken, chatID, message, apiEndpoint string) error {
+func telegramAPIURL(apiEndpoint, botToken, method string) string {
 	endpoint := "https://api.telegram.org"
 	if apiEndpoint != "" {
-		endpoint = apiEndpoint
+		endpoint = strings.TrimRight(apiEndpoint, "/")
 	}
-	url := fmt.Sprintf("%s/bot%s/sendMessage", endpoint, botToken)
+	return fmt.Sprintf("%s/bot%s/%s", endpoint, botToken, method)
+}
+
+func sendTelegramNotification(botToken, chatID, message, apiEndpoint string) error {
+	url := telegramAPIURL(apiEndpoint, botToken, "sendMessage")
 
 	payload := telegramPayload{ChatID: chatID, Text: message, ParseMode: "HTML"}
 	body, err := json.Marshal(payload)
 	if err != nil {
 		return err
 	}
-	resp, err := http.Post(url, "application/json", bytes.NewReader(body))
+	resp, err := notifyHTTPClient.Post(url, "application/json", bytes.NewReader(body))
 	if err != nil {
 		return err
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
-		return fmt.Errorf("telegram status: %s", resp.Status)
+		return &telegramStatusError{Code: resp.StatusCode, Status: resp.Status}
 	}
 	return nil
 }
 
-func checkAndNotifyLowGas(store *Store, settings Settings, remain decimal.Decimal) {
+type telegramStatusError struct {
+	Code   int
+	Status string
+}
+
+func (e *telegramStatusError) Error() string {
+	return "telegram status: " + e.Status
+}
+
+// 除 429 限流外的 4xx（如 Chat 不存在、Bot 被拉黑、消息格式错误）重试也不会成功
+func (e *telegramStatusError) Permanent() bool {
+	return e.Code >= 400 && e.Code < 500 && e.Code != http.StatusTooManyRequests
+}
+
+// 预测耗尽天数是否已进入提醒窗口
+func forecastAlertDue(settings Settings, forecast Forecast) bool {
+	if settings.TGAlertMode != "forecast" || !forecast.Available || forecast.DaysUntilEmpty < 0 {
+		return false
+	}
+	days := parseDecimal(settings.TGForecastDays, defaultTGForecastDays)
+	return decimal.NewFromFloat(forecast.DaysUntilEmpty).LessThanOrEqual(days)
+}
+
+// 是否需要低气量预警，byForecast 表示由预测触发。预测模式只按预测天数判断；
+// 历史数据不足或近期没有用量、无法估算耗尽日期时退回按阈值判断
+func lowGasAlertDue(settings Settings, remain, threshold decimal.Decimal, forecast Forecast) (due, byForecast bool) {
+	if settings.TGAlertMode == "forecast" && forecast.Available && forecast.DaysUntilEmpty >= 0 {
+		byForecast = forecastAlertDue(settings, forecast)
+		return byForecast, byForecast
+	}
+	return remain.LessThan(threshold), false
+}
+
+// 预警静音截止时间（Unix 秒），0 表示未静音
+func notifyMutedUntil(store *Store) int64 {
+	raw, _ := store.GetSetting("notify_mute_until", "0")
+	until, _ := strconv.ParseInt(raw, 10, 64)
+	return until
+}
+
+func notificationsMuted(store *Store, now time.Time) bool {
+	return notifyMutedUntil(store) > now.Unix()
+}
+
+func checkAndNotifyLowGas(store *Store, outbox *NotificationOutbox, settings Settings, remain decimal.Decimal, forecast Forecast) {
 	if !settings.TGEnabled {
 		return
 	}
@@ -49,39 +99,40 @@ func checkAndNotifyLowGas(store *Store, settings Settings, remain decimal.Decima
 		return
 	}
 
+	state, err := store.GetAlertState(alertLowGas)
+	if err != nil {
+		log.Printf("low gas alert: load state: %v", err)
+		return
+	}
+
 	threshold := parseDecimal(settings.TGThreshold, defaultTGThreshold)
-	if remain.GreaterThanOrEqual(threshold) {
-		_ = store.SetSetting("low_gas_notify_count", "0")
-		_ = store.SetSetting("low_gas_first_notify_time", "0")
-		_ = store.SetSetting("last_notify_time", "0")
+	below, byForecast := lowGasAlertDue(settings, remain, threshold, forecast)
+	if !below {
+		if state.Active || state.NotifyCount > 0 {
+			_ = store.SaveAlertState(AlertState{Name: alertLowGas})
+		}
 		return
 	}
 
-	lastNotifyRaw, _ := store.GetSetting("last_notify_time", "0")
-	lastNotify, _ := strconv.ParseInt(lastNotifyRaw, 10, 64)
 	now := time.Now().Unix()
-	if lastNotify > 0 && now-lastNotify < 30 {
+	if state.LastNotifyTS > 0 && now-state.LastNotifyTS < 30 {
 		return
 	}
 
-	notifyCountRaw, _ := store.GetSetting("low_gas_notify_count", "0")
-	notifyCount, _ := strconv.ParseInt(notifyCountRaw, 10, 64)
-	firstNotifyRaw, _ := store.GetSetting("low_gas_first_notify_time", "0")
-	firstNotify, _ := strconv.ParseInt(firstNotifyRaw, 10, 64)
-
 	intervalHours, err := decimal.NewFromString(settings.TGNotifyIntervalHour)
 	if err != nil {
 		intervalHours = decimal.RequireFromString(defaultTGNotifyInterval)
 	}
 	intervalSeconds := intervalHours.Mul(decimal.NewFromInt(3600)).IntPart()
 
+	notifyCount := state.NotifyCount
 	shouldNotify := false
 	notifyType := ""
 	if notifyCount == 0 {
 		shouldNotify = true
 		notifyType = "首次预警"
 	} else if notifyCount < int64(settings.TGNotifyTimes) {
-		elapsed := now - firstNotify
+		elapsed := now - state.FirstNotifyTS
 		required := intervalSeconds * notifyCount
 		if elapsed >= required {
 			shouldNotify = true
@@ -93,19 +144,31 @@ func checkAndNotifyLowGas(store *Store, settings Settings, remain decimal.Decima
 		}
 	}
 
-	if !shouldNotify {
+	if !shouldNotify || notificationsMuted(store, time.Now()) {
+		if !state.Active {
+			state.Active = true
+			_ = store.SaveAlertState(state)
+		}
 		return
 	}
 
-	message := fmt.Sprintf("🔥 <b>燃气余量预警</b> [%s]\n\n⚠️ 当前剩余燃气：<b>%s m³</b>\n📉 已低于阈值：<b>%s m³</b>\n\n💡 请及时充值燃气额度！\n\n⏰ 通知时间：%s", notifyType, remain.StringFixed(3), threshold.StringFixed(3), time.Now().Format("2006-01-02 15:04:05"))
+	message := fmt.Sprintf("🔥 <b>燃气余量预警</b> [%s]\n\n⚠️ 当前剩余燃气：<b>%s m³</b>\n📉 已低于阈值：<b>%s m³</b>\n\n💡 请及时充值燃气额度！\n\n⏰ 通知时间：%s", notifyType, remain.StringFixed(3), threshold.StringFixed(3), time.Now().In(storeLocation(store)).Format("2006-01-02 15:04:05"))
+	if byForecast {
+		message = fmt.Sprintf("🔥 <b>燃气余量预警</b> [%s]\n\n⚠️ 当前剩余燃气：<b>%s m³</b>\n📅 预计 <b>%.1f 天</b>后用完（%s）\n📊 近期日均用气：%s m³\n\n💡 请及时充值燃气额度！\n\n⏰ 通知时间：%s", notifyType, remain.StringFixed(3), forecast.DaysUntilEmpty, forecast.EmptyDate.Format("2006-01-02"), quantize3(forecast.DailyAvgGas).StringFixed(3), time.Now().In(storeLocation(store)).Format("2006-01-02 15:04:05"))
+	}
 
-	_ = store.SetSetting("last_notify_time", fmt.Sprintf("%d", now))
-	if err := sendTelegramNotification(settings.TGBotToken, settings.TGChatID, message, settings.TGAPIEndpoint); err != nil {
-		_ = store.SetSetting("last_notify_time", lastNotifyRaw)
+	state.Active = true
+	if err := outbox.Enqueue(settings, []string{channelTelegram}, alertLowGas, message); err != nil {
+		log.Printf("low gas alert: enqueue: %v", err)
+		_ = store.SaveAlertState(state)
 		return
 	}
 	if notifyCount == 0 {
-		_ = store.SetSetting("low_gas_first_notify_time", fmt.Sprintf("%d", now))
+		state.FirstNotifyTS = now
+	}
+	state.NotifyCount = notifyCount + 1
+	state.LastNotifyTS = now
+	if err := store.SaveAlertState(state); err != nil {
+		log.Printf("low gas alert: save state: %v", err)
 	}
-	_ = store.SetSetting("low_gas_notify_count", fmt.Sprintf("%d", notifyCount+1))
-}
\ No newline at end of file
+}
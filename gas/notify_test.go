@@ -0,0 +1,34 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/shopspring/decimal"
+)
+
+func TestLowGasAlertDue(t *testing.T) {
+	threshold := decimal.NewFromInt(10)
+	forecastMode := Settings{TGAlertMode: "forecast", TGForecastDays: "3"}
+	cases := []struct {
+		name            string
+		settings        Settings
+		remain          string
+		forecast        Forecast
+		due, byForecast bool
+	}{
+		{"阈值模式低于阈值", Settings{TGAlertMode: "threshold"}, "5", Forecast{}, true, false},
+		{"阈值模式高于阈值", Settings{TGAlertMode: "threshold"}, "15", Forecast{}, false, false},
+		{"预测进入提醒窗口", forecastMode, "15", Forecast{Available: true, DaysUntilEmpty: 2}, true, true},
+		{"预测未进入窗口时不按阈值", forecastMode, "5", Forecast{Available: true, DaysUntilEmpty: 20}, false, false},
+		{"历史不足退回阈值", forecastMode, "5", Forecast{}, true, false},
+		{"近期无用量退回阈值", forecastMode, "5", Forecast{Available: true, DaysUntilEmpty: -1}, true, false},
+		{"余量为零且无用量", forecastMode, "0", Forecast{Available: true, DaysUntilEmpty: -1}, true, false},
+		{"近期无用量且高于阈值", forecastMode, "15", Forecast{Available: true, DaysUntilEmpty: -1}, false, false},
+	}
+	for _, c := range cases {
+		due, byForecast := lowGasAlertDue(c.settings, decimal.RequireFromString(c.remain), threshold, c.forecast)
+		if due != c.due || byForecast != c.byForecast {
+			t.Errorf("%s: got (%v, %v), want (%v, %v)", c.name, due, byForecast, c.due, c.byForecast)
+		}
+	}
+}
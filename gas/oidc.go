@@ -0,0 +1,385 @@
+package main
+
+import (
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	oidcHTTPTimeout    = 10 * time.Second
+	oidcDiscoveryTTL   = time.Hour
+	oidcJWKSMinRefresh = time.Minute
+	oidcStateTTL       = 10 * time.Minute
+)
+
+var oidcHTTPClient = &http.Client{Timeout: oidcHTTPTimeout}
+
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	UserinfoEndpoint      string `json:"userinfo_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+type oidcJWKS struct {
+	Keys []struct {
+		Kty string `json:"kty"`
+		Kid string `json:"kid"`
+		Use string `json:"use"`
+		N   string `json:"n"`
+		E   string `json:"e"`
+	} `json:"keys"`
+}
+
+// 发现文档和签名公钥按 Issuer 缓存，公钥遇到未知 kid 时刷新
+var oidcCache = struct {
+	sync.Mutex
+	discovery   map[string]oidcDiscovery
+	discoveryAt map[string]time.Time
+	keys        map[string]map[string]*rsa.PublicKey
+	keysAt      map[string]time.Time
+}{
+	discovery:   make(map[string]oidcDiscovery),
+	discoveryAt: make(map[string]time.Time),
+	keys:        make(map[string]map[string]*rsa.PublicKey),
+	keysAt:      make(map[string]time.Time),
+}
+
+// 跳转到 IdP 前生成的 state，保存 PKCE verifier 和 nonce
+type oidcState struct {
+	verifier string
+	nonce    string
+	expires  time.Time
+}
+
+var oidcStates = struct {
+	sync.Mutex
+	items map[string]oidcState
+}{items: make(map[string]oidcState)}
+
+// OIDC 授权码登录（PKCE S256），ID Token 使用 IdP 的 JWKS 公钥（RS256）校验
+type oidcProvider struct {
+	settings Settings
+}
+
+func newOIDCProvider(settings Settings) *oidcProvider {
+	return &oidcProvider{settings: settings}
+}
+
+func (p *oidcProvider) Name() string { return "oidc" }
+
+func getJSON(rawURL string, out interface{}) error {
+	resp, err := oidcHTTPClient.Get(rawURL)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", rawURL, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+func (p *oidcProvider) discover() (oidcDiscovery, error) {
+	issuer := strings.TrimRight(p.settings.OIDCIssuer, "/")
+	oidcCache.Lock()
+	doc, ok := oidcCache.discovery[issuer]
+	fresh := time.Since(oidcCache.discoveryAt[issuer]) < oidcDiscoveryTTL
+	oidcCache.Unlock()
+	if ok && fresh {
+		return doc, nil
+	}
+
+	if err := getJSON(issuer+"/.well-known/openid-configuration", &doc); err != nil {
+		return oidcDiscovery{}, fmt.Errorf("获取 OIDC 发现文档失败: %w", err)
+	}
+	if strings.TrimRight(doc.Issuer, "/") != issuer {
+		return oidcDiscovery{}, fmt.Errorf("OIDC 发现文档中的 issuer 不匹配: %s", doc.Issuer)
+	}
+	if doc.AuthorizationEndpoint == "" || doc.TokenEndpoint == "" || doc.JWKSURI == "" {
+		return oidcDiscovery{}, errors.New("OIDC 发现文档缺少必要的端点")
+	}
+	oidcCache.Lock()
+	oidcCache.discovery[issuer] = doc
+	oidcCache.discoveryAt[issuer] = time.Now()
+	oidcCache.Unlock()
+	return doc, nil
+}
+
+func (p *oidcProvider) publicKey(jwksURI, kid string) (*rsa.PublicKey, error) {
+	oidcCache.Lock()
+	key := oidcCache.keys[jwksURI][kid]
+	canRefresh := time.Since(oidcCache.keysAt[jwksURI]) >= oidcJWKSMinRefresh
+	oidcCache.Unlock()
+	if key != nil {
+		return key, nil
+	}
+	if !canRefresh {
+		return nil, fmt.Errorf("未知的签名密钥: %s", kid)
+	}
+
+	var set oidcJWKS
+	if err := getJSON(jwksURI, &set); err != nil {
+		return nil, fmt.Errorf("获取 JWKS 失败: %w", err)
+	}
+	keys := make(map[string]*rsa.PublicKey)
+	for _, k := range set.Keys {
+		if k.Kty != "RSA" || (k.Use != "" && k.Use != "sig") {
+			continue
+		}
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			continue
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			continue
+		}
+		keys[k.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+	}
+	oidcCache.Lock()
+	oidcCache.keys[jwksURI] = keys
+	oidcCache.keysAt[jwksURI] = time.Now()
+	oidcCache.Unlock()
+
+	if key = keys[kid]; key == nil {
+		return nil, fmt.Errorf("未知的签名密钥: %s", kid)
+	}
+	return key, nil
+}
+
+func (p *oidcProvider) LoginURL(r *http.Request) (string, error) {
+	doc, err := p.discover()
+	if err != nil {
+		return "", err
+	}
+	state, err := generateSecureKey(16)
+	if err != nil {
+		return "", err
+	}
+	nonce, err := generateSecureKey(16)
+	if err != nil {
+		return "", err
+	}
+	verifier, err := generateSecureKey(32)
+	if err != nil {
+		return "", err
+	}
+	challenge := sha256.Sum256([]byte(verifier))
+
+	now := time.Now()
+	oidcStates.Lock()
+	for key, st := range oidcStates.items {
+		if now.After(st.expires) {
+			delete(oidcStates.items, key)
+		}
+	}
+	oidcStates.items[state] = oidcState{verifier: verifier, nonce: nonce, expires: now.Add(oidcStateTTL)}
+	oidcStates.Unlock()
+
+	query := url.Values{}
+	query.Set("response_type", "code")
+	query.Set("client_id", p.settings.OIDCClientID)
+	query.Set("redirect_uri", p.settings.OIDCRedirectURL)
+	query.Set("scope", p.scopes())
+	query.Set("state", state)
+	query.Set("nonce", nonce)
+	query.Set("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:]))
+	query.Set("code_challenge_method", "S256")
+
+	sep := "?"
+	if strings.Contains(doc.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	return doc.AuthorizationEndpoint + sep + query.Encode(), nil
+}
+
+func (p *oidcProvider) scopes() string {
+	scopes := strings.Join(strings.Fields(strings.ReplaceAll(p.settings.OIDCScopes, ",", " ")), " ")
+	if scopes == "" {
+		scopes = defaultOIDCScopes
+	}
+	if !strings.Contains(" "+scopes+" ", " openid ") {
+		scopes = "openid " + scopes
+	}
+	return scopes
+}
+
+func (p *oidcProvider) CompleteLogin(r *http.Request) (*ExternalIdentity, error) {
+	query := r.URL.Query()
+	if e := query.Get("error"); e != "" {
+		return nil, fmt.Errorf("IdP 返回错误: %s %s", e, query.Get("error_description"))
+	}
+	oidcStates.Lock()
+	st, ok := oidcStates.items[query.Get("state")]
+	delete(oidcStates.items, query.Get("state"))
+	oidcStates.Unlock()
+	if !ok || time.Now().After(st.expires) {
+		return nil, errors.New("登录状态无效或已过期，请重新登录")
+	}
+	code := query.Get("code")
+	if code == "" {
+		return nil, errors.New("缺少授权码")
+	}
+
+	doc, err := p.discover()
+	if err != nil {
+		return nil, err
+	}
+	tokens, err := p.exchangeCode(doc, code, st.verifier)
+	if err != nil {
+		return nil, err
+	}
+
+	claims := jwt.MapClaims{}
+	_, err = jwt.ParseWithClaims(tokens.IDToken, claims, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		return p.publicKey(doc.JWKSURI, kid)
+	},
+		jwt.WithValidMethods([]string{"RS256"}),
+		jwt.WithIssuer(doc.Issuer),
+		jwt.WithAudience(p.settings.OIDCClientID),
+		jwt.WithExpirationRequired(),
+		jwt.WithLeeway(time.Minute),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("ID Token 校验失败: %w", err)
+	}
+	if nonce, _ := claims["nonce"].(string); nonce != st.nonce {
+		return nil, errors.New("ID Token 校验失败: nonce 不匹配")
+	}
+
+	// 部分 IdP 只在 userinfo 中返回用户名和组，ID Token 缺少时补充查询
+	usernameClaim := p.settings.OIDCUsernameClaim
+	if usernameClaim == "" {
+		usernameClaim = defaultOIDCUserClaim
+	}
+	groupsClaim := p.settings.OIDCGroupsClaim
+	if groupsClaim == "" {
+		groupsClaim = defaultOIDCGroupsClaim
+	}
+	_, hasUser := claims[usernameClaim]
+	_, hasGroups := claims[groupsClaim]
+	if (!hasUser || !hasGroups) && doc.UserinfoEndpoint != "" && tokens.AccessToken != "" {
+		info, err := p.userinfo(doc.UserinfoEndpoint, tokens.AccessToken)
+		if err != nil {
+			return nil, err
+		}
+		// userinfo 的 sub 必须与 ID Token 一致
+		if info["sub"] != claims["sub"] {
+			return nil, errors.New("userinfo 与 ID Token 的 sub 不一致")
+		}
+		for k, v := range info {
+			if _, exists := claims[k]; !exists {
+				claims[k] = v
+			}
+		}
+	}
+
+	username, _ := claims[usernameClaim].(string)
+	if username == "" {
+		return nil, fmt.Errorf("ID Token 中缺少用户名声明 %s", usernameClaim)
+	}
+	subject, _ := claims["sub"].(string)
+	if subject == "" {
+		return nil, errors.New("ID Token 中缺少 sub 声明")
+	}
+	return &ExternalIdentity{
+		Provider: p.Name(),
+		Subject:  subject,
+		Username: username,
+		Groups:   claimStrings(claims[groupsClaim]),
+	}, nil
+}
+
+type oidcTokenResponse struct {
+	AccessToken string `json:"access_token"`
+	IDToken     string `json:"id_token"`
+	Error       string `json:"error"`
+	Description string `json:"error_description"`
+}
+
+func (p *oidcProvider) exchangeCode(doc oidcDiscovery, code, verifier string) (oidcTokenResponse, error) {
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", p.settings.OIDCRedirectURL)
+	form.Set("code_verifier", verifier)
+	form.Set("client_id", p.settings.OIDCClientID)
+
+	req, err := http.NewRequest(http.MethodPost, doc.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return oidcTokenResponse{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if p.settings.OIDCClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(p.settings.OIDCClientID), url.QueryEscape(p.settings.OIDCClientSecret))
+	}
+
+	resp, err := oidcHTTPClient.Do(req)
+	if err != nil {
+		return oidcTokenResponse{}, err
+	}
+	defer resp.Body.Close()
+
+	var tokens oidcTokenResponse
+	if err := json.NewDecoder(resp.Body).Decode(&tokens); err != nil {
+		return oidcTokenResponse{}, fmt.Errorf("解析 Token 响应失败: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK || tokens.Error != "" {
+		return oidcTokenResponse{}, fmt.Errorf("换取 Token 失败: %s %s %s", resp.Status, tokens.Error, tokens.Description)
+	}
+	if tokens.IDToken == "" {
+		return oidcTokenResponse{}, errors.New("Token 响应中缺少 id_token")
+	}
+	return tokens, nil
+}
+
+func (p *oidcProvider) userinfo(endpoint, accessToken string) (map[string]interface{}, error) {
+	req, err := http.NewRequest(http.MethodGet, endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+	resp, err := oidcHTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("获取 userinfo 失败: %s", resp.Status)
+	}
+	info := map[string]interface{}{}
+	return info, json.NewDecoder(resp.Body).Decode(&info)
+}
+
+// 组声明可能是字符串数组，也可能是逗号分隔的字符串
+func claimStrings(v interface{}) []string {
+	switch val := v.(type) {
+	case string:
+		return splitList(val)
+	case []interface{}:
+		out := make([]string, 0, len(val))
+		for _, item := range val {
+			if s, ok := item.(string); ok && s != "" {
+				out = append(out, s)
+			}
+		}
+		return out
+	}
+	return nil
+}
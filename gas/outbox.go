@@ -0,0 +1,221 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+const (
+	notifyHTTPTimeout    = 10 * time.Second
+	outboxPollInterval   = 5 * time.Second
+	outboxBatchSize      = 20
+	outboxBaseBackoff    = 30 * time.Second
+	outboxMaxBackoff     = time.Hour
+	outboxMaxAttempts    = 8
+	notificationPending  = "pending"
+	notificationSent     = "sent"
+	notificationFailed   = "failed"
+	notificationKindTest = "test"
+)
+
+// 所有通知渠道共用的 HTTP 客户端，避免对端无响应时永久阻塞
+var notifyHTTPClient = &http.Client{Timeout: notifyHTTPTimeout}
+
+// NotificationOutbox 是持久化的通知发件箱：消息先入库，
+// 再由后台协程投递，失败后按指数退避重试，每次尝试都有记录
+type NotificationOutbox struct {
+	store   *Store
+	trigger chan struct{}
+	stopCh  chan struct{}
+}
+
+func NewNotificationOutbox(store *Store) *NotificationOutbox {
+	return &NotificationOutbox{
+		store:   store,
+		trigger: make(chan struct{}, 1),
+		stopCh:  make(chan struct{}),
+	}
+}
+
+func (o *NotificationOutbox) Start() {
+	go func() {
+		ticker := time.NewTicker(outboxPollInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-o.stopCh:
+				return
+			case <-o.trigger:
+				o.deliverDue()
+			case <-ticker.C:
+				o.deliverDue()
+			}
+		}
+	}()
+}
+
+func (o *NotificationOutbox) Stop() {
+	close(o.stopCh)
+}
+
+func (o *NotificationOutbox) wake() {
+	select {
+	case o.trigger <- struct{}{}:
+	default:
+	}
+}
+
+// 将消息加入发件箱，每个渠道一条记录；渠道未配置时直接返回错误
+func (o *NotificationOutbox) Enqueue(settings Settings, channels []string, kind, message string) error {
+	if len(channels) == 0 {
+		return errors.New("没有已启用的通知渠道")
+	}
+	now := time.Now().Unix()
+	for _, channel := range channels {
+		var target string
+		switch channel {
+		case channelTelegram:
+			if !settings.TGEnabled || settings.TGBotToken == "" || settings.TGChatID == "" {
+				return errors.New("Telegram 通知未启用或未配置")
+			}
+			target = settings.TGChatID
+		default:
+			return fmt.Errorf("不支持的通知渠道: %s", channel)
+		}
+		if _, err := o.store.InsertNotification(Notification{
+			Channel:       channel,
+			Target:        target,
+			Kind:          kind,
+			Message:       message,
+			Status:        notificationPending,
+			NextAttemptTS: now,
+			CreatedTS:     now,
+		}); err != nil {
+			return err
+		}
+	}
+	o.wake()
+	return nil
+}
+
+// 立即投递一条通知并等待结果，用于测试通知；失败时不自动重试，但同样记录历史
+func (o *NotificationOutbox) SendNow(settings Settings, channel, target, kind, message string) error {
+	now := time.Now()
+	n := Notification{
+		Channel:       channel,
+		Target:        target,
+		Kind:          kind,
+		Message:       message,
+		Status:        notificationPending,
+		NextAttemptTS: now.Unix(),
+		CreatedTS:     now.Unix(),
+	}
+	id, err := o.store.InsertNotification(n)
+	if err != nil {
+		return err
+	}
+	n.ID = id
+
+	sendErr := deliverNotification(settings, n)
+	n.Attempts = 1
+	attempt := NotificationAttempt{NotificationID: id, TS: now.Unix(), Success: sendErr == nil, DurationMS: time.Since(now).Milliseconds()}
+	if sendErr != nil {
+		n.Status = notificationFailed
+		n.LastError = sendErr.Error()
+		attempt.Error = sendErr.Error()
+	} else {
+		n.Status = notificationSent
+		n.SentTS = time.Now().Unix()
+	}
+	if err := o.store.RecordNotificationAttempt(n, attempt); err != nil {
+		log.Printf("notification outbox: record attempt %d: %v", id, err)
+	}
+	return sendErr
+}
+
+// 重试间隔：30s、60s、120s……最长 1 小时
+func outboxBackoff(attempts int) time.Duration {
+	d := outboxBaseBackoff
+	for i := 1; i < attempts; i++ {
+		d *= 2
+		if d >= outboxMaxBackoff {
+			return outboxMaxBackoff
+		}
+	}
+	return d
+}
+
+func (o *NotificationOutbox) deliverDue() {
+	pending, err := o.store.FetchDueNotifications(time.Now().Unix(), outboxBatchSize)
+	if err != nil {
+		log.Printf("notification outbox: load: %v", err)
+		return
+	}
+	if len(pending) == 0 {
+		return
+	}
+	settings, err := loadSettings(o.store)
+	if err != nil {
+		log.Printf("notification outbox: load settings: %v", err)
+		return
+	}
+
+	for _, n := range pending {
+		started := time.Now()
+		sendErr := deliverNotification(settings, n)
+		attempt := NotificationAttempt{
+			NotificationID: n.ID,
+			TS:             started.Unix(),
+			Success:        sendErr == nil,
+			DurationMS:     time.Since(started).Milliseconds(),
+		}
+
+		n.Attempts++
+		if sendErr == nil {
+			n.Status = notificationSent
+			n.SentTS = time.Now().Unix()
+			n.LastError = ""
+		} else {
+			attempt.Error = sendErr.Error()
+			n.LastError = sendErr.Error()
+			var statusErr *telegramStatusError
+			if errors.As(sendErr, &statusErr) && statusErr.Permanent() {
+				n.Status = notificationFailed
+				log.Printf("notification outbox: %d rejected, not retrying: %v", n.ID, sendErr)
+			} else if n.Attempts >= outboxMaxAttempts {
+				n.Status = notificationFailed
+				log.Printf("notification outbox: %d giving up after %d attempts: %v", n.ID, n.Attempts, sendErr)
+			} else {
+				n.NextAttemptTS = time.Now().Add(outboxBackoff(n.Attempts)).Unix()
+				log.Printf("notification outbox: %d attempt %d failed: %v", n.ID, n.Attempts, sendErr)
+			}
+		}
+		if err := o.store.RecordNotificationAttempt(n, attempt); err != nil {
+			log.Printf("notification outbox: record attempt %d: %v", n.ID, err)
+		}
+	}
+}
+
+// 投递时使用最新的渠道凭据，接收方沿用入队时的目标
+func deliverNotification(settings Settings, n Notification) error {
+	switch n.Channel {
+	case channelTelegram:
+		if settings.TGBotToken == "" {
+			return errors.New("Telegram Bot Token 未配置")
+		}
+		return sendTelegramNotification(settings.TGBotToken, n.Target, n.Message, settings.TGAPIEndpoint)
+	}
+	return fmt.Errorf("不支持的通知渠道: %s", n.Channel)
+}
+
+// 将失败的通知重新放回队列
+func (o *NotificationOutbox) Retry(id int64) error {
+	if err := o.store.RequeueNotification(id, time.Now().Unix()); err != nil {
+		return err
+	}
+	o.wake()
+	return nil
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestOutboxBackoff(t *testing.T) {
+	cases := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{1, 30 * time.Second},
+		{2, time.Minute},
+		{3, 2 * time.Minute},
+		{7, 32 * time.Minute},
+		{8, time.Hour},
+		{20, time.Hour},
+	}
+	for _, c := range cases {
+		if got := outboxBackoff(c.attempts); got != c.want {
+			t.Errorf("outboxBackoff(%d) = %s, want %s", c.attempts, got, c.want)
+		}
+	}
+}
+
+func TestOutboxDeliverStatus(t *testing.T) {
+	cases := []struct {
+		name        string
+		code        int
+		wantStatus  string
+		wantBackoff bool
+	}{
+		{"成功", http.StatusOK, notificationSent, false},
+		{"Chat 不存在不再重试", http.StatusBadRequest, notificationFailed, false},
+		{"Bot 被拉黑不再重试", http.StatusForbidden, notificationFailed, false},
+		{"限流稍后重试", http.StatusTooManyRequests, notificationPending, true},
+		{"服务端错误稍后重试", http.StatusBadGateway, notificationPending, true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(c.code)
+			}))
+			defer srv.Close()
+
+			store, err := NewStore(filepath.Join(t.TempDir(), "gas.db"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer store.Close()
+			if err := store.SetSettings(map[string]string{"tg_bot_token": "token", "tg_api_endpoint": srv.URL}); err != nil {
+				t.Fatal(err)
+			}
+			id, err := store.InsertNotification(Notification{
+				Channel: channelTelegram, Target: "42", Kind: "alert", Message: "hi",
+				Status: notificationPending, NextAttemptTS: time.Now().Unix(), CreatedTS: time.Now().Unix(),
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			NewNotificationOutbox(store).deliverDue()
+
+			n, err := store.FetchNotification(id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n.Status != c.wantStatus || n.Attempts != 1 {
+				t.Fatalf("status %q after %d attempts, want %q after 1", n.Status, n.Attempts, c.wantStatus)
+			}
+			if c.wantBackoff && n.NextAttemptTS < time.Now().Add(outboxBaseBackoff-time.Second).Unix() {
+				t.Errorf("next attempt at %d was not backed off", n.NextAttemptTS)
+			}
+		})
+	}
+}
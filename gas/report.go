@@ -0,0 +1,315 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+const (
+	defaultReportTime     = "08:00"
+	reportCheckInterval   = time.Minute
+	reportKindDaily       = "daily"
+	reportKindWeekly      = "weekly"
+	reportKindMonthly     = "monthly"
+	defaultDailyReportTpl = `📊 <b>每日用气报告</b> {{.Date}}
+
+昨日用气：<b>{{.YesterdayGas}} m³</b>（{{.YesterdayCost}} 元）
+本周累计：{{.WeekToDateGas}} m³，上周同期 {{.LastWeekToDateGas}} m³（{{.WeekToDateChange}}）
+本期账单：{{.BillGas}} m³（{{.BillCost}} 元）
+
+🔋 剩余燃气：<b>{{.RemainGas}} m³</b>{{if .DaysLeft}}
+📅 预计 {{.DaysLeft}} 天后用完（{{.EmptyDate}}）{{end}}`
+	defaultWeeklyReportTpl = `📊 <b>每周用气报告</b> {{.LastWeekStart}} ~ {{.LastWeekEnd}}
+
+上周用气：<b>{{.LastWeekGas}} m³</b>（{{.LastWeekCost}} 元）
+前一周：{{.PrevWeekGas}} m³（{{.LastWeekChange}}）
+本期账单：{{.BillGas}} m³（{{.BillCost}} 元）
+
+🔋 剩余燃气：<b>{{.RemainGas}} m³</b>{{if .DaysLeft}}
+📅 预计 {{.DaysLeft}} 天后用完（{{.EmptyDate}}）{{end}}`
+	defaultMonthlyReportTpl = `📊 <b>账单周期报告</b> {{.LastBillStart}} ~ {{.LastBillEnd}}
+
+上期用气：<b>{{.LastBillGas}} m³</b>（{{.LastBillCost}} 元）
+日均用气：{{.DailyAvgGas}} m³
+
+🔋 剩余燃气：<b>{{.RemainGas}} m³</b>{{if .DaysLeft}}
+📅 预计 {{.DaysLeft}} 天后用完（{{.EmptyDate}}）{{end}}`
+)
+
+var reportKinds = []string{reportKindDaily, reportKindWeekly, reportKindMonthly}
+
+// 报告模板可用的数据
+type ReportData struct {
+	Date              string
+	YesterdayGas      string
+	YesterdayCost     string
+	WeekToDateGas     string
+	LastWeekToDateGas string
+	WeekToDateChange  string
+	LastWeekStart     string
+	LastWeekEnd       string
+	LastWeekGas       string
+	LastWeekCost      string
+	PrevWeekGas       string
+	LastWeekChange    string
+	BillGas           string
+	BillCost          string
+	LastBillStart     string
+	LastBillEnd       string
+	LastBillGas       string
+	LastBillCost      string
+	RemainGas         string
+	DailyAvgGas       string
+	DaysLeft          string
+	EmptyDate         string
+}
+
+func defaultReportTemplate(kind string) string {
+	switch kind {
+	case reportKindWeekly:
+		return defaultWeeklyReportTpl
+	case reportKindMonthly:
+		return defaultMonthlyReportTpl
+	}
+	return defaultDailyReportTpl
+}
+
+func reportTemplate(settings Settings, kind string) string {
+	var tpl string
+	switch kind {
+	case reportKindDaily:
+		tpl = settings.ReportDailyTemplate
+	case reportKindWeekly:
+		tpl = settings.ReportWeeklyTemplate
+	case reportKindMonthly:
+		tpl = settings.ReportMonthlyTemplate
+	}
+	if strings.TrimSpace(tpl) == "" {
+		return defaultReportTemplate(kind)
+	}
+	return tpl
+}
+
+func validateReportTemplate(tpl string) error {
+	if strings.TrimSpace(tpl) == "" {
+		return nil
+	}
+	t, err := template.New("report").Parse(tpl)
+	if err != nil {
+		return err
+	}
+	return t.Execute(&bytes.Buffer{}, ReportData{})
+}
+
+// 相对变化百分比，基数为 0 时返回 "--"
+func formatChange(cur, prev decimal.Decimal) string {
+	if prev.IsZero() {
+		return "--"
+	}
+	pct := cur.Sub(prev).Div(prev).Mul(decimal.NewFromInt(100)).Round(1)
+	if pct.IsPositive() {
+		return "+" + pct.StringFixed(1) + "%"
+	}
+	return pct.StringFixed(1) + "%"
+}
+
+func buildReportData(store *Store, settings Settings, now time.Time) (ReportData, error) {
+	gasPerPulse := parseDecimal(settings.GasPerPulse, defaultGasPerPulse)
+	price := parseDecimal(settings.GasPrice, defaultGasPrice)
+	rules := periodRulesFromSettings(settings)
+
+	gasBetween := func(start, end time.Time) (decimal.Decimal, error) {
+		pulses, err := calcUsagePulsesByDelta(store, start, end)
+		if err != nil {
+			return decimal.Zero, err
+		}
+		return quantize3(pulsesToGas(pulses, gasPerPulse)), nil
+	}
+	cost := func(gas decimal.Decimal) string {
+		return gas.Mul(price).StringFixed(2)
+	}
+
+	today := startOfDay(now)
+	yesterday, err := gasBetween(today.AddDate(0, 0, -1), today)
+	if err != nil {
+		return ReportData{}, err
+	}
+
+	weekStart := startOfWeek(now, rules.WeekStart)
+	lastWeekStart := weekStart.AddDate(0, 0, -7)
+	weekToDate, err := gasBetween(weekStart, now)
+	if err != nil {
+		return ReportData{}, err
+	}
+	lastWeekToDate, err := gasBetween(lastWeekStart, now.AddDate(0, 0, -7))
+	if err != nil {
+		return ReportData{}, err
+	}
+	lastWeek, err := gasBetween(lastWeekStart, weekStart)
+	if err != nil {
+		return ReportData{}, err
+	}
+	prevWeek, err := gasBetween(lastWeekStart.AddDate(0, 0, -7), lastWeekStart)
+	if err != nil {
+		return ReportData{}, err
+	}
+
+	bill := billingPeriodFor(now, rules)
+	billGas, err := gasBetween(bill.Start, now)
+	if err != nil {
+		return ReportData{}, err
+	}
+	lastBillStart := bill.Start.AddDate(0, -1, 0)
+	lastBillGas, err := gasBetween(lastBillStart, bill.Start)
+	if err != nil {
+		return ReportData{}, err
+	}
+
+	metrics, err := computeMetrics(store)
+	if err != nil {
+		return ReportData{}, err
+	}
+
+	return ReportData{
+		Date:              now.Format("2006-01-02"),
+		YesterdayGas:      yesterday.StringFixed(3),
+		YesterdayCost:     cost(yesterday),
+		WeekToDateGas:     weekToDate.StringFixed(3),
+		LastWeekToDateGas: lastWeekToDate.StringFixed(3),
+		WeekToDateChange:  formatChange(weekToDate, lastWeekToDate),
+		LastWeekStart:     lastWeekStart.Format("2006-01-02"),
+		LastWeekEnd:       weekStart.AddDate(0, 0, -1).Format("2006-01-02"),
+		LastWeekGas:       lastWeek.StringFixed(3),
+		LastWeekCost:      cost(lastWeek),
+		PrevWeekGas:       prevWeek.StringFixed(3),
+		LastWeekChange:    formatChange(lastWeek, prevWeek),
+		BillGas:           billGas.StringFixed(3),
+		BillCost:          cost(billGas),
+		LastBillStart:     lastBillStart.Format("2006-01-02"),
+		LastBillEnd:       bill.Start.AddDate(0, 0, -1).Format("2006-01-02"),
+		LastBillGas:       lastBillGas.StringFixed(3),
+		LastBillCost:      cost(lastBillGas),
+		RemainGas:         metrics.RemainGas,
+		DailyAvgGas:       metrics.DailyAvgGas,
+		DaysLeft:          metrics.DaysLeft,
+		EmptyDate:         metrics.EmptyDate,
+	}, nil
+}
+
+func renderReport(store *Store, settings Settings, kind string, now time.Time) (string, error) {
+	tpl, err := template.New(kind).Parse(reportTemplate(settings, kind))
+	if err != nil {
+		return "", err
+	}
+	data, err := buildReportData(store, settings, now)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	if err := tpl.Execute(&buf, data); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// ReportScheduler 在独立协程中按配置时间发送定期报告
+type ReportScheduler struct {
+	store  *Store
+	outbox *NotificationOutbox
+	stopCh chan struct{}
+}
+
+func NewReportScheduler(store *Store, outbox *NotificationOutbox) *ReportScheduler {
+	return &ReportScheduler{store: store, outbox: outbox, stopCh: make(chan struct{})}
+}
+
+func (s *ReportScheduler) Start() {
+	go func() {
+		ticker := time.NewTicker(reportCheckInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-s.stopCh:
+				return
+			case <-ticker.C:
+				s.runDue()
+			}
+		}
+	}()
+}
+
+func (s *ReportScheduler) Stop() {
+	close(s.stopCh)
+}
+
+// 报告是否到期：返回该报告所属周期的标识，为空表示今天不发送
+func reportPeriodKey(settings Settings, kind string, now time.Time) string {
+	rules := periodRulesFromSettings(settings)
+	switch kind {
+	case reportKindDaily:
+		if settings.ReportDailyEnabled {
+			return now.Format("2006-01-02")
+		}
+	case reportKindWeekly:
+		if settings.ReportWeeklyEnabled && now.Weekday() == rules.WeekStart {
+			return now.Format("2006-01-02")
+		}
+	case reportKindMonthly:
+		if settings.ReportMonthlyEnabled && now.Day() == rules.BillingDay {
+			return now.Format("2006-01-02")
+		}
+	}
+	return ""
+}
+
+func parseClock(value string) (int, int, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(value))
+	if err != nil {
+		return 0, 0, fmt.Errorf("时间格式应为 HH:MM: %s", value)
+	}
+	return t.Hour(), t.Minute(), nil
+}
+
+func (s *ReportScheduler) runDue() {
+	settings, err := loadSettings(s.store)
+	if err != nil {
+		log.Printf("report scheduler: load settings: %v", err)
+		return
+	}
+	now := time.Now().In(loadLocation(settings.Timezone))
+	hour, minute, err := parseClock(settings.ReportTime)
+	if err != nil {
+		hour, minute, _ = parseClock(defaultReportTime)
+	}
+	sendAt := time.Date(now.Year(), now.Month(), now.Day(), hour, minute, 0, 0, now.Location())
+	if now.Before(sendAt) {
+		return
+	}
+
+	for _, kind := range reportKinds {
+		key := reportPeriodKey(settings, kind, now)
+		if key == "" {
+			continue
+		}
+		lastKey := "report_last_" + kind
+		if last, _ := s.store.GetSetting(lastKey, ""); last == key {
+			continue
+		}
+		message, err := renderReport(s.store, settings, kind, now)
+		if err != nil {
+			log.Printf("report scheduler: render %s: %v", kind, err)
+			continue
+		}
+		if err := s.outbox.Enqueue(settings, []string{channelTelegram}, "report_"+kind, message); err != nil {
+			log.Printf("report scheduler: enqueue %s: %v", kind, err)
+			continue
+		}
+		_ = s.store.SetSetting(lastKey, key)
+	}
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+const (
+	ruleRemainBelow = "remain_below"
+	ruleDailyAbove  = "daily_above"
+	ruleHourlyAbove = "hourly_above"
+	ruleNoData      = "no_data"
+
+	severityInfo     = "info"
+	severityWarning  = "warning"
+	severityCritical = "critical"
+
+	channelTelegram = "telegram"
+)
+
+var alertRuleKinds = map[string]struct {
+	Label string
+	Unit  string
+	Below bool
+}{
+	ruleRemainBelow: {Label: "剩余燃气", Unit: "m³", Below: true},
+	ruleDailyAbove:  {Label: "今日用气", Unit: "m³"},
+	ruleHourlyAbove: {Label: "近 1 小时用气", Unit: "m³/h"},
+	ruleNoData:      {Label: "未收到数据", Unit: "分钟"},
+}
+
+var alertSeverityLabels = map[string]string{
+	severityInfo:     "提示",
+	severityWarning:  "警告",
+	severityCritical: "严重",
+}
+
+var alertChannels = map[string]struct{}{
+	channelTelegram: {},
+}
+
+// 拆分逗号分隔的列表，忽略空项
+func splitList(raw string) []string {
+	items := []string{}
+	for _, item := range strings.Split(raw, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// 校验并规范化规则，未填写的可选项使用默认值
+func normalizeAlertRule(rule *AlertRule) error {
+	rule.Name = strings.TrimSpace(rule.Name)
+	if rule.Name == "" {
+		return errors.New("规则名称不能为空")
+	}
+	if _, ok := alertRuleKinds[rule.Kind]; !ok {
+		return fmt.Errorf("不支持的规则类型: %s", rule.Kind)
+	}
+	threshold, err := decimal.NewFromString(strings.TrimSpace(rule.Threshold))
+	if err != nil || threshold.IsNegative() {
+		return errors.New("阈值必须是非负数")
+	}
+	rule.Threshold = threshold.String()
+	if strings.TrimSpace(rule.Hysteresis) == "" {
+		rule.Hysteresis = "0"
+	}
+	hysteresis, err := decimal.NewFromString(strings.TrimSpace(rule.Hysteresis))
+	if err != nil || hysteresis.IsNegative() {
+		return errors.New("回差必须是非负数")
+	}
+	rule.Hysteresis = hysteresis.String()
+	if rule.Severity == "" {
+		rule.Severity = severityWarning
+	}
+	if _, ok := alertSeverityLabels[rule.Severity]; !ok {
+		return fmt.Errorf("不支持的严重级别: %s", rule.Severity)
+	}
+	if rule.RepeatMinutes < 0 || rule.MaxRepeats < 0 {
+		return errors.New("重复间隔和重复次数不能为负数")
+	}
+	rule.QuietStart = strings.TrimSpace(rule.QuietStart)
+	rule.QuietEnd = strings.TrimSpace(rule.QuietEnd)
+	if (rule.QuietStart == "") != (rule.QuietEnd == "") {
+		return errors.New("免打扰时段需要同时设置开始和结束时间")
+	}
+	if rule.QuietStart != "" {
+		if _, _, err := parseClock(rule.QuietStart); err != nil {
+			return err
+		}
+		if _, _, err := parseClock(rule.QuietEnd); err != nil {
+			return err
+		}
+	}
+	if len(rule.Channels) == 0 {
+		rule.Channels = []string{channelTelegram}
+	}
+	for _, c := range rule.Channels {
+		if _, ok := alertChannels[c]; !ok {
+			return fmt.Errorf("不支持的通知渠道: %s", c)
+		}
+	}
+	return nil
+}
+
+// 是否处于免打扰时段，支持跨午夜（如 22:00-07:00）
+func inQuietHours(now time.Time, start, end string) bool {
+	if start == "" || end == "" {
+		return false
+	}
+	sh, sm, err := parseClock(start)
+	if err != nil {
+		return false
+	}
+	eh, em, err := parseClock(end)
+	if err != nil {
+		return false
+	}
+	cur := now.Hour()*60 + now.Minute()
+	from, to := sh*60+sm, eh*60+em
+	if from == to {
+		return false
+	}
+	if from < to {
+		return cur >= from && cur < to
+	}
+	return cur >= from || cur < to
+}
+
+// 规则评估所需的当前指标
+type alertInputs struct {
+	Remain     decimal.Decimal
+	TodayGas   decimal.Decimal
+	HourlyGas  decimal.Decimal
+	DataAgeMin decimal.Decimal
+	HasData    bool
+}
+
+func collectAlertInputs(store *Store, settings Settings, remain decimal.Decimal, now time.Time) (alertInputs, error) {
+	gasPerPulse := parseDecimal(settings.GasPerPulse, defaultGasPerPulse)
+	inputs := alertInputs{Remain: remain}
+
+	todayPulses, err := calcUsagePulsesByDelta(store, startOfDay(now), now)
+	if err != nil {
+		return inputs, err
+	}
+	inputs.TodayGas = quantize3(pulsesToGas(todayPulses, gasPerPulse))
+
+	hourPulses, err := calcUsagePulsesByDelta(store, now.Add(-time.Hour), now)
+	if err != nil {
+		return inputs, err
+	}
+	inputs.HourlyGas = quantize3(pulsesToGas(hourPulses, gasPerPulse))
+
+	lastTS, _, err := store.FetchLatestEvent()
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return inputs, err
+	}
+	if err == nil && lastTS > 0 {
+		inputs.HasData = true
+		inputs.DataAgeMin = decimal.NewFromInt(now.Unix() - lastTS).Div(decimal.NewFromInt(60)).Round(1)
+	}
+	return inputs, nil
+}
+
+func (in alertInputs) valueFor(kind string) (decimal.Decimal, bool) {
+	switch kind {
+	case ruleRemainBelow:
+		return in.Remain, true
+	case ruleDailyAbove:
+		return in.TodayGas, true
+	case ruleHourlyAbove:
+		return in.HourlyGas, true
+	case ruleNoData:
+		return in.DataAgeMin, in.HasData
+	}
+	return decimal.Zero, false
+}
+
+// 判断规则状态：breached 表示越过阈值，recovered 表示已越过回差恢复线
+func ruleState(rule AlertRule, value decimal.Decimal) (breached, recovered bool) {
+	threshold := parseDecimal(rule.Threshold, "0")
+	hysteresis := parseDecimal(rule.Hysteresis, "0")
+	if alertRuleKinds[rule.Kind].Below {
+		return value.LessThan(threshold), value.GreaterThanOrEqual(threshold.Add(hysteresis))
+	}
+	return value.GreaterThan(threshold), value.LessThanOrEqual(threshold.Sub(hysteresis))
+}
+
+func alertRuleMessage(rule AlertRule, value decimal.Decimal, resolved bool, now time.Time) string {
+	kind := alertRuleKinds[rule.Kind]
+	if resolved {
+		return fmt.Sprintf("✅ <b>预警已恢复</b> %s\n\n%s：<b>%s %s</b>\n\n⏰ 恢复时间：%s",
+			rule.Name, kind.Label, value.String(), kind.Unit, now.Format("2006-01-02 15:04:05"))
+	}
+	cmp := "高于"
+	if kind.Below {
+		cmp = "低于"
+	}
+	return fmt.Sprintf("🚨 <b>[%s] %s</b>\n\n%s：<b>%s %s</b>\n已%s阈值：<b>%s %s</b>\n\n⏰ 通知时间：%s",
+		alertSeverityLabels[rule.Severity], rule.Name, kind.Label, value.String(), kind.Unit, cmp, rule.Threshold, kind.Unit, now.Format("2006-01-02 15:04:05"))
+}
+
+// 是否应发送（重复）通知：已确认的预警不再提醒；repeat_minutes 为 0 只通知一次，
+// max_repeats 为 0 表示不限重复次数
+func alertNotifyDue(rule AlertRule, h AlertHistory, now time.Time) bool {
+	if h.AckedTS > 0 {
+		return false
+	}
+	if h.NotifyCount == 0 {
+		return true
+	}
+	if rule.RepeatMinutes <= 0 {
+		return false
+	}
+	if rule.MaxRepeats > 0 && h.NotifyCount > int64(rule.MaxRepeats) {
+		return false
+	}
+	return now.Unix()-h.LastNotifyTS >= int64(rule.RepeatMinutes)*60
+}
+
+// 严重级别为 critical 的预警不受免打扰时段限制
+func alertSuppressed(rule AlertRule, now time.Time) bool {
+	return rule.Severity != severityCritical && inQuietHours(now, rule.QuietStart, rule.QuietEnd)
+}
+
+func evaluateAlertRules(store *Store, outbox *NotificationOutbox, settings Settings, remain decimal.Decimal, now time.Time) {
+	rules, err := store.FetchAlertRules()
+	if err != nil {
+		log.Printf("alert rules: load: %v", err)
+		return
+	}
+	if len(rules) == 0 {
+		return
+	}
+	inputs, err := collectAlertInputs(store, settings, remain, now)
+	if err != nil {
+		log.Printf("alert rules: collect inputs: %v", err)
+		return
+	}
+	muted := notificationsMuted(store, now)
+
+	for _, rule := range rules {
+		if !rule.Enabled {
+			continue
+		}
+		value, ok := inputs.valueFor(rule.Kind)
+		if !ok {
+			continue
+		}
+		breached, recovered := ruleState(rule, value)
+
+		open, err := store.FetchOpenAlert(rule.ID)
+		hasOpen := err == nil
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			log.Printf("alert rules: load open alert for rule %d: %v", rule.ID, err)
+			continue
+		}
+
+		if hasOpen && recovered {
+			if err := store.ResolveAlert(open.ID, value.String(), now.Unix()); err != nil {
+				log.Printf("alert rules: resolve %d: %v", open.ID, err)
+				continue
+			}
+			if rule.NotifyOnResolve && open.NotifyCount > 0 && !muted && !alertSuppressed(rule, now) {
+				if err := outbox.Enqueue(settings, rule.Channels, "alert_resolved", alertRuleMessage(rule, value, true, now)); err != nil {
+					log.Printf("alert rules: enqueue resolve for rule %d: %v", rule.ID, err)
+				}
+			}
+			continue
+		}
+		if !hasOpen {
+			if !breached {
+				continue
+			}
+			open = AlertHistory{
+				RuleID:    rule.ID,
+				RuleName:  rule.Name,
+				Kind:      rule.Kind,
+				Severity:  rule.Severity,
+				Value:     value.String(),
+				Threshold: rule.Threshold,
+				FiredTS:   now.Unix(),
+			}
+			if open.ID, err = store.InsertAlertHistory(open); err != nil {
+				log.Printf("alert rules: record rule %d: %v", rule.ID, err)
+				continue
+			}
+		}
+
+		if muted || !alertNotifyDue(rule, open, now) || alertSuppressed(rule, now) {
+			continue
+		}
+		if err := outbox.Enqueue(settings, rule.Channels, "alert_rule", alertRuleMessage(rule, value, false, now)); err != nil {
+			log.Printf("alert rules: enqueue rule %d: %v", rule.ID, err)
+			continue
+		}
+		if err := store.UpdateAlertNotified(open.ID, value.String(), open.NotifyCount+1, now.Unix()); err != nil {
+			log.Printf("alert rules: update %d: %v", open.ID, err)
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+func TestRuleStateHysteresis(t *testing.T) {
+	remain := AlertRule{Kind: ruleRemainBelow, Threshold: "10", Hysteresis: "2"}
+	daily := AlertRule{Kind: ruleDailyAbove, Threshold: "5", Hysteresis: "1"}
+	cases := []struct {
+		name                        string
+		rule                        AlertRule
+		value                       string
+		wantBreached, wantRecovered bool
+	}{
+		{"剩余低于阈值", remain, "9.9", true, false},
+		{"剩余等于阈值不触发", remain, "10", false, false},
+		{"剩余处于回差区间", remain, "11.9", false, false},
+		{"剩余越过恢复线", remain, "12", false, true},
+		{"用气高于阈值", daily, "5.1", true, false},
+		{"用气处于回差区间", daily, "4.5", false, false},
+		{"用气回落到恢复线", daily, "4", false, true},
+		{"无回差时离开阈值即恢复", AlertRule{Kind: ruleDailyAbove, Threshold: "5", Hysteresis: "0"}, "5", false, true},
+	}
+	for _, c := range cases {
+		breached, recovered := ruleState(c.rule, decimal.RequireFromString(c.value))
+		if breached != c.wantBreached || recovered != c.wantRecovered {
+			t.Errorf("%s: ruleState(%s) = %v, %v; want %v, %v", c.name, c.value, breached, recovered, c.wantBreached, c.wantRecovered)
+		}
+	}
+}
+
+func TestAlertNotifyDue(t *testing.T) {
+	now := time.Unix(1_700_000_000, 0)
+	ago := func(d time.Duration) int64 { return now.Add(-d).Unix() }
+	cases := []struct {
+		name string
+		rule AlertRule
+		h    AlertHistory
+		want bool
+	}{
+		{"首次触发", AlertRule{}, AlertHistory{}, true},
+		{"已确认不再提醒", AlertRule{RepeatMinutes: 10}, AlertHistory{AckedTS: ago(time.Hour)}, false},
+		{"不重复时只通知一次", AlertRule{}, AlertHistory{NotifyCount: 1, LastNotifyTS: ago(time.Hour)}, false},
+		{"未到重复间隔", AlertRule{RepeatMinutes: 30}, AlertHistory{NotifyCount: 1, LastNotifyTS: ago(29 * time.Minute)}, false},
+		{"到达重复间隔", AlertRule{RepeatMinutes: 30}, AlertHistory{NotifyCount: 1, LastNotifyTS: ago(30 * time.Minute)}, true},
+		{"重复次数未用完", AlertRule{RepeatMinutes: 30, MaxRepeats: 2}, AlertHistory{NotifyCount: 2, LastNotifyTS: ago(time.Hour)}, true},
+		{"重复次数已用完", AlertRule{RepeatMinutes: 30, MaxRepeats: 2}, AlertHistory{NotifyCount: 3, LastNotifyTS: ago(time.Hour)}, false},
+	}
+	for _, c := range cases {
+		if got := alertNotifyDue(c.rule, c.h, now); got != c.want {
+			t.Errorf("%s: got %v, want %v", c.name, got, c.want)
+		}
+	}
+}
+
+func TestInQuietHours(t *testing.T) {
+	at := func(hour, min int) time.Time { return time.Date(2024, 3, 15, hour, min, 0, 0, time.UTC) }
+	cases := []struct {
+		name       string
+		now        time.Time
+		start, end string
+		want       bool
+	}{
+		{"未设置", at(23, 0), "", "", false},
+		{"当日时段内", at(13, 0), "12:00", "14:00", true},
+		{"当日时段结束时刻不含", at(14, 0), "12:00", "14:00", false},
+		{"跨午夜的夜间", at(23, 30), "22:00", "07:00", true},
+		{"跨午夜的清晨", at(6, 59), "22:00", "07:00", true},
+		{"跨午夜的白天", at(7, 0), "22:00", "07:00", false},
+		{"开始等于结束视为未设置", at(8, 0), "08:00", "08:00", false},
+	}
+	for _, c := range cases {
+		if got := inQuietHours(c.now, c.start, c.end); got != c.want {
+			t.Errorf("%s: inQuietHours(%s, %s, %s) = %v, want %v", c.name, c.now.Format("15:04"), c.start, c.end, got, c.want)
+		}
+	}
+
+	night := at(23, 0)
+	quiet := AlertRule{Severity: severityWarning, QuietStart: "22:00", QuietEnd: "07:00"}
+	if !alertSuppressed(quiet, night) {
+		t.Error("warning during quiet hours was not suppressed")
+	}
+	quiet.Severity = severityCritical
+	if alertSuppressed(quiet, night) {
+		t.Error("critical alert was suppressed during quiet hours")
+	}
+}
+
+func TestNormalizeAlertRule(t *testing.T) {
+	rule := AlertRule{Name: " 余量 ", Kind: ruleRemainBelow, Threshold: "10.50"}
+	if err := normalizeAlertRule(&rule); err != nil {
+		t.Fatal(err)
+	}
+	if rule.Name != "余量" || rule.Threshold != "10.5" || rule.Hysteresis != "0" || rule.Severity != severityWarning ||
+		len(rule.Channels) != 1 || rule.Channels[0] != channelTelegram {
+		t.Errorf("defaults not applied: %+v", rule)
+	}
+
+	cases := []struct {
+		name string
+		rule AlertRule
+	}{
+		{"名称为空", AlertRule{Kind: ruleRemainBelow, Threshold: "1"}},
+		{"未知类型", AlertRule{Name: "x", Kind: "pressure", Threshold: "1"}},
+		{"负阈值", AlertRule{Name: "x", Kind: ruleRemainBelow, Threshold: "-1"}},
+		{"负回差", AlertRule{Name: "x", Kind: ruleRemainBelow, Threshold: "1", Hysteresis: "-0.5"}},
+		{"未知严重级别", AlertRule{Name: "x", Kind: ruleRemainBelow, Threshold: "1", Severity: "fatal"}},
+		{"负重复次数", AlertRule{Name: "x", Kind: ruleRemainBelow, Threshold: "1", MaxRepeats: -1}},
+		{"免打扰只设开始", AlertRule{Name: "x", Kind: ruleRemainBelow, Threshold: "1", QuietStart: "22:00"}},
+		{"免打扰时间无效", AlertRule{Name: "x", Kind: ruleRemainBelow, Threshold: "1", QuietStart: "25:00", QuietEnd: "07:00"}},
+		{"未知渠道", AlertRule{Name: "x", Kind: ruleRemainBelow, Threshold: "1", Channels: []string{"sms"}}},
+	}
+	for _, c := range cases {
+		rule := c.rule
+		if err := normalizeAlertRule(&rule); err == nil {
+			t.Errorf("%s: expected error", c.name)
+		}
+	}
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	secretPrefix      = "enc:v1:"
+	secretMask        = "******"
+	masterKeyBytes    = 32
+	masterKeyEnv      = "GAS_MASTER_KEY"
+	masterKeyFileEnv  = "GAS_MASTER_KEY_FILE"
+	masterKeyFileName = "master.key"
+)
+
+// 敏感字段只返回打码值，明文不离开服务端
+func maskSecretSettings(settings *Settings) {
+	for _, def := range settingDefs {
+		if field := settingField(settings, def); def.Secret && field.String() != "" {
+			field.SetString(secretMask)
+		}
+	}
+}
+
+// AES-256-GCM 加密，密文格式为 enc:v1:<密钥标识>:<base64(nonce|密文)>
+type secretBox struct {
+	aead  cipher.AEAD
+	keyID string
+}
+
+func newSecretBox(key []byte) (*secretBox, error) {
+	if len(key) != masterKeyBytes {
+		return nil, fmt.Errorf("主密钥长度必须为 %d 字节", masterKeyBytes)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(key)
+	return &secretBox{aead: aead, keyID: hex.EncodeToString(sum[:4])}, nil
+}
+
+func isSealed(value string) bool {
+	return strings.HasPrefix(value, secretPrefix)
+}
+
+func (b *secretBox) seal(plain string) (string, error) {
+	nonce := make([]byte, b.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := b.aead.Seal(nonce, nonce, []byte(plain), []byte(b.keyID))
+	return secretPrefix + b.keyID + ":" + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+func (b *secretBox) open(value string) (string, error) {
+	keyID, payload, ok := strings.Cut(strings.TrimPrefix(value, secretPrefix), ":")
+	if !ok {
+		return "", errors.New("密文格式错误")
+	}
+	if keyID != b.keyID {
+		return "", fmt.Errorf("密文由其他主密钥（%s）加密，当前主密钥为 %s", keyID, b.keyID)
+	}
+	raw, err := base64.StdEncoding.DecodeString(payload)
+	if err != nil || len(raw) < b.aead.NonceSize() {
+		return "", errors.New("密文格式错误")
+	}
+	nonce, sealed := raw[:b.aead.NonceSize()], raw[b.aead.NonceSize():]
+	plain, err := b.aead.Open(nil, nonce, sealed, []byte(keyID))
+	if err != nil {
+		return "", errors.New("解密失败，主密钥不正确或密文已损坏")
+	}
+	return string(plain), nil
+}
+
+// 主密钥支持 base64 或 hex 编码的 32 字节随机数
+func parseMasterKey(raw string) ([]byte, error) {
+	raw = strings.TrimSpace(raw)
+	if key, err := base64.StdEncoding.DecodeString(raw); err == nil && len(key) == masterKeyBytes {
+		return key, nil
+	}
+	if key, err := hex.DecodeString(raw); err == nil && len(key) == masterKeyBytes {
+		return key, nil
+	}
+	return nil, fmt.Errorf("主密钥必须是 base64 或 hex 编码的 %d 字节随机数", masterKeyBytes)
+}
+
+func generateMasterKey() (string, error) {
+	key := make([]byte, masterKeyBytes)
+	if _, err := rand.Read(key); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(key), nil
+}
+
+// 主密钥来源；File 为空表示来自环境变量
+type masterKeySource struct {
+	Key  []byte
+	File string
+}
+
+// 依次读取 GAS_MASTER_KEY、GAS_MASTER_KEY_FILE，都未设置时使用数据库目录下的
+// master.key，不存在则自动生成
+func loadMasterKey(dbPath string) (masterKeySource, error) {
+	if raw := os.Getenv(masterKeyEnv); raw != "" {
+		key, err := parseMasterKey(raw)
+		if err != nil {
+			return masterKeySource{}, fmt.Errorf("%s: %w", masterKeyEnv, err)
+		}
+		return masterKeySource{Key: key}, nil
+	}
+
+	file := os.Getenv(masterKeyFileEnv)
+	explicit := file != ""
+	if !explicit {
+		file = filepath.Join(filepath.Dir(dbPath), masterKeyFileName)
+	}
+	data, err := os.ReadFile(file)
+	if errors.Is(err, os.ErrNotExist) && !explicit {
+		encoded, err := generateMasterKey()
+		if err != nil {
+			return masterKeySource{}, err
+		}
+		if err := os.WriteFile(file, []byte(encoded+"\n"), 0o600); err != nil {
+			return masterKeySource{}, fmt.Errorf("创建主密钥文件失败: %w", err)
+		}
+		log.Printf("已生成主密钥文件 %s，请妥善备份；丢失后已加密的配置将无法解密", file)
+		data = []byte(encoded)
+	} else if err != nil {
+		return masterKeySource{}, fmt.Errorf("读取主密钥文件失败: %w", err)
+	}
+	key, err := parseMasterKey(string(data))
+	if err != nil {
+		return masterKeySource{}, fmt.Errorf("%s: %w", file, err)
+	}
+	return masterKeySource{Key: key, File: file}, nil
+}
+
+// 启动时加载主密钥，校验已有密文并加密尚未加密的敏感配置
+func initSecretEncryption(store *Store, dbPath string) error {
+	source, err := loadMasterKey(dbPath)
+	if err != nil {
+		return err
+	}
+	box, err := newSecretBox(source.Key)
+	if err != nil {
+		return err
+	}
+	return store.EnableSecretEncryption(box)
+}
+
+// 命令行：gas-go rotate-master-key [-new-key <base64|hex>]
+// 需在服务停止时执行；密钥来自文件时原地替换，来自环境变量时输出新密钥
+func rotateMasterKey(dbPath string, args []string) error {
+	fs := flag.NewFlagSet("rotate-master-key", flag.ContinueOnError)
+	newKeyRaw := fs.String("new-key", os.Getenv("GAS_NEW_MASTER_KEY"), "新的主密钥（base64 或 hex），留空自动生成")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	store, err := NewStore(dbPath)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	source, err := loadMasterKey(dbPath)
+	if err != nil {
+		return err
+	}
+	oldBox, err := newSecretBox(source.Key)
+	if err != nil {
+		return err
+	}
+	if err := store.EnableSecretEncryption(oldBox); err != nil {
+		return err
+	}
+
+	encoded := strings.TrimSpace(*newKeyRaw)
+	if encoded == "" {
+		if encoded, err = generateMasterKey(); err != nil {
+			return err
+		}
+	}
+	newKey, err := parseMasterKey(encoded)
+	if err != nil {
+		return err
+	}
+	newBox, err := newSecretBox(newKey)
+	if err != nil {
+		return err
+	}
+
+	// 先写入临时文件，数据库重新加密成功后再替换，避免两者不一致
+	var pending string
+	if source.File != "" {
+		pending = source.File + ".new"
+		if err := os.WriteFile(pending, []byte(encoded+"\n"), 0o600); err != nil {
+			return fmt.Errorf("写入新主密钥失败: %w", err)
+		}
+	}
+	count, err := store.ReencryptSecrets(oldBox, newBox)
+	if err != nil {
+		if pending != "" {
+			_ = os.Remove(pending)
+		}
+		return fmt.Errorf("重新加密失败，数据库未修改: %w", err)
+	}
+	if pending != "" {
+		if err := os.Rename(pending, source.File); err != nil {
+			return fmt.Errorf("数据库已使用新密钥加密，但替换密钥文件失败，请手动将 %s 重命名为 %s: %w", pending, source.File, err)
+		}
+		fmt.Printf("主密钥已轮换（%s → %s），重新加密 %d 项配置和签名密钥，新密钥已写入 %s\n", oldBox.keyID, newBox.keyID, count, source.File)
+		return nil
+	}
+	fmt.Printf("主密钥已轮换（%s → %s），重新加密 %d 项配置和签名密钥。\n请将环境变量 %s 更新为以下值后再启动服务：\n%s\n",
+		oldBox.keyID, newBox.keyID, count, masterKeyEnv, encoded)
+	return nil
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func testSecretBox(t *testing.T, seed byte) *secretBox {
+	t.Helper()
+	key := make([]byte, masterKeyBytes)
+	for i := range key {
+		key[i] = seed
+	}
+	box, err := newSecretBox(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return box
+}
+
+func TestReencryptSecrets(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "gas.db")
+	store, err := NewStore(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	// 升级前保存的明文在启用加密时被加密，普通配置保持明文
+	if err := store.SetSettings(map[string]string{"tg_bot_token": "123:abc", "mqtt_pass": "hunter2", "tg_chat_id": "42"}); err != nil {
+		t.Fatal(err)
+	}
+	oldBox := testSecretBox(t, 1)
+	if err := store.EnableSecretEncryption(oldBox); err != nil {
+		t.Fatal(err)
+	}
+	raw := func(key string) string {
+		var v string
+		if err := store.db.QueryRow(`SELECT v FROM settings WHERE k=?;`, key).Scan(&v); err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+	sealed := raw("tg_bot_token")
+	if !isSealed(sealed) || raw("tg_chat_id") != "42" {
+		t.Fatalf("after enable: tg_bot_token=%q tg_chat_id=%q", sealed, raw("tg_chat_id"))
+	}
+
+	newBox := testSecretBox(t, 2)
+	count, err := store.ReencryptSecrets(oldBox, newBox)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 2 {
+		t.Errorf("re-encrypted %d secrets, want 2", count)
+	}
+	if v := raw("tg_bot_token"); v == sealed || !isSealed(v) {
+		t.Fatalf("tg_bot_token not re-encrypted: %q", v)
+	}
+	for key, want := range map[string]string{"tg_bot_token": "123:abc", "mqtt_pass": "hunter2", "tg_chat_id": "42"} {
+		if got, err := store.GetSetting(key, ""); err != nil || got != want {
+			t.Errorf("GetSetting(%s) = %q, %v; want %q", key, got, err, want)
+		}
+	}
+
+	// 新密文只能用新主密钥打开：旧密钥启动失败，新密钥正常启动
+	if _, err := oldBox.open(raw("mqtt_pass")); err == nil {
+		t.Error("old master key still opens re-encrypted secret")
+	}
+	reopened, err := NewStore(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	if err := reopened.EnableSecretEncryption(oldBox); err == nil {
+		t.Error("startup with the old master key succeeded")
+	}
+	if err := reopened.EnableSecretEncryption(newBox); err != nil {
+		t.Errorf("startup with the new master key: %v", err)
+	}
+
+	// 主密钥不匹配时整体回滚，数据库保持不变
+	before := raw("tg_bot_token")
+	if _, err := store.ReencryptSecrets(oldBox, testSecretBox(t, 3)); err == nil {
+		t.Fatal("re-encrypt with the wrong old key succeeded")
+	}
+	if raw("tg_bot_token") != before {
+		t.Error("failed re-encrypt modified the database")
+	}
+}
@@ -1,8 +1,15 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"reflect"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/shopspring/decimal"
 )
@@ -16,111 +23,568 @@ const (
 	defaultMQTTTopic        = "homeassistant/sensor/ir_counter/state"
 	defaultMQTTTLS          = true
 	defaultMQTTTLSInsecure  = false
+	defaultMQTTDeviceID     = "ir_counter"
+	defaultMQTTCmdTopic     = "gas/devices/{device}/cmd"
+	defaultMQTTRespTopic    = "gas/devices/{device}/resp"
 	defaultGasPerPulse      = "0.001"
 	defaultInitialGas       = "100.000"
 	defaultMeterBase        = "0.000"
+	defaultGasPrice         = "0.00"
 	defaultTGThreshold      = "5.0"
 	defaultTGNotifyTimes    = 2
 	defaultTGNotifyInterval = "2.0"
+	defaultTGAlertMode      = "threshold"
+	defaultTGForecastDays   = "7"
+	defaultProxyUserHeader  = "Remote-User"
+	defaultProxyGroupHeader = "Remote-Groups"
+	defaultOIDCScopes       = "openid profile email groups"
+	defaultOIDCUserClaim    = "preferred_username"
+	defaultOIDCGroupsClaim  = "groups"
 )
 
+// 配置项的值类型；数据库中统一以字符串保存，布尔值保存为 1/0
+type settingType int
+
+const (
+	settingString settingType = iota
+	settingBool
+	settingInt
+	settingDecimal
+)
+
+// 配置项定义。Name 为接口字段名（与 Settings 的 json 标签一致），Key 为
+// settings 表中的键名，为空时与 Name 相同；Validate 接收规范化后的字符串值
+type settingDef struct {
+	Name        string
+	Key         string
+	Type        settingType
+	Default     string
+	DefaultFunc func() string
+	Secret      bool
+	Validate    func(string) error
+}
+
+func (d settingDef) key() string {
+	if d.Key != "" {
+		return d.Key
+	}
+	return d.Name
+}
+
+func (d settingDef) defaultValue() string {
+	if d.DefaultFunc != nil {
+		return d.DefaultFunc()
+	}
+	return d.Default
+}
+
+// 全部可通过 /api/settings 读写的配置项；新增配置时在 Settings 中加字段并在此登记
+var settingDefs = []settingDef{
+	{Name: "gas_per_pulse", Type: settingDecimal, Default: defaultGasPerPulse, Validate: positiveDecimal},
+	{Name: "initial_gas", Type: settingDecimal, Default: defaultInitialGas},
+	{Name: "initial_base_pulses", Key: "initial_gas_base_pulses", Type: settingInt, Default: "0", Validate: minInt(0)},
+	{Name: "meter_base_m3", Type: settingDecimal, Default: defaultMeterBase, Validate: nonNegativeDecimal},
+	{Name: "desired_meter_m3", Type: settingDecimal, Default: defaultMeterBase, Validate: nonNegativeDecimal},
+	{Name: "gas_price", Type: settingDecimal, Default: defaultGasPrice, Validate: nonNegativeDecimal},
+	{Name: "timezone", Type: settingString, DefaultFunc: defaultTimezone, Validate: validateTimezone},
+	{Name: "week_start", Type: settingInt, Default: strconv.Itoa(defaultWeekStart), Validate: intRange(0, 6)},
+	{Name: "billing_cycle_day", Type: settingInt, Default: strconv.Itoa(defaultBillingCycleDay), Validate: intRange(1, maxBillingCycleDay)},
+	{Name: "billing_year_start_month", Type: settingInt, Default: strconv.Itoa(defaultBillingYearMonth), Validate: intRange(1, 12)},
+	{Name: "auth_enabled", Type: settingBool, Default: "0"},
+	{Name: "public_dashboard", Type: settingBool, Default: "1"},
+	{Name: "mqtt_host", Type: settingString, Default: defaultMQTTHost, Validate: notEmpty},
+	{Name: "mqtt_port", Type: settingInt, Default: strconv.Itoa(defaultMQTTPort), Validate: intRange(1, 65535)},
+	{Name: "mqtt_user", Type: settingString, Default: defaultMQTTUser},
+	{Name: "mqtt_password", Key: "mqtt_pass", Type: settingString, Default: defaultMQTTPassword, Secret: true},
+	{Name: "mqtt_topic", Type: settingString, Default: defaultMQTTTopic, Validate: notEmpty},
+	{Name: "mqtt_tls", Type: settingBool, Default: "1"},
+	{Name: "mqtt_tls_insecure", Type: settingBool, Default: "0"},
+	{Name: "mqtt_device_id", Type: settingString, Default: defaultMQTTDeviceID},
+	{Name: "mqtt_cmd_topic", Type: settingString, Default: defaultMQTTCmdTopic},
+	{Name: "mqtt_resp_topic", Type: settingString, Default: defaultMQTTRespTopic},
+	{Name: "mqtt_temp_topic", Type: settingString},
+	{Name: "hdd_base_temp", Type: settingDecimal, Default: defaultHDDBaseTemp},
+	{Name: "tg_enabled", Key: "tg_notify_enabled", Type: settingBool, Default: "0"},
+	{Name: "tg_bot_token", Type: settingString, Secret: true},
+	{Name: "tg_chat_id", Type: settingString},
+	{Name: "tg_api_endpoint", Type: settingString, Validate: httpURL},
+	{Name: "tg_threshold", Type: settingDecimal, Default: defaultTGThreshold, Validate: nonNegativeDecimal},
+	{Name: "tg_notify_times", Type: settingInt, Default: strconv.Itoa(defaultTGNotifyTimes), Validate: minInt(0)},
+	{Name: "tg_notify_interval_hours", Type: settingDecimal, Default: defaultTGNotifyInterval, Validate: nonNegativeDecimal},
+	{Name: "tg_alert_mode", Type: settingString, Default: defaultTGAlertMode, Validate: oneOf("threshold", "forecast")},
+	{Name: "tg_forecast_days", Type: settingDecimal, Default: defaultTGForecastDays, Validate: positiveDecimal},
+	{Name: "tg_bot_enabled", Type: settingBool, Default: "0"},
+	{Name: "tg_allowed_chat_ids", Type: settingString},
+	{Name: "tg_allowed_user_ids", Type: settingString},
+	{Name: "report_daily_enabled", Type: settingBool, Default: "0"},
+	{Name: "report_weekly_enabled", Type: settingBool, Default: "0"},
+	{Name: "report_monthly_enabled", Type: settingBool, Default: "0"},
+	{Name: "report_time", Type: settingString, Default: defaultReportTime, Validate: validateClock},
+	{Name: "report_daily_template", Type: settingString, Validate: validateTemplateSetting},
+	{Name: "report_weekly_template", Type: settingString, Validate: validateTemplateSetting},
+	{Name: "report_monthly_template", Type: settingString, Validate: validateTemplateSetting},
+	{Name: "auth_proxy_enabled", Type: settingBool, Default: "0"},
+	{Name: "auth_proxy_cidrs", Type: settingString, Validate: validateCIDRSetting},
+	{Name: "auth_proxy_user_header", Type: settingString, Default: defaultProxyUserHeader, Validate: notEmpty},
+	{Name: "auth_proxy_groups_header", Type: settingString, Default: defaultProxyGroupHeader},
+	{Name: "trusted_proxy_cidrs", Type: settingString, Validate: validateCIDRSetting},
+	{Name: "oidc_enabled", Type: settingBool, Default: "0"},
+	{Name: "oidc_issuer", Type: settingString, Validate: httpURL},
+	{Name: "oidc_client_id", Type: settingString},
+	{Name: "oidc_client_secret", Type: settingString, Secret: true},
+	{Name: "oidc_redirect_url", Type: settingString, Validate: httpURL},
+	{Name: "oidc_scopes", Type: settingString, Default: defaultOIDCScopes},
+	{Name: "oidc_username_claim", Type: settingString, Default: defaultOIDCUserClaim, Validate: notEmpty},
+	{Name: "oidc_groups_claim", Type: settingString, Default: defaultOIDCGroupsClaim},
+	{Name: "auth_group_roles", Type: settingString, Validate: validateGroupRolesSetting},
+	{Name: "auth_default_role", Type: settingString, Validate: validateRoleSetting},
+	{Name: "audit_retention_days", Type: settingInt, Default: strconv.Itoa(defaultAuditRetentionDays), Validate: minInt(0)},
+	{Name: "gap_threshold_minutes", Type: settingInt, Default: strconv.Itoa(defaultGapThresholdMinutes), Validate: minInt(0)},
+}
+
+// 认证中间件每个请求都要读取的外部认证配置
+var authProviderSettingNames = []string{
+	"auth_proxy_enabled", "auth_proxy_cidrs", "auth_proxy_user_header", "auth_proxy_groups_header",
+	"oidc_enabled", "oidc_issuer", "oidc_client_id", "oidc_client_secret", "oidc_redirect_url",
+	"oidc_scopes", "oidc_username_claim", "oidc_groups_claim", "auth_group_roles", "auth_default_role",
+}
+
+var (
+	settingDefsByName = make(map[string]settingDef)
+	settingDefsByKey  = make(map[string]settingDef)
+	// 配置项对应的 Settings 字段下标
+	settingFields = make(map[string]int)
+)
+
+// 启动时核对登记表与 Settings 结构体，漏登记或类型不符属于编码错误，直接 panic
+func init() {
+	t := reflect.TypeOf(Settings{})
+	for i := 0; i < t.NumField(); i++ {
+		name, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+		settingFields[name] = i
+	}
+	kinds := map[settingType]reflect.Kind{
+		settingString:  reflect.String,
+		settingDecimal: reflect.String,
+		settingBool:    reflect.Bool,
+	}
+	for _, def := range settingDefs {
+		index, ok := settingFields[def.Name]
+		if !ok {
+			panic("settings: 未知的配置字段 " + def.Name)
+		}
+		kind := t.Field(index).Type.Kind()
+		if want, ok := kinds[def.Type]; (ok && kind != want) || (!ok && kind != reflect.Int && kind != reflect.Int64) {
+			panic("settings: 配置字段类型不符 " + def.Name)
+		}
+		settingDefsByName[def.Name] = def
+		settingDefsByKey[def.key()] = def
+	}
+	for name := range settingFields {
+		if _, ok := settingDefsByName[name]; !ok {
+			panic("settings: 配置字段未登记 " + name)
+		}
+	}
+}
+
+func isSecretSetting(key string) bool {
+	return settingDefsByKey[key].Secret
+}
+
+// 需要加密保存的配置项键名
+func secretSettingKeys() []string {
+	var keys []string
+	for _, def := range settingDefs {
+		if def.Secret {
+			keys = append(keys, def.key())
+		}
+	}
+	return keys
+}
+
+func settingField(settings *Settings, def settingDef) reflect.Value {
+	return reflect.ValueOf(settings).Elem().Field(settingFields[def.Name])
+}
+
+// 读取字段的规范化字符串值，即保存到数据库的值
+func getSettingValue(settings *Settings, def settingDef) string {
+	field := settingField(settings, def)
+	switch def.Type {
+	case settingBool:
+		return boolToString(field.Bool())
+	case settingInt:
+		return strconv.FormatInt(field.Int(), 10)
+	default:
+		return field.String()
+	}
+}
+
+// 按类型解析字符串并写入字段；空值的数值项恢复为默认值
+func setSettingValue(settings *Settings, def settingDef, raw string) error {
+	field := settingField(settings, def)
+	switch def.Type {
+	case settingBool:
+		b, ok := parseBool(raw)
+		if !ok {
+			return errors.New("必须是布尔值")
+		}
+		field.SetBool(b)
+	case settingInt:
+		raw = strings.TrimSpace(raw)
+		if raw == "" {
+			raw = def.defaultValue()
+		}
+		n, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil || field.OverflowInt(n) {
+			return errors.New("必须是整数")
+		}
+		field.SetInt(n)
+	case settingDecimal:
+		raw = strings.TrimSpace(raw)
+		if raw == "" {
+			raw = def.defaultValue()
+		}
+		if _, err := decimal.NewFromString(raw); err != nil {
+			return errors.New("必须是数字")
+		}
+		field.SetString(raw)
+	default:
+		field.SetString(raw)
+	}
+	return nil
+}
+
 func loadSettings(store *Store) (Settings, error) {
-	settings := Settings{}
+	var settings Settings
+	err := loadSettingDefs(store, &settings, settingDefs)
+	return settings, err
+}
 
-	var err error
-	settings.GasPerPulse, err = store.GetSetting("gas_per_pulse", defaultGasPerPulse)
-	if err != nil {
-		return settings, err
+// 外部认证相关配置，认证中间件只需要这一部分，单独加载以减少查询
+func loadAuthProviderSettings(store *Store, settings *Settings) error {
+	defs := make([]settingDef, 0, len(authProviderSettingNames))
+	for _, name := range authProviderSettingNames {
+		defs = append(defs, settingDefsByName[name])
 	}
-	settings.InitialGas, err = store.GetSetting("initial_gas", defaultInitialGas)
-	if err != nil {
-		return settings, err
+	return loadSettingDefs(store, settings, defs)
+}
+
+// 数据库中遗留的非法值（早期版本未校验）按默认值处理
+func loadSettingDefs(store *Store, settings *Settings, defs []settingDef) error {
+	for _, def := range defs {
+		raw, err := store.GetSetting(def.key(), def.defaultValue())
+		if err != nil {
+			return err
+		}
+		if err := setSettingValue(settings, def, raw); err != nil {
+			_ = setSettingValue(settings, def, def.defaultValue())
+		}
 	}
-	basePulses, err := store.GetSetting("initial_gas_base_pulses", "0")
-	if err != nil {
-		return settings, err
+	return nil
+}
+
+// 只写入发生变化的配置项，返回变化的字段名
+func saveSettings(store *Store, before, after Settings) ([]string, error) {
+	values := make(map[string]string)
+	var changed []string
+	for _, def := range settingDefs {
+		value := getSettingValue(&after, def)
+		if value == getSettingValue(&before, def) {
+			continue
+		}
+		values[def.key()] = value
+		changed = append(changed, def.Name)
 	}
-	settings.InitialBasePulses, _ = strconv.ParseInt(basePulses, 10, 64)
+	if len(values) == 0 {
+		return nil, nil
+	}
+	return changed, store.SetSettings(values)
+}
 
-	settings.MeterBaseM3, err = store.GetSetting("meter_base_m3", defaultMeterBase)
-	if err != nil {
-		return settings, err
+// 按请求体更新配置。replace 为 true 时是完整替换（PUT），未提交的字段恢复默认值；
+// 否则只修改提交的字段（PATCH）。null 表示恢复默认值，敏感字段提交打码值表示保持不变。
+// 类型错误的字段保持原值，其余字段照常应用，便于后续校验一次返回全部错误。
+// locked 中的字段由配置文件或环境变量决定，提交与当前值不同的值时报错
+func applySettingsPatch(current Settings, body map[string]json.RawMessage, replace bool, locked map[string]settingOverride) (Settings, settingsErrors) {
+	next := current
+	errs := settingsErrors{}
+	for name := range body {
+		if _, ok := settingDefsByName[name]; !ok {
+			errs[name] = "未知的配置项"
+		}
 	}
-	settings.DesiredMeterM3, err = store.GetSetting("desired_meter_m3", defaultMeterBase)
-	if err != nil {
-		return settings, err
+	for _, def := range settingDefs {
+		raw, ok := body[def.Name]
+		if override, isLocked := locked[def.Name]; isLocked {
+			if ok && !lockedValueUnchanged(current, def, raw) {
+				errs[def.Name] = "已由" + override.String() + " 锁定，不能在此修改"
+			}
+			continue
+		}
+		if !ok {
+			if replace {
+				_ = setSettingValue(&next, def, def.defaultValue())
+			}
+			continue
+		}
+		value, err := decodeSettingValue(def, raw)
+		if err != nil {
+			errs[def.Name] = err.Error()
+			continue
+		}
+		if value == nil {
+			_ = setSettingValue(&next, def, def.defaultValue())
+			continue
+		}
+		if def.Secret && *value == secretMask {
+			continue
+		}
+		if err := setSettingValue(&next, def, *value); err != nil {
+			errs[def.Name] = err.Error()
+		}
 	}
+	if len(errs) > 0 {
+		return next, errs
+	}
+	return next, nil
+}
 
-	authEnabled, err := store.GetSetting("auth_enabled", "0")
-	if err != nil {
-		return settings, err
+// 界面提交完整配置时会带上被锁定字段的当前值，值相同视为未修改
+func lockedValueUnchanged(current Settings, def settingDef, raw json.RawMessage) bool {
+	value, err := decodeSettingValue(def, raw)
+	if err != nil || value == nil {
+		return false
+	}
+	if def.Secret && *value == secretMask {
+		return true
 	}
-	settings.AuthEnabled = parseBoolSetting(authEnabled, false)
+	next := current
+	if err := setSettingValue(&next, def, *value); err != nil {
+		return false
+	}
+	return getSettingValue(&next, def) == getSettingValue(&current, def)
+}
 
-	settings.MQTTHost, err = store.GetSetting("mqtt_host", defaultMQTTHost)
-	if err != nil {
-		return settings, err
+// 将 JSON 值转为字符串形式；数值项同时接受数字和数字字符串，null 返回 nil
+func decodeSettingValue(def settingDef, raw json.RawMessage) (*string, error) {
+	if string(raw) == "null" {
+		return nil, nil
 	}
-	port, err := store.GetSetting("mqtt_port", strconv.Itoa(defaultMQTTPort))
-	if err != nil {
-		return settings, err
+	var value string
+	switch def.Type {
+	case settingBool:
+		var b bool
+		if err := json.Unmarshal(raw, &b); err != nil {
+			return nil, errors.New("必须是布尔值")
+		}
+		value = boolToString(b)
+	case settingInt, settingDecimal:
+		var n json.Number
+		if err := json.Unmarshal(raw, &value); err == nil {
+			break
+		}
+		if err := json.Unmarshal(raw, &n); err != nil {
+			return nil, errors.New("必须是数字")
+		}
+		value = n.String()
+	default:
+		if err := json.Unmarshal(raw, &value); err != nil {
+			return nil, errors.New("必须是字符串")
+		}
 	}
-	settings.MQTTPort, _ = strconv.Atoi(port)
-	settings.MQTTUser, err = store.GetSetting("mqtt_user", defaultMQTTUser)
-	if err != nil {
-		return settings, err
+	return &value, nil
+}
+
+// 字段级校验错误，键为配置字段名
+type settingsErrors map[string]string
+
+func (e settingsErrors) Error() string {
+	parts := make([]string, 0, len(e))
+	for _, def := range settingDefs {
+		if msg, ok := e[def.Name]; ok {
+			parts = append(parts, def.Name+": "+msg)
+		}
 	}
-	settings.MQTTPassword, err = store.GetSetting("mqtt_pass", defaultMQTTPassword)
-	if err != nil {
-		return settings, err
+	for name, msg := range e {
+		if _, ok := settingDefsByName[name]; !ok {
+			parts = append(parts, name+": "+msg)
+		}
 	}
-	settings.MQTTTopic, err = store.GetSetting("mqtt_topic", defaultMQTTTopic)
-	if err != nil {
-		return settings, err
+	return "配置校验失败（" + strings.Join(parts, "；") + "）"
+}
+
+// 校验有变化的字段及跨字段规则；未修改的字段不重复校验，避免历史数据阻塞其他修改
+func validateSettings(before, after Settings) settingsErrors {
+	errs := settingsErrors{}
+	for _, def := range settingDefs {
+		value := getSettingValue(&after, def)
+		if def.Validate == nil || value == getSettingValue(&before, def) {
+			continue
+		}
+		if err := def.Validate(value); err != nil {
+			errs[def.Name] = err.Error()
+		}
 	}
-	mqttTLS, err := store.GetSetting("mqtt_tls", "1")
-	if err != nil {
-		return settings, err
+	for name, msg := range validateAuthProviderSettings(after) {
+		if _, ok := errs[name]; !ok {
+			errs[name] = msg
+		}
 	}
-	settings.MQTTTLS = parseBoolSetting(mqttTLS, true)
-	mqttTLSInsecure, err := store.GetSetting("mqtt_tls_insecure", "0")
-	if err != nil {
-		return settings, err
+	if len(errs) == 0 {
+		return nil
 	}
-	settings.MQTTTLSInsecure = parseBoolSetting(mqttTLSInsecure, false)
+	return errs
+}
 
-	tgEnabled, err := store.GetSetting("tg_notify_enabled", "0")
-	if err != nil {
-		return settings, err
+type settingsHook struct {
+	names []string
+	fn    func(Settings)
+}
+
+var settingsHooks struct {
+	sync.Mutex
+	items []settingsHook
+}
+
+// 注册配置变更回调；names 为关注的字段，支持 mqtt_* 形式的前缀，留空表示任意字段
+func onSettingsChange(fn func(Settings), names ...string) {
+	settingsHooks.Lock()
+	settingsHooks.items = append(settingsHooks.items, settingsHook{names: names, fn: fn})
+	settingsHooks.Unlock()
+}
+
+func notifySettingsChange(changed []string, after Settings) {
+	if len(changed) == 0 {
+		return
 	}
-	settings.TGEnabled = parseBoolSetting(tgEnabled, false)
-	settings.TGBotToken, err = store.GetSetting("tg_bot_token", "")
-	if err != nil {
-		return settings, err
+	settingsHooks.Lock()
+	hooks := append([]settingsHook(nil), settingsHooks.items...)
+	settingsHooks.Unlock()
+	for _, hook := range hooks {
+		if settingsHookMatches(hook.names, changed) {
+			hook.fn(after)
+		}
 	}
-	settings.TGChatID, err = store.GetSetting("tg_chat_id", "")
-	if err != nil {
-		return settings, err
+}
+
+func settingsHookMatches(names, changed []string) bool {
+	if len(names) == 0 {
+		return true
 	}
-	settings.TGAPIEndpoint, err = store.GetSetting("tg_api_endpoint", "")
-	if err != nil {
-		return settings, err
+	for _, name := range names {
+		for _, field := range changed {
+			if field == name || (strings.HasSuffix(name, "*") && strings.HasPrefix(field, strings.TrimSuffix(name, "*"))) {
+				return true
+			}
+		}
 	}
-	settings.TGThreshold, err = store.GetSetting("tg_threshold", defaultTGThreshold)
-	if err != nil {
-		return settings, err
+	return false
+}
+
+func notEmpty(value string) error {
+	if strings.TrimSpace(value) == "" {
+		return errors.New("不能为空")
 	}
-	notifyTimes, err := store.GetSetting("tg_notify_times", strconv.Itoa(defaultTGNotifyTimes))
-	if err != nil {
-		return settings, err
+	return nil
+}
+
+func intRange(min, max int) func(string) error {
+	return func(value string) error {
+		n, _ := strconv.Atoi(value)
+		if n < min || n > max {
+			return fmt.Errorf("取值范围为 %d-%d", min, max)
+		}
+		return nil
 	}
-	settings.TGNotifyTimes, _ = strconv.Atoi(notifyTimes)
-	settings.TGNotifyIntervalHour, err = store.GetSetting("tg_notify_interval_hours", defaultTGNotifyInterval)
-	if err != nil {
-		return settings, err
+}
+
+func minInt(min int) func(string) error {
+	return func(value string) error {
+		if n, _ := strconv.ParseInt(value, 10, 64); n < int64(min) {
+			return fmt.Errorf("不能小于 %d", min)
+		}
+		return nil
 	}
+}
 
-	return settings, nil
+func positiveDecimal(value string) error {
+	if dec, _ := decimal.NewFromString(value); !dec.IsPositive() {
+		return errors.New("必须大于 0")
+	}
+	return nil
+}
+
+func nonNegativeDecimal(value string) error {
+	if dec, _ := decimal.NewFromString(value); dec.IsNegative() {
+		return errors.New("不能为负数")
+	}
+	return nil
+}
+
+func oneOf(options ...string) func(string) error {
+	return func(value string) error {
+		for _, option := range options {
+			if value == option {
+				return nil
+			}
+		}
+		return fmt.Errorf("仅支持 %s", strings.Join(options, "、"))
+	}
+}
+
+// 留空表示不使用，填写时必须是 http(s) 地址
+func httpURL(value string) error {
+	if value == "" {
+		return nil
+	}
+	u, err := url.Parse(value)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return errors.New("必须是 http:// 或 https:// 开头的地址")
+	}
+	return nil
+}
+
+// 留空表示跟随 TZ 环境变量
+func validateTimezone(value string) error {
+	if value == "" {
+		return nil
+	}
+	if _, err := time.LoadLocation(value); err != nil {
+		return fmt.Errorf("无效的时区: %s", value)
+	}
+	return nil
+}
+
+func validateClock(value string) error {
+	_, _, err := parseClock(value)
+	return err
+}
+
+func validateTemplateSetting(value string) error {
+	if err := validateReportTemplate(value); err != nil {
+		return fmt.Errorf("报告模板错误: %v", err)
+	}
+	return nil
+}
+
+func validateCIDRSetting(value string) error {
+	_, err := parseCIDRs(value)
+	return err
+}
+
+func validateGroupRolesSetting(value string) error {
+	_, err := parseGroupRoles(value)
+	return err
+}
+
+func validateRoleSetting(value string) error {
+	if value == "" {
+		return nil
+	}
+	if _, ok := roleRanks[value]; !ok {
+		return fmt.Errorf("无效的角色: %s", value)
+	}
+	return nil
 }
 
 func parseDecimal(value string, fallback string) decimal.Decimal {
@@ -132,13 +596,20 @@ func parseDecimal(value string, fallback string) decimal.Decimal {
 }
 
 func parseBoolSetting(value string, fallback bool) bool {
+	if b, ok := parseBool(value); ok {
+		return b
+	}
+	return fallback
+}
+
+func parseBool(value string) (bool, bool) {
 	switch strings.ToLower(strings.TrimSpace(value)) {
 	case "1", "true", "yes", "on":
-		return true
+		return true, true
 	case "0", "false", "no", "off":
-		return false
+		return false, true
 	default:
-		return fallback
+		return false, false
 	}
 }
 
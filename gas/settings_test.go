@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func defaultSettings() Settings {
+	var settings Settings
+	for _, def := range settingDefs {
+		_ = setSettingValue(&settings, def, def.defaultValue())
+	}
+	return settings
+}
+
+func TestApplySettingsPatch(t *testing.T) {
+	current := defaultSettings()
+	current.GasPrice = "3.5"
+	current.MQTTPort = 1883
+	current.MQTTPassword = "hunter2"
+	current.TGChatID = "42"
+
+	cases := []struct {
+		name     string
+		body     string
+		replace  bool
+		errs     []string
+		check    func(Settings) bool
+		describe string
+	}{
+		{"PATCH 只改提交的字段", `{"gas_price": "4"}`, false, nil,
+			func(s Settings) bool { return s.GasPrice == "4" && s.MQTTPort == 1883 && s.TGChatID == "42" }, "gas_price=4，其余不变"},
+		{"PUT 未提交的字段恢复默认值", `{"gas_price": "4"}`, true, nil,
+			func(s Settings) bool { return s.GasPrice == "4" && s.MQTTPort == defaultMQTTPort && s.TGChatID == "" }, "mqtt_port、tg_chat_id 恢复默认"},
+		{"null 恢复默认值", `{"mqtt_port": null}`, false, nil,
+			func(s Settings) bool { return s.MQTTPort == defaultMQTTPort && s.GasPrice == "3.5" }, "mqtt_port 恢复默认"},
+		{"数值字段接受字符串", `{"mqtt_port": "1884"}`, false, nil,
+			func(s Settings) bool { return s.MQTTPort == 1884 }, "mqtt_port=1884"},
+		{"打码值保持敏感字段不变", `{"mqtt_password": "******"}`, true, nil,
+			func(s Settings) bool { return s.MQTTPassword == "hunter2" }, "mqtt_password 不变"},
+		{"类型错误的字段保持原值", `{"mqtt_port": true, "gas_price": "4"}`, false, []string{"mqtt_port"},
+			func(s Settings) bool { return s.MQTTPort == 1883 && s.GasPrice == "4" }, "mqtt_port 不变，gas_price=4"},
+		{"未知字段", `{"gas_prize": "4"}`, false, []string{"gas_prize"},
+			func(s Settings) bool { return s.GasPrice == "3.5" }, "不变"},
+	}
+	for _, c := range cases {
+		var body map[string]json.RawMessage
+		if err := json.Unmarshal([]byte(c.body), &body); err != nil {
+			t.Fatal(err)
+		}
+		next, errs := applySettingsPatch(current, body, c.replace, nil)
+		if len(errs) != len(c.errs) {
+			t.Errorf("%s: errors %v, want fields %v", c.name, errs, c.errs)
+		}
+		for _, name := range c.errs {
+			if _, ok := errs[name]; !ok {
+				t.Errorf("%s: missing error for %s", c.name, name)
+			}
+		}
+		if !c.check(next) {
+			t.Errorf("%s: got %+v, want %s", c.name, next, c.describe)
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"sync"
+	"time"
+	_ "time/tzdata" // 内嵌时区数据库，容器内缺少 tzdata 时也能解析 IANA 时区
+)
+
+const fallbackTimezone = "Asia/Shanghai"
+
+var locationCache sync.Map
+
+// 默认时区：优先使用 TZ 环境变量（docker-compose 中配置），否则为 Asia/Shanghai
+func defaultTimezone() string {
+	if tz := strings.TrimSpace(os.Getenv("TZ")); tz != "" {
+		if _, err := time.LoadLocation(tz); err == nil {
+			return tz
+		}
+	}
+	return fallbackTimezone
+}
+
+// 解析 IANA 时区名称，无效时回退到默认时区
+func loadLocation(name string) *time.Location {
+	if name == "" {
+		name = defaultTimezone()
+	}
+	if loc, ok := locationCache.Load(name); ok {
+		return loc.(*time.Location)
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		if name == defaultTimezone() {
+			return time.UTC
+		}
+		return loadLocation(defaultTimezone())
+	}
+	locationCache.Store(name, loc)
+	return loc
+}
+
+// 当前配置的统计时区
+func storeLocation(store *Store) *time.Location {
+	name, err := store.GetSetting("timezone", "")
+	if err != nil {
+		return loadLocation("")
+	}
+	return loadLocation(name)
+}
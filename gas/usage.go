@@ -0,0 +1,238 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+const maxUsageBuckets = 10000
+
+var usageBuckets = map[string]struct{}{
+	"minute": {},
+	"hour":   {},
+	"day":    {},
+	"week":   {},
+	"month":  {},
+	"year":   {},
+	"bill":   {},
+}
+
+type UsageBucket struct {
+	Start  int64  `json:"start"`
+	End    int64  `json:"end"`
+	Label  string `json:"label"`
+	Pulses int64  `json:"pulses"`
+	Gas    string `json:"gas"`
+	Cost   string `json:"cost"`
+}
+
+type UsageTotal struct {
+	Pulses int64  `json:"pulses"`
+	Gas    string `json:"gas"`
+	Cost   string `json:"cost"`
+}
+
+type UsageSeries struct {
+	From    int64         `json:"from"`
+	To      int64         `json:"to"`
+	Bucket  string        `json:"bucket"`
+	GapMode string        `json:"gap_mode"`
+	Buckets []UsageBucket `json:"buckets"`
+	Total   UsageTotal    `json:"total"`
+}
+
+type UsageResponse struct {
+	UsageSeries
+	Previous *UsageSeries `json:"previous,omitempty"`
+}
+
+// 按给定的区间边界统计脉冲增量，edges 长度为桶数+1，增量计入事件所在的桶，
+// 补录的脉冲及按 gapMode 插值的断档按时长分配
+func calcBucketedPulses(store *Store, edges []time.Time, gapMode string) ([]int64, error) {
+	if len(edges) < 2 {
+		return nil, nil
+	}
+	bounds := make([]int64, len(edges))
+	for i, t := range edges {
+		bounds[i] = t.Unix()
+	}
+	spans, err := loadPulseSpans(store, edges[0], edges[len(edges)-1], gapMode)
+	if err != nil {
+		return nil, err
+	}
+	return distributePulses(spans, bounds), nil
+}
+
+// 截断到桶起点。分钟/小时按绝对时间回退，避免夏令时重复的小时被 time.Date 映射到第一次出现
+func truncateToBucket(t time.Time, bucket string, rules PeriodRules) time.Time {
+	sub := time.Duration(t.Second())*time.Second + time.Duration(t.Nanosecond())
+	switch bucket {
+	case "minute":
+		return t.Add(-sub)
+	case "hour":
+		return t.Add(-sub - time.Duration(t.Minute())*time.Minute)
+	case "day":
+		return startOfDay(t)
+	case "week":
+		return startOfWeek(t, rules.WeekStart)
+	case "month":
+		return startOfMonth(t)
+	case "bill":
+		return billingPeriodFor(t, rules).Start
+	case "year":
+		// 按年度阶梯周期切分，与阶梯计价的年度起点一致
+		if rules.BillingYearMonth == 0 {
+			return time.Date(t.Year(), time.January, 1, 0, 0, 0, 0, t.Location())
+		}
+		return billingYearFor(t, rules).Start
+	}
+	return t
+}
+
+// 将时间按桶粒度平移 n 个桶（n 可为负）
+func shiftBuckets(t time.Time, bucket string, n int) time.Time {
+	switch bucket {
+	case "minute":
+		return t.Add(time.Duration(n) * time.Minute)
+	case "hour":
+		return t.Add(time.Duration(n) * time.Hour)
+	case "day":
+		return t.AddDate(0, 0, n)
+	case "week":
+		return t.AddDate(0, 0, 7*n)
+	case "month", "bill":
+		return t.AddDate(0, n, 0)
+	case "year":
+		return t.AddDate(n, 0, 0)
+	}
+	return t
+}
+
+// 生成 [from, to) 内的桶边界，首尾桶按 from/to 截断
+func usageBucketEdges(from, to time.Time, bucket string, rules PeriodRules) ([]time.Time, error) {
+	if !to.After(from) {
+		return nil, errors.New("结束时间必须晚于开始时间")
+	}
+	edges := []time.Time{from}
+	cur := truncateToBucket(from, bucket, rules)
+	for {
+		cur = shiftBuckets(cur, bucket, 1)
+		if !cur.Before(to) {
+			break
+		}
+		if !cur.After(edges[len(edges)-1]) {
+			continue
+		}
+		edges = append(edges, cur)
+		if len(edges) > maxUsageBuckets {
+			return nil, fmt.Errorf("时间范围过大，最多 %d 个统计区间", maxUsageBuckets)
+		}
+	}
+	return append(edges, to), nil
+}
+
+func bucketLabel(t time.Time, bucket string) string {
+	switch bucket {
+	case "minute":
+		return t.Format("2006-01-02 15:04")
+	case "hour":
+		return t.Format("2006-01-02 15:00")
+	case "month":
+		return t.Format("2006-01")
+	case "year":
+		return t.Format("2006")
+	}
+	return t.Format("2006-01-02")
+}
+
+func calcUsageSeries(store *Store, from, to time.Time, bucket string, rules PeriodRules, gapMode string, gasPerPulse, price decimal.Decimal) (UsageSeries, error) {
+	edges, err := usageBucketEdges(from, to, bucket, rules)
+	if err != nil {
+		return UsageSeries{}, err
+	}
+	pulses, err := calcBucketedPulses(store, edges, gapMode)
+	if err != nil {
+		return UsageSeries{}, err
+	}
+
+	series := UsageSeries{
+		From:    from.Unix(),
+		To:      to.Unix(),
+		Bucket:  bucket,
+		GapMode: gapMode,
+		Buckets: make([]UsageBucket, 0, len(pulses)),
+	}
+	var total int64
+	for i, p := range pulses {
+		gas := quantize3(pulsesToGas(p, gasPerPulse))
+		series.Buckets = append(series.Buckets, UsageBucket{
+			Start:  edges[i].Unix(),
+			End:    edges[i+1].Unix(),
+			Label:  bucketLabel(edges[i], bucket),
+			Pulses: p,
+			Gas:    gas.StringFixed(3),
+			Cost:   gas.Mul(price).StringFixed(2),
+		})
+		total += p
+	}
+	totalGas := quantize3(pulsesToGas(total, gasPerPulse))
+	series.Total = UsageTotal{
+		Pulses: total,
+		Gas:    totalGas.StringFixed(3),
+		Cost:   totalGas.Mul(price).StringFixed(2),
+	}
+	return series, nil
+}
+
+// 对比区间：取能覆盖当前区间的最小日历周期（日、周、月、年），
+// 返回前一个周期内相同的挂钟时间窗口，例如今日 00:00-14:30 对应昨日 00:00-14:30
+func previousRange(from, to time.Time) (time.Time, time.Time) {
+	shift := func(t time.Time) time.Time { return t.AddDate(0, 0, -1) }
+	switch {
+	case !to.After(from.AddDate(0, 0, 1)):
+	case !to.After(from.AddDate(0, 0, 7)):
+		shift = func(t time.Time) time.Time { return t.AddDate(0, 0, -7) }
+	case !to.After(addMonthsClamped(from, 1)):
+		shift = func(t time.Time) time.Time { return addMonthsClamped(t, -1) }
+	default:
+		years := 1
+		for to.After(addMonthsClamped(from, 12*years)) {
+			years++
+		}
+		shift = func(t time.Time) time.Time { return addMonthsClamped(t, -12*years) }
+	}
+	return shift(from), shift(to)
+}
+
+// 按月平移，日期超出目标月份天数时取月末，避免 AddDate 把 3 月 31 日的上个月归一化到 3 月 3 日
+func addMonthsClamped(t time.Time, n int) time.Time {
+	first := time.Date(t.Year(), t.Month()+time.Month(n), 1, t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), t.Location())
+	day := t.Day()
+	if last := first.AddDate(0, 1, -1).Day(); day > last {
+		day = last
+	}
+	return first.AddDate(0, 0, day-1)
+}
+
+// 解析时间参数，支持日期和日期时间（含 2006 和 2006-01）、RFC3339 及 Unix 秒。
+// 先按日期格式解析，from=2024 表示 2024 年而不是 Unix 时间 2024 秒
+func parseTimeParam(raw string, loc *time.Location) (time.Time, error) {
+	raw = strings.TrimSpace(raw)
+	for _, layout := range []string{"2006-01-02 15:04:05", "2006-01-02T15:04", "2006-01-02 15:04", "2006-01-02", "2006-01", "2006"} {
+		if t, err := time.ParseInLocation(layout, raw, loc); err == nil {
+			return t, nil
+		}
+	}
+	if t, err := time.Parse(time.RFC3339, raw); err == nil {
+		return t.In(loc), nil
+	}
+	if ts, err := strconv.ParseInt(raw, 10, 64); err == nil {
+		return time.Unix(ts, 0).In(loc), nil
+	}
+	return time.Time{}, fmt.Errorf("无法解析时间: %s", raw)
+}
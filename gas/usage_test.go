@@ -0,0 +1,98 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPreviousRange(t *testing.T) {
+	loc, err := time.LoadLocation("Asia/Shanghai")
+	if err != nil {
+		t.Skip(err)
+	}
+	at := func(s string) time.Time {
+		v, err := time.ParseInLocation("2006-01-02 15:04", s, loc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+	cases := []struct {
+		name             string
+		from, to         string
+		wantFrom, wantTo string
+	}{
+		{"今日截至当前", "2024-03-15 00:00", "2024-03-15 14:30", "2024-03-14 00:00", "2024-03-14 14:30"},
+		{"整日", "2024-03-15 00:00", "2024-03-16 00:00", "2024-03-14 00:00", "2024-03-15 00:00"},
+		{"本周截至当前", "2024-03-11 00:00", "2024-03-15 14:30", "2024-03-04 00:00", "2024-03-08 14:30"},
+		{"本月截至当前", "2024-03-01 00:00", "2024-03-15 14:30", "2024-02-01 00:00", "2024-02-15 14:30"},
+		{"整月", "2024-03-01 00:00", "2024-04-01 00:00", "2024-02-01 00:00", "2024-03-01 00:00"},
+		{"月末对齐", "2024-03-31 00:00", "2024-03-31 12:00", "2024-03-30 00:00", "2024-03-30 12:00"},
+		{"月末跨月", "2024-03-20 00:00", "2024-03-31 12:00", "2024-02-20 00:00", "2024-02-29 12:00"},
+		{"本年截至当前", "2024-01-01 00:00", "2024-03-15 14:30", "2023-01-01 00:00", "2023-03-15 14:30"},
+		{"两年", "2022-01-01 00:00", "2024-01-01 00:00", "2020-01-01 00:00", "2022-01-01 00:00"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			from, to := previousRange(at(c.from), at(c.to))
+			if !from.Equal(at(c.wantFrom)) || !to.Equal(at(c.wantTo)) {
+				t.Errorf("previousRange(%s, %s) = %s, %s; want %s, %s", c.from, c.to,
+					from.Format("2006-01-02 15:04"), to.Format("2006-01-02 15:04"), c.wantFrom, c.wantTo)
+			}
+		})
+	}
+}
+
+func TestParseTimeParam(t *testing.T) {
+	loc, err := time.LoadLocation("Asia/Shanghai")
+	if err != nil {
+		t.Skip(err)
+	}
+	cases := []struct {
+		raw  string
+		want time.Time
+	}{
+		{"2024", time.Date(2024, 1, 1, 0, 0, 0, 0, loc)},
+		{"2024-03", time.Date(2024, 3, 1, 0, 0, 0, 0, loc)},
+		{"2024-03-15", time.Date(2024, 3, 15, 0, 0, 0, 0, loc)},
+		{"2024-03-15 08:30", time.Date(2024, 3, 15, 8, 30, 0, 0, loc)},
+		{"2024-03-15T08:30:00Z", time.Date(2024, 3, 15, 8, 30, 0, 0, time.UTC)},
+		{"1710491400", time.Unix(1710491400, 0)},
+	}
+	for _, c := range cases {
+		got, err := parseTimeParam(c.raw, loc)
+		if err != nil {
+			t.Errorf("parseTimeParam(%q): %v", c.raw, err)
+			continue
+		}
+		if !got.Equal(c.want) {
+			t.Errorf("parseTimeParam(%q) = %s, want %s", c.raw, got, c.want)
+		}
+	}
+	if _, err := parseTimeParam("yesterday", loc); err == nil {
+		t.Error("parseTimeParam(\"yesterday\") should fail")
+	}
+}
+
+func TestUsageBucketEdgesBillingYear(t *testing.T) {
+	loc, err := time.LoadLocation("Asia/Shanghai")
+	if err != nil {
+		t.Skip(err)
+	}
+	rules := PeriodRules{WeekStart: time.Monday, BillingDay: 5, BillingYearMonth: time.April}
+	from := time.Date(2023, 1, 1, 0, 0, 0, 0, loc)
+	to := time.Date(2025, 1, 1, 0, 0, 0, 0, loc)
+	edges, err := usageBucketEdges(from, to, "year", rules)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []time.Time{from, time.Date(2023, 4, 5, 0, 0, 0, 0, loc), time.Date(2024, 4, 5, 0, 0, 0, 0, loc), to}
+	if len(edges) != len(want) {
+		t.Fatalf("got %d edges %v, want %v", len(edges), edges, want)
+	}
+	for i := range want {
+		if !edges[i].Equal(want[i]) {
+			t.Errorf("edge %d = %s, want %s", i, edges[i], want[i])
+		}
+	}
+}
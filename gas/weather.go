@@ -0,0 +1,212 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/shopspring/decimal"
+)
+
+const (
+	defaultHDDBaseTemp = "18.0"
+	dayLayout          = "2006-01-02"
+)
+
+type DailyTemperature struct {
+	Day     string  `json:"day"`
+	AvgTemp float64 `json:"avg_temp"`
+	Samples int64   `json:"samples"`
+	Source  string  `json:"source"`
+}
+
+type MonthlyHDD struct {
+	Month        int    `json:"month"`
+	Pulses       int64  `json:"pulses"`
+	Gas          string `json:"gas"`
+	HDD          string `json:"hdd"`
+	DaysWithTemp int    `json:"days_with_temp"`
+	// 同时有气温和完整用气数据的天数，m³/度日只按这些天计算
+	DaysMatched int    `json:"days_matched"`
+	GasPerHDD   string `json:"gas_per_hdd"`
+}
+
+// 采暖度日：日均气温低于基准温度的差值，高于基准时为 0
+func heatingDegreeDays(avgTemp, baseTemp float64) float64 {
+	if avgTemp >= baseTemp {
+		return 0
+	}
+	return baseTemp - avgTemp
+}
+
+// 解析气温 CSV，支持 "日期,均温" 或 "日期,最低,最高" 两种格式，首行可为表头
+func parseTemperatureCSV(r io.Reader) (map[string]float64, []string, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	temps := make(map[string]float64)
+	var problems []string
+	for i, rec := range records {
+		if len(rec) < 2 {
+			problems = append(problems, fmt.Sprintf("第 %d 行列数不足", i+1))
+			continue
+		}
+		day, err := time.Parse(dayLayout, strings.TrimSpace(rec[0]))
+		if err != nil {
+			if i == 0 {
+				continue // 表头
+			}
+			problems = append(problems, fmt.Sprintf("第 %d 行日期无效: %s", i+1, rec[0]))
+			continue
+		}
+		values := make([]float64, 0, 2)
+		for _, raw := range rec[1:] {
+			raw = strings.TrimSpace(raw)
+			if raw == "" {
+				continue
+			}
+			v, err := strconv.ParseFloat(raw, 64)
+			if err != nil {
+				problems = append(problems, fmt.Sprintf("第 %d 行气温无效: %s", i+1, raw))
+				values = nil
+				break
+			}
+			values = append(values, v)
+		}
+		switch len(values) {
+		case 1:
+			temps[day.Format(dayLayout)] = values[0]
+		case 2:
+			temps[day.Format(dayLayout)] = (values[0] + values[1]) / 2
+		default:
+			if values != nil {
+				problems = append(problems, fmt.Sprintf("第 %d 行缺少气温", i+1))
+			}
+		}
+	}
+	return temps, problems, nil
+}
+
+// 解析 MQTT 气温消息，支持纯数字或 {"temperature": x} / {"temp": x}
+func parseTemperaturePayload(payload []byte) (float64, error) {
+	raw := strings.TrimSpace(string(payload))
+	if v, err := strconv.ParseFloat(raw, 64); err == nil {
+		return v, nil
+	}
+	var body map[string]interface{}
+	if err := json.Unmarshal(payload, &body); err != nil {
+		return 0, err
+	}
+	for _, key := range []string{"temperature", "temp"} {
+		switch v := body[key].(type) {
+		case float64:
+			return v, nil
+		case string:
+			return strconv.ParseFloat(v, 64)
+		}
+	}
+	return 0, errors.New("missing temperature field")
+}
+
+func (w *MQTTWorker) handleTemperature(_ mqtt.Client, msg mqtt.Message) {
+	temp, err := parseTemperaturePayload(msg.Payload())
+	if err != nil {
+		log.Printf("temperature payload parse error: %v, payload: %s", err, string(msg.Payload()))
+		return
+	}
+	day := time.Now().In(storeLocation(w.store)).Format(dayLayout)
+	if err := w.store.AddTemperatureSample(day, temp); err != nil {
+		log.Printf("temperature insert error: %v", err)
+	}
+}
+
+// 按月汇总用气量与采暖度日。m³/度日只统计当天同时有气温和完整用气数据的日期
+// （当天开始前和结束后都有事件），避免缺少气温或传感器未接入的日子拉偏比值
+func calcMonthlyHDD(store *Store, settings Settings, year int, loc *time.Location) ([]MonthlyHDD, error) {
+	monthly, err := calcMonthlyPulsesCurrentYear(store, time.Date(year, time.January, 1, 0, 0, 0, 0, loc), gapModeNone)
+	if err != nil {
+		return nil, err
+	}
+	temps, err := store.FetchDailyTemperatures(fmt.Sprintf("%04d-01-01", year), fmt.Sprintf("%04d-12-31", year))
+	if err != nil {
+		return nil, err
+	}
+
+	var edges []time.Time
+	for d := time.Date(year, time.January, 1, 0, 0, 0, 0, loc); d.Year() == year; d = d.AddDate(0, 0, 1) {
+		edges = append(edges, d)
+	}
+	edges = append(edges, time.Date(year+1, time.January, 1, 0, 0, 0, 0, loc))
+	daily, err := calcBucketedPulses(store, edges, gapModeNone)
+	if err != nil {
+		return nil, err
+	}
+	first, err := store.FetchNextEventFrom(math.MinInt64)
+	if err != nil {
+		return nil, err
+	}
+	last, err := store.FetchPrevEventBefore(math.MaxInt64)
+	if err != nil {
+		return nil, err
+	}
+	covered := func(i int) bool {
+		return first != nil && last != nil && first.Timestamp <= edges[i].Unix() && last.Timestamp >= edges[i+1].Unix()
+	}
+
+	gasPerPulse := parseDecimal(settings.GasPerPulse, defaultGasPerPulse)
+	baseTemp, _ := parseDecimal(settings.HDDBaseTemp, defaultHDDBaseTemp).Float64()
+
+	hdd := make([]float64, 12)
+	days := make([]int, 12)
+	matchedHDD := make([]float64, 12)
+	matchedPulses := make([]int64, 12)
+	matchedDays := make([]int, 12)
+	for _, t := range temps {
+		day, err := time.ParseInLocation(dayLayout, t.Day, loc)
+		if err != nil {
+			continue
+		}
+		m := day.Month() - 1
+		dd := heatingDegreeDays(t.AvgTemp, baseTemp)
+		hdd[m] += dd
+		days[m]++
+		if i := day.YearDay() - 1; i < len(daily) && covered(i) {
+			matchedHDD[m] += dd
+			matchedPulses[m] += daily[i]
+			matchedDays[m]++
+		}
+	}
+
+	result := make([]MonthlyHDD, 12)
+	for i := range result {
+		gas := quantize3(pulsesToGas(monthly[i], gasPerPulse))
+		monthHDD := decimal.NewFromFloat(hdd[i]).Round(1)
+		perHDD := ""
+		if d := decimal.NewFromFloat(matchedHDD[i]).Round(1); d.IsPositive() {
+			perHDD = quantize3(pulsesToGas(matchedPulses[i], gasPerPulse)).Div(d).StringFixed(3)
+		}
+		result[i] = MonthlyHDD{
+			Month:        i + 1,
+			Pulses:       monthly[i],
+			Gas:          gas.StringFixed(3),
+			HDD:          monthHDD.StringFixed(1),
+			DaysWithTemp: days[i],
+			DaysMatched:  matchedDays[i],
+			GasPerHDD:    perHDD,
+		}
+	}
+	return result, nil
+}